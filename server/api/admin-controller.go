@@ -0,0 +1,328 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package api
+
+import (
+	"bytes"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+
+	"go.mukunda.com/nanopaint/cat"
+	"go.mukunda.com/nanopaint/core"
+	"go.mukunda.com/nanopaint/core/block2"
+	"go.mukunda.com/nanopaint/core/clock"
+)
+
+// Tools for admins, behind the admin key (see httpService.UseAdminAuth).
+//
+//	POST /api/admin/stamp/<coords>?depth=<levels>&dryRun=true
+//
+// Stamps the PNG in the request body into the region under the root block. See
+// core.ImageService.StampImage. A dry run paints nothing and reports how many pixels
+// would be rejected for being dry.
+//
+//	GET /api/admin/history?coords=<coords>&since=<ms>&until=<ms>&limit=<n>
+//
+// Returns the paint history under the coords (default everything) in the time range,
+// newest first, for investigating vandalism. See core.HistoryService.
+//
+//	GET /api/admin/palettes
+//	PUT /api/admin/palettes/<coords>  {"palette": ["f00", "ff8000", ...], "snap": false}
+//	DELETE /api/admin/palettes/<coords>
+//
+// Lists, sets or removes the palette zones that restrict painting under the coords to the
+// given colors. Other colors get COLOR_NOT_ALLOWED, or are changed to the nearest palette
+// color if `snap` is true. 24-bit colors are rounded to 12 bits on 12-bit canvases when
+// the zone is saved. See core.PaletteService.
+//
+//	GET /api/admin/protection
+//	PUT /api/admin/protection/<coords>  {"duration": <seconds>}
+//	DELETE /api/admin/protection/<coords>
+//
+// Lists, sets or removes the protected zones that freeze everything under the coords.
+// Paints and undos there get PROTECTED until the duration passes, or until the zone is
+// removed if there's no duration. See core.ProtectionService.
+
+type AdminController interface {
+	StampImage(c Ct) error
+	GetHistory(c Ct) error
+	GetPalettes(c Ct) error
+	SetPalette(c Ct) error
+	DeletePalette(c Ct) error
+	GetProtection(c Ct) error
+	SetProtection(c Ct) error
+	DeleteProtection(c Ct) error
+}
+
+type adminController struct {
+	images     core.ImageService
+	history    core.HistoryService
+	palettes   core.PaletteService
+	protection core.ProtectionService
+	clock      clock.ClockService
+}
+
+type historyEntryData struct {
+	Time    block2.UnixMillis `json:"time"`
+	Coords  string            `json:"coords"`
+	Color   string            `json:"color,omitempty"` // Empty for undos.
+	Painter string            `json:"painter"`
+	Undo    bool              `json:"undo,omitempty"`
+}
+
+type paletteZoneData struct {
+	Coords  string   `json:"coords"`
+	Palette []string `json:"palette"`
+	Snap    bool     `json:"snap"`
+}
+
+type paletteInput struct {
+	Palette []string `json:"palette"`
+	Snap    bool     `json:"snap"`
+}
+
+type protectedZoneData struct {
+	Coords  string            `json:"coords"`
+	Expires block2.UnixMillis `json:"expires,omitempty"` // Empty if it never expires.
+}
+
+type protectionInput struct {
+	// Seconds until the zone expires. Zero for never.
+	Duration int64 `json:"duration"`
+}
+
+// Largest PNG accepted for stamping, in bytes.
+const maxStampImageBytes = 32 << 20
+
+// Most history entries returned by one request, and the default.
+const (
+	maxHistoryEntries     = 1000
+	defaultHistoryEntries = 100
+)
+
+// Most colors in a zone's palette.
+const maxPaletteColors = 256
+
+// ---------------------------------------------------------------------------------------
+func CreateAdminController(routes Router, hs HttpService, images core.ImageService, history core.HistoryService,
+	palettes core.PaletteService, protection core.ProtectionService, clock clock.ClockService) AdminController {
+	ac := &adminController{
+		images:     images,
+		history:    history,
+		palettes:   palettes,
+		protection: protection,
+		clock:      clock,
+	}
+
+	// The empty string is not valid coords, but it should still be a 400, not a 404.
+	routes.POST("/api/admin/stamp/:coords", ac.StampImage, hs.UseAdminAuth())
+	routes.POST("/api/admin/stamp/", ac.StampImage, hs.UseAdminAuth())
+
+	routes.GET("/api/admin/history", ac.GetHistory, hs.UseAdminAuth())
+
+	routes.GET("/api/admin/palettes", ac.GetPalettes, hs.UseAdminAuth())
+	routes.PUT("/api/admin/palettes/:coords", ac.SetPalette, hs.UseAdminAuth())
+	routes.PUT("/api/admin/palettes/", ac.SetPalette, hs.UseAdminAuth())
+	routes.DELETE("/api/admin/palettes/:coords", ac.DeletePalette, hs.UseAdminAuth())
+	routes.DELETE("/api/admin/palettes/", ac.DeletePalette, hs.UseAdminAuth())
+
+	routes.GET("/api/admin/protection", ac.GetProtection, hs.UseAdminAuth())
+	routes.PUT("/api/admin/protection/:coords", ac.SetProtection, hs.UseAdminAuth())
+	routes.PUT("/api/admin/protection/", ac.SetProtection, hs.UseAdminAuth())
+	routes.DELETE("/api/admin/protection/:coords", ac.DeleteProtection, hs.UseAdminAuth())
+	routes.DELETE("/api/admin/protection/", ac.DeleteProtection, hs.UseAdminAuth())
+
+	return ac
+}
+
+// ---------------------------------------------------------------------------------------
+func (ac *adminController) StampImage(c Ct) error {
+	root := block2.CoordsFromBase64(c.Param("coords"))
+	depth := queryInt(c, "depth", 0)
+	dryRun := c.QueryParam("dryRun") == "true"
+
+	data, err := io.ReadAll(http.MaxBytesReader(c.Response(), c.Request().Body, maxStampImageBytes))
+	cat.BadIf(err != nil, "Image is too large. The limit is "+strconv.Itoa(maxStampImageBytes)+" bytes.")
+
+	// Check the size before decoding the whole image.
+	config, err := png.DecodeConfig(bytes.NewReader(data))
+	cat.BadIf(err != nil, "Body must be a PNG image.")
+	cat.BadIf(config.Width > core.MaxImageSize || config.Height > core.MaxImageSize,
+		"Invalid image size. Images can be at most "+strconv.Itoa(core.MaxImageSize)+" pixels wide.")
+	img, err := png.Decode(bytes.NewReader(data))
+	cat.BadIf(err != nil, "Body must be a PNG image.")
+
+	result, err := ac.images.StampImage(c, img, root, depth, dryRun)
+	cat.BadIf(err == core.ErrImageSize, "Invalid image size. The image must fit in the region.")
+	cat.Catch(err, "Failed to stamp image.")
+
+	var response struct {
+		baseResponse
+		Pixels     int `json:"pixels"`
+		Painted    int `json:"painted"`
+		Dry        int `json:"dry"`
+		TooDeep    int `json:"tooDeep"`
+		NotAllowed int `json:"notAllowed"`
+		Protected  int `json:"protected"`
+	}
+	response.Code = "STAMPED"
+	if dryRun {
+		response.Code = "DRY_RUN"
+	}
+	response.Pixels = result.Pixels
+	response.Painted = result.Painted
+	response.Dry = result.Dry
+	response.TooDeep = result.TooDeep
+	response.NotAllowed = result.NotAllowed
+	response.Protected = result.Protected
+
+	return c.JSON(200, response)
+}
+
+// ---------------------------------------------------------------------------------------
+func (ac *adminController) GetHistory(c Ct) error {
+	query := block2.HistoryQuery{
+		Coords: block2.MakeEmptyCoords(),
+		Since:  block2.UnixMillis(queryInt(c, "since", 0)),
+		Until:  block2.UnixMillis(queryInt(c, "until", 0)),
+		Limit:  queryInt(c, "limit", defaultHistoryEntries),
+	}
+	if coords := c.QueryParam("coords"); coords != "" {
+		query.Coords = block2.CoordsFromBase64(coords)
+	}
+	cat.BadIf(query.Limit < 1 || query.Limit > maxHistoryEntries,
+		"`limit` must be 1 to "+strconv.Itoa(maxHistoryEntries)+".")
+
+	var response struct {
+		baseResponse
+		Entries []historyEntryData `json:"entries"`
+	}
+	response.Code = "HISTORY"
+	response.Entries = []historyEntryData{}
+	for _, entry := range ac.history.Query(query) {
+		data := historyEntryData{
+			Time:    entry.Time,
+			Coords:  entry.Coords.ToBase64(),
+			Painter: entry.Painter,
+			Undo:    entry.Undo,
+		}
+		if !entry.Undo {
+			data.Color = formatColor(entry.Color)
+		}
+		response.Entries = append(response.Entries, data)
+	}
+
+	return c.JSON(200, response)
+}
+
+// ---------------------------------------------------------------------------------------
+func (ac *adminController) GetPalettes(c Ct) error {
+	var response struct {
+		baseResponse
+		Zones []paletteZoneData `json:"zones"`
+	}
+	response.Code = "PALETTES"
+	response.Zones = []paletteZoneData{}
+	for _, zone := range ac.palettes.GetZones() {
+		data := paletteZoneData{
+			Coords:  zone.Coords.ToBase64(),
+			Palette: []string{},
+			Snap:    zone.Snap,
+		}
+		for _, color := range zone.Palette {
+			data.Palette = append(data.Palette, formatColor(color))
+		}
+		response.Zones = append(response.Zones, data)
+	}
+
+	return c.JSON(200, response)
+}
+
+// ---------------------------------------------------------------------------------------
+// Adds or replaces the palette zone at the coords.
+func (ac *adminController) SetPalette(c Ct) error {
+	coords := block2.CoordsFromBase64(c.Param("coords"))
+	var body paletteInput
+	c.Bind(&body)
+	cat.BadIf(len(body.Palette) == 0, "`body.palette` is missing.")
+	cat.BadIf(len(body.Palette) > maxPaletteColors, "Too many colors. The limit is "+
+		strconv.Itoa(maxPaletteColors)+".")
+
+	zone := block2.PaletteZone{
+		Coords: coords,
+		Snap:   body.Snap,
+	}
+	for _, color := range body.Palette {
+		parsed := parseColor(color)
+		cat.BadIf(parsed == block2.Transparent, "Palette colors can't be transparent.")
+		zone.Palette = append(zone.Palette, parsed)
+	}
+	ac.palettes.SetZone(zone)
+
+	return c.JSON(200, baseResponse{
+		Code: "PALETTE_SET",
+	})
+}
+
+// ---------------------------------------------------------------------------------------
+func (ac *adminController) DeletePalette(c Ct) error {
+	coords := block2.CoordsFromBase64(c.Param("coords"))
+	cat.NotFoundIf(!ac.palettes.DeleteZone(coords), "Palette zone not found.")
+
+	return c.JSON(200, baseResponse{
+		Code: "PALETTE_DELETED",
+	})
+}
+
+// ---------------------------------------------------------------------------------------
+func (ac *adminController) GetProtection(c Ct) error {
+	var response struct {
+		baseResponse
+		Zones []protectedZoneData `json:"zones"`
+	}
+	response.Code = "PROTECTION"
+	response.Zones = []protectedZoneData{}
+	for _, zone := range ac.protection.GetZones() {
+		response.Zones = append(response.Zones, protectedZoneData{
+			Coords:  zone.Coords.ToBase64(),
+			Expires: zone.Expires,
+		})
+	}
+
+	return c.JSON(200, response)
+}
+
+// ---------------------------------------------------------------------------------------
+// Adds or replaces the protected zone at the coords.
+func (ac *adminController) SetProtection(c Ct) error {
+	coords := block2.CoordsFromBase64(c.Param("coords"))
+	var body protectionInput
+	c.Bind(&body)
+	cat.BadIf(body.Duration < 0, "`body.duration` can't be negative.")
+
+	zone := block2.ProtectedZone{
+		Coords: coords,
+	}
+	if body.Duration > 0 {
+		zone.Expires = ac.clock.Now().UnixMilli() + body.Duration*1000
+	}
+	ac.protection.Protect(zone)
+
+	return c.JSON(200, baseResponse{
+		Code: "PROTECTION_SET",
+	})
+}
+
+// ---------------------------------------------------------------------------------------
+func (ac *adminController) DeleteProtection(c Ct) error {
+	coords := block2.CoordsFromBase64(c.Param("coords"))
+	cat.NotFoundIf(!ac.protection.Unprotect(coords), "Protected zone not found.")
+
+	return c.JSON(200, baseResponse{
+		Code: "PROTECTION_DELETED",
+	})
+}
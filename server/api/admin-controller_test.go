@@ -0,0 +1,321 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package api
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mukunda.com/nanopaint/config"
+	"go.mukunda.com/nanopaint/core"
+	"go.mukunda.com/nanopaint/core/clock"
+	"go.mukunda.com/nanopaint/test"
+	"go.uber.org/fx"
+	"go.uber.org/fx/fxtest"
+)
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func createAdminControllerTester(t *testing.T, adminKey string) (*fxtest.App, testreqFactory) {
+	var hs HttpService
+
+	app := fxtest.New(t,
+		config.ProvideFromYamlString(`
+http:
+  port: 0
+  disableRateLimit: true
+  adminKey: "`+adminKey+`"
+  trustedProxies: ["127.0.0.1/32", "::1/128"]
+core:
+  disableBlockDryInterval: true
+`),
+		fx.Provide(
+			clock.CreateTestClockService,
+			CreateHttpService,
+			unwrapHttpRouter,
+			annotateController(CreatePaintController),
+			annotateController(CreateAdminController),
+		),
+		core.Fx(),
+		fx.Invoke(func(s StartControllersParam, phs HttpService) {
+			hs = phs
+		}),
+	).RequireStart()
+
+	return app, func() *test.Request {
+		return testreq(t, hs)
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+func encodeTestPng(t *testing.T, img image.Image) []byte {
+	var data bytes.Buffer
+	assert.NoError(t, png.Encode(&data, img))
+	return data.Bytes()
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestAdminController_StampImage(t *testing.T) {
+	app, rq := createAdminControllerTester(t, "secret")
+	defer app.RequireStop()
+
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{0, 0, 255, 255})
+	data := encodeTestPng(t, img)
+	admin := func() *test.Request {
+		return rq().Header("Authorization", "Bearer secret")
+	}
+
+	/////////////////////////////////////////////////////////
+	// The admin key is required.
+	rq().Post("/api/admin/stamp/Aw==").Send(data).Expect(403, "FORBIDDEN", "Invalid admin key.")
+	rq().Post("/api/admin/stamp/Aw==").Header("Authorization", "Bearer wrong").Send(data).
+		Expect(403, "FORBIDDEN", "Invalid admin key.")
+
+	/////////////////////////////////////////////////////////
+	// A dry run paints nothing.
+	var result struct {
+		Pixels  int `json:"pixels"`
+		Painted int `json:"painted"`
+		Dry     int `json:"dry"`
+	}
+	admin().Post("/api/admin/stamp/Aw==?dryRun=true").Send(data).Expect(200, "DRY_RUN").Save(&result)
+	assert.Equal(t, 2, result.Pixels)
+	assert.Equal(t, 2, result.Painted)
+	rq().Get("/api/block/Aw==").Expect(404, "NOT_FOUND")
+
+	/////////////////////////////////////////////////////////
+	// The image is painted into the root block.
+	admin().Post("/api/admin/stamp/Aw==").Send(data).Expect(200, "STAMPED").Save(&result)
+	assert.Equal(t, 2, result.Painted)
+	rq().Get("/api/block/Aw==").Expect(200, "BLOCK")
+
+	// Painting again within the dry time is allowed, since the pixels are still wet.
+	admin().Post("/api/admin/stamp/Aw==?dryRun=true").Send(data).Expect(200, "DRY_RUN").Save(&result)
+	assert.Equal(t, 0, result.Dry)
+
+	/////////////////////////////////////////////////////////
+	// Bad images are rejected.
+	admin().Post("/api/admin/stamp/Aw==").Send([]byte("not a png")).
+		Expect(400, "BAD_REQUEST", "Body must be a PNG image.")
+	big := encodeTestPng(t, image.NewNRGBA(image.Rect(0, 0, 65, 1)))
+	admin().Post("/api/admin/stamp/Aw==").Send(big).
+		Expect(400, "BAD_REQUEST", "The image must fit in the region.")
+	admin().Post("/api/admin/stamp/").Send(data).Expect(400, "BAD_REQUEST", "invalid coords")
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestAdminController_Disabled(t *testing.T) {
+	app, rq := createAdminControllerTester(t, "")
+	defer app.RequireStop()
+
+	rq().Post("/api/admin/stamp/Aw==").Header("Authorization", "Bearer ").
+		Send([]byte{}).Expect(403, "FORBIDDEN", "The admin API is disabled.")
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestAdminController_GetHistory(t *testing.T) {
+	app, rq := createAdminControllerTester(t, "secret")
+	defer app.RequireStop()
+
+	admin := func() *test.Request {
+		return rq().Header("Authorization", "Bearer secret")
+	}
+	type historyResponse struct {
+		Entries []historyEntryData `json:"entries"`
+	}
+
+	rq().Post("/api/paint/"+urlCoords("000000,000000")).Header("X-Forwarded-For", "1.2.3.4").
+		Send(paintInput{Color: "f80"}).Expect(200, "PIXEL_SET")
+	rq().Post("/api/paint/"+urlCoords("100000,000000")).Header("X-Forwarded-For", "5.6.7.8").
+		Send(paintInput{Color: "0f0"}).Expect(200, "PIXEL_SET")
+
+	/////////////////////////////////////////////////////////
+	// Painted pixels are recorded with the painter's IP, newest first.
+	var response historyResponse
+	admin().Get("/api/admin/history").Expect(200, "HISTORY").Save(&response)
+	assert.Len(t, response.Entries, 2)
+	assert.Equal(t, urlCoords("100000,000000"), response.Entries[0].Coords)
+	assert.Equal(t, "0f0", response.Entries[0].Color)
+	assert.Equal(t, "5.6.7.8", response.Entries[0].Painter)
+	assert.Equal(t, "f80", response.Entries[1].Color)
+	assert.Equal(t, "1.2.3.4", response.Entries[1].Painter)
+
+	/////////////////////////////////////////////////////////
+	// By area, time and count.
+	admin().Get("/api/admin/history?coords="+urlCoords("0,0")).Expect(200, "HISTORY").Save(&response)
+	assert.Len(t, response.Entries, 1)
+	assert.Equal(t, "1.2.3.4", response.Entries[0].Painter)
+	admin().Get("/api/admin/history?limit=1").Expect(200, "HISTORY").Save(&response)
+	assert.Len(t, response.Entries, 1)
+	since := strconv.FormatInt(response.Entries[0].Time+1, 10)
+	admin().Get("/api/admin/history?since="+since).Expect(200, "HISTORY").Save(&response)
+	assert.Empty(t, response.Entries)
+
+	/////////////////////////////////////////////////////////
+	// Only for admins, with sane limits.
+	rq().Get("/api/admin/history").Expect(403, "FORBIDDEN", "Invalid admin key.")
+	admin().Get("/api/admin/history?limit=0").Expect(400, "BAD_REQUEST", "`limit` must be 1 to 1000.")
+	admin().Get("/api/admin/history?limit=1001").Expect(400, "BAD_REQUEST", "`limit` must be 1 to 1000.")
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestAdminController_Palettes(t *testing.T) {
+	app, rq := createAdminControllerTester(t, "secret")
+	defer app.RequireStop()
+
+	admin := func() *test.Request {
+		return rq().Header("Authorization", "Bearer secret")
+	}
+	paint := func(coords, color string) *test.Request {
+		return rq().Post("/api/paint/" + urlCoords(coords)).Send(paintInput{Color: color})
+	}
+	type palettesResponse struct {
+		Zones []paletteZoneData `json:"zones"`
+	}
+
+	/////////////////////////////////////////////////////////
+	// The top left quarter of the canvas only takes black and white, and the top left of
+	// that snaps to blue.
+	admin().Put("/api/admin/palettes/"+urlCoords("0,0")).Send(paletteInput{
+		Palette: []string{"000", "fff"},
+	}).Expect(200, "PALETTE_SET")
+	admin().Put("/api/admin/palettes/"+urlCoords("00,00")).Send(paletteInput{
+		Palette: []string{"00f"},
+		Snap:    true,
+	}).Expect(200, "PALETTE_SET")
+
+	var response palettesResponse
+	admin().Get("/api/admin/palettes").Expect(200, "PALETTES").Save(&response)
+	assert.Equal(t, []paletteZoneData{
+		{Coords: urlCoords("0,0"), Palette: []string{"000", "fff"}},
+		{Coords: urlCoords("00,00"), Palette: []string{"00f"}, Snap: true},
+	}, response.Zones)
+
+	paint("010100,000000", "f00").Expect(400, "COLOR_NOT_ALLOWED")
+	paint("010100,000000", "fff").Expect(200, "PIXEL_SET")
+	paint("000000,000000", "f00").Expect(200, "PIXEL_SET")
+	paint("101000,000000", "f00").Expect(200, "PIXEL_SET")
+
+	var history struct {
+		Entries []historyEntryData `json:"entries"`
+	}
+	admin().Get("/api/admin/history?coords="+urlCoords("000000,000000")).Expect(200, "HISTORY").Save(&history)
+	assert.Equal(t, "00f", history.Entries[0].Color)
+
+	var stroke struct {
+		Results []string `json:"results"`
+	}
+	rq().Post("/api/stroke").Send(strokeInput{Pixels: []strokePixelInput{
+		{Coords: urlCoords("010101,000000"), Color: "f00"},
+		{Coords: urlCoords("010101,000001"), Color: "000"},
+	}}).Expect(200, "STROKE").Save(&stroke)
+	assert.Equal(t, []string{"COLOR_NOT_ALLOWED", "OK"}, stroke.Results)
+
+	/////////////////////////////////////////////////////////
+	// 24-bit colors are rounded on a 12-bit canvas, the same as painted colors.
+	admin().Put("/api/admin/palettes/"+urlCoords("1,1")).Send(paletteInput{
+		Palette: []string{"ff8800", "f80"},
+	}).Expect(200, "PALETTE_SET")
+	admin().Get("/api/admin/palettes").Expect(200, "PALETTES").Save(&response)
+	assert.Equal(t, paletteZoneData{Coords: urlCoords("1,1"), Palette: []string{"f80"}},
+		response.Zones[2])
+	paint("100000,100000", "ff8800").Expect(200, "PIXEL_SET")
+	paint("100001,100000", "f00").Expect(400, "COLOR_NOT_ALLOWED")
+	admin().Delete("/api/admin/palettes/"+urlCoords("1,1")).Expect(200, "PALETTE_DELETED")
+
+	/////////////////////////////////////////////////////////
+	// Removing a zone lifts its restriction.
+	admin().Delete("/api/admin/palettes/"+urlCoords("0,0")).Expect(200, "PALETTE_DELETED")
+	admin().Delete("/api/admin/palettes/"+urlCoords("0,0")).Expect(404, "NOT_FOUND", "Palette zone not found.")
+	paint("010110,000000", "f00").Expect(200, "PIXEL_SET")
+	admin().Get("/api/admin/palettes").Expect(200, "PALETTES").Save(&response)
+	assert.Len(t, response.Zones, 1)
+
+	/////////////////////////////////////////////////////////
+	// Only for admins, with valid palettes.
+	rq().Get("/api/admin/palettes").Expect(403, "FORBIDDEN", "Invalid admin key.")
+	rq().Put("/api/admin/palettes/"+urlCoords("0,0")).Send(paletteInput{Palette: []string{"000"}}).
+		Expect(403, "FORBIDDEN", "Invalid admin key.")
+	rq().Delete("/api/admin/palettes/"+urlCoords("00,00")).Expect(403, "FORBIDDEN", "Invalid admin key.")
+	admin().Put("/api/admin/palettes/"+urlCoords("0,0")).Send(paletteInput{}).
+		Expect(400, "BAD_REQUEST", "`body.palette` is missing.")
+	admin().Put("/api/admin/palettes/"+urlCoords("0,0")).Send(paletteInput{Palette: []string{"transparent"}}).
+		Expect(400, "BAD_REQUEST", "Palette colors can't be transparent.")
+	admin().Put("/api/admin/palettes/"+urlCoords("0,0")).Send(paletteInput{Palette: []string{"red"}}).
+		Expect(400, "BAD_REQUEST")
+	admin().Put("/api/admin/palettes/").Send(paletteInput{Palette: []string{"000"}}).Expect(400, "BAD_REQUEST")
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestAdminController_Protection(t *testing.T) {
+	app, rq := createAdminControllerTester(t, "secret")
+	defer app.RequireStop()
+
+	admin := func() *test.Request {
+		return rq().Header("Authorization", "Bearer secret")
+	}
+	paint := func(coords, color string) *test.Request {
+		return rq().Post("/api/paint/"+urlCoords(coords)).Header("X-Forwarded-For", "1.2.3.4").
+			Send(paintInput{Color: color})
+	}
+	type protectionResponse struct {
+		Zones []protectedZoneData `json:"zones"`
+	}
+
+	/////////////////////////////////////////////////////////
+	// Freezing the top left quarter of the canvas, including wet pixels.
+	paint("010100,000000", "f00").Expect(200, "PIXEL_SET")
+	admin().Put("/api/admin/protection/"+urlCoords("0,0")).Send(protectionInput{}).
+		Expect(200, "PROTECTION_SET")
+	admin().Put("/api/admin/protection/"+urlCoords("1,1")).Send(protectionInput{Duration: 60}).
+		Expect(200, "PROTECTION_SET")
+
+	var response protectionResponse
+	admin().Get("/api/admin/protection").Expect(200, "PROTECTION").Save(&response)
+	assert.Len(t, response.Zones, 2)
+	assert.Equal(t, protectedZoneData{Coords: urlCoords("0,0")}, response.Zones[0])
+	assert.Equal(t, urlCoords("1,1"), response.Zones[1].Coords)
+	assert.NotZero(t, response.Zones[1].Expires)
+
+	paint("010100,000000", "0f0").Expect(403, "PROTECTED", "Pixel is in a protected area.")
+	paint("101000,101000", "0f0").Expect(403, "PROTECTED")
+	rq().Post("/api/undo/"+urlCoords("010100,000000")).Header("X-Forwarded-For", "1.2.3.4").
+		Expect(403, "PROTECTED")
+	paint("101000,000000", "0f0").Expect(200, "PIXEL_SET")
+
+	var stroke struct {
+		Results []string `json:"results"`
+	}
+	rq().Post("/api/stroke").Send(strokeInput{Pixels: []strokePixelInput{
+		{Coords: urlCoords("010101,000000"), Color: "f00"},
+		{Coords: urlCoords("101001,000000"), Color: "f00"},
+	}}).Expect(200, "STROKE").Save(&stroke)
+	assert.Equal(t, []string{"PROTECTED", "OK"}, stroke.Results)
+
+	/////////////////////////////////////////////////////////
+	// Removing a zone lifts the protection.
+	admin().Delete("/api/admin/protection/"+urlCoords("0,0")).Expect(200, "PROTECTION_DELETED")
+	admin().Delete("/api/admin/protection/"+urlCoords("0,0")).Expect(404, "NOT_FOUND", "Protected zone not found.")
+	rq().Post("/api/undo/"+urlCoords("010100,000000")).Header("X-Forwarded-For", "1.2.3.4").
+		Expect(200, "PIXEL_UNDONE")
+	admin().Get("/api/admin/protection").Expect(200, "PROTECTION").Save(&response)
+	assert.Len(t, response.Zones, 1)
+
+	/////////////////////////////////////////////////////////
+	// Only for admins, with valid durations.
+	rq().Get("/api/admin/protection").Expect(403, "FORBIDDEN", "Invalid admin key.")
+	rq().Put("/api/admin/protection/"+urlCoords("0,0")).Send(protectionInput{}).
+		Expect(403, "FORBIDDEN", "Invalid admin key.")
+	rq().Delete("/api/admin/protection/"+urlCoords("1,1")).Expect(403, "FORBIDDEN", "Invalid admin key.")
+	admin().Put("/api/admin/protection/"+urlCoords("0,0")).Send(protectionInput{Duration: -1}).
+		Expect(400, "BAD_REQUEST", "`body.duration` can't be negative.")
+	admin().Put("/api/admin/protection/").Send(protectionInput{}).Expect(400, "BAD_REQUEST")
+}
@@ -0,0 +1,141 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package api
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mukunda.com/nanopaint/core/block2"
+)
+
+// Blocks can be requested in a binary format instead of JSON with the Accept header. The
+// JSON pixel data is base64, which is about 22 KB per block before compression.
+//
+// application/octet-stream is only the pixel data: 4096 uint32 little-endian pixels,
+// followed by 4096 more with the fine pixel data for 24-bit blocks (see block2.Block).
+// The block metadata is left to the ETag and Last-Modified headers.
+//
+// application/vnd.nanopaint.block is the full block:
+//
+//	[0]     Version, currently 2.
+//	[1]     Flags. 1 if the pixels are compressed. 2 if the block is 24-bit.
+//	[2:10]  LastUpdated, int64 unix ms.
+//	[10:18] DryTime, int64 unix ms. Zero if the block is dry.
+//	[18:20] Number of wet pixels, uint16.
+//	...     For each wet pixel: index uint16, dry time int64 unix ms.
+//	...     The pixels.
+//	...     The fine pixels, for 24-bit blocks. Compressed the same as the pixels.
+//
+// All numbers are little-endian. Uncompressed pixels are the same as octet-stream. When
+// compressed, the pixels are a uint16 palette size, then that many uint32 palette colors,
+// then runs of pixels in order, each a uvarint length and a uvarint palette index, until
+// all 4096 pixels are covered (see block2.AppendPalettePixels). Most blocks are only a
+// few colors, so the server compresses them unless a plane has too many colors or doesn't
+// get smaller.
+//
+// Version 1 sent the remaining wet time of each pixel as uint32 ms. The times are
+// absolute now so that the body stays the same under its ETag; the server time is in the
+// X-Server-Time header.
+
+const (
+	contentTypeBlock = "application/vnd.nanopaint.block"
+
+	blockFormatVersion = 2
+	// Flag for palette/RLE compressed pixels.
+	blockFormatPalette = 1
+	// Flag for fine pixels after the pixels.
+	blockFormatFine = 2
+)
+
+// ---------------------------------------------------------------------------------------
+// Returns the content type to send for the Accept header. Quality values are respected,
+// and JSON is the default when nothing supported is asked for.
+func negotiateBlockFormat(accept string) string {
+	supported := []string{echo.MIMEApplicationJSON, echo.MIMEOctetStream, contentTypeBlock}
+
+	best := echo.MIMEApplicationJSON
+	bestQuality := -1.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		quality := 1.0
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if name == "q" {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		if mediaType == "*/*" || mediaType == "application/*" {
+			mediaType = echo.MIMEApplicationJSON
+		}
+		// Earlier ranges win ties.
+		if quality > bestQuality && quality > 0 {
+			for _, contentType := range supported {
+				if mediaType == contentType {
+					best, bestQuality = contentType, quality
+				}
+			}
+		}
+	}
+	return best
+}
+
+// ---------------------------------------------------------------------------------------
+func encodeRawPixels(data []byte, pixels []block2.Pixel) []byte {
+	for _, pixel := range pixels {
+		data = binary.LittleEndian.AppendUint32(data, uint32(pixel))
+	}
+	return data
+}
+
+// ---------------------------------------------------------------------------------------
+// The pixels, followed by the fine pixels for 24-bit blocks.
+func blockPixelPlanes(block *block2.Block) [][]block2.Pixel {
+	if block.Fine == nil {
+		return [][]block2.Pixel{block.Pixels}
+	}
+	return [][]block2.Pixel{block.Pixels, block.Fine}
+}
+
+// ---------------------------------------------------------------------------------------
+func encodeBinaryBlock(block *block2.Block) []byte {
+	wet := encodeWetPixels(block.DryTimes)
+
+	data := make([]byte, 0, 20+len(wet)*10+len(block.Pixels)*4)
+	data = append(data, blockFormatVersion, 0)
+	data = binary.LittleEndian.AppendUint64(data, uint64(block.LastUpdated))
+	data = binary.LittleEndian.AppendUint64(data, uint64(block.DryTime))
+	data = binary.LittleEndian.AppendUint16(data, uint16(len(wet)))
+	for _, entry := range wet {
+		data = binary.LittleEndian.AppendUint16(data, uint16(entry[0]))
+		data = binary.LittleEndian.AppendUint64(data, uint64(entry[1]))
+	}
+
+	if block.Fine != nil {
+		data[1] |= blockFormatFine
+	}
+
+	header := len(data)
+	planes := blockPixelPlanes(block)
+	for _, plane := range planes {
+		var ok bool
+		if data, ok = block2.AppendPalettePixels(data, plane); !ok {
+			// Noisy blocks are smaller as they are.
+			data = data[:header]
+			for _, plane := range planes {
+				data = encodeRawPixels(data, plane)
+			}
+			return data
+		}
+	}
+	data[1] |= blockFormatPalette
+	return data
+}
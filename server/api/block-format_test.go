@@ -0,0 +1,164 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package api
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mukunda.com/nanopaint/core/block2"
+)
+
+type decodedBinaryBlock struct {
+	Flags       byte
+	LastUpdated int64
+	DryTime     int64
+	Wet         [][2]int64
+	Pixels      []block2.Pixel
+	Fine        []block2.Pixel
+}
+
+// ---------------------------------------------------------------------------------------
+// Decodes the binary block format the way a client would.
+func decodeBinaryBlock(t *testing.T, data []byte) decodedBinaryBlock {
+	var block decodedBinaryBlock
+	require.GreaterOrEqual(t, len(data), 20)
+	require.Equal(t, byte(blockFormatVersion), data[0])
+	block.Flags = data[1]
+	block.LastUpdated = int64(binary.LittleEndian.Uint64(data[2:]))
+	block.DryTime = int64(binary.LittleEndian.Uint64(data[10:]))
+	wetCount := int(binary.LittleEndian.Uint16(data[18:]))
+	data = data[20:]
+	for i := 0; i < wetCount; i++ {
+		block.Wet = append(block.Wet, [2]int64{
+			int64(binary.LittleEndian.Uint16(data)),
+			int64(binary.LittleEndian.Uint64(data[2:])),
+		})
+		data = data[10:]
+	}
+
+	readPixels := func(count int) []block2.Pixel {
+		pixels := make([]block2.Pixel, count)
+		for i := range pixels {
+			pixels[i] = block2.Pixel(binary.LittleEndian.Uint32(data[i*4:]))
+		}
+		data = data[count*4:]
+		return pixels
+	}
+
+	readPlane := func() []block2.Pixel {
+		if block.Flags&blockFormatPalette == 0 {
+			return readPixels(64 * 64)
+		}
+
+		paletteSize := int(binary.LittleEndian.Uint16(data))
+		data = data[2:]
+		palette := readPixels(paletteSize)
+		var pixels []block2.Pixel
+		for len(pixels) < 64*64 {
+			length, n := binary.Uvarint(data)
+			require.Greater(t, n, 0)
+			index, m := binary.Uvarint(data[n:])
+			require.Greater(t, m, 0)
+			data = data[n+m:]
+			for i := uint64(0); i < length; i++ {
+				pixels = append(pixels, palette[index])
+			}
+		}
+		require.Len(t, pixels, 64*64)
+		return pixels
+	}
+
+	block.Pixels = readPlane()
+	if block.Flags&blockFormatFine != 0 {
+		block.Fine = readPlane()
+	}
+	require.Empty(t, data)
+	return block
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestNegotiateBlockFormat(t *testing.T) {
+	assert.Equal(t, "application/json", negotiateBlockFormat(""))
+	assert.Equal(t, "application/json", negotiateBlockFormat("*/*"))
+	assert.Equal(t, "application/json", negotiateBlockFormat("text/html"))
+	assert.Equal(t, "application/octet-stream", negotiateBlockFormat("application/octet-stream"))
+	assert.Equal(t, contentTypeBlock, negotiateBlockFormat(
+		"application/json;q=0.5, application/vnd.nanopaint.block"))
+	assert.Equal(t, "application/octet-stream", negotiateBlockFormat(
+		"application/vnd.nanopaint.block;q=0.2, application/octet-stream;q=0.8, */*;q=0.1"))
+	assert.Equal(t, "application/json", negotiateBlockFormat(
+		"application/vnd.nanopaint.block;q=0, */*"))
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestEncodeBinaryBlock(t *testing.T) {
+	block := &block2.Block{
+		Pixels:      make([]block2.Pixel, 64*64),
+		LastUpdated: 1000,
+		DryTime:     6000,
+		DryTimes:    map[uint16]block2.UnixMillis{9: 6000, 3: 5000},
+	}
+	for i := 100; i < 200; i++ {
+		block.Pixels[i] = block2.PIXEL_SET | 0xF00<<16
+	}
+	block.Pixels[4095] = 0x0000F00F
+
+	/////////////////////////////////////////////////////////////////////////////
+	// A block with a few colors is compressed.
+	data := encodeBinaryBlock(block)
+	assert.Less(t, len(data), 100)
+	assert.Equal(t, decodedBinaryBlock{
+		Flags:       blockFormatPalette,
+		LastUpdated: 1000,
+		DryTime:     6000,
+		Wet:         [][2]int64{{3, 5000}, {9, 6000}},
+		Pixels:      block.Pixels,
+	}, decodeBinaryBlock(t, data))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// Noisy blocks are sent as they are.
+	for i := range block.Pixels {
+		block.Pixels[i] = block2.Pixel(i)
+	}
+	block.DryTimes = nil
+	block.DryTime = 0
+	data = encodeBinaryBlock(block)
+	assert.Len(t, data, 20+64*64*4)
+	assert.Equal(t, decodedBinaryBlock{
+		LastUpdated: 1000,
+		Pixels:      block.Pixels,
+	}, decodeBinaryBlock(t, data))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// 24-bit blocks have the fine pixels after the pixels, compressed the same way.
+	block.Fine = make([]block2.Pixel, 64*64)
+	for i := range block.Fine {
+		block.Fine[i] = block2.Pixel(i << 16)
+	}
+	data = encodeBinaryBlock(block)
+	assert.Len(t, data, 20+2*64*64*4)
+	assert.Equal(t, decodedBinaryBlock{
+		Flags:       blockFormatFine,
+		LastUpdated: 1000,
+		Pixels:      block.Pixels,
+		Fine:        block.Fine,
+	}, decodeBinaryBlock(t, data))
+
+	for i := range block.Pixels {
+		block.Pixels[i] = 0x0000F00F
+		block.Fine[i] = 0x00000ABC
+	}
+	data = encodeBinaryBlock(block)
+	assert.Less(t, len(data), 100)
+	assert.Equal(t, decodedBinaryBlock{
+		Flags:       blockFormatPalette | blockFormatFine,
+		LastUpdated: 1000,
+		Pixels:      block.Pixels,
+		Fine:        block.Fine,
+	}, decodeBinaryBlock(t, data))
+}
@@ -31,6 +31,11 @@ func translateErrorForEcho(c Ct, ce cat.ControlledError) error {
 			"NOT_FOUND",
 			ce.Problem.Error(),
 		})
+	case cat.ProtectedError:
+		return echo.NewHTTPError(403, baseResponse{
+			"PROTECTED",
+			ce.Problem.Error(),
+		})
 	case cat.ExecutionError:
 		return echo.NewHTTPError(500, baseResponse{
 			"INTERNAL_ERROR",
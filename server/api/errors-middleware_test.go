@@ -69,6 +69,10 @@ func TestErrorsMiddleware(t *testing.T) {
 					// NotFound errors will show as 404 Not Found with the provided message.
 					cat.NotFoundIf(false, "notfound0")
 					cat.NotFoundIf(true, "notfound1")
+				case "protected1":
+					// Protected errors will show as 403 Forbidden with their own code.
+					cat.ProtectedIf(false, "protected0")
+					cat.ProtectedIf(true, "protected1")
 				}
 
 				return c.JSON(405, "not implemented")
@@ -84,4 +88,5 @@ func TestErrorsMiddleware(t *testing.T) {
 	testreq(t, hs).Post("/test/ise").Expect(500, "INTERNAL_ERROR", "An internal error occurred and has been logged.")
 	testreq(t, hs).Post("/test/denied1").Expect(403, "FORBIDDEN", "denied1")
 	testreq(t, hs).Post("/test/notfound1").Expect(404, "NOT_FOUND", "notfound1")
+	testreq(t, hs).Post("/test/protected1").Expect(403, "PROTECTED", "protected1")
 }
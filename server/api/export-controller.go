@@ -0,0 +1,81 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package api
+
+import (
+	"bytes"
+	"strconv"
+
+	"go.mukunda.com/nanopaint/cat"
+	"go.mukunda.com/nanopaint/core"
+	"go.mukunda.com/nanopaint/core/block2"
+)
+
+// Exports regions of the canvas as PNG images to share artwork outside of the app.
+//
+//	GET /api/export/<coords>?depth=<levels>&pixelSize=<n>
+//
+// coords is the root block, depth is how many levels below it to render (default 0, the
+// root block only) and pixelSize is how many image pixels each canvas pixel takes
+// (default 1). See core.ImageService.
+//
+// Anyone can export, so images are capped at maxExportSize, far below what the export
+// command allows (core.MaxImageSize). Larger images take hundreds of MB to render.
+
+// Largest width or height of an exported image.
+const maxExportSize = 1024
+
+type ExportController interface {
+	ExportPng(c Ct) error
+}
+
+type exportController struct {
+	images core.ImageService
+}
+
+// ---------------------------------------------------------------------------------------
+func CreateExportController(routes Router, hs HttpService, images core.ImageService) ExportController {
+	ec := &exportController{
+		images: images,
+	}
+
+	// The empty string is not valid coords, but it should still be a 400, not a 404.
+	routes.GET("/api/export/:coords", ec.ExportPng, hs.UseRateLimiter())
+	routes.GET("/api/export/", ec.ExportPng, hs.UseRateLimiter())
+
+	return ec
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the integer query parameter, or the default if it's missing.
+func queryInt(c Ct, name string, defaultValue int) int {
+	value := c.QueryParam(name)
+	if value == "" {
+		return defaultValue
+	}
+	result, err := strconv.Atoi(value)
+	cat.BadIf(err != nil, "`"+name+"` must be an integer.")
+	return result
+}
+
+// ---------------------------------------------------------------------------------------
+func (ec *exportController) ExportPng(c Ct) error {
+	root := block2.CoordsFromBase64(c.Param("coords"))
+	depth := queryInt(c, "depth", 0)
+	pixelSize := queryInt(c, "pixelSize", 1)
+
+	sizeMessage := "Invalid image size. Images can be at most " + strconv.Itoa(maxExportSize) +
+		" pixels wide."
+	cat.BadIf(depth < 0 || pixelSize < 1 || 64<<min(depth, 16) > maxExportSize/pixelSize,
+		sizeMessage)
+
+	var data bytes.Buffer
+	err := ec.images.ExportPng(&data, root, depth, pixelSize)
+	cat.BadIf(err == core.ErrImageSize, sizeMessage)
+	cat.NotFoundIf(err == block2.ErrBlockNotFound, "Block not found.")
+	cat.Catch(err, "Failed to export image.")
+
+	return c.Blob(200, "image/png", data.Bytes())
+}
@@ -0,0 +1,97 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package api
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mukunda.com/nanopaint/config"
+	"go.mukunda.com/nanopaint/core"
+	"go.mukunda.com/nanopaint/core/clock"
+	"go.mukunda.com/nanopaint/test"
+	"go.uber.org/fx"
+	"go.uber.org/fx/fxtest"
+)
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func createExportControllerTester(t *testing.T) (*fxtest.App, testreqFactory) {
+	var hs HttpService
+
+	app := fxtest.New(t,
+		config.ProvideFromYamlString(`
+http:
+  port: 0
+  disableRateLimit: true
+core:
+  disableBlockDryInterval: true
+`),
+		fx.Provide(
+			clock.CreateTestClockService,
+			CreateHttpService,
+			unwrapHttpRouter,
+			annotateController(CreatePaintController),
+			annotateController(CreateExportController),
+		),
+		core.Fx(),
+		fx.Invoke(func(s StartControllersParam, phs HttpService) {
+			hs = phs
+		}),
+	).RequireStart()
+
+	return app, func() *test.Request {
+		return testreq(t, hs)
+	}
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestExportController(t *testing.T) {
+	app, rq := createExportControllerTester(t)
+	defer app.RequireStop()
+
+	rq().Post("/api/paint/"+urlCoords("000001,000000")).Send(paintInput{
+		Color: "f00",
+	}).Expect(200, "PIXEL_SET")
+
+	/////////////////////////////////////////////////////////
+	// The region is sent as a PNG.
+	response := rq().Get("/api/export/Aw==?depth=1&pixelSize=2").Run()
+	assert.Equal(t, 200, response.StatusCode)
+	assert.Equal(t, "image/png", response.Response.Get("Content-Type"))
+	img, err := png.Decode(bytes.NewReader(response.ResponseBody))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 256, 256), img.Bounds())
+	assert.Equal(t, color.NRGBA{255, 0, 0, 255}, color.NRGBAModel.Convert(img.At(4, 0)))
+	assert.Equal(t, color.NRGBA{}, color.NRGBAModel.Convert(img.At(0, 0)))
+
+	response = rq().Get("/api/export/Aw==").Run()
+	assert.Equal(t, 200, response.StatusCode)
+	img, err = png.Decode(bytes.NewReader(response.ResponseBody))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 64, 64), img.Bounds())
+
+	response = rq().Get("/api/export/Aw==?depth=3&pixelSize=2").Run()
+	assert.Equal(t, 200, response.StatusCode)
+	img, err = png.Decode(bytes.NewReader(response.ResponseBody))
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 1024, 1024), img.Bounds())
+
+	/////////////////////////////////////////////////////////
+	// Bad sizes and missing blocks are rejected.
+	rq().Get("/api/export/").Expect(400, "BAD_REQUEST", "invalid coords")
+	rq().Get("/api/export/Aw==?depth=x").Expect(400, "BAD_REQUEST", "`depth` must be an integer")
+	rq().Get("/api/export/Aw==?depth=8").Expect(400, "BAD_REQUEST", "Invalid image size")
+	// The CLI can export up to core.MaxImageSize, but the API stops at 1024.
+	rq().Get("/api/export/Aw==?depth=5").Expect(400, "BAD_REQUEST", "at most 1024 pixels")
+	rq().Get("/api/export/Aw==?depth=4&pixelSize=2").Expect(400, "BAD_REQUEST", "at most 1024 pixels")
+	rq().Get("/api/export/Aw==?pixelSize=1025").Expect(400, "BAD_REQUEST", "at most 1024 pixels")
+	rq().Get("/api/export/Aw==?pixelSize=0").Expect(400, "BAD_REQUEST", "Invalid image size")
+	rq().Get("/api/export/a@@b").Expect(400, "BAD_REQUEST", "invalid coords")
+	rq().Get("/api/export/"+urlCoords("1,1")).Expect(404, "NOT_FOUND", "Block not found.")
+}
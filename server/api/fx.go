@@ -39,6 +39,13 @@ func Fx() fx.Option {
 			unwrapHttpRouter,
 
 			annotateController(CreateTestController),
+			annotateController(CreatePaintController),
+			annotateController(CreateAdminController),
+			annotateController(CreateExportController),
+			annotateController(CreateTileController),
+			annotateController(CreateReplayController),
+			annotateController(CreateStreamController),
+			annotateController(CreateSseController),
 		),
 
 		// Create all controllers.
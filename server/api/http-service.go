@@ -6,11 +6,15 @@ package api
 
 import (
 	"context"
+	"crypto/subtle"
+	"fmt"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/labstack/echo/v4"
+	"go.mukunda.com/nanopaint/cat"
 	"go.mukunda.com/nanopaint/config"
 	"go.mukunda.com/nanopaint/core/clock"
 	"go.uber.org/fx"
@@ -22,6 +26,7 @@ type HttpService interface {
 	Router() Router
 	Echo() *echo.Echo
 	UseRateLimiter() echo.MiddlewareFunc
+	UseAdminAuth() echo.MiddlewareFunc
 }
 
 // ---------------------------------------------------------------------------------------
@@ -37,6 +42,12 @@ type httpConfig struct {
 	RateLimitPeriod  int  `yaml:"rateLimitPeriod"`
 	RateLimitBurst   int  `yaml:"rateLimitBurst"`
 	DisableRateLimit bool `yaml:"disableRateLimit"`
+	// Bearer token for the admin API. The admin API is disabled when this is empty.
+	AdminKey string `yaml:"adminKey"`
+	// CIDR ranges of reverse proxies whose X-Forwarded-For header is trusted. When empty,
+	// the client is the address of the connection and the headers are ignored, since any
+	// client can send them.
+	TrustedProxies []string `yaml:"trustedProxies"`
 }
 
 // ---------------------------------------------------------------------------------------
@@ -79,7 +90,11 @@ func createServer(e *echo.Echo, port int) (*http.Server, net.Listener, int) {
 }
 
 // ---------------------------------------------------------------------------------------
-func CreateHttpService(lc fx.Lifecycle, config config.Config, clock clock.ClockService) HttpService {
+//
+// Errors:
+//
+//	A trusted proxy range is not valid CIDR notation.
+func CreateHttpService(lc fx.Lifecycle, config config.Config, clock clock.ClockService) (HttpService, error) {
 	log.Infoln(nil, "Creating HTTP Service.")
 	hs := &httpService{
 		E:           echo.New(),
@@ -87,6 +102,11 @@ func CreateHttpService(lc fx.Lifecycle, config config.Config, clock clock.ClockS
 	}
 	hs.config = defaultHttpConfig
 	config.Load("http", &hs.config)
+	extractor, err := createIPExtractor(hs.config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	hs.E.IPExtractor = extractor
 	installErrorsMiddleware(hs.E)
 	hs.installMiddleware()
 	if !hs.config.DisableRateLimit {
@@ -105,11 +125,43 @@ func CreateHttpService(lc fx.Lifecycle, config config.Config, clock clock.ClockS
 		},
 	})
 
-	return hs
+	return hs, nil
 }
 
-func (hs *httpService) installMiddleware() {
+// ---------------------------------------------------------------------------------------
+// Returns how the client's IP is found for c.RealIP(). Only the trusted proxies are
+// skipped in X-Forwarded-For, from the right, so a client can't choose its IP by sending
+// the header itself.
+func createIPExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
 
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, proxy := range trustedProxies {
+		_, ipRange, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http.trustedProxies range %q: %w", proxy, err)
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Identifies the requester in the context, e.g., for the paint history (see
+// common.Identity).
+func (hs *httpService) installMiddleware() {
+	hs.E.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("ip", c.RealIP())
+			return next(c)
+		}
+	})
 }
 
 // ---------------------------------------------------------------------------------------
@@ -172,3 +224,20 @@ func (hs *httpService) UseRateLimiter() echo.MiddlewareFunc {
 		}
 	}
 }
+
+// ---------------------------------------------------------------------------------------
+// Restricts a route to requests with the admin key, given as "Authorization: Bearer
+// <key>".
+func (hs *httpService) UseAdminAuth() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			cat.DenyIf(hs.config.AdminKey == "", "The admin API is disabled.")
+
+			key, ok := strings.CutPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+			cat.DenyIf(!ok || subtle.ConstantTimeCompare([]byte(key), []byte(hs.config.AdminKey)) != 1,
+				"Invalid admin key.")
+
+			return next(c)
+		}
+	}
+}
@@ -6,56 +6,92 @@ package api
 
 import (
 	"encoding/base64"
+	"encoding/binary"
+	"hash/fnv"
+	"net/http"
 	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/labstack/echo/v4"
 	"go.mukunda.com/nanopaint/cat"
 	"go.mukunda.com/nanopaint/core"
 	"go.mukunda.com/nanopaint/core/block2"
+	"go.mukunda.com/nanopaint/core/clock"
 )
 
 type PaintController interface {
 	GetBlock(c Ct) error
+	GetBlocks(c Ct) error
 	Paint(c Ct) error
+	Stroke(c Ct) error
+	Undo(c Ct) error
 }
 
 type paintController struct {
 	blocks core.BlockService
+	clock  clock.ClockService
 }
 
 var reValidCoords = regexp.MustCompile(`^[0-9A-Za-z_-]*$`)
-var reValidColor = regexp.MustCompile(`^[a-fA-F0-9]{3}$`)
+var reValidColor = regexp.MustCompile(`^([a-fA-F0-9]{3,4}|[a-fA-F0-9]{6}|[a-fA-F0-9]{8})$`)
+
+// Most pixels accepted by one stroke request.
+const maxStrokePixels = 1024
+
+// Most blocks returned by one multi-block request.
+const maxFetchBlocks = 64
 
 // ---------------------------------------------------------------------------------------
-func CreatePaintController(routes Router, blocks core.BlockService, hs HttpService) PaintController {
+func CreatePaintController(routes Router, blocks core.BlockService, hs HttpService, clock clock.ClockService) PaintController {
 	pc := &paintController{
 		blocks: blocks,
+		clock:  clock,
 	}
 
 	// Double route since we also want to include the empty string as valid coords.
 	routes.GET("/api/block/:coords", pc.GetBlock, hs.UseRateLimiter())
 	routes.GET("/api/block/", pc.GetBlock, hs.UseRateLimiter())
 
+	// Many blocks for the cost of one request, e.g., to fill the viewport.
+	routes.GET("/api/blocks", pc.GetBlocks, hs.UseRateLimiter())
+
 	routes.POST("/api/paint/:coords", pc.Paint, hs.UseRateLimiter())
 	// The empty string is not valid for POST, but we still want to customize the error
 	// message (should be 400, not 404).
 	routes.POST("/api/paint/", pc.Paint, hs.UseRateLimiter())
 
+	// Many pixels for the cost of one request.
+	routes.POST("/api/stroke", pc.Stroke, hs.UseRateLimiter())
+
+	// Misclicks can be undone by their painter while the pixel is wet.
+	routes.POST("/api/undo/:coords", pc.Undo, hs.UseRateLimiter())
+	routes.POST("/api/undo/", pc.Undo, hs.UseRateLimiter())
+
 	return &paintController{}
 }
 
 // ---------------------------------------------------------------------------------------
 func encodePixels(pixels []block2.Pixel) string {
-	byteArray := make([]byte, len(pixels)*4)
-	for i, pixel := range pixels {
-		s := i * 4
-		byteArray[s] = byte(pixel)
-		byteArray[s+1] = byte(pixel >> 8)
-		byteArray[s+2] = byte(pixel >> 16)
-		byteArray[s+3] = byte(pixel >> 24)
-	}
+	return base64.URLEncoding.EncodeToString(encodeRawPixels(nil, pixels))
+}
 
-	return base64.URLEncoding.EncodeToString(byteArray)
+// ---------------------------------------------------------------------------------------
+// Returns [pixel index, dry time] pairs for the wet pixels, ordered by index. The dry
+// times are absolute so that the body doesn't change while the block doesn't, which the
+// ETag relies on. Clients compare them to the server time (see setServerTime) rather
+// than their own clock.
+func encodeWetPixels(dryTimes map[uint16]block2.UnixMillis) [][2]int64 {
+	wet := make([][2]int64, 0, len(dryTimes))
+	for index, dryTime := range dryTimes {
+		wet = append(wet, [2]int64{int64(index), dryTime})
+	}
+	slices.SortFunc(wet, func(a, b [2]int64) int {
+		return int(a[0] - b[0])
+	})
+	return wet
 }
 
 // ---------------------------------------------------------------------------------------
@@ -68,21 +104,174 @@ func catchMissingField(fieldName, value string) {
 	cat.BadIf(value == "", "`body."+fieldName+"` is missing.")
 }
 
+// Painting this color erases the pixel. See block2.Transparent.
+const transparentColor = "transparent"
+
 // ---------------------------------------------------------------------------------------
+// Colors are 3 hex digits `rgb`, or 4 digits `rgba` to paint translucent. 24-bit colors
+// are 6 digits `rrggbb` or 8 digits `rrggbbaa`, which 12-bit canvases round to 12 bits.
+// Pixels only have a few opacities, so the alpha is rounded to the closest one (see
+// block2.ColorWithAlpha), and zero alpha is the same as "transparent".
 func parseColor(color string) block2.Color {
-	cat.BadIf(!reValidColor.MatchString(color), "Invalid color. Must be 3 hex digits `rgb`.")
+	if color == transparentColor {
+		return block2.Transparent
+	}
+	cat.BadIf(!reValidColor.MatchString(color),
+		"Invalid color. Must be 3 or 6 hex digits `rgb`/`rrggbb`, 4 or 8 hex digits "+
+			"`rgba`/`rrggbbaa` or `"+transparentColor+"`.")
 	// convert color from a RRGGBB string to a 32-bit integer
-	result, err := strconv.ParseInt(color, 16, 32)
+	result, err := strconv.ParseUint(color, 16, 32)
 	cat.Catch(err, "Unexpected parse failure in api.parseColor.")
 
+	if len(color) >= 6 {
+		alpha := 255
+		if len(color) == 8 {
+			alpha = int(result & 0xFF)
+			result >>= 8
+		}
+		r := (result & 0xFF0000) >> 16
+		g := (result & 0xFF00) >> 8
+		b := result & 0xFF
+		return block2.Color24WithAlpha(uint32(r|g<<8|b<<16), alpha)
+	}
+
+	alpha := 15
+	if len(color) == 4 {
+		alpha = int(result & 0xF)
+		result >>= 4
+	}
+
 	r := (result & 0xF00) >> 8
 	g := (result & 0xF0) >> 4
 	b := result & 0xF
 
-	return block2.Color(r | g<<4 | b<<8)
+	return block2.ColorWithAlpha(block2.Color(r|g<<4|b<<8), alpha)
+}
+
+// ---------------------------------------------------------------------------------------
+// The reverse of parseColor. Opaque colors have 3 digits, or 6 for 24-bit colors.
+func formatColor(color block2.Color) string {
+	if color == block2.Transparent {
+		return transparentColor
+	}
+	if color.IsDeep() {
+		rgb := color.RGB24()
+		r := rgb & 0xFF
+		g := (rgb >> 8) & 0xFF
+		b := (rgb >> 16) & 0xFF
+		hex := strconv.FormatInt(int64(r<<16|g<<8|b)|0x1000000, 16)[1:]
+		if alpha := color.Alpha(); alpha != 15 {
+			return hex + strconv.FormatInt(int64(alpha*17), 16)
+		}
+		return hex
+	}
+	r := color & 0xF
+	g := (color >> 4) & 0xF
+	b := (color >> 8) & 0xF
+	rgb := strconv.FormatInt(int64(r<<8|g<<4|b)|0x1000, 16)[1:]
+	if alpha := color.Alpha(); alpha != 15 {
+		return rgb + strconv.FormatInt(int64(alpha), 16)
+	}
+	return rgb
+}
+
+type blockData struct {
+	Pixels string `json:"pixels"`
+	// The fine pixel data of 24-bit blocks, encoded like the pixels. See block2.Block.
+	Fine        string            `json:"fine,omitempty"`
+	LastUpdated block2.UnixMillis `json:"lastUpdated"`
+	// When the last wet pixel dries. Zero if there are none.
+	DryTime block2.UnixMillis `json:"dryTime"`
+	// [index, dry time in unix ms] for each wet pixel.
+	Wet [][2]int64 `json:"wet"`
+}
+
+// The server clock in unix ms, sent with blocks so that clients can tell how long the wet
+// pixels have left without a synchronized clock.
+const serverTimeHeader = "X-Server-Time"
+
+// ---------------------------------------------------------------------------------------
+// Sets the server time header. It's a header rather than part of the block so that
+// cached blocks stay valid, and it is sent with 304 responses too.
+func (pc *paintController) setServerTime(c Ct) block2.UnixMillis {
+	now := pc.clock.Now().UnixMilli()
+	c.Response().Header().Set(serverTimeHeader, strconv.FormatInt(int64(now), 10))
+	return now
+}
+
+// ---------------------------------------------------------------------------------------
+func makeBlockData(block *block2.Block) blockData {
+	var fine string
+	if block.Fine != nil {
+		fine = encodePixels(block.Fine)
+	}
+	return blockData{
+		Pixels:      encodePixels(block.Pixels[:]),
+		Fine:        fine,
+		LastUpdated: block.LastUpdated,
+		DryTime:     block.DryTime,
+		Wet:         encodeWetPixels(block.DryTimes),
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// The ETag is LastUpdated plus a hash of the block contents, so two changes within the
+// same millisecond still give different tags. The contents include the pixel deadlines,
+// which are absolute in every format, so a tag always matches the same body.
+func blockETag(block *block2.Block, contentType string) string {
+	hash := fnv.New64a()
+	// Each format is a different representation, so it needs its own tag.
+	hash.Write([]byte(contentType))
+	var buffer []byte
+	for _, plane := range blockPixelPlanes(block) {
+		buffer = encodeRawPixels(buffer, plane)
+	}
+	hash.Write(buffer)
+
+	wet := encodeWetPixels(block.DryTimes)
+	buffer = buffer[:0]
+	for _, entry := range wet {
+		buffer = binary.LittleEndian.AppendUint64(buffer, uint64(entry[0]))
+		buffer = binary.LittleEndian.AppendUint64(buffer, uint64(entry[1]))
+	}
+	hash.Write(buffer)
+
+	return `"` + strconv.FormatInt(int64(block.LastUpdated), 36) + "-" +
+		strconv.FormatUint(hash.Sum64(), 36) + `"`
+}
+
+// ---------------------------------------------------------------------------------------
+// True if the If-None-Match header has the ETag or "*". Weak tags compare the same as
+// strong ones, as they should for GET.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ---------------------------------------------------------------------------------------
+// Sets the cache headers for a representation of the block with the given ETag. Returns
+// true if the client's copy is current, in which case the response should be a 304.
+func checkBlockCache(c Ct, block *block2.Block, etag string) bool {
+	header := c.Response().Header()
+	header.Set("ETag", etag)
+	if block.LastUpdated != 0 {
+		header.Set("Last-Modified",
+			time.UnixMilli(int64(block.LastUpdated)).UTC().Format(http.TimeFormat))
+	}
+	// Caches must always check with the server, since blocks change at any time.
+	header.Set("Cache-Control", "no-cache")
+
+	return etagMatches(c.Request().Header.Get("If-None-Match"), etag)
 }
 
 // ---------------------------------------------------------------------------------------
+// Clients can poll blocks cheaply with If-None-Match. Unchanged blocks get a 304 without
+// a body. The Accept header chooses between JSON and the binary formats.
 func (pc *paintController) GetBlock(c Ct) error {
 	coordsString := c.Param("coords")
 	coords := block2.CoordsFromBase64(coordsString)
@@ -91,16 +280,105 @@ func (pc *paintController) GetBlock(c Ct) error {
 	cat.NotFoundIf(err == block2.ErrBlockNotFound, "Block not found.")
 	cat.Catch(err, "unexpected error from core.GetBlock")
 
+	contentType := negotiateBlockFormat(c.Request().Header.Get("Accept"))
+	c.Response().Header().Set("Vary", "Accept")
+	pc.setServerTime(c)
+	if checkBlockCache(c, block, blockETag(block, contentType)) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	switch contentType {
+	case echo.MIMEOctetStream:
+		var data []byte
+		for _, plane := range blockPixelPlanes(block) {
+			data = encodeRawPixels(data, plane)
+		}
+		return c.Blob(200, contentType, data)
+	case contentTypeBlock:
+		return c.Blob(200, contentType, encodeBinaryBlock(block))
+	}
+
 	var response struct {
 		baseResponse
-
-		Pixels      string            `json:"pixels"`
-		LastUpdated block2.UnixMillis `json:"lastUpdated"`
+		blockData
 	}
 
 	response.Code = "BLOCK"
-	response.Pixels = encodePixels(block.Pixels[:])
-	response.LastUpdated = block.LastUpdated
+	response.blockData = makeBlockData(block)
+
+	return c.JSON(200, response)
+}
+
+// ---------------------------------------------------------------------------------------
+// Parses the blocks requested from GetBlocks. Either `coords` is a comma separated list,
+// or `origin` is the top-left block of a rectangle with `width` and `height`. Blocks
+// of the rectangle that are past the edge of the canvas are left out.
+func parseBlockList(c Ct) []block2.Coords {
+	var coords []block2.Coords
+	params := c.QueryParams()
+
+	if params.Has("coords") {
+		for _, coordsString := range strings.Split(c.QueryParam("coords"), ",") {
+			cat.BadIf(len(coords) >= maxFetchBlocks, "Too many blocks. The limit is "+
+				strconv.Itoa(maxFetchBlocks)+".")
+			coords = append(coords, block2.CoordsFromBase64(coordsString))
+		}
+		return coords
+	}
+
+	cat.BadIf(!params.Has("origin"), "Either `coords` or `origin` is required.")
+	origin := block2.CoordsFromBase64(c.QueryParam("origin"))
+	width, err := strconv.Atoi(c.QueryParam("width"))
+	cat.BadIf(err != nil || width < 1, "`width` must be a positive integer.")
+	height, err := strconv.Atoi(c.QueryParam("height"))
+	cat.BadIf(err != nil || height < 1, "`height` must be a positive integer.")
+	cat.BadIf(width*height > maxFetchBlocks, "Too many blocks. The limit is "+
+		strconv.Itoa(maxFetchBlocks)+".")
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if block, ok := origin.Offset(x, y); ok {
+				coords = append(coords, block)
+			}
+		}
+	}
+	return coords
+}
+
+type blockListEntry struct {
+	Coords string `json:"coords"`
+	// BLOCK or NOT_FOUND
+	Code string `json:"code"`
+	*blockData
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns many blocks in one request. Each entry has the same fields as GetBlock, or
+// only the coords and NOT_FOUND if the block doesn't exist. The list isn't cached, so the
+// server time is in the body as well as the header.
+func (pc *paintController) GetBlocks(c Ct) error {
+	coords := parseBlockList(c)
+
+	var response struct {
+		baseResponse
+		Now    block2.UnixMillis `json:"now"`
+		Blocks []blockListEntry  `json:"blocks"`
+	}
+	response.Code = "BLOCKS"
+	response.Now = pc.setServerTime(c)
+	response.Blocks = make([]blockListEntry, len(coords))
+
+	for i, block := range pc.blocks.GetBlocks(coords) {
+		entry := &response.Blocks[i]
+		entry.Coords = coords[i].ToBase64()
+		if block == nil {
+			entry.Code = "NOT_FOUND"
+			continue
+		}
+		entry.Code = "BLOCK"
+		data := makeBlockData(block)
+		entry.blockData = &data
+	}
 
 	return c.JSON(200, response)
 }
@@ -119,7 +397,8 @@ func (pc *paintController) Paint(c Ct) error {
 
 	coords := block2.CoordsFromBase64(coordsString)
 
-	err := pc.blocks.SetPixel(coords, parseColor(body.Color))
+	err := pc.blocks.SetPixel(c, coords, parseColor(body.Color))
+	cat.ProtectedIf(err == core.ErrProtected, "Pixel is in a protected area.")
 	if err == block2.ErrPixelIsDry {
 		return c.JSON(400, baseResponse{
 			Code:    "PIXEL_DRY",
@@ -135,6 +414,11 @@ func (pc *paintController) Paint(c Ct) error {
 			Code:    "MAX_DEPTH_EXCEEDED",
 			Message: "Max depth exceeded.",
 		})
+	} else if err == core.ErrColorNotAllowed {
+		return c.JSON(400, baseResponse{
+			Code:    "COLOR_NOT_ALLOWED",
+			Message: "Color is not in the palette of this area.",
+		})
 	}
 	cat.Catch(err, "Failed to set pixel.")
 
@@ -142,3 +426,95 @@ func (pc *paintController) Paint(c Ct) error {
 		Code: "PIXEL_SET",
 	})
 }
+
+type strokeInput struct {
+	Pixels []strokePixelInput `json:"pixels"`
+}
+
+type strokePixelInput struct {
+	Coords string `json:"coords"`
+	Color  string `json:"color"`
+}
+
+// ---------------------------------------------------------------------------------------
+// Paints a batch of pixels, possibly at different depths. The whole request is rejected
+// if any pixel is malformed. Otherwise each pixel gets its own result code, in the same
+// order: OK, PIXEL_DRY, MAX_DEPTH_EXCEEDED, COLOR_NOT_ALLOWED or PROTECTED, or ERROR if
+// the pixel failed for any other reason.
+func (pc *paintController) Stroke(c Ct) error {
+	var body strokeInput
+	c.Bind(&body)
+	cat.BadIf(len(body.Pixels) == 0, "`body.pixels` is missing.")
+	cat.BadIf(len(body.Pixels) > maxStrokePixels, "Too many pixels. The limit is "+
+		strconv.Itoa(maxStrokePixels)+".")
+
+	pixels := make([]block2.PixelPaint, len(body.Pixels))
+	for i, pixel := range body.Pixels {
+		catchMissingField("pixels.coords", pixel.Coords)
+		catchMissingField("pixels.color", pixel.Color)
+		coords := block2.CoordsFromBase64(pixel.Coords)
+		cat.BadIf(coords.BitLength() < 6, "Invalid pixel coordinates.")
+		pixels[i] = block2.PixelPaint{
+			Coords: coords,
+			Color:  parseColor(pixel.Color),
+		}
+	}
+
+	var response struct {
+		baseResponse
+		Results []string `json:"results"`
+	}
+	response.Code = "STROKE"
+
+	for _, err := range pc.blocks.SetPixels(c, pixels) {
+		switch err {
+		case nil:
+			response.Results = append(response.Results, "OK")
+		case block2.ErrPixelIsDry:
+			response.Results = append(response.Results, "PIXEL_DRY")
+		case block2.ErrMaxDepthExceeded:
+			response.Results = append(response.Results, "MAX_DEPTH_EXCEEDED")
+		case core.ErrColorNotAllowed:
+			response.Results = append(response.Results, "COLOR_NOT_ALLOWED")
+		case core.ErrProtected:
+			response.Results = append(response.Results, "PROTECTED")
+		default:
+			log.WithError(c, err).Errorln("Failed to paint stroke pixel.")
+			response.Results = append(response.Results, "ERROR")
+		}
+	}
+
+	return c.JSON(200, response)
+}
+
+// ---------------------------------------------------------------------------------------
+// Reverts the caller's last paint of a wet pixel to what it was before. Only the painter
+// can undo it, as identified by core.BlockService.UndoPixel.
+func (pc *paintController) Undo(c Ct) error {
+	coords := block2.CoordsFromBase64(c.Param("coords"))
+	cat.BadIf(coords.BitLength() < 6, "Invalid pixel coordinates.")
+
+	err := pc.blocks.UndoPixel(c, coords)
+	cat.ProtectedIf(err == core.ErrProtected, "Pixel is in a protected area.")
+	if err == block2.ErrPixelIsDry {
+		return c.JSON(400, baseResponse{
+			Code:    "PIXEL_DRY",
+			Message: "Pixel is dry and cannot be updated.",
+		})
+	} else if err == block2.ErrNothingToUndo {
+		return c.JSON(400, baseResponse{
+			Code:    "NOTHING_TO_UNDO",
+			Message: "Pixel has no paint to undo.",
+		})
+	} else if err == core.ErrNotPainter {
+		return c.JSON(403, baseResponse{
+			Code:    "NOT_PAINTER",
+			Message: "Only the last painter of the pixel can undo it.",
+		})
+	}
+	cat.Catch(err, "Failed to undo pixel.")
+
+	return c.JSON(200, baseResponse{
+		Code: "PIXEL_UNDONE",
+	})
+}
@@ -5,11 +5,17 @@
 package api
 
 import (
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"net/http"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
 	"go.mukunda.com/nanopaint/config"
 	"go.mukunda.com/nanopaint/core"
 	"go.mukunda.com/nanopaint/core/block2"
@@ -26,12 +32,21 @@ func createPaintControllerTester(t *testing.T, options string) (*fxtest.App, tes
 	var hs HttpService
 	var tc *clock.TestClockService
 
-	configFields := map[string]any{}
+	// Use a random port. Reusing the same port between tests can leave the client with a
+	// stale keep-alive connection to the previous server.
+	httpFields := map[string]any{"port": 0}
+	configFields := map[string]any{"http": httpFields}
 
 	if strings.Contains(options, "noratelimit") {
-		configFields["http"] = struct {
-			DisableRateLimit bool
-		}{true}
+		httpFields["disableRateLimit"] = true
+	}
+	if strings.Contains(options, "proxy") {
+		// The test client stands in for a reverse proxy, so painters can be told apart
+		// by X-Forwarded-For.
+		httpFields["trustedProxies"] = []string{"127.0.0.1/32", "::1/128"}
+	}
+	if strings.Contains(options, "color24") {
+		configFields["core"] = map[string]any{"colorDepth": 24}
 	}
 
 	configString, _ := json.Marshal(configFields)
@@ -58,7 +73,7 @@ func createPaintControllerTester(t *testing.T, options string) (*fxtest.App, tes
 
 // ///////////////////////////////////////////////////////////////////////////////////////
 func TestBlockController_GetBlock(t *testing.T) {
-	app, rq, _ := createPaintControllerTester(t, "noratelimit")
+	app, rq, tc := createPaintControllerTester(t, "noratelimit")
 	defer app.RequireStop()
 
 	/////////////////////////////////////////////////////////
@@ -73,12 +88,166 @@ func TestBlockController_GetBlock(t *testing.T) {
 	}).Expect(200, "PIXEL_SET")
 	rq().Get("/api/block/Aw==").Expect(200, "BLOCK")
 
+	/////////////////////////////////////////////////////////
+	// The dry deadline of the block is included while it is wet. The top block
+	// takes 15 seconds by default.
+	//
+	// Each wet pixel is listed with its index and dry time. The server time is in a
+	// header for clients to compare with.
+	var block struct {
+		DryTime int64
+		Wet     [][2]int64
+	}
+	start := tc.Now().UnixMilli()
+	rq().Get("/api/block/Aw==").Expect(200, "BLOCK").Save(&block).Then(func(r *test.Request) {
+		assert.Equal(t, strconv.FormatInt(start, 10), r.Response.Get(serverTimeHeader))
+	})
+	assert.Equal(t, start+15000, block.DryTime)
+	assert.Equal(t, [][2]int64{{21 + 21*64, start + 15000}}, block.Wet)
+
+	tc.Advance(5 * time.Second)
+	rq().Post("/api/paint/"+urlCoords("000001,000000")).Send(paintInput{
+		Color: "f00",
+	}).Expect(200, "PIXEL_SET")
+	rq().Get("/api/block/Aw==").Expect(200, "BLOCK").Save(&block)
+	assert.Equal(t, [][2]int64{{1, start + 20000}, {21 + 21*64, start + 15000}}, block.Wet)
+
+	tc.Advance(time.Hour)
+	rq().Get("/api/block/Aw==").Expect(200, "BLOCK").Save(&block)
+	assert.Zero(t, block.DryTime)
+	assert.Empty(t, block.Wet)
+
 	/////////////////////////////////////////////////////////
 	// Non-existing blocks result in a 404 response.
 	rq().Get("/api/block/"+urlCoords("1,1")).Expect(404, "NOT_FOUND", "Block not found.")
 
 }
 
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestBlockController_GetBlockBinary(t *testing.T) {
+	app, rq, tc := createPaintControllerTester(t, "noratelimit")
+	defer app.RequireStop()
+
+	rq().Post("/api/paint/"+urlCoords("000001,000000")).Send(paintInput{
+		Color: "f00",
+	}).Expect(200, "PIXEL_SET")
+
+	var block struct {
+		Pixels string
+	}
+	asJson := rq().Get("/api/block/Aw==").Expect(200, "BLOCK").Save(&block)
+	pixels, err := base64.URLEncoding.DecodeString(block.Pixels)
+	assert.NoError(t, err)
+
+	/////////////////////////////////////////////////////////
+	// octet-stream is the raw pixel data.
+	asRaw := rq().Get("/api/block/Aw==").Header("Accept", "application/octet-stream").Run()
+	assert.Equal(t, 200, asRaw.StatusCode)
+	assert.Equal(t, "application/octet-stream", asRaw.Response.Get("Content-Type"))
+	assert.Equal(t, pixels, asRaw.ResponseBody)
+
+	/////////////////////////////////////////////////////////
+	// The block format has the rest of the block and is compressed.
+	asBlock := rq().Get("/api/block/Aw==").Header("Accept", contentTypeBlock).Run()
+	assert.Equal(t, 200, asBlock.StatusCode)
+	assert.Equal(t, contentTypeBlock, asBlock.Response.Get("Content-Type"))
+	decoded := decodeBinaryBlock(t, asBlock.ResponseBody)
+	assert.Equal(t, byte(blockFormatPalette), decoded.Flags)
+	assert.Equal(t, tc.Now().UnixMilli(), decoded.LastUpdated)
+	assert.Equal(t, [][2]int64{{1, tc.Now().UnixMilli() + 15000}}, decoded.Wet)
+	assert.Equal(t, pixels, encodeRawPixels(nil, decoded.Pixels))
+
+	/////////////////////////////////////////////////////////
+	// Each format has its own ETag.
+	assert.Equal(t, "Accept", asBlock.Response.Get("Vary"))
+	assert.NotEqual(t, asJson.Response.Get("ETag"), asRaw.Response.Get("ETag"))
+	assert.NotEqual(t, asRaw.Response.Get("ETag"), asBlock.Response.Get("ETag"))
+	rq().Get("/api/block/Aw==").Header("Accept", contentTypeBlock).
+		Header("If-None-Match", asJson.Response.Get("ETag")).Run().Then(func(r *test.Request) {
+		assert.Equal(t, 200, r.StatusCode)
+	})
+	rq().Get("/api/block/Aw==").Header("Accept", contentTypeBlock).
+		Header("If-None-Match", asBlock.Response.Get("ETag")).Run().Then(func(r *test.Request) {
+		assert.Equal(t, 304, r.StatusCode)
+	})
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestBlockController_GetBlockConditional(t *testing.T) {
+	app, rq, tc := createPaintControllerTester(t, "noratelimit")
+	defer app.RequireStop()
+
+	rq().Post("/api/paint/"+urlCoords("000001,000000")).Send(paintInput{
+		Color: "f00",
+	}).Expect(200, "PIXEL_SET")
+	painted := tc.Now()
+
+	/////////////////////////////////////////////////////////
+	// Blocks have an ETag and the time of their last change.
+	first := rq().Get("/api/block/Aw==").Expect(200, "BLOCK")
+	etag := first.Response.Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, painted.UTC().Format(http.TimeFormat), first.Response.Get("Last-Modified"))
+	assert.Equal(t, "no-cache", first.Response.Get("Cache-Control"))
+
+	/////////////////////////////////////////////////////////
+	// An unchanged block is not sent again.
+	rq().Get("/api/block/Aw==").Header("If-None-Match", etag).Run().Then(func(r *test.Request) {
+		assert.Equal(t, 304, r.StatusCode)
+		assert.Empty(t, r.ResponseBody)
+		assert.Equal(t, etag, r.Response.Get("ETag"))
+	})
+	rq().Get("/api/block/Aw==").Header("If-None-Match", `"x", W/`+etag).Run().Then(func(r *test.Request) {
+		assert.Equal(t, 304, r.StatusCode)
+	})
+	rq().Get("/api/block/Aw==").Header("If-None-Match", `"x"`).Expect(200, "BLOCK")
+
+	/////////////////////////////////////////////////////////
+	// Time passing doesn't change the block, so the cached body stays correct. The
+	// deadlines are absolute and the server time comes with the 304.
+	var cached struct{ Wet [][2]int64 }
+	first.Save(&cached)
+	tc.Advance(5 * time.Second)
+	for _, accept := range []string{echo.MIMEApplicationJSON, contentTypeBlock} {
+		full := rq().Get("/api/block/Aw==").Header("Accept", accept).Run()
+		assert.Equal(t, 200, full.StatusCode)
+		rq().Get("/api/block/Aw==").Header("Accept", accept).
+			Header("If-None-Match", full.Response.Get("ETag")).Run().Then(func(r *test.Request) {
+			assert.Equal(t, 304, r.StatusCode)
+			assert.Equal(t, strconv.FormatInt(tc.Now().UnixMilli(), 10),
+				r.Response.Get(serverTimeHeader))
+		})
+		if accept == contentTypeBlock {
+			assert.Equal(t, cached.Wet, decodeBinaryBlock(t, full.ResponseBody).Wet)
+		}
+	}
+	var later struct{ Wet [][2]int64 }
+	rq().Get("/api/block/Aw==").Header("If-None-Match", `"x"`).Expect(200, "BLOCK").Save(&later)
+	assert.Equal(t, [][2]int64{{1, painted.UnixMilli() + 15000}}, cached.Wet)
+	assert.Equal(t, cached.Wet, later.Wet)
+	rq().Get("/api/block/Aw==").Header("If-None-Match", etag).Run().Then(func(r *test.Request) {
+		assert.Equal(t, 304, r.StatusCode)
+	})
+
+	/////////////////////////////////////////////////////////
+	// Painting in the same millisecond still changes the ETag.
+	painted = tc.Now()
+	rq().Post("/api/paint/"+urlCoords("000010,000000")).Send(paintInput{
+		Color: "f00",
+	}).Expect(200, "PIXEL_SET")
+	second := rq().Get("/api/block/Aw==").Header("If-None-Match", etag).Expect(200, "BLOCK")
+	assert.NotEqual(t, etag, second.Response.Get("ETag"))
+	etag = second.Response.Get("ETag")
+
+	/////////////////////////////////////////////////////////
+	// So does drying. The block was last changed when the pixels dried.
+	tc.Advance(time.Hour)
+	dried := rq().Get("/api/block/Aw==").Header("If-None-Match", etag).Expect(200, "BLOCK")
+	assert.NotEqual(t, etag, dried.Response.Get("ETag"))
+	assert.Equal(t, painted.Add(15*time.Second).UTC().Format(http.TimeFormat),
+		dried.Response.Get("Last-Modified"))
+}
+
 func coordsFromBits(x, y string) block2.Coords {
 	x = strings.ReplaceAll(x, " ", "")
 	y = strings.ReplaceAll(y, " ", "")
@@ -127,7 +296,7 @@ func TestPaintController_Paint(t *testing.T) {
 	///////////////////////////////////////////////////////////
 	// The "color" field is validated, rejecting invalid input.
 	invalidColors := []string{
-		"FF000", "FF0000FF", "abcdefg", "g", "a", "ab", "1", "12", "123a", "1234", "12345", "12345 6", "😃", " ",
+		"FF000", "FF0000F", "FF0000FFF", "Transparent", "none", "abcdefg", "g", "a", "ab", "1", "12", "12345", "12345 6", "😃", " ",
 	}
 	for _, color := range invalidColors {
 		rq().Post("/api/paint/"+urlCoords("010101,010101")).Send(paintInput{
@@ -145,6 +314,32 @@ func TestPaintController_Paint(t *testing.T) {
 		Color: "ff0",
 	}).Expect(200, "PIXEL_SET")
 
+	//////////////////////////////////////////////////////////////////////////////////
+	// Painting "transparent" erases a wet pixel, so it has no deadline anymore.
+	var block struct {
+		Wet [][2]int64
+	}
+	rq().Post("/api/paint/"+urlCoords("010101,010101")).Send(paintInput{
+		Color: "transparent",
+	}).Expect(200, "PIXEL_SET")
+	rq().Get("/api/block/Aw==").Expect(200, "BLOCK").Save(&block)
+	assert.Empty(t, block.Wet)
+
+	//////////////////////////////////////////////////////////////////////////////////
+	// A 4th digit is the alpha. Zero alpha erases like "transparent".
+	rq().Post("/api/paint/"+urlCoords("010101,010101")).Send(paintInput{
+		Color: "ff08",
+	}).Expect(200, "PIXEL_SET")
+	rq().Post("/api/paint/"+urlCoords("010101,010101")).Send(paintInput{
+		Color: "ff00",
+	}).Expect(200, "PIXEL_SET")
+	rq().Get("/api/block/Aw==").Expect(200, "BLOCK").Save(&block)
+	assert.Empty(t, block.Wet)
+
+	rq().Post("/api/paint/"+urlCoords("010101,010101")).Send(paintInput{
+		Color: "ff0",
+	}).Expect(200, "PIXEL_SET")
+
 	// ////////////////////////////////////////////////////////////////////////////////
 	// // A 404 is returned when a block parent is not dry yet. Same as when the parent
 	// // doesn't exist.
@@ -197,3 +392,217 @@ func TestBlockController_RateLimiting(t *testing.T) {
 		rq().Get("/api/block/Aw==").Expect(200, "BLOCK")
 	}
 }
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestPaintController_Stroke(t *testing.T) {
+	app, rq, tc := createPaintControllerTester(t, "noratelimit")
+	defer app.RequireStop()
+
+	////////////////////////////////////////////////////////////////////
+	// The pixels are validated. Any malformed pixel rejects the request.
+	rq().Post("/api/stroke").Send(strokeInput{}).Expect(400, "BAD_REQUEST", "body.pixels")
+	rq().Post("/api/stroke").Send(strokeInput{Pixels: []strokePixelInput{
+		{Coords: urlCoords("010101,010101"), Color: "f00"},
+		{Coords: urlCoords("010101,010101"), Color: "f0"},
+	}}).Expect(400, "BAD_REQUEST", "color")
+	rq().Post("/api/stroke").Send(strokeInput{Pixels: []strokePixelInput{
+		{Coords: urlCoords("0101,0101"), Color: "f00"},
+	}}).Expect(400, "BAD_REQUEST", "coordinates")
+
+	tooMany := strokeInput{}
+	for i := 0; i <= maxStrokePixels; i++ {
+		tooMany.Pixels = append(tooMany.Pixels, strokePixelInput{
+			Coords: urlCoords("010101,010101"), Color: "f00",
+		})
+	}
+	rq().Post("/api/stroke").Send(tooMany).Expect(400, "BAD_REQUEST", "Too many pixels")
+
+	////////////////////////////////////////////////////////////////////////
+	// Each pixel gets a result, in order. Pixels at mixed depths are allowed.
+	rq().Post("/api/paint/"+urlCoords("000000,000000")).Send(paintInput{
+		Color: "f00",
+	}).Expect(200, "PIXEL_SET")
+	tc.Advance(time.Hour)
+
+	var response struct {
+		Results []string
+	}
+	rq().Post("/api/stroke").Send(strokeInput{Pixels: []strokePixelInput{
+		{Coords: urlCoords("000001,000000"), Color: "0f0"},
+		{Coords: urlCoords("000000,000000"), Color: "0f0"},
+		{Coords: urlCoords("1 000000,1 000000"), Color: "00f"},
+		{Coords: urlCoords(strings.Repeat("0", 107) + "," + strings.Repeat("0", 107)), Color: "00f"},
+	}}).Expect(200, "STROKE").Save(&response)
+	assert.Equal(t, []string{"OK", "PIXEL_DRY", "OK", "MAX_DEPTH_EXCEEDED"}, response.Results)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestPaintController_Undo(t *testing.T) {
+	app, rq, tc := createPaintControllerTester(t, "noratelimit proxy")
+	defer app.RequireStop()
+
+	pixel := urlCoords("010101,010101")
+	rq().Post("/api/undo/").Expect(400, "BAD_REQUEST")
+	rq().Post("/api/undo/"+urlCoords("0101,0101")).Expect(400, "BAD_REQUEST", "coordinates")
+	rq().Post("/api/undo/"+pixel).Header("X-Forwarded-For", "1.2.3.4").Expect(400, "NOTHING_TO_UNDO")
+
+	///////////////////////////////////////////////////////////////////////////
+	// Only the painter can undo their paint, and only once, while it's wet.
+	rq().Post("/api/paint/"+pixel).Header("X-Forwarded-For", "1.2.3.4").
+		Send(paintInput{Color: "f00"}).Expect(200, "PIXEL_SET")
+	rq().Post("/api/undo/"+pixel).Header("X-Forwarded-For", "5.6.7.8").Expect(403, "NOT_PAINTER")
+	// Someone else can't pass as the painter by forging the headers. The proxy appends
+	// the address it sees, which is the one used.
+	rq().Post("/api/undo/"+pixel).Header("X-Forwarded-For", "1.2.3.4, 5.6.7.8").
+		Expect(403, "NOT_PAINTER")
+	rq().Post("/api/undo/"+pixel).Header("X-Real-IP", "1.2.3.4").Header("X-Forwarded-For", "5.6.7.8").
+		Expect(403, "NOT_PAINTER")
+	rq().Post("/api/undo/"+pixel).Header("X-Forwarded-For", "1.2.3.4").Expect(200, "PIXEL_UNDONE")
+	rq().Post("/api/undo/"+pixel).Header("X-Forwarded-For", "1.2.3.4").Expect(400, "NOTHING_TO_UNDO")
+
+	rq().Post("/api/paint/"+pixel).Header("X-Forwarded-For", "1.2.3.4").
+		Send(paintInput{Color: "0f0"}).Expect(200, "PIXEL_SET")
+	tc.Advance(time.Hour)
+	rq().Post("/api/undo/"+pixel).Header("X-Forwarded-For", "1.2.3.4").Expect(400, "PIXEL_DRY")
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestPaintController_ForwardedHeaders(t *testing.T) {
+	app, rq, _ := createPaintControllerTester(t, "noratelimit")
+	defer app.RequireStop()
+
+	///////////////////////////////////////////////////////////////////////////
+	// Without trusted proxies, the painter is the address of the connection. The
+	// headers that a client could forge are ignored.
+	pixel := urlCoords("010101,010101")
+	rq().Post("/api/paint/"+pixel).Header("X-Forwarded-For", "1.2.3.4").Header("X-Real-IP", "1.2.3.4").
+		Send(paintInput{Color: "f00"}).Expect(200, "PIXEL_SET")
+	rq().Post("/api/undo/"+pixel).Expect(200, "PIXEL_UNDONE")
+
+	///////////////////////////////////////////////////////////////////////////
+	// Trusted proxies must be valid ranges.
+	_, err := createIPExtractor([]string{"10.0.0.0/8", "nope"})
+	assert.ErrorContains(t, err, "nope")
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestPaintController_GetBlocks(t *testing.T) {
+	app, rq, tc := createPaintControllerTester(t, "noratelimit")
+	defer app.RequireStop()
+
+	type blocksResponse struct {
+		Now    int64
+		Blocks []struct {
+			Coords string
+			Code   string
+			Pixels string
+		}
+	}
+
+	/////////////////////////////////////////////////////////////////////
+	// The request is validated.
+	rq().Get("/api/blocks").Expect(400, "BAD_REQUEST", "`coords` or `origin`")
+	rq().Get("/api/blocks?coords=a@@b").Expect(400, "BAD_REQUEST", "invalid coords")
+	rq().Get("/api/blocks?origin=Aw==&width=0&height=1").Expect(400, "BAD_REQUEST", "width")
+	rq().Get("/api/blocks?origin=Aw==&width=1").Expect(400, "BAD_REQUEST", "height")
+	rq().Get("/api/blocks?origin=Aw==&width=8&height=9").Expect(400, "BAD_REQUEST", "Too many")
+	rq().Get("/api/blocks?coords="+strings.Repeat("Aw==,", maxFetchBlocks)+"Aw==").
+		Expect(400, "BAD_REQUEST", "Too many")
+
+	/////////////////////////////////////////////////////////////////////
+	// Listed blocks are returned in order, and missing ones are marked.
+	rq().Post("/api/paint/"+urlCoords("1 010101,0 010101")).Send(paintInput{
+		Color: "f00",
+	}).Expect(200, "PIXEL_SET")
+
+	var response blocksResponse
+	rq().Get("/api/blocks?coords="+urlCoords("0,0")+","+urlCoords("1,0")+",Aw==").
+		Expect(200, "BLOCKS").Save(&response)
+	assert.Len(t, response.Blocks, 3)
+	assert.Equal(t, urlCoords("0,0"), response.Blocks[0].Coords)
+	assert.Equal(t, "NOT_FOUND", response.Blocks[0].Code)
+	assert.Empty(t, response.Blocks[0].Pixels)
+	assert.Equal(t, urlCoords("1,0"), response.Blocks[1].Coords)
+	assert.Equal(t, "BLOCK", response.Blocks[1].Code)
+	assert.NotEmpty(t, response.Blocks[1].Pixels)
+	assert.Equal(t, "BLOCK", response.Blocks[2].Code)
+	assert.Equal(t, tc.Now().UnixMilli(), response.Now)
+
+	/////////////////////////////////////////////////////////////////////
+	// A rectangle is read row by row. Blocks past the edge are left out.
+	response = blocksResponse{}
+	rq().Get("/api/blocks?origin="+urlCoords("0,0")+"&width=3&height=2").
+		Expect(200, "BLOCKS").Save(&response)
+	var coords, codes []string
+	for _, block := range response.Blocks {
+		coords = append(coords, block.Coords)
+		codes = append(codes, block.Code)
+	}
+	assert.Equal(t, []string{
+		urlCoords("0,0"), urlCoords("1,0"), urlCoords("0,1"), urlCoords("1,1"),
+	}, coords)
+	assert.Equal(t, []string{"NOT_FOUND", "BLOCK", "NOT_FOUND", "NOT_FOUND"}, codes)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestPaintController_Colors(t *testing.T) {
+	// Alphas are rounded to the opacities that pixels can have.
+	assert.Equal(t, block2.Color(0x00F), parseColor("f00"))
+	assert.Equal(t, block2.Color(0x00F), parseColor("f00f"))
+	assert.Equal(t, block2.Transparent, parseColor("f000"))
+	assert.Equal(t, block2.Transparent, parseColor("transparent"))
+	for color, formatted := range map[string]string{
+		"f00": "f00", "F00E": "f00", "f008": "f007", "1234": "1233", "f000": "transparent",
+	} {
+		assert.Equal(t, formatted, formatColor(parseColor(color)))
+	}
+
+	// 6 and 8 digits are 24-bit colors.
+	assert.Equal(t, block2.Color24WithAlpha(0x3380FF, 255), parseColor("ff8033"))
+	assert.Equal(t, block2.Color24WithAlpha(0x3380FF, 128), parseColor("ff803380"))
+	assert.Equal(t, block2.Transparent, parseColor("ff803300"))
+	for color, formatted := range map[string]string{
+		"ff8033": "ff8033", "FF8033FF": "ff8033", "ff803380": "ff803377", "00000001": "00000033",
+	} {
+		assert.Equal(t, formatted, formatColor(parseColor(color)))
+	}
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestPaintController_Color24(t *testing.T) {
+	var block struct {
+		Pixels string
+		Fine   string
+	}
+
+	/////////////////////////////////////////////////////////////////////////////
+	// 12-bit canvases round 24-bit colors, and their blocks have no fine pixels.
+	app, rq, _ := createPaintControllerTester(t, "noratelimit")
+	rq().Post("/api/paint/"+urlCoords("010101,010101")).Send(paintInput{
+		Color: "ff8033",
+	}).Expect(200, "PIXEL_SET")
+	rq().Get("/api/block/Aw==").Expect(200, "BLOCK").Save(&block)
+	assert.Empty(t, block.Fine)
+	raw := rq().Get("/api/block/Aw==").Header("Accept", "application/octet-stream").Run()
+	assert.Len(t, raw.ResponseBody, 64*64*4)
+	app.RequireStop()
+
+	/////////////////////////////////////////////////////////////////////////////
+	// 24-bit canvases keep them. The low nibbles are in the fine pixels.
+	app, rq, _ = createPaintControllerTester(t, "noratelimit color24")
+	defer app.RequireStop()
+	rq().Post("/api/paint/"+urlCoords("010101,010101")).Send(paintInput{
+		Color: "ff8033",
+	}).Expect(200, "PIXEL_SET")
+	rq().Get("/api/block/Aw==").Expect(200, "BLOCK").Save(&block)
+	pixels, err := base64.URLEncoding.DecodeString(block.Pixels)
+	assert.NoError(t, err)
+	fine, err := base64.URLEncoding.DecodeString(block.Fine)
+	assert.NoError(t, err)
+	index := (21 + 21*64) * 4
+	assert.Equal(t, uint32(block2.PIXEL_SET|0x038F0000), binary.LittleEndian.Uint32(pixels[index:]))
+	assert.Equal(t, uint32(0x030F0000), binary.LittleEndian.Uint32(fine[index:]))
+
+	raw = rq().Get("/api/block/Aw==").Header("Accept", "application/octet-stream").Run()
+	assert.Equal(t, append(pixels, fine...), raw.ResponseBody)
+}
@@ -0,0 +1,88 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package api
+
+import (
+	"strconv"
+
+	"go.mukunda.com/nanopaint/cat"
+	"go.mukunda.com/nanopaint/core"
+	"go.mukunda.com/nanopaint/core/block2"
+)
+
+// Replays the paint history of a region, e.g., for clients to animate a time-lapse.
+//
+//	GET /api/replay/<coords>?since=<ms>&until=<ms>&limit=<n>
+//
+// Returns the paint events under the root block in the time range, oldest first, with
+// undos as events that revert the pixel's last paint. until is exclusive and defaults to
+// no end. Long windows are paged: `next` is the since of the next page, and it's left out
+// after the last one. Pages only end between milliseconds, so a page can have fewer
+// events than the limit, or more when one stroke or stamp has more pixels than that.
+// Painters aren't included; see the admin history for those. See core.TimelapseService.
+
+type ReplayController interface {
+	GetEvents(c Ct) error
+}
+
+type replayController struct {
+	timelapse core.TimelapseService
+}
+
+type replayEventData struct {
+	Time   block2.UnixMillis `json:"time"`
+	Coords string            `json:"coords"`
+	Color  string            `json:"color,omitempty"` // Empty for undos.
+	Undo   bool              `json:"undo,omitempty"`
+}
+
+// Most replay events returned by one request, and the default.
+const maxReplayEvents = 1000
+
+// ---------------------------------------------------------------------------------------
+func CreateReplayController(routes Router, hs HttpService, timelapse core.TimelapseService) ReplayController {
+	rc := &replayController{
+		timelapse: timelapse,
+	}
+
+	// The empty string is not valid coords, but it should still be a 400, not a 404.
+	routes.GET("/api/replay/:coords", rc.GetEvents, hs.UseRateLimiter())
+	routes.GET("/api/replay/", rc.GetEvents, hs.UseRateLimiter())
+
+	return rc
+}
+
+// ---------------------------------------------------------------------------------------
+func (rc *replayController) GetEvents(c Ct) error {
+	root := block2.CoordsFromBase64(c.Param("coords"))
+	since := block2.UnixMillis(queryInt(c, "since", 0))
+	until := block2.UnixMillis(queryInt(c, "until", 0))
+	limit := queryInt(c, "limit", maxReplayEvents)
+	cat.BadIf(limit < 1 || limit > maxReplayEvents,
+		"`limit` must be 1 to "+strconv.Itoa(maxReplayEvents)+".")
+
+	var response struct {
+		baseResponse
+		Events []replayEventData `json:"events"`
+		Next   block2.UnixMillis `json:"next,omitempty"`
+	}
+	response.Code = "REPLAY"
+	response.Events = []replayEventData{}
+	events, next := rc.timelapse.EventPage(root, since, until, limit)
+	response.Next = next
+	for _, event := range events {
+		data := replayEventData{
+			Time:   event.Time,
+			Coords: event.Coords.ToBase64(),
+			Undo:   event.Undo,
+		}
+		if !event.Undo {
+			data.Color = formatColor(event.Color)
+		}
+		response.Events = append(response.Events, data)
+	}
+
+	return c.JSON(200, response)
+}
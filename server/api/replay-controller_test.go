@@ -0,0 +1,144 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mukunda.com/nanopaint/config"
+	"go.mukunda.com/nanopaint/core"
+	"go.mukunda.com/nanopaint/core/clock"
+	"go.mukunda.com/nanopaint/test"
+	"go.uber.org/fx"
+	"go.uber.org/fx/fxtest"
+)
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func createReplayControllerTester(t *testing.T) (*fxtest.App, testreqFactory, *clock.TestClockService) {
+	var hs HttpService
+	var tc *clock.TestClockService
+
+	app := fxtest.New(t,
+		config.ProvideFromYamlString(`
+http:
+  port: 0
+  disableRateLimit: true
+core:
+  disableBlockDryInterval: true
+`),
+		fx.Provide(
+			clock.CreateTestClockService,
+			CreateHttpService,
+			unwrapHttpRouter,
+			annotateController(CreatePaintController),
+			annotateController(CreateReplayController),
+		),
+		core.Fx(),
+		fx.Invoke(func(s StartControllersParam, phs HttpService, cs clock.ClockService) {
+			hs = phs
+			tc = cs.(*clock.TestClockService)
+		}),
+	).RequireStart()
+
+	return app, func() *test.Request {
+		return testreq(t, hs)
+	}, tc
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestReplayController(t *testing.T) {
+	app, rq, tc := createReplayControllerTester(t)
+	defer app.RequireStop()
+
+	type replayResponse struct {
+		Events []replayEventData `json:"events"`
+		Next   int64             `json:"next"`
+	}
+
+	rq().Post("/api/paint/"+urlCoords("000000,000000")).Send(paintInput{Color: "f80"}).Expect(200, "PIXEL_SET")
+	tc.Advance(time.Millisecond)
+	rq().Post("/api/paint/"+urlCoords("100000,000000")).Send(paintInput{Color: "0f0"}).Expect(200, "PIXEL_SET")
+
+	/////////////////////////////////////////////////////////
+	// Events under the root are oldest first.
+	var response replayResponse
+	rq().Get("/api/replay/Aw==").Expect(200, "REPLAY").Save(&response)
+	assert.Len(t, response.Events, 2)
+	assert.Equal(t, urlCoords("000000,000000"), response.Events[0].Coords)
+	assert.Equal(t, "f80", response.Events[0].Color)
+	assert.Equal(t, urlCoords("100000,000000"), response.Events[1].Coords)
+	assert.Equal(t, "0f0", response.Events[1].Color)
+
+	rq().Get("/api/replay/"+urlCoords("1,0")).Expect(200, "REPLAY").Save(&response)
+	assert.Len(t, response.Events, 1)
+	assert.Equal(t, "0f0", response.Events[0].Color)
+
+	/////////////////////////////////////////////////////////
+	// Pages continue from `next`, which is left out after the last page.
+	assert.Zero(t, response.Next)
+	response = replayResponse{}
+	rq().Get("/api/replay/Aw==?limit=1").Expect(200, "REPLAY").Save(&response)
+	assert.Len(t, response.Events, 1)
+	assert.Equal(t, "f80", response.Events[0].Color)
+	assert.NotZero(t, response.Next)
+	next := strconv.FormatInt(response.Next, 10)
+	response = replayResponse{}
+	rq().Get("/api/replay/Aw==?limit=1&since="+next).Expect(200, "REPLAY").Save(&response)
+	assert.Len(t, response.Events, 1)
+	assert.Equal(t, "0f0", response.Events[0].Color)
+	next = strconv.FormatInt(response.Next, 10)
+	response = replayResponse{}
+	rq().Get("/api/replay/Aw==?since="+next).Expect(200, "REPLAY").Save(&response)
+	assert.Empty(t, response.Events)
+	assert.Zero(t, response.Next)
+
+	/////////////////////////////////////////////////////////
+	// A millisecond with more events than the limit is returned whole, so none are
+	// skipped. A page that ends partway through a millisecond leaves it for the next.
+	tc.Advance(time.Millisecond)
+	first := tc.Now().UnixMilli()
+	rq().Post("/api/paint/"+urlCoords("000000,000001")).Send(paintInput{Color: "f00"}).Expect(200, "PIXEL_SET")
+	tc.Advance(time.Millisecond)
+	batch := tc.Now().UnixMilli()
+	for stroke := 0; stroke < 2; stroke++ {
+		var input strokeInput
+		for i := stroke * maxStrokePixels; i < (stroke+1)*maxStrokePixels; i++ {
+			input.Pixels = append(input.Pixels, strokePixelInput{
+				Coords: urlCoords(fmt.Sprintf("%06b,%06b", i%64, i/64)),
+				Color:  "00f",
+			})
+		}
+		rq().Post("/api/stroke").Send(input).Expect(200, "STROKE")
+	}
+	tc.Advance(time.Millisecond)
+	rq().Post("/api/paint/"+urlCoords("000000,000001")).Send(paintInput{Color: "0f0"}).Expect(200, "PIXEL_SET")
+
+	since := strconv.FormatInt(first, 10)
+	response = replayResponse{}
+	rq().Get("/api/replay/Aw==?since="+since).Expect(200, "REPLAY").Save(&response)
+	assert.Len(t, response.Events, 1)
+	assert.Equal(t, batch, response.Next)
+
+	response = replayResponse{}
+	rq().Get("/api/replay/Aw==?since="+strconv.FormatInt(batch, 10)).Expect(200, "REPLAY").Save(&response)
+	assert.Len(t, response.Events, 2*maxStrokePixels)
+	assert.Equal(t, batch+1, response.Next)
+
+	response = replayResponse{}
+	rq().Get("/api/replay/Aw==?since="+strconv.FormatInt(batch+1, 10)).Expect(200, "REPLAY").Save(&response)
+	assert.Len(t, response.Events, 1)
+	assert.Equal(t, "0f0", response.Events[0].Color)
+	assert.Zero(t, response.Next)
+
+	/////////////////////////////////////////////////////////
+	// Bad requests.
+	rq().Get("/api/replay/").Expect(400, "BAD_REQUEST")
+	rq().Get("/api/replay/Aw==?limit=0").Expect(400, "BAD_REQUEST", "`limit` must be 1 to 1000.")
+	rq().Get("/api/replay/Aw==?since=abc").Expect(400, "BAD_REQUEST", "`since` must be an integer.")
+}
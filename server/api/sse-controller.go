@@ -0,0 +1,325 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mukunda.com/nanopaint/cat"
+	"go.mukunda.com/nanopaint/config"
+	"go.mukunda.com/nanopaint/core"
+	"go.mukunda.com/nanopaint/core/block2"
+	"go.uber.org/fx"
+)
+
+// A Server-Sent Events fallback for clients that can't use the WebSocket stream, e.g.,
+// behind proxies that break WebSockets. The same block events are sent as text/event-
+// stream from /api/events. The blocks are chosen with query parameters:
+//
+//	blocks:  comma separated list of block coords.
+//	regions: comma separated list of coords. Every block at or under them is included.
+//
+// Each event has an id. When the browser reconnects it sends the last id that it saw in
+// Last-Event-ID, and the missed events are replayed from a bounded buffer. If they are
+// no longer available, a RESET event is sent and the client should reload its blocks.
+// Every stream starts with a READY event so that the client has an id to resume from.
+
+type SseController interface {
+	Events(c Ct) error
+}
+
+type (
+	sseController struct {
+		mutex sync.Mutex
+		// Ids are <epoch>-<seq>. The epoch changes when the server restarts, so ids from
+		// an older process are never mistaken for current ones.
+		epoch   int64
+		nextSeq uint64
+		// Ring buffer of recent events. Event seq is at seq % len(replay).
+		replay  []sseEvent
+		clients map[*sseClient]bool
+		// Closed when the server stops.
+		stopped chan struct{}
+	}
+
+	sseEvent struct {
+		seq     uint64
+		block   block2.Coords
+		message blockEventMessage
+	}
+
+	sseClient struct {
+		filter sseFilter
+		send   chan sseEvent
+		// Closed when the client falls too far behind.
+		overflow  chan struct{}
+		closeOnce sync.Once
+	}
+
+	sseFilter struct {
+		blocks  map[string]bool
+		regions []block2.Coords
+	}
+)
+
+type sseConfig struct {
+	// Events kept for Last-Event-ID resume.
+	ReplayEvents int `yaml:"replayEvents"`
+}
+
+var defaultSseConfig = sseConfig{
+	ReplayEvents: 4096,
+}
+
+const (
+	// Events queued for a client before it's disconnected. It can resume from the replay
+	// buffer when it reconnects.
+	sseSendBuffer = 256
+	// Keeps proxies from closing idle streams.
+	sseHeartbeatInterval = 15 * time.Second
+	// Most blocks plus regions in one stream.
+	maxSseFilters = 256
+)
+
+// ---------------------------------------------------------------------------------------
+func CreateSseController(lc fx.Lifecycle, config config.Config, routes Router, hs HttpService, events core.BlockEventService) SseController {
+	cfg := defaultSseConfig
+	config.Load("sse", &cfg)
+
+	sc := &sseController{
+		epoch:   time.Now().UnixMilli(),
+		nextSeq: 1,
+		replay:  make([]sseEvent, max(cfg.ReplayEvents, 1)),
+		clients: make(map[*sseClient]bool),
+		stopped: make(chan struct{}),
+	}
+
+	routes.GET("/api/events", sc.Events, hs.UseRateLimiter())
+
+	unsubscribe := events.Subscribe(sc.onBlockEvent)
+	lc.Append(fx.Hook{
+		OnStop: func(context.Context) error {
+			// Open streams would otherwise hold up the HTTP server shutdown.
+			unsubscribe()
+			close(sc.stopped)
+			return nil
+		},
+	})
+
+	return sc
+}
+
+// ---------------------------------------------------------------------------------------
+func (f sseFilter) matches(block block2.Coords) bool {
+	if f.blocks[block.ToBase64()] {
+		return true
+	}
+	for _, region := range f.regions {
+		if block.HasPrefix(region) {
+			return true
+		}
+	}
+	return false
+}
+
+// ---------------------------------------------------------------------------------------
+func parseSseFilter(c Ct) sseFilter {
+	filter := sseFilter{blocks: make(map[string]bool)}
+	count := 0
+	split := func(param string) []string {
+		value := c.QueryParam(param)
+		if value == "" {
+			return nil
+		}
+		list := strings.Split(value, ",")
+		count += len(list)
+		return list
+	}
+
+	for _, coords := range split("blocks") {
+		filter.blocks[block2.CoordsFromBase64(coords).ToBase64()] = true
+	}
+	for _, coords := range split("regions") {
+		filter.regions = append(filter.regions, block2.CoordsFromBase64(coords))
+	}
+
+	cat.BadIf(count == 0, "`blocks` or `regions` is required.")
+	cat.BadIf(count > maxSseFilters, "Too many blocks. The limit is "+
+		strconv.Itoa(maxSseFilters)+".")
+	return filter
+}
+
+// ---------------------------------------------------------------------------------------
+func (sc *sseController) formatId(seq uint64) string {
+	return strconv.FormatInt(sc.epoch, 10) + "-" + strconv.FormatUint(seq, 10)
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the seq of the last event that the client saw, or false if it can't be resumed
+// from this process.
+func (sc *sseController) parseId(id string) (uint64, bool) {
+	epoch, seq, found := strings.Cut(id, "-")
+	if !found || epoch != strconv.FormatInt(sc.epoch, 10) {
+		return 0, false
+	}
+	value, err := strconv.ParseUint(seq, 10, 64)
+	return value, err == nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Called while the block repo is locked, so this only queues the event.
+func (sc *sseController) onBlockEvent(event block2.BlockEvent) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	stored := sseEvent{
+		seq:     sc.nextSeq,
+		block:   event.Block,
+		message: makeBlockEventMessage(event),
+	}
+	sc.replay[stored.seq%uint64(len(sc.replay))] = stored
+	sc.nextSeq++
+
+	for client := range sc.clients {
+		if client.filter.matches(stored.block) {
+			client.queue(stored)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+func (client *sseClient) queue(event sseEvent) {
+	select {
+	case client.send <- event:
+	default:
+		client.closeOnce.Do(func() {
+			close(client.overflow)
+		})
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Registers the client and returns the events that it missed since lastId, and the id of
+// the latest event before anything new is queued for it. reset is true if the missed
+// events are no longer available.
+func (sc *sseController) connect(client *sseClient, lastId string) (missed []sseEvent, latest string, reset bool) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	sc.clients[client] = true
+	latest = sc.formatId(sc.nextSeq - 1)
+
+	if lastId == "" {
+		return nil, latest, false
+	}
+
+	lastSeq, ok := sc.parseId(lastId)
+	oldest := uint64(1)
+	if sc.nextSeq > uint64(len(sc.replay)) {
+		oldest = sc.nextSeq - uint64(len(sc.replay))
+	}
+	if !ok || lastSeq >= sc.nextSeq || lastSeq+1 < oldest {
+		return nil, latest, true
+	}
+
+	for seq := lastSeq + 1; seq < sc.nextSeq; seq++ {
+		event := sc.replay[seq%uint64(len(sc.replay))]
+		if client.filter.matches(event.block) {
+			missed = append(missed, event)
+		}
+	}
+	return missed, latest, false
+}
+
+// ---------------------------------------------------------------------------------------
+func (sc *sseController) disconnect(client *sseClient) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	delete(sc.clients, client)
+}
+
+// ---------------------------------------------------------------------------------------
+func writeSseEvent(c Ct, id string, eventName string, data any) error {
+	encoded, err := json.Marshal(data)
+	cat.Catch(err, "Failed to encode event.")
+
+	if id != "" {
+		if _, err := fmt.Fprintf(c.Response(), "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(c.Response(), "event: %s\ndata: %s\n\n", eventName, encoded)
+	return err
+}
+
+// ---------------------------------------------------------------------------------------
+func (sc *sseController) Events(c Ct) error {
+	client := &sseClient{
+		filter:   parseSseFilter(c),
+		send:     make(chan sseEvent, sseSendBuffer),
+		overflow: make(chan struct{}),
+	}
+
+	lastId := c.Request().Header.Get("Last-Event-ID")
+	if lastId == "" {
+		// For clients that can't set headers when reconnecting.
+		lastId = c.QueryParam("lastEventId")
+	}
+
+	missed, latest, reset := sc.connect(client, lastId)
+	defer sc.disconnect(client)
+
+	header := c.Response().Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	// Disables response buffering in nginx.
+	header.Set("X-Accel-Buffering", "no")
+	c.Response().WriteHeader(200)
+
+	if reset {
+		if err := writeSseEvent(c, "", "RESET", baseResponse{Code: "RESET"}); err != nil {
+			return nil
+		}
+	}
+	for _, event := range missed {
+		if err := writeSseEvent(c, sc.formatId(event.seq), event.message.Code, event.message); err != nil {
+			return nil
+		}
+	}
+	// Also gives the client an id to resume from if nothing was replayed. Nothing in the
+	// filter happened between the last replayed event and this id.
+	if err := writeSseEvent(c, latest, "READY", baseResponse{Code: "READY"}); err != nil {
+		return nil
+	}
+	c.Response().Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-sc.stopped:
+			return nil
+		case <-client.overflow:
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(c.Response(), ": heartbeat\n\n"); err != nil {
+				return nil
+			}
+		case event := <-client.send:
+			if err := writeSseEvent(c, sc.formatId(event.seq), event.message.Code, event.message); err != nil {
+				return nil
+			}
+		}
+		c.Response().Flush()
+	}
+}
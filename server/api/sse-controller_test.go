@@ -0,0 +1,193 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mukunda.com/nanopaint/config"
+	"go.mukunda.com/nanopaint/core"
+	"go.mukunda.com/nanopaint/core/block2"
+	"go.mukunda.com/nanopaint/core/clock"
+	"go.uber.org/fx"
+	"go.uber.org/fx/fxtest"
+)
+
+type sseTestEvent struct {
+	Id    string
+	Event string
+	Data  streamMessage
+}
+
+type sseTestStream struct {
+	response *http.Response
+	reader   *bufio.Reader
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func createSseControllerTester(t *testing.T) (*fxtest.App, HttpService) {
+	var hs HttpService
+
+	app := fxtest.New(t,
+		config.ProvideFromYamlString(`
+http:
+  port: 0
+  disableRateLimit: true
+core:
+  disableBlockDryInterval: true
+sse:
+  replayEvents: 8
+`),
+		fx.Provide(
+			clock.CreateTestClockService,
+			CreateHttpService,
+			unwrapHttpRouter,
+			annotateController(CreatePaintController),
+			annotateController(CreateSseController),
+		),
+		core.Fx(),
+		fx.Invoke(func(s StartControllersParam, phs HttpService) {
+			hs = phs
+		}),
+	).RequireStart()
+
+	return app, hs
+}
+
+// ---------------------------------------------------------------------------------------
+func openSseStream(t *testing.T, hs HttpService, query string, lastId string) *sseTestStream {
+	request, err := http.NewRequest("GET",
+		"http://localhost:"+strconv.Itoa(hs.GetPort())+"/api/events?"+query, nil)
+	require.NoError(t, err)
+	if lastId != "" {
+		request.Header.Set("Last-Event-ID", lastId)
+	}
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	return &sseTestStream{response, bufio.NewReader(response.Body)}
+}
+
+// ---------------------------------------------------------------------------------------
+func (s *sseTestStream) close() {
+	s.response.Body.Close()
+}
+
+// ---------------------------------------------------------------------------------------
+func (s *sseTestStream) next(t *testing.T) sseTestEvent {
+	var event sseTestEvent
+	for {
+		line, err := s.reader.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return event
+		}
+		field, value, _ := strings.Cut(line, ": ")
+		switch field {
+		case "id":
+			event.Id = value
+		case "event":
+			event.Event = value
+		case "data":
+			require.NoError(t, json.Unmarshal([]byte(value), &event.Data))
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+func paintForSse(t *testing.T, hs HttpService, xy string) {
+	testreq(t, hs).Post("/api/paint/"+urlCoords(xy)).Send(paintInput{
+		Color: "f00",
+	}).Expect(200, "PIXEL_SET")
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestSseController(t *testing.T) {
+	app, hs := createSseControllerTester(t)
+	defer app.RequireStop()
+
+	/////////////////////////////////////////////////////////////////////
+	// The blocks are validated.
+	testreq(t, hs).Get("/api/events").Expect(400, "BAD_REQUEST", "`blocks` or `regions`")
+	testreq(t, hs).Get("/api/events?blocks=a@@b").Expect(400, "BAD_REQUEST", "invalid coords")
+
+	/////////////////////////////////////////////////////////////////////
+	// The stream starts with READY, then the events of the chosen blocks follow.
+	block := urlCoords("1,0")
+	stream := openSseStream(t, hs, "blocks="+block, "")
+	assert.Equal(t, "text/event-stream", stream.response.Header.Get("Content-Type"))
+	ready := stream.next(t)
+	assert.Equal(t, "READY", ready.Event)
+	assert.NotEmpty(t, ready.Id)
+
+	paintForSse(t, hs, "1 000010,0 000000")
+	event := stream.next(t)
+	assert.Equal(t, "PIXELS_SET", event.Event)
+	assert.Equal(t, block, event.Data.Block)
+	assert.Equal(t, [][2]int64{{2, int64(block2.PIXEL_SET | 0xF<<16)}}, event.Data.Pixels)
+	stream.close()
+
+	/////////////////////////////////////////////////////////////////////
+	// Regions include the blocks under them, which is the whole canvas here.
+	stream = openSseStream(t, hs, "regions=Aw==", "")
+	stream.next(t)
+	paintForSse(t, hs, "1 000011,0 000000")
+	assert.Equal(t, "PIXELS_SET", stream.next(t).Event)
+	assert.Equal(t, "PIXELS_BUBBLED", stream.next(t).Event)
+	stream.close()
+
+	/////////////////////////////////////////////////////////////////////
+	// A client that reconnects with Last-Event-ID gets what it missed.
+	paintForSse(t, hs, "1 000100,0 000000")
+	paintForSse(t, hs, "1 000101,0 000000")
+	stream = openSseStream(t, hs, "blocks="+block, event.Id)
+	var missed []int64
+	for i := 0; i < 3; i++ {
+		event := stream.next(t)
+		require.Equal(t, "PIXELS_SET", event.Event)
+		missed = append(missed, event.Data.Pixels[0][0])
+	}
+	assert.Equal(t, []int64{3, 4, 5}, missed)
+	assert.Equal(t, "READY", stream.next(t).Event)
+	stream.close()
+
+	/////////////////////////////////////////////////////////////////////
+	// Once the events are out of the buffer, or from another server, the client is
+	// told to reload. Each paint here is two events, set and bubbled.
+	paintForSse(t, hs, "1 000110,0 000000")
+	paintForSse(t, hs, "1 000111,0 000000")
+	stream = openSseStream(t, hs, "blocks="+block, event.Id)
+	assert.Equal(t, "RESET", stream.next(t).Event)
+	assert.Equal(t, "READY", stream.next(t).Event)
+	stream.close()
+
+	stream = openSseStream(t, hs, "blocks="+block, "1-1")
+	assert.Equal(t, "RESET", stream.next(t).Event)
+	stream.close()
+
+	/////////////////////////////////////////////////////////////////////
+	// Stopping the server ends open streams.
+	stream = openSseStream(t, hs, "blocks="+block, "")
+	stream.next(t)
+	done := make(chan bool)
+	go func() {
+		app.RequireStop()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	stream.close()
+}
@@ -0,0 +1,322 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"go.mukunda.com/nanopaint/cat"
+	"go.mukunda.com/nanopaint/core"
+	"go.mukunda.com/nanopaint/core/block2"
+	"go.uber.org/fx"
+)
+
+// Clients open a WebSocket at /api/stream and subscribe to blocks to receive their
+// changes as they happen, instead of polling.
+//
+// Client messages:
+//
+//	{"subscribe": ["<coords>", ...]}
+//	{"unsubscribe": ["<coords>", ...]}
+//
+// Server messages:
+//
+//	{"code": "SUBSCRIBED", "blocks": <number of subscribed blocks>}
+//	{"code": "PIXELS_SET" | "PIXELS_DRIED" | "PIXELS_BUBBLED",
+//	 "block": "<coords>", "pixels": [[index, value], ...], "fine": [value, ...],
+//	 "time": <unix ms>}
+//	{"code": "BAD_REQUEST", "message": "..."}
+//
+// Pixel values have the same format as the block pixel data. For 24-bit blocks, "fine"
+// has the fine pixel data of the same pixels, in the same order. It's left out for 12-bit
+// blocks.
+
+type StreamController interface {
+	Stream(c Ct) error
+}
+
+type (
+	streamController struct {
+		upgrader websocket.Upgrader
+		mutex    sync.Mutex
+		clients  map[*streamClient]bool
+		// Subscribed clients by block coords.
+		blocks map[string]map[*streamClient]bool
+	}
+
+	streamClient struct {
+		conn *websocket.Conn
+		send chan any
+		// Closed when the client is disconnected.
+		done      chan struct{}
+		closeOnce sync.Once
+		// Protected by the controller mutex.
+		blocks map[string]bool
+	}
+
+	streamInput struct {
+		Subscribe   []string `json:"subscribe"`
+		Unsubscribe []string `json:"unsubscribe"`
+	}
+
+	blockEventMessage struct {
+		Code   string     `json:"code"`
+		Block  string     `json:"block"`
+		Pixels [][2]int64 `json:"pixels"`
+		Fine   []int64    `json:"fine,omitempty"`
+		Time   int64      `json:"time"`
+	}
+)
+
+const (
+	// Most blocks that one client can be subscribed to.
+	maxStreamSubscriptions = 256
+	// Messages queued for a client before it's considered too slow and disconnected.
+	streamSendBuffer   = 256
+	streamWriteTimeout = 10 * time.Second
+	// Largest client message. A full list of maxStreamSubscriptions deep coords fits.
+	// Larger messages close the stream.
+	streamReadLimit = 16 << 10
+)
+
+// ---------------------------------------------------------------------------------------
+func CreateStreamController(lc fx.Lifecycle, routes Router, hs HttpService, events core.BlockEventService) StreamController {
+	sc := &streamController{
+		clients: make(map[*streamClient]bool),
+		blocks:  make(map[string]map[*streamClient]bool),
+	}
+
+	// Upgrade requests only cost one request.
+	routes.GET("/api/stream", sc.Stream, hs.UseRateLimiter())
+
+	unsubscribe := events.Subscribe(sc.onBlockEvent)
+	lc.Append(fx.Hook{
+		OnStop: func(context.Context) error {
+			// The HTTP server doesn't track hijacked connections, so close them here.
+			unsubscribe()
+			sc.closeAll()
+			return nil
+		},
+	})
+
+	return sc
+}
+
+// ---------------------------------------------------------------------------------------
+func blockEventCode(eventType block2.BlockEventType) string {
+	switch eventType {
+	case block2.BLOCK_EVENT_PIXELS_SET:
+		return "PIXELS_SET"
+	case block2.BLOCK_EVENT_PIXELS_DRIED:
+		return "PIXELS_DRIED"
+	case block2.BLOCK_EVENT_PIXELS_BUBBLED:
+		return "PIXELS_BUBBLED"
+	}
+	return "UNKNOWN"
+}
+
+// ---------------------------------------------------------------------------------------
+func makeBlockEventMessage(event block2.BlockEvent) blockEventMessage {
+	pixels := make([][2]int64, len(event.Pixels))
+	for i, index := range event.Pixels {
+		pixels[i] = [2]int64{int64(index), int64(event.Values[i])}
+	}
+	var fine []int64
+	for _, value := range event.Fine {
+		fine = append(fine, int64(value))
+	}
+	return blockEventMessage{
+		Code:   blockEventCode(event.Type),
+		Block:  event.Block.ToBase64(),
+		Pixels: pixels,
+		Fine:   fine,
+		Time:   int64(event.Time),
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Called while the block repo is locked, so this only queues the message.
+func (sc *streamController) onBlockEvent(event block2.BlockEvent) {
+	key := event.Block.ToBase64()
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if len(sc.blocks[key]) == 0 {
+		return
+	}
+
+	message := makeBlockEventMessage(event)
+	for client := range sc.blocks[key] {
+		client.queue(message)
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Queues a message without blocking. A client that can't keep up is disconnected rather
+// than silently missing changes. It can load the blocks and subscribe again.
+func (client *streamClient) queue(message any) {
+	select {
+	case client.send <- message:
+	default:
+		client.close()
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+func (client *streamClient) close() {
+	client.closeOnce.Do(func() {
+		close(client.done)
+		client.conn.Close()
+	})
+}
+
+// ---------------------------------------------------------------------------------------
+func (client *streamClient) writeLoop() {
+	for {
+		select {
+		case <-client.done:
+			return
+		case message := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err := client.conn.WriteJSON(message); err != nil {
+				client.close()
+				return
+			}
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+func (sc *streamController) closeAll() {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	for client := range sc.clients {
+		client.close()
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+func (sc *streamController) removeClient(client *streamClient) {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	for key := range client.blocks {
+		sc.unsubscribe(client, key)
+	}
+	delete(sc.clients, client)
+}
+
+// ---------------------------------------------------------------------------------------
+// The controller must be locked.
+func (sc *streamController) unsubscribe(client *streamClient, key string) {
+	delete(client.blocks, key)
+	delete(sc.blocks[key], client)
+	if len(sc.blocks[key]) == 0 {
+		delete(sc.blocks, key)
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Applies a subscription message. Returns the number of subscribed blocks.
+func (sc *streamController) updateSubscriptions(client *streamClient, input streamInput) int {
+	// Validate everything before changing anything.
+	parseKeys := func(list []string) []string {
+		keys := make([]string, len(list))
+		for i, coords := range list {
+			keys[i] = block2.CoordsFromBase64(coords).ToBase64()
+		}
+		return keys
+	}
+	subscribe := parseKeys(input.Subscribe)
+	unsubscribe := parseKeys(input.Unsubscribe)
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	blocks := maps.Clone(client.blocks)
+	for _, key := range unsubscribe {
+		delete(blocks, key)
+	}
+	for _, key := range subscribe {
+		blocks[key] = true
+	}
+	cat.BadIf(len(blocks) > maxStreamSubscriptions,
+		"Too many subscriptions. The limit is "+strconv.Itoa(maxStreamSubscriptions)+".")
+
+	for _, key := range unsubscribe {
+		sc.unsubscribe(client, key)
+	}
+	for _, key := range subscribe {
+		client.blocks[key] = true
+		if sc.blocks[key] == nil {
+			sc.blocks[key] = make(map[*streamClient]bool)
+		}
+		sc.blocks[key][client] = true
+	}
+
+	return len(client.blocks)
+}
+
+// ---------------------------------------------------------------------------------------
+// Handles one message from the client. Errors are sent back to the client instead of
+// ending the stream.
+func (sc *streamController) handleMessage(c Ct, client *streamClient, data []byte) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			ce := cat.Handle(c, recovered)
+			httpError := translateErrorForEcho(c, ce).(*echo.HTTPError)
+			client.queue(httpError.Message)
+		}
+	}()
+
+	var input streamInput
+	cat.BadIf(json.Unmarshal(data, &input) != nil, "Invalid message.")
+
+	var response struct {
+		baseResponse
+		Blocks int `json:"blocks"`
+	}
+	response.Code = "SUBSCRIBED"
+	response.Blocks = sc.updateSubscriptions(client, input)
+	client.queue(response)
+}
+
+// ---------------------------------------------------------------------------------------
+func (sc *streamController) Stream(c Ct) error {
+	conn, err := sc.upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		// The upgrader already responded with an error.
+		return nil
+	}
+	conn.SetReadLimit(streamReadLimit)
+
+	client := &streamClient{
+		conn:   conn,
+		send:   make(chan any, streamSendBuffer),
+		done:   make(chan struct{}),
+		blocks: make(map[string]bool),
+	}
+	sc.mutex.Lock()
+	sc.clients[client] = true
+	sc.mutex.Unlock()
+
+	defer sc.removeClient(client)
+	defer client.close()
+	go client.writeLoop()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return nil
+		}
+		sc.handleMessage(c, client, data)
+	}
+}
@@ -0,0 +1,163 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mukunda.com/nanopaint/config"
+	"go.mukunda.com/nanopaint/core"
+	"go.mukunda.com/nanopaint/core/block2"
+	"go.mukunda.com/nanopaint/core/clock"
+	"go.uber.org/fx"
+	"go.uber.org/fx/fxtest"
+)
+
+type streamMessage struct {
+	Code    string
+	Message string
+	Blocks  int
+	Block   string
+	Pixels  [][2]int64
+	Time    int64
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func createStreamControllerTester(t *testing.T) (*fxtest.App, HttpService, *clock.TestClockService) {
+	var hs HttpService
+	var tc *clock.TestClockService
+
+	app := fxtest.New(t,
+		config.ProvideFromYamlString(`
+http:
+  port: 0
+  disableRateLimit: true
+core:
+  disableBlockDryInterval: true
+`),
+		fx.Provide(
+			clock.CreateTestClockService,
+			CreateHttpService,
+			unwrapHttpRouter,
+			annotateController(CreatePaintController),
+			annotateController(CreateStreamController),
+		),
+		core.Fx(),
+		fx.Invoke(func(s StartControllersParam, phs HttpService, cs clock.ClockService) {
+			hs = phs
+			tc = cs.(*clock.TestClockService)
+		}),
+	).RequireStart()
+
+	return app, hs, tc
+}
+
+// ---------------------------------------------------------------------------------------
+func dialStream(t *testing.T, hs HttpService) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(
+		"ws://localhost:"+strconv.Itoa(hs.GetPort())+"/api/stream", nil)
+	require.NoError(t, err)
+	return conn
+}
+
+// ---------------------------------------------------------------------------------------
+func readStream(t *testing.T, conn *websocket.Conn) streamMessage {
+	var message streamMessage
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, conn.ReadJSON(&message))
+	return message
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestStreamController(t *testing.T) {
+	app, hs, tc := createStreamControllerTester(t)
+	defer app.RequireStop()
+
+	conn := dialStream(t, hs)
+	defer conn.Close()
+
+	/////////////////////////////////////////////////////////////////////
+	// Bad messages are reported without closing the stream.
+	conn.WriteMessage(websocket.TextMessage, []byte("nope"))
+	assert.Equal(t, "BAD_REQUEST", readStream(t, conn).Code)
+
+	conn.WriteJSON(streamInput{Subscribe: []string{"a@@b"}})
+	message := readStream(t, conn)
+	assert.Equal(t, "BAD_REQUEST", message.Code)
+	assert.Contains(t, message.Message, "invalid coords")
+
+	var tooMany []string
+	for i := 0; i <= maxStreamSubscriptions; i++ {
+		tooMany = append(tooMany, urlCoords(fmt.Sprintf("%09b,000000000", i)))
+	}
+	conn.WriteJSON(streamInput{Subscribe: tooMany})
+	assert.Equal(t, "BAD_REQUEST", readStream(t, conn).Code)
+
+	/////////////////////////////////////////////////////////////////////
+	// Messages over the read limit close the stream instead of being buffered.
+	big := dialStream(t, hs)
+	defer big.Close()
+	big.WriteMessage(websocket.TextMessage, make([]byte, streamReadLimit+1))
+	big.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := big.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), err)
+
+	/////////////////////////////////////////////////////////////////////
+	// Only changes to subscribed blocks are pushed.
+	block := urlCoords("1,0")
+	conn.WriteJSON(streamInput{Subscribe: []string{block}})
+	assert.Equal(t, streamMessage{Code: "SUBSCRIBED", Blocks: 1}, readStream(t, conn))
+
+	testreq(t, hs).Post("/api/paint/"+urlCoords("1 000010,0 000000")).Send(paintInput{
+		Color: "f00",
+	}).Expect(200, "PIXEL_SET")
+	assert.Equal(t, streamMessage{
+		Code:   "PIXELS_SET",
+		Block:  block,
+		Pixels: [][2]int64{{2, int64(block2.PIXEL_SET | 0xF<<16)}},
+		Time:   tc.Now().UnixMilli(),
+	}, readStream(t, conn))
+
+	/////////////////////////////////////////////////////////////////////
+	// Bubbled colors are pushed for the blocks above.
+	conn.WriteJSON(streamInput{Subscribe: []string{block2.MakeEmptyCoords().ToBase64()}})
+	assert.Equal(t, 2, readStream(t, conn).Blocks)
+
+	testreq(t, hs).Post("/api/paint/"+urlCoords("1 000011,0 000000")).Send(paintInput{
+		Color: "f00",
+	}).Expect(200, "PIXEL_SET")
+	assert.Equal(t, "PIXELS_SET", readStream(t, conn).Code)
+	message = readStream(t, conn)
+	assert.Equal(t, "PIXELS_BUBBLED", message.Code)
+	assert.Equal(t, block2.MakeEmptyCoords().ToBase64(), message.Block)
+	assert.Equal(t, [][2]int64{{33, 0x700F}}, message.Pixels)
+
+	/////////////////////////////////////////////////////////////////////
+	// Drying is pushed too.
+	tc.Advance(time.Hour)
+	testreq(t, hs).Get("/api/block/"+block).Expect(200, "BLOCK")
+	message = readStream(t, conn)
+	assert.Equal(t, "PIXELS_DRIED", message.Code)
+	assert.Equal(t, block, message.Block)
+	assert.Equal(t, [][2]int64{
+		{2, int64(block2.PIXEL_SET | block2.PIXEL_DRY | 0xF<<16)},
+		{3, int64(block2.PIXEL_SET | block2.PIXEL_DRY | 0xF<<16)},
+	}, message.Pixels)
+
+	/////////////////////////////////////////////////////////////////////
+	// Unsubscribed blocks stop being pushed.
+	conn.WriteJSON(streamInput{Unsubscribe: []string{block}})
+	assert.Equal(t, 1, readStream(t, conn).Blocks)
+	testreq(t, hs).Post("/api/paint/"+urlCoords("1 000100,0 000000")).Send(paintInput{
+		Color: "f00",
+	}).Expect(200, "PIXEL_SET")
+	assert.Equal(t, "PIXELS_BUBBLED", readStream(t, conn).Code)
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"go.mukunda.com/nanopaint/config"
+	"go.mukunda.com/nanopaint/core"
 	"go.mukunda.com/nanopaint/core/clock"
 	"go.uber.org/fx"
 	"go.uber.org/fx/fxtest"
@@ -23,8 +24,12 @@ http:
   port: 0
   rateLimitPeriod: 50
   rateLimitBurst: 10
+core:
+  disableBlockDryInterval: true
 `),
 		fx.Provide(clock.CreateTestClockService),
+		// The other controllers need the core services.
+		core.Fx(),
 		Fx(),
 		fx.Invoke(func(phs HttpService, cs clock.ClockService) {
 			hs = phs
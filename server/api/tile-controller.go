@@ -0,0 +1,79 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package api
+
+import (
+	"bytes"
+	"image/png"
+	"net/http"
+	"strings"
+
+	"go.mukunda.com/nanopaint/cat"
+	"go.mukunda.com/nanopaint/core"
+	"go.mukunda.com/nanopaint/core/block2"
+)
+
+// Serves blocks as rendered PNG tiles for third-party viewers and embeds, which don't
+// want to decode the pixel flags.
+//
+//	GET /api/tile/<coords>.png?checkerboard=false&debug=true
+//
+// Tiles show a checkerboard where the block is fully transparent, unless checkerboard is
+// false. debug tints wet pixels magenta and dry pixels cyan. Tiles have the same cache
+// headers as GetBlock, so they can be revalidated with If-None-Match.
+
+type TileController interface {
+	GetTile(c Ct) error
+}
+
+type tileController struct {
+	blocks core.BlockService
+	images core.ImageService
+}
+
+// ---------------------------------------------------------------------------------------
+func CreateTileController(routes Router, hs HttpService, blocks core.BlockService, images core.ImageService) TileController {
+	tc := &tileController{
+		blocks: blocks,
+		images: images,
+	}
+
+	routes.GET("/api/tile/:tile", tc.GetTile, hs.UseRateLimiter())
+
+	return tc
+}
+
+// ---------------------------------------------------------------------------------------
+func (tc *tileController) GetTile(c Ct) error {
+	coordsString, ok := strings.CutSuffix(c.Param("tile"), ".png")
+	cat.NotFoundIf(!ok, "Tiles are only available as PNG.")
+	coords := block2.CoordsFromBase64(coordsString)
+
+	options := core.TileOptions{
+		Checkerboard: c.QueryParam("checkerboard") != "false",
+		DebugDrying:  c.QueryParam("debug") == "true",
+	}
+
+	block, err := tc.blocks.GetBlock(coords)
+	cat.NotFoundIf(err == block2.ErrBlockNotFound, "Block not found.")
+	cat.Catch(err, "unexpected error from core.GetBlock")
+
+	// Each set of options is a different rendering, so it needs its own tag.
+	variant := "image/png"
+	if options.Checkerboard {
+		variant += ";checkerboard"
+	}
+	if options.DebugDrying {
+		variant += ";debug"
+	}
+	if checkBlockCache(c, block, blockETag(block, variant)) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	var data bytes.Buffer
+	cat.Catch(png.Encode(&data, tc.images.RenderTile(block, options)), "Failed to encode tile.")
+
+	return c.Blob(200, "image/png", data.Bytes())
+}
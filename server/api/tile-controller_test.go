@@ -0,0 +1,112 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package api
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mukunda.com/nanopaint/config"
+	"go.mukunda.com/nanopaint/core"
+	"go.mukunda.com/nanopaint/core/clock"
+	"go.mukunda.com/nanopaint/test"
+	"go.uber.org/fx"
+	"go.uber.org/fx/fxtest"
+)
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func createTileControllerTester(t *testing.T) (*fxtest.App, testreqFactory) {
+	var hs HttpService
+
+	app := fxtest.New(t,
+		config.ProvideFromYamlString(`
+http:
+  port: 0
+  disableRateLimit: true
+core:
+  disableBlockDryInterval: true
+`),
+		fx.Provide(
+			clock.CreateTestClockService,
+			CreateHttpService,
+			unwrapHttpRouter,
+			annotateController(CreatePaintController),
+			annotateController(CreateTileController),
+		),
+		core.Fx(),
+		fx.Invoke(func(s StartControllersParam, phs HttpService) {
+			hs = phs
+		}),
+	).RequireStart()
+
+	return app, func() *test.Request {
+		return testreq(t, hs)
+	}
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestTileController(t *testing.T) {
+	app, rq := createTileControllerTester(t)
+	defer app.RequireStop()
+
+	rq().Post("/api/paint/"+urlCoords("000000,000000")).Send(paintInput{
+		Color: "f00",
+	}).Expect(200, "PIXEL_SET")
+
+	decode := func(r *test.Request) image.Image {
+		assert.Equal(t, 200, r.StatusCode)
+		assert.Equal(t, "image/png", r.Response.Get("Content-Type"))
+		img, err := png.Decode(bytes.NewReader(r.ResponseBody))
+		assert.NoError(t, err)
+		return img
+	}
+
+	/////////////////////////////////////////////////////////
+	// The block's colors over a checkerboard.
+	tile := rq().Get("/api/tile/Aw==.png").Run()
+	img := decode(tile)
+	assert.Equal(t, image.Rect(0, 0, 64, 64), img.Bounds())
+	assert.Equal(t, color.NRGBA{255, 0, 0, 255}, color.NRGBAModel.Convert(img.At(0, 0)))
+	assert.Equal(t, color.NRGBA{255, 255, 255, 255}, color.NRGBAModel.Convert(img.At(1, 0)))
+	assert.Equal(t, color.NRGBA{204, 204, 204, 255}, color.NRGBAModel.Convert(img.At(8, 0)))
+
+	img = decode(rq().Get("/api/tile/Aw==.png?checkerboard=false").Run())
+	assert.Equal(t, color.NRGBA{}, color.NRGBAModel.Convert(img.At(1, 0)))
+
+	img = decode(rq().Get("/api/tile/Aw==.png?debug=true").Run())
+	assert.Equal(t, color.NRGBA{255, 0, 128, 255}, color.NRGBAModel.Convert(img.At(0, 0)))
+
+	/////////////////////////////////////////////////////////
+	// Tiles are cached by the block version.
+	etag := tile.Response.Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, "no-cache", tile.Response.Get("Cache-Control"))
+	assert.NotEmpty(t, tile.Response.Get("Last-Modified"))
+	rq().Get("/api/tile/Aw==.png").Header("If-None-Match", etag).Run().Then(func(r *test.Request) {
+		assert.Equal(t, 304, r.StatusCode)
+		assert.Empty(t, r.ResponseBody)
+	})
+	rq().Get("/api/tile/Aw==.png?debug=true").Header("If-None-Match", etag).Run().Then(func(r *test.Request) {
+		assert.Equal(t, 200, r.StatusCode)
+	})
+
+	rq().Post("/api/paint/"+urlCoords("000001,000000")).Send(paintInput{
+		Color: "0f0",
+	}).Expect(200, "PIXEL_SET")
+	rq().Get("/api/tile/Aw==.png").Header("If-None-Match", etag).Run().Then(func(r *test.Request) {
+		assert.Equal(t, 200, r.StatusCode)
+		assert.NotEqual(t, etag, r.Response.Get("ETag"))
+	})
+
+	/////////////////////////////////////////////////////////
+	// Only PNG tiles of existing blocks.
+	rq().Get("/api/tile/Aw==").Expect(404, "NOT_FOUND", "Tiles are only available as PNG.")
+	rq().Get("/api/tile/"+urlCoords("1,1")+".png").Expect(404, "NOT_FOUND", "Block not found.")
+	rq().Get("/api/tile/a@@b.png").Expect(400, "BAD_REQUEST", "invalid coords")
+}
@@ -34,6 +34,9 @@ type ExecutionError struct{ Message string }
 // Caused from missing resource.
 type NotFoundError struct{ Message string }
 
+// Caused from changing something that is protected, e.g., a frozen region.
+type ProtectedError struct{ Message string }
+
 // When passing an error directly as the problem.
 type OtherError struct{ WrappedError error }
 
@@ -42,6 +45,7 @@ func (e ArgumentError) Error() string   { return e.Message }
 func (e PermissionError) Error() string { return e.Message }
 func (e ExecutionError) Error() string  { return e.Message }
 func (e NotFoundError) Error() string   { return e.Message }
+func (e ProtectedError) Error() string  { return e.Message }
 func (e OtherError) Error() string      { return e.WrappedError.Error() }
 func (e OtherError) Unwrap() error      { return e.WrappedError }
 
@@ -90,6 +94,10 @@ func Handle(c common.Context, recovered any) ControlledError {
 			le.WithField("problem", cp.Problem.Error()).
 				Debugln("Caught 'not found' error.")
 			return cp
+		case ProtectedError:
+			le.WithField("problem", cp.Problem.Error()).
+				Debugln("Caught protected error.")
+			return cp
 		case ArgumentError:
 			le.WithField("problem", cp.Problem.Error()).
 				Debugln("Caught argument error (bad request).")
@@ -132,7 +140,7 @@ func Bubble(err error) {
 func translateProblem(problem any) Problem {
 	switch p := problem.(type) {
 	case UnknownError, ArgumentError, PermissionError, ExecutionError,
-		NotFoundError, OtherError:
+		NotFoundError, ProtectedError, OtherError:
 
 		return problem.(Problem)
 	case string:
@@ -201,6 +209,12 @@ func NotFoundIf(condition bool, message string) {
 	Catch(condition, NotFoundError{message})
 }
 
+// ---------------------------------------------------------------------------------------
+// Wrapper for raising a Protected error.
+func ProtectedIf(condition bool, message string) {
+	Catch(condition, ProtectedError{message})
+}
+
 type Lockable interface {
 	TryLock() bool
 	Unlock()
@@ -24,6 +24,21 @@ func (c *basicContext) Set(key string, value any) {
 	c.data[key] = value
 }
 
+// ---------------------------------------------------------------------------------------
+// Returns who the context is acting for: the "username" if there is one, otherwise the
+// "ip". Empty for the system, including a nil context.
+func Identity(c Context) string {
+	if c == nil {
+		return ""
+	}
+	if username, ok := c.Get("username").(string); ok && username != "" {
+		return username
+	}
+	ip, _ := c.Get("ip").(string)
+	return ip
+}
+
+// ---------------------------------------------------------------------------------------
 func CreateBasicContext() Context {
 	c := &basicContext{
 		data: make(map[string]any),
@@ -24,3 +24,18 @@ func TestContext(t *testing.T) {
 	// Context keys are case-sensitive.
 	assert.Nil(t, ct.Get("hello"))
 }
+
+func TestIdentity(t *testing.T) {
+
+	//////////////////////////////////////////////////
+	// The username wins over the IP, and nil is the system.
+	ct := CreateBasicContext()
+	assert.Equal(t, "", Identity(ct))
+	assert.Equal(t, "", Identity(nil))
+
+	ct.Set("ip", "1.2.3.4")
+	assert.Equal(t, "1.2.3.4", Identity(ct))
+
+	ct.Set("username", "alice")
+	assert.Equal(t, "alice", Identity(ct))
+}
@@ -0,0 +1,65 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package core
+
+import (
+	"sync"
+
+	"go.mukunda.com/nanopaint/core/block2"
+)
+
+// Fans out events from the block repo to any number of subscribers, e.g., API streams.
+
+type (
+	BlockEventHandler func(event block2.BlockEvent)
+
+	BlockEventService interface {
+		// Handlers are called synchronously while the repo is locked. They must not block
+		// or call back into the block service. Returns a function that removes the
+		// handler.
+		Subscribe(handler BlockEventHandler) (unsubscribe func())
+	}
+
+	blockEventService struct {
+		mutex    sync.RWMutex
+		handlers map[int]BlockEventHandler
+		nextId   int
+	}
+)
+
+// ---------------------------------------------------------------------------------------
+func CreateBlockEventService(repo block2.BlockRepo) BlockEventService {
+	s := &blockEventService{
+		handlers: make(map[int]BlockEventHandler),
+	}
+	repo.SetEventListener(s.publish)
+	return s
+}
+
+// ---------------------------------------------------------------------------------------
+func (s *blockEventService) Subscribe(handler BlockEventHandler) func() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	id := s.nextId
+	s.nextId++
+	s.handlers[id] = handler
+
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		delete(s.handlers, id)
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+func (s *blockEventService) publish(event block2.BlockEvent) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, handler := range s.handlers {
+		handler(event)
+	}
+}
@@ -5,25 +5,80 @@
 package core
 
 import (
+	"errors"
+	"sync"
+
 	"go.mukunda.com/nanopaint/cat"
+	"go.mukunda.com/nanopaint/common"
 	"go.mukunda.com/nanopaint/core/block2"
 )
 
 type (
 	BlockService interface {
 		GetBlock(coords block2.Coords) (*block2.Block, error)
-		SetPixel(coords block2.Coords, color block2.Color) error
+		GetBlocks(coords []block2.Coords) []*block2.Block
+		HasBlocksUnder(coords block2.Coords, levels int) bool
+		SetPixel(c common.Context, coords block2.Coords, color block2.Color) error
+		SetPixels(c common.Context, pixels []block2.PixelPaint) []error
+		UndoPixel(c common.Context, coords block2.Coords) error
 	}
 
 	blockService struct {
-		repo block2.BlockRepo
+		repo    block2.BlockRepo
+		history HistoryService
+		// 12 or 24, see coreConfig.ColorDepth.
+		colorDepth int
+		// Checks painted colors against the palette zones. Nil if there are none.
+		palettes PaletteService
+		// Rejects changes in protected zones. Nil if there are none.
+		protection ProtectionService
+		// Held while painting and recording, so that an undo can't revert a paint that
+		// isn't in the history yet.
+		paintMutex sync.Mutex
 	}
 )
 
-func CreateBlockService(repo block2.BlockRepo) BlockService {
+var ErrNotPainter = errors.New("pixel was last painted by someone else")
+
+// Pixels painted through the BlockService are recorded in the history with the painter
+// from the context. The history also decides who can undo a pixel. The canvas is 12-bit
+// unless the config says otherwise.
+func CreateBlockService(repo block2.BlockRepo, history HistoryService) BlockService {
 	return &blockService{
-		repo: repo,
+		repo:       repo,
+		history:    history,
+		colorDepth: 12,
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// 24-bit colors are rounded to 12 bits on 12-bit canvases, before they're painted or
+// recorded.
+func (s *blockService) canvasColor(color block2.Color) block2.Color {
+	if s.colorDepth == 12 {
+		return color.To12()
+	}
+	return color
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the color to paint at the pixel, rounded for the canvas and checked against its
+// palette zone. The error is ErrProtected or ErrColorNotAllowed.
+func (s *blockService) paintColor(coords block2.Coords, color block2.Color) (block2.Color, error) {
+	if s.isProtected(coords) {
+		return color, ErrProtected
+	}
+	color = s.canvasColor(color)
+	if s.palettes == nil {
+		return color, nil
 	}
+	color, err := s.palettes.CheckColor(coords, color)
+	return s.canvasColor(color), err
+}
+
+// ---------------------------------------------------------------------------------------
+func (s *blockService) isProtected(coords block2.Coords) bool {
+	return s.protection != nil && s.protection.IsProtected(coords)
 }
 
 // ---------------------------------------------------------------------------------------
@@ -40,6 +95,25 @@ func (s *blockService) GetBlock(coords block2.Coords) (*block2.Block, error) {
 	return block, nil
 }
 
+// ---------------------------------------------------------------------------------------
+// Returns many blocks at once, in the same order as the given coordinates. Entries are
+// nil for blocks that don't exist. Errors are panics.
+func (s *blockService) GetBlocks(coords []block2.Coords) []*block2.Block {
+	blocks, err := s.repo.GetBlocks(coords)
+	cat.Catch(err, "Failed to get blocks.")
+
+	return blocks
+}
+
+// ---------------------------------------------------------------------------------------
+// True if the block or any block up to `levels` under it exists. Errors are panics.
+func (s *blockService) HasBlocksUnder(coords block2.Coords, levels int) bool {
+	result, err := s.repo.HasBlocksUnder(coords, levels)
+	cat.Catch(err, "Failed to search blocks.")
+
+	return result
+}
+
 // ---------------------------------------------------------------------------------------
 // Creates a new block or updates a wet block.
 //
@@ -47,13 +121,97 @@ func (s *blockService) GetBlock(coords block2.Coords) (*block2.Block, error) {
 //
 //	ErrBlockNotFound: the parent doesn't exist.
 //	ErrBlockIsDry: the block is already dry and cannot be updated.
-func (s *blockService) SetPixel(coords block2.Coords, color block2.Color) error {
-	err := s.repo.SetPixel(coords, color)
+//	ErrColorNotAllowed: the color isn't in the palette of the pixel's zone.
+//	ErrProtected: the pixel is in a protected zone.
+func (s *blockService) SetPixel(c common.Context, coords block2.Coords, color block2.Color) error {
+	s.paintMutex.Lock()
+	defer s.paintMutex.Unlock()
+
+	color, err := s.paintColor(coords, color)
+	if err != nil {
+		return err
+	}
+	err = s.repo.SetPixel(coords, color)
 	if err == block2.ErrPixelIsDry || err == block2.ErrMaxDepthExceeded {
 		// Filter for these error types only. Others panic.
 		return err
 	}
 	cat.Catch(err, "Failed to set block.")
 
+	s.history.Record(c, []block2.PixelPaint{{Coords: coords, Color: color}})
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Paints many pixels in one operation, e.g., a brush stroke. Returns the result of each
+// pixel: nil, ErrPixelIsDry, ErrMaxDepthExceeded, ErrColorNotAllowed or ErrProtected.
+// Other errors are panics.
+func (s *blockService) SetPixels(c common.Context, pixels []block2.PixelPaint) []error {
+	s.paintMutex.Lock()
+	defer s.paintMutex.Unlock()
+
+	// Pixels that are protected or have colors that aren't allowed are left out of the
+	// paint.
+	results := make([]error, len(pixels))
+	allowed := make([]block2.PixelPaint, 0, len(pixels))
+	indexes := make([]int, 0, len(pixels))
+	for i, pixel := range pixels {
+		pixel.Color, results[i] = s.paintColor(pixel.Coords, pixel.Color)
+		if results[i] == nil {
+			allowed = append(allowed, pixel)
+			indexes = append(indexes, i)
+		}
+	}
+	if len(allowed) == 0 {
+		return results
+	}
+	painted, err := s.repo.SetPixels(allowed)
+	cat.Catch(err, "Failed to set pixels.")
+
+	recorded := make([]block2.PixelPaint, 0, len(allowed))
+	for i, result := range painted {
+		results[indexes[i]] = result
+		if result == nil {
+			recorded = append(recorded, allowed[i])
+		}
+	}
+	s.history.Record(c, recorded)
+	return results
+}
+
+// ---------------------------------------------------------------------------------------
+// Reverts the last paint of a wet pixel, if the context's identity painted it. See
+// block2.BlockRepo.UndoPixel. The undo is recorded in the history.
+//
+// Errors:
+//
+//	ErrNotPainter: someone else painted the pixel last, or the context has no identity.
+//	block2.ErrNothingToUndo: the pixel isn't painted, or its last paint was undone.
+//	block2.ErrPixelIsDry: the pixel is dry and can't be changed anymore.
+//	ErrProtected: the pixel is in a protected zone.
+func (s *blockService) UndoPixel(c common.Context, coords block2.Coords) error {
+	s.paintMutex.Lock()
+	defer s.paintMutex.Unlock()
+
+	if s.isProtected(coords) {
+		return ErrProtected
+	}
+
+	last := s.history.Query(block2.HistoryQuery{Coords: coords, Exact: true, Limit: 1})
+	if len(last) == 0 || last[0].Undo {
+		return block2.ErrNothingToUndo
+	}
+	painter := common.Identity(c)
+	if painter == "" || last[0].Painter != painter {
+		return ErrNotPainter
+	}
+
+	err := s.repo.UndoPixel(coords)
+	if err == block2.ErrPixelIsDry || err == block2.ErrNothingToUndo {
+		return err
+	}
+	cat.Catch(err, "Failed to undo pixel.")
+
+	s.history.RecordUndo(c, coords)
 	return nil
 }
@@ -0,0 +1,477 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
+// Serialization of blocks for storage, both persistent and in memory.
+//
+// MemBlock record:
+//   [0]    format version (6)
+//   [1:9]  LastUpdated, int64 little-endian
+//   [9:]   dry times (see encodeDryTimes)
+//   [n:]   undo states (see encodeUndo)
+//   [m:]   length of the packed fine pixels, uint32 little-endian, zero for 12-bit blocks
+//   [m+4:] packed fine pixels (see Block.Fine and packPixels)
+//   [k:]   packed pixels (see packPixels)
+//
+// Dry times:
+//   [0:2]  number of wet pixels, uint16 little-endian
+//   For each wet pixel, ordered by index:
+//     pixel index uint16, deadline int64
+//
+// Undo states:
+//   [0:2]  number of entries, uint16 little-endian, with undoFineFlag for 24-bit blocks
+//   For each entry, ordered by index:
+//     pixel index uint16, pixel uint32, fine uint32 (24-bit only), deadline int64
+//
+// Packed pixels:
+//   [0]    encoding
+//   pixelEncodingRaw:     64*64 uint32 little-endian
+//   pixelEncodingUniform: one uint32, the color of every pixel
+//   pixelEncodingPalette: uint16 palette size, the palette as uint32s, then runs of
+//                         pixels in order, each a uvarint length and a uvarint palette
+//                         index, until all 64*64 pixels are covered
+//
+// Most blocks are a single inherited color or a handful of colors with a few painted
+// dots, so they pack down to tens of bytes instead of 16 KB.
+//
+// Version 5 didn't have the fine pixels, so all of its blocks are 12-bit. Version 4
+// also didn't have the undo states, so its wet pixels can't be undone. Version 3
+// also had raw pixel data in place of the packed pixels. Version 2 also didn't have
+// LastUpdated. Version 1 also had a single int64 DryTime for the whole block in place of
+// the dry times, which gives all of the wet pixels that deadline. They are all still
+// read, with LastUpdated as zero when it's missing.
+
+const memBlockEncodingVersion = 6
+
+// Set in the undo count when the entries have the fine pixel. There are never more
+// entries than pixels, so the top bit is free.
+const undoFineFlag = 0x8000
+
+const (
+	pixelEncodingRaw     = 0
+	pixelEncodingUniform = 1
+	pixelEncodingPalette = 2
+)
+
+// Blocks with more colors than this are stored raw. They rarely pack much smaller, and
+// noisy blocks are given up on early.
+const maxPackedPaletteSize = 256
+
+var ErrBadBlockData = errors.New("invalid block data")
+
+// ---------------------------------------------------------------------------------------
+func encodePixelData(pixels []Pixel) []byte {
+	data := make([]byte, len(pixels)*4)
+	for i, pixel := range pixels {
+		binary.LittleEndian.PutUint32(data[i*4:], uint32(pixel))
+	}
+	return data
+}
+
+// ---------------------------------------------------------------------------------------
+func decodePixelData(data []byte) ([]Pixel, error) {
+	if len(data) != 64*64*4 {
+		return nil, ErrBadBlockData
+	}
+	pixels := make([]Pixel, 64*64)
+	for i := range pixels {
+		pixels[i] = Pixel(binary.LittleEndian.Uint32(data[i*4:]))
+	}
+	return pixels, nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Packs the pixels with whichever encoding is smallest.
+func packPixels(pixels []Pixel) []byte {
+	uniform := true
+	for _, pixel := range pixels {
+		if pixel != pixels[0] {
+			uniform = false
+			break
+		}
+	}
+	if uniform {
+		return binary.LittleEndian.AppendUint32([]byte{pixelEncodingUniform}, uint32(pixels[0]))
+	}
+
+	if data, ok := AppendPalettePixels([]byte{pixelEncodingPalette}, pixels); ok {
+		return data
+	}
+	return append([]byte{pixelEncodingRaw}, encodePixelData(pixels)...)
+}
+
+// ---------------------------------------------------------------------------------------
+// Appends the pixels compressed with a palette and runs: a uint16 palette size, that many
+// uint32 colors, then for each run of one color a uvarint length and a uvarint palette
+// index. The API sends blocks in the same format.
+//
+// Returns the data unchanged and false if the pixels have too many colors, or wouldn't
+// be smaller than 4 bytes per pixel plus one.
+func AppendPalettePixels(data []byte, pixels []Pixel) ([]byte, bool) {
+	rawSize := 1 + len(pixels)*4
+
+	// Palette indexes by color in an open-addressed table twice the palette's size, since
+	// this runs for every saved block. Slots are found with the top 9 bits of a
+	// multiplicative hash, and hold the index plus one, so zero is empty.
+	var slots [2 * maxPackedPaletteSize]struct {
+		color Pixel
+		index uint16
+	}
+	palette := make([]Pixel, 0, 16)
+	runs := make([]byte, 0, 256)
+	for start := 0; start < len(pixels); {
+		end := start + 1
+		for end < len(pixels) && pixels[end] == pixels[start] {
+			end++
+		}
+
+		slot := uint32(pixels[start]) * 2654435761 >> 23
+		for slots[slot].index != 0 && slots[slot].color != pixels[start] {
+			slot = (slot + 1) % uint32(len(slots))
+		}
+		if slots[slot].index == 0 {
+			if len(palette) == maxPackedPaletteSize {
+				return data, false
+			}
+			palette = append(palette, pixels[start])
+			slots[slot].color = pixels[start]
+			slots[slot].index = uint16(len(palette))
+		}
+		runs = binary.AppendUvarint(runs, uint64(end-start))
+		runs = binary.AppendUvarint(runs, uint64(slots[slot].index-1))
+		if 3+len(palette)*4+len(runs) >= rawSize {
+			return data, false
+		}
+		start = end
+	}
+
+	data = slices.Grow(data, 2+len(palette)*4+len(runs))
+	data = binary.LittleEndian.AppendUint16(data, uint16(len(palette)))
+	for _, color := range palette {
+		data = binary.LittleEndian.AppendUint32(data, uint32(color))
+	}
+	return append(data, runs...), true
+}
+
+// ---------------------------------------------------------------------------------------
+func unpackPixels(data []byte) ([]Pixel, error) {
+	if len(data) < 1 {
+		return nil, ErrBadBlockData
+	}
+
+	switch data[0] {
+	case pixelEncodingRaw:
+		return decodePixelData(data[1:])
+
+	case pixelEncodingUniform:
+		if len(data) != 5 {
+			return nil, ErrBadBlockData
+		}
+		pixels := make([]Pixel, 64*64)
+		color := Pixel(binary.LittleEndian.Uint32(data[1:]))
+		for i := range pixels {
+			pixels[i] = color
+		}
+		return pixels, nil
+
+	case pixelEncodingPalette:
+		return unpackPalettePixels(data[1:])
+	}
+
+	return nil, ErrBadBlockData
+}
+
+// ---------------------------------------------------------------------------------------
+func unpackPalettePixels(data []byte) ([]Pixel, error) {
+	if len(data) < 2 {
+		return nil, ErrBadBlockData
+	}
+	paletteSize := int(binary.LittleEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < paletteSize*4 {
+		return nil, ErrBadBlockData
+	}
+	palette := make([]Pixel, paletteSize)
+	for i := range palette {
+		palette[i] = Pixel(binary.LittleEndian.Uint32(data[i*4:]))
+	}
+	data = data[paletteSize*4:]
+
+	pixels := make([]Pixel, 0, 64*64)
+	for len(pixels) < 64*64 {
+		length, n := binary.Uvarint(data)
+		if n <= 0 || length == 0 || length > uint64(64*64-len(pixels)) {
+			return nil, ErrBadBlockData
+		}
+		data = data[n:]
+		index, n := binary.Uvarint(data)
+		if n <= 0 || index >= uint64(paletteSize) {
+			return nil, ErrBadBlockData
+		}
+		data = data[n:]
+		for i := uint64(0); i < length; i++ {
+			pixels = append(pixels, palette[index])
+		}
+	}
+
+	if len(data) != 0 {
+		return nil, ErrBadBlockData
+	}
+	return pixels, nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the entries of the map ordered by pixel index. Busy blocks have thousands of
+// them, so they're ordered with a table of the 64*64 pixels rather than sorted.
+func orderPixelEntries[V any](entries map[uint16]V) ([]uint16, []V) {
+	var present [64 * 64]bool
+	var table [64 * 64]V
+	for index, value := range entries {
+		present[index] = true
+		table[index] = value
+	}
+	indexes := make([]uint16, 0, len(entries))
+	values := make([]V, 0, len(entries))
+	for index, ok := range present {
+		if ok {
+			indexes = append(indexes, uint16(index))
+			values = append(values, table[index])
+		}
+	}
+	return indexes, values
+}
+
+// ---------------------------------------------------------------------------------------
+func encodeDryTimes(dryTimes map[uint16]UnixMillis) []byte {
+	return appendDryTimes(make([]byte, 0, 2+len(dryTimes)*10), dryTimes)
+}
+
+// ---------------------------------------------------------------------------------------
+func appendDryTimes(data []byte, dryTimes map[uint16]UnixMillis) []byte {
+	indexes, deadlines := orderPixelEntries(dryTimes)
+	data = binary.LittleEndian.AppendUint16(data, uint16(len(indexes)))
+	for i, index := range indexes {
+		data = binary.LittleEndian.AppendUint16(data, index)
+		data = binary.LittleEndian.AppendUint64(data, uint64(deadlines[i]))
+	}
+	return data
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the dry times and the number of bytes read.
+func decodeDryTimes(data []byte) (map[uint16]UnixMillis, int, error) {
+	if len(data) < 2 {
+		return nil, 0, ErrBadBlockData
+	}
+	count := int(binary.LittleEndian.Uint16(data))
+	size := 2 + count*10
+	if count > 64*64 || len(data) < size {
+		return nil, 0, ErrBadBlockData
+	}
+	if count == 0 {
+		return nil, size, nil
+	}
+
+	dryTimes := make(map[uint16]UnixMillis, count)
+	for i := 0; i < count; i++ {
+		entry := data[2+i*10:]
+		index := binary.LittleEndian.Uint16(entry)
+		if index >= 64*64 {
+			return nil, 0, ErrBadBlockData
+		}
+		dryTimes[index] = UnixMillis(binary.LittleEndian.Uint64(entry[2:]))
+	}
+	return dryTimes, size, nil
+}
+
+// ---------------------------------------------------------------------------------------
+// The fine pixels are only written for 24-bit blocks.
+func encodeUndo(undo map[uint16]PixelUndo, fine bool) []byte {
+	return appendUndo(make([]byte, 0, 2+len(undo)*18), undo, fine)
+}
+
+// ---------------------------------------------------------------------------------------
+func appendUndo(data []byte, undo map[uint16]PixelUndo, fine bool) []byte {
+	indexes, states := orderPixelEntries(undo)
+	count := uint16(len(indexes))
+	if fine {
+		count |= undoFineFlag
+	}
+	data = binary.LittleEndian.AppendUint16(data, count)
+	for i, index := range indexes {
+		data = binary.LittleEndian.AppendUint16(data, index)
+		data = binary.LittleEndian.AppendUint32(data, uint32(states[i].Pixel))
+		if fine {
+			data = binary.LittleEndian.AppendUint32(data, uint32(states[i].Fine))
+		}
+		data = binary.LittleEndian.AppendUint64(data, uint64(states[i].DryTime))
+	}
+	return data
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the undo states and the number of bytes read.
+func decodeUndo(data []byte) (map[uint16]PixelUndo, int, error) {
+	if len(data) < 2 {
+		return nil, 0, ErrBadBlockData
+	}
+	count := int(binary.LittleEndian.Uint16(data))
+	fine := count&undoFineFlag != 0
+	count &^= undoFineFlag
+	entrySize := 14
+	if fine {
+		entrySize = 18
+	}
+	size := 2 + count*entrySize
+	if count > 64*64 || len(data) < size {
+		return nil, 0, ErrBadBlockData
+	}
+	if count == 0 {
+		return nil, size, nil
+	}
+
+	undo := make(map[uint16]PixelUndo, count)
+	for i := 0; i < count; i++ {
+		entry := data[2+i*entrySize:]
+		index := binary.LittleEndian.Uint16(entry)
+		if index >= 64*64 {
+			return nil, 0, ErrBadBlockData
+		}
+		state := PixelUndo{
+			Pixel:   Pixel(binary.LittleEndian.Uint32(entry[2:])),
+			DryTime: UnixMillis(binary.LittleEndian.Uint64(entry[entrySize-8:])),
+		}
+		if fine {
+			state.Fine = Pixel(binary.LittleEndian.Uint32(entry[6:]))
+		}
+		undo[index] = state
+	}
+	return undo, size, nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Converts a block-wide deadline from older storage to per-pixel deadlines.
+func legacyDryTimes(pixels []Pixel, dryTime UnixMillis) map[uint16]UnixMillis {
+	if dryTime == 0 {
+		return nil
+	}
+	var dryTimes map[uint16]UnixMillis
+	for i, pixel := range pixels {
+		if pixel&PIXEL_SET != 0 && pixel&PIXEL_DRY == 0 {
+			if dryTimes == nil {
+				dryTimes = make(map[uint16]UnixMillis)
+			}
+			dryTimes[uint16(i)] = dryTime
+		}
+	}
+	return dryTimes
+}
+
+// ---------------------------------------------------------------------------------------
+func encodeMemBlock(block *MemBlock) []byte {
+	data := make([]byte, 0, 13+len(block.DryTimes)*10+len(block.Undo)*18+64)
+	data = append(data, memBlockEncodingVersion)
+	data = binary.LittleEndian.AppendUint64(data, uint64(block.LastUpdated))
+	data = appendDryTimes(data, block.DryTimes)
+	data = appendUndo(data, block.Undo, block.Fine != nil)
+	var fine []byte
+	if block.Fine != nil {
+		fine = packPixels(block.Fine)
+	}
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(fine)))
+	data = append(data, fine...)
+	return append(data, packPixels(block.Pixels)...)
+}
+
+// ---------------------------------------------------------------------------------------
+func decodeMemBlock(data []byte) (*MemBlock, error) {
+	if len(data) < 1 {
+		return nil, ErrBadBlockData
+	}
+
+	switch data[0] {
+	case 1:
+		if len(data) < 9 {
+			return nil, ErrBadBlockData
+		}
+		pixels, err := decodePixelData(data[9:])
+		if err != nil {
+			return nil, err
+		}
+		dryTime := UnixMillis(binary.LittleEndian.Uint64(data[1:]))
+		block := &MemBlock{
+			Pixels:   pixels,
+			DryTimes: legacyDryTimes(pixels, dryTime),
+		}
+		block.updateDryTimeRange()
+		return block, nil
+
+	case 2, 3, 4, 5, memBlockEncodingVersion:
+		offset := 1
+		var lastUpdated UnixMillis
+		if data[0] >= 3 {
+			if len(data) < 9 {
+				return nil, ErrBadBlockData
+			}
+			lastUpdated = UnixMillis(binary.LittleEndian.Uint64(data[1:]))
+			offset = 9
+		}
+		dryTimes, size, err := decodeDryTimes(data[offset:])
+		if err != nil {
+			return nil, err
+		}
+		offset += size
+		var undo map[uint16]PixelUndo
+		if data[0] >= 5 {
+			if undo, size, err = decodeUndo(data[offset:]); err != nil {
+				return nil, err
+			}
+			offset += size
+		}
+		var fine []Pixel
+		if data[0] >= 6 {
+			if len(data) < offset+4 {
+				return nil, ErrBadBlockData
+			}
+			length := int(binary.LittleEndian.Uint32(data[offset:]))
+			offset += 4
+			if len(data) < offset+length {
+				return nil, ErrBadBlockData
+			}
+			if length > 0 {
+				if fine, err = unpackPixels(data[offset : offset+length]); err != nil {
+					return nil, err
+				}
+			}
+			offset += length
+		}
+		var pixels []Pixel
+		if data[0] >= 4 {
+			pixels, err = unpackPixels(data[offset:])
+		} else {
+			pixels, err = decodePixelData(data[offset:])
+		}
+		if err != nil {
+			return nil, err
+		}
+		block := &MemBlock{
+			Pixels:      pixels,
+			Fine:        fine,
+			DryTimes:    dryTimes,
+			Undo:        undo,
+			LastUpdated: lastUpdated,
+		}
+		block.updateDryTimeRange()
+		return block, nil
+	}
+
+	return nil, ErrBadBlockData
+}
@@ -0,0 +1,255 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestMemBlockEncoding(t *testing.T) {
+	block := &MemBlock{
+		Pixels:       make([]Pixel, 64*64),
+		DryTimes:     map[uint16]UnixMillis{5: 1000, 4095: 2000, 0: 3000},
+		FirstDryTime: 1000,
+		LastDryTime:  3000,
+		Undo:         map[uint16]PixelUndo{0: {Pixel: PIXEL_SET | 0x0F000000, DryTime: 900}, 4095: {}},
+		LastUpdated:  500,
+	}
+	block.Pixels[0] = 0x80ABC123
+	block.Pixels[4095] = 0x80000FFF
+
+	data := encodeMemBlock(block)
+	// Each wet pixel takes 10 bytes and each undo state 14. A 12-bit block has no fine
+	// pixels. The pixels are three colors, so they're packed in a palette.
+	assert.Equal(t, byte(pixelEncodingPalette), data[1+8+2+3*10+2+2*14+4])
+	assert.Len(t, data, 1+8+2+3*10+2+2*14+4+len(packPixels(block.Pixels)))
+
+	decoded, err := decodeMemBlock(data)
+	assert.NoError(t, err)
+	assert.Equal(t, block, decoded)
+
+	// Dry blocks don't store any deadlines or undo states.
+	block.DryTimes = nil
+	block.FirstDryTime, block.LastDryTime = 0, 0
+	block.Undo = nil
+	data = encodeMemBlock(block)
+	assert.Len(t, data, 1+8+2+2+4+len(packPixels(block.Pixels)))
+	decoded, err = decodeMemBlock(data)
+	assert.NoError(t, err)
+	assert.Equal(t, block, decoded)
+
+	// 24-bit blocks have the fine pixels, and undo states with the fine pixel take 18.
+	block.upgrade()
+	block.Undo = map[uint16]PixelUndo{0: {Pixel: PIXEL_SET, Fine: 0x0ABC0000, DryTime: 900}}
+	block.Fine[4095] = 0x00000123
+	data = encodeMemBlock(block)
+	assert.Len(t, data, 1+8+2+2+18+4+len(packPixels(block.Fine))+len(packPixels(block.Pixels)))
+	decoded, err = decodeMemBlock(data)
+	assert.NoError(t, err)
+	assert.Equal(t, block, decoded)
+	block.Fine = nil
+	block.Undo = nil
+	data = encodeMemBlock(block)
+
+	// Truncated or corrupted data is rejected.
+	_, err = decodeMemBlock(data[:20])
+	assert.ErrorIs(t, err, ErrBadBlockData)
+	_, err = decodeMemBlock([]byte{memBlockEncodingVersion, 0xFF, 0xFF})
+	assert.ErrorIs(t, err, ErrBadBlockData)
+	_, err = decodeMemBlock(append([]byte{memBlockEncodingVersion}, make([]byte, 8)...))
+	assert.ErrorIs(t, err, ErrBadBlockData)
+	_, err = decodeMemBlock([]byte{99})
+	assert.ErrorIs(t, err, ErrBadBlockData)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestPackPixels(t *testing.T) {
+	pixels := make([]Pixel, 64*64)
+	unpack := func(data []byte) []Pixel {
+		unpacked, err := unpackPixels(data)
+		assert.NoError(t, err)
+		return unpacked
+	}
+
+	/////////////////////////////////////////////////////////////////////////////
+	// A block of one color is just that color.
+	for i := range pixels {
+		pixels[i] = 0x0000F00F
+	}
+	data := packPixels(pixels)
+	assert.Equal(t, []byte{pixelEncodingUniform, 0x0F, 0xF0, 0, 0}, data)
+	assert.Equal(t, pixels, unpack(data))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// A few dots on top of that are a palette and runs.
+	pixels[0] = PIXEL_SET | 0x0F00000
+	pixels[100] = PIXEL_SET | 0x0F00000
+	pixels[4095] = PIXEL_SET | PIXEL_DRY | 0x00F0000
+	data = packPixels(pixels)
+	assert.Equal(t, byte(pixelEncodingPalette), data[0])
+	// Header, 3 colors, and 5 runs. The longest run takes 2 bytes for its length.
+	assert.Len(t, data, 3+3*4+5*2+1)
+	assert.Equal(t, pixels, unpack(data))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// Noise is stored raw.
+	for i := range pixels {
+		pixels[i] = Pixel(i * 7919)
+	}
+	data = packPixels(pixels)
+	assert.Equal(t, byte(pixelEncodingRaw), data[0])
+	assert.Len(t, data, 1+64*64*4)
+	assert.Equal(t, pixels, unpack(data))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// Corrupted data is rejected.
+	for _, bad := range [][]byte{
+		{},
+		{pixelEncodingUniform, 1, 2},
+		{pixelEncodingPalette, 1, 0, 1, 2, 3, 4},
+		// Index out of the palette.
+		{pixelEncodingPalette, 1, 0, 1, 2, 3, 4, 0x80, 0x20, 1},
+		// Runs past the end of the block.
+		{pixelEncodingPalette, 1, 0, 1, 2, 3, 4, 0x81, 0x20, 0},
+		// Too short.
+		{pixelEncodingPalette, 1, 0, 1, 2, 3, 4, 0xFF, 0x1F, 0},
+		// Trailing data.
+		{pixelEncodingPalette, 1, 0, 1, 2, 3, 4, 0x80, 0x20, 0, 0},
+		{pixelEncodingRaw, 1, 2, 3, 4},
+		{99},
+	} {
+		_, err := unpackPixels(bad)
+		assert.ErrorIs(t, err, ErrBadBlockData, bad)
+	}
+	assert.Equal(t, 64*64, len(unpack([]byte{pixelEncodingPalette, 1, 0, 1, 2, 3, 4, 0x80, 0x20, 0})))
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestMemBlockLegacyEncoding(t *testing.T) {
+	/////////////////////////////////////////////////////////////////////////////
+	// Version 5 blocks have no fine pixels, so they're 12-bit.
+	block := &MemBlock{
+		Pixels:       make([]Pixel, 64*64),
+		DryTimes:     map[uint16]UnixMillis{7: 1000},
+		FirstDryTime: 1000,
+		LastDryTime:  1000,
+		Undo:         map[uint16]PixelUndo{7: {Pixel: PIXEL_SET | 0x0F000000, DryTime: 500}},
+		LastUpdated:  900,
+	}
+	block.Pixels[7] = PIXEL_SET | 0x0F00000
+	data := []byte{5}
+	data = binary.LittleEndian.AppendUint64(data, 900)
+	data = append(data, encodeDryTimes(block.DryTimes)...)
+	data = append(data, encodeUndo(block.Undo, false)...)
+	data = append(data, packPixels(block.Pixels)...)
+
+	decoded, err := decodeMemBlock(data)
+	assert.NoError(t, err)
+	assert.Equal(t, block, decoded)
+
+	/////////////////////////////////////////////////////////////////////////////
+	// Version 4 blocks have no undo states.
+	block.Undo = nil
+	data = []byte{4}
+	data = binary.LittleEndian.AppendUint64(data, 900)
+	data = append(data, encodeDryTimes(block.DryTimes)...)
+	data = append(data, packPixels(block.Pixels)...)
+
+	decoded, err = decodeMemBlock(data)
+	assert.NoError(t, err)
+	assert.Equal(t, block, decoded)
+
+	/////////////////////////////////////////////////////////////////////////////
+	// Version 3 blocks have raw pixel data.
+	data = []byte{3}
+	data = binary.LittleEndian.AppendUint64(data, 900)
+	data = append(data, encodeDryTimes(block.DryTimes)...)
+	data = append(data, encodePixelData(block.Pixels)...)
+
+	decoded, err = decodeMemBlock(data)
+	assert.NoError(t, err)
+	assert.Equal(t, block, decoded)
+
+	/////////////////////////////////////////////////////////////////////////////
+	// Version 2 blocks have no LastUpdated.
+	block.LastUpdated = 0
+	data = []byte{2}
+	data = append(data, encodeDryTimes(block.DryTimes)...)
+	data = append(data, encodePixelData(block.Pixels)...)
+
+	decoded, err = decodeMemBlock(data)
+	assert.NoError(t, err)
+	assert.Equal(t, block, decoded)
+
+	/////////////////////////////////////////////////////////////////////////////
+	// Version 1 blocks had one deadline for the whole block. It is given to each
+	// wet pixel.
+	pixels := make([]Pixel, 64*64)
+	pixels[1] = PIXEL_SET | 0x00F0000
+	pixels[2] = PIXEL_SET | PIXEL_DRY | 0x00F0000
+	pixels[3] = 0x0000F00F // Inherited color only.
+
+	data = []byte{1}
+	data = binary.LittleEndian.AppendUint64(data, 12345)
+	data = append(data, encodePixelData(pixels)...)
+
+	decoded, err = decodeMemBlock(data)
+	assert.NoError(t, err)
+	assert.Equal(t, pixels, decoded.Pixels)
+	assert.Equal(t, map[uint16]UnixMillis{1: 12345}, decoded.DryTimes)
+
+	// A dry version 1 block has no deadlines.
+	data = []byte{1}
+	data = binary.LittleEndian.AppendUint64(data, 0)
+	data = append(data, encodePixelData(pixels)...)
+	decoded, err = decodeMemBlock(data)
+	assert.NoError(t, err)
+	assert.Nil(t, decoded.DryTimes)
+}
+
+// ---------------------------------------------------------------------------------------
+// A block of one inherited color with a few painted dots, the most common kind.
+func makeSparseBlockPixels() []Pixel {
+	pixels := make([]Pixel, 64*64)
+	for i := range pixels {
+		pixels[i] = 0x0000F123
+	}
+	for i := 0; i < 64*64; i += 397 {
+		pixels[i] = PIXEL_SET | PIXEL_DRY | Pixel(i)<<16
+	}
+	return pixels
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func BenchmarkPackPixels(b *testing.B) {
+	pixels := makeSparseBlockPixels()
+	b.ReportMetric(float64(len(packPixels(pixels))), "bytes")
+	for i := 0; i < b.N; i++ {
+		packPixels(pixels)
+	}
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func BenchmarkUnpackPixels(b *testing.B) {
+	data := packPixels(makeSparseBlockPixels())
+	for i := 0; i < b.N; i++ {
+		unpackPixels(data)
+	}
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func BenchmarkPackNoisyPixels(b *testing.B) {
+	pixels := make([]Pixel, 64*64)
+	for i := range pixels {
+		pixels[i] = PIXEL_SET | Pixel(i*7919)<<16
+	}
+	for i := 0; i < b.N; i++ {
+		packPixels(pixels)
+	}
+}
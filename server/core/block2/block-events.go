@@ -0,0 +1,50 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+// Repositories report changes to blocks through an event listener. Events are only
+// published after the change is saved, in the order they happened.
+//
+// The listener is called while the repository is locked, so it must return quickly and
+// must not call back into the repository.
+
+type (
+	BlockEventType int
+
+	BlockEvent struct {
+		Type BlockEventType
+		// Coordinates of the block that changed.
+		Block Coords
+		// Indexes of the pixels that changed, in ascending order.
+		Pixels []uint16
+		// New values of the pixels, in the same order.
+		Values []Pixel
+		// Low nibbles of the new values for 24-bit blocks, see Block.Fine. Nil for
+		// 12-bit blocks.
+		Fine []Pixel
+		Time UnixMillis
+	}
+
+	BlockEventListener func(event BlockEvent)
+)
+
+const (
+	// Wet pixels reached their deadline and are now dry.
+	BLOCK_EVENT_PIXELS_DRIED BlockEventType = iota + 1
+	// Pixels were painted.
+	BLOCK_EVENT_PIXELS_SET
+	// The inherited colors of pixels changed because something below them was painted.
+	BLOCK_EVENT_PIXELS_BUBBLED
+)
+
+// ---------------------------------------------------------------------------------------
+func publishBlockEvents(listener BlockEventListener, events []BlockEvent) {
+	if listener == nil {
+		return
+	}
+	for _, event := range events {
+		listener(event)
+	}
+}
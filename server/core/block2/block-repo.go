@@ -7,18 +7,66 @@ package block2
 import "errors"
 
 type (
-	Color uint16
+	Color uint32
 	Pixel uint32
 
 	Block struct {
-		Pixels      []Pixel
+		Pixels []Pixel
+		// The low nibbles of each channel for 24-bit blocks, at the same positions as in
+		// Pixels, so an 8-bit channel is the Pixels nibble followed by the Fine nibble.
+		// The flags and painted opacity are only in Pixels. Nil for 12-bit blocks.
+		Fine        []Pixel
 		LastUpdated UnixMillis
-		//DryTime int64 (should this be exposed?)
+		// When the last wet pixel in the block dries. Zero if the block is dry.
+		DryTime UnixMillis
+		// Drying deadlines of the wet pixels, by pixel index.
+		DryTimes map[uint16]UnixMillis
+	}
+
+	// One pixel of a batch paint operation.
+	PixelPaint struct {
+		Coords Coords
+		Color  Color
 	}
 
 	BlockRepo interface {
 		GetBlock(coords Coords) (*Block, error)
+
+		// Reads many blocks in one operation. The result has an entry for each of the given
+		// coordinates, in the same order, which is nil if the block doesn't exist.
+		GetBlocks(coords []Coords) ([]*Block, error)
+
+		// True if the block at the coordinates or any block up to `levels` under it
+		// exists. Bubbling can stop before reaching the top, so blocks can exist under a
+		// block that doesn't.
+		HasBlocksUnder(coords Coords, levels int) (bool, error)
+
 		SetPixel(coords Coords, color Color) error
+
+		// Paints many pixels, possibly at different depths, in one operation. Returns the
+		// result of each pixel (nil, ErrPixelIsDry or ErrMaxDepthExceeded), or an error if
+		// the operation failed as a whole, in which case nothing is changed. Pixels can be
+		// erased by painting them Transparent.
+		SetPixels(pixels []PixelPaint) ([]error, error)
+
+		// Reverts a wet pixel to what it was before it was last painted, either unset or
+		// the earlier wet color with its deadline, and bubbles the change. Only the last
+		// paint can be undone, and not an erase. Returns ErrPixelIsDry, ErrNothingToUndo
+		// or a storage error.
+		UndoPixel(coords Coords) error
+
+		// Converts every 12-bit block to 24 bits, e.g., when a canvas moves to 24-bit
+		// color. The colors don't change, but bubbling into the converted blocks is more
+		// precise from then on. Returns how many blocks were converted.
+		UpgradeColorDepth() (int, error)
+
+		// Routine function to dry pending pixels, called periodically by the core.
+		// Expired pixels are also dried whenever their block is accessed, but only this
+		// guarantees that BLOCK_EVENT_PIXELS_DRIED is published in a timely manner.
+		DryPixels() error
+
+		// Receives events for changes made by the repo.
+		SetEventListener(listener BlockEventListener)
 	}
 )
 
@@ -26,13 +74,253 @@ var (
 	ErrBadCoords     = errors.New("given coordinates are not valid")
 	ErrBlockNotFound = errors.New("block does not exist")
 	ErrPixelIsDry    = errors.New("pixel is dry")
+	ErrNothingToUndo = errors.New("pixel has nothing to undo")
 
-	// How long in seconds it takes for each level to dry (max is on the right).
+	// How long in seconds it takes for each level to dry (max is on the right). This is
+	// the table used by DefaultDryingPolicy.
 	DEFAULT_DRY_TIME = []int{0, 15, 30, 60, 150, 300, 600}
 )
 
+// Painting a pixel Transparent erases it. The painted color is cleared, so only the
+// inherited color shows, and the pixel can be painted again by anyone like it was never
+// painted. Erasing a pixel that isn't painted changes nothing. Outside the 12-bit range
+// of the painted colors.
+const Transparent Color = 0x1000
+
+// Painted colors can be translucent. Pixels only have two bits left for it, so a color
+// has one of four opacities, from opaque (zero, like all colors before) down to nearly
+// clear. The level is in bits 13-14 of a Color and bits 28-29 of a Pixel.
+const colorOpacityShift = 13
+
+// The 4-bit alpha of each opacity level.
+var paintedAlphas = [4]int{15, 11, 7, 3}
+
+// Colors with this flag are 24-bit, 0xBBGGRR, with the opacity level in bits 24-25.
+// Painting one into a 12-bit block converts the block to 24 bits first, and bubbling
+// from a 24-bit block does the same to the blocks above it, so a block only stays 12-bit
+// while everything under it is.
+const (
+	colorDeep             Color = 0x80000000
+	deepColorOpacityShift       = 24
+)
+
+// ---------------------------------------------------------------------------------------
+// Returns the 12-bit color with the opacity closest to the 4-bit alpha. Zero alpha is
+// Transparent.
+func ColorWithAlpha(rgb Color, alpha int) Color {
+	if alpha <= 0 {
+		return Transparent
+	}
+	return rgb&0xFFF | Color(opacityLevel(alpha, 1))<<colorOpacityShift
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the 24-bit color with the opacity closest to the 8-bit alpha. Zero alpha is
+// Transparent.
+func Color24WithAlpha(rgb uint32, alpha int) Color {
+	if alpha <= 0 {
+		return Transparent
+	}
+	return colorDeep | Color(rgb&0xFFFFFF) | Color(opacityLevel(alpha, 17))<<deepColorOpacityShift
+}
+
+// ---------------------------------------------------------------------------------------
+// The opacity level closest to the alpha, which is 4-bit scaled by `scale`.
+func opacityLevel(alpha int, scale int) int {
+	level := 0
+	for i, levelAlpha := range paintedAlphas {
+		if abs(levelAlpha*scale-alpha) < abs(paintedAlphas[level]*scale-alpha) {
+			level = i
+		}
+	}
+	return level
+}
+
+// ---------------------------------------------------------------------------------------
+func abs(value int) int {
+	return max(value, -value)
+}
+
+// ---------------------------------------------------------------------------------------
+// True for 24-bit colors.
+func (c Color) IsDeep() bool {
+	return c&colorDeep != 0
+}
+
+// ---------------------------------------------------------------------------------------
+func (c Color) opacity() int {
+	if c.IsDeep() {
+		return int(c>>deepColorOpacityShift) & 3
+	}
+	return int(c>>colorOpacityShift) & 3
+}
+
+// ---------------------------------------------------------------------------------------
+// The 12-bit color without the opacity. 24-bit colors are rounded to the nearest one.
+func (c Color) RGB() Color {
+	if c.IsDeep() {
+		rgb := c.RGB24()
+		return Color(quantize8(rgb) | quantize8(rgb>>8)<<4 | quantize8(rgb>>16)<<8)
+	}
+	return c & 0xFFF
+}
+
+// ---------------------------------------------------------------------------------------
+// The 24-bit color without the opacity. 12-bit colors are expanded, 0xF to 0xFF.
+func (c Color) RGB24() uint32 {
+	if c.IsDeep() {
+		return uint32(c & 0xFFFFFF)
+	}
+	return uint32(c&0xF)*0x11 | uint32(c>>4&0xF)*0x11<<8 | uint32(c>>8&0xF)*0x11<<16
+}
+
+// ---------------------------------------------------------------------------------------
+// Rounds the low byte to 4 bits.
+func quantize8(value uint32) uint32 {
+	return ((value&0xFF)*15 + 127) / 255
+}
+
+// ---------------------------------------------------------------------------------------
+// The 4-bit alpha of the color. Zero for Transparent.
+func (c Color) Alpha() int {
+	if c == Transparent {
+		return 0
+	}
+	return paintedAlphas[c.opacity()]
+}
+
+// ---------------------------------------------------------------------------------------
+// The closest 12-bit color with the same opacity. 12-bit colors are returned as is.
+func (c Color) To12() Color {
+	if !c.IsDeep() {
+		return c
+	}
+	return c.RGB() | Color(c.opacity())<<colorOpacityShift
+}
+
+// ---------------------------------------------------------------------------------------
+// The red, green and blue of the color at the precision of a 12-bit or 24-bit block.
+func (c Color) channels(deep bool) [3]int {
+	if deep {
+		rgb := c.RGB24()
+		return [3]int{int(rgb & 0xFF), int(rgb >> 8 & 0xFF), int(rgb >> 16 & 0xFF)}
+	}
+	rgb := c.RGB()
+	return [3]int{int(rgb & 0xF), int(rgb >> 4 & 0xF), int(rgb >> 8 & 0xF)}
+}
+
+// ---------------------------------------------------------------------------------------
+// The painted color of the pixel, with its opacity. For 24-bit blocks, this is the high
+// nibbles only; see Block.PaintedColor.
+func (p Pixel) PaintedColor() Color {
+	return Color(p>>16&0xFFF) | Color(p>>28&3)<<colorOpacityShift
+}
+
+// ---------------------------------------------------------------------------------------
+// The 4-bit alpha of the painted color.
+func (p Pixel) PaintedAlpha() int {
+	return paintedAlphas[p>>28&3]
+}
+
 const (
 	// Pixel flags.
 	PIXEL_SET Pixel = 0x80000000
 	PIXEL_DRY Pixel = 0x40000000
 )
+
+// ---------------------------------------------------------------------------------------
+// True if painting the pixel is rejected with ErrPixelIsDry. Besides dry pixels, that
+// includes pixels completely covered by the level below. For 24-bit blocks, see
+// Block.IsPixelDry.
+func (p Pixel) IsDry() bool {
+	return p&PIXEL_DRY != 0 || p&0xF000 == 0xF000
+}
+
+// ---------------------------------------------------------------------------------------
+// The colors of a pixel at the precision of its block, 4 bits per channel for 12-bit
+// blocks and 8 bits for 24-bit blocks.
+type PixelChannels struct {
+	// Red, green and blue of the painted color, and its alpha. All zero if the pixel
+	// isn't painted.
+	Painted      [3]int
+	PaintedAlpha int
+	// Red, green and blue of the color inherited from the level below, and its alpha.
+	Inherited [3]int
+	Alpha     int
+	// A full channel, 15 or 255.
+	Max int
+}
+
+// ---------------------------------------------------------------------------------------
+// Reads a pixel of a block, where fine is nil for 12-bit blocks.
+func readChannels(pixels []Pixel, fine []Pixel, index int) PixelChannels {
+	channel := func(shift int) int {
+		value := int(pixels[index]>>shift) & 0xF
+		if fine != nil {
+			value = value<<4 | int(fine[index]>>shift)&0xF
+		}
+		return value
+	}
+
+	result := PixelChannels{
+		Inherited: [3]int{channel(0), channel(4), channel(8)},
+		Alpha:     channel(12),
+		Max:       15,
+	}
+	if fine != nil {
+		result.Max = 255
+	}
+	if pixels[index]&PIXEL_SET != 0 {
+		result.Painted = [3]int{channel(16), channel(20), channel(24)}
+		result.PaintedAlpha = pixels[index].PaintedAlpha() * (result.Max / 15)
+	}
+	return result
+}
+
+// ---------------------------------------------------------------------------------------
+// Splits channel values into consecutive nibbles, the high nibbles for Pixels and the
+// low nibbles for Fine. The low nibbles are zero when deep is false, since the values
+// are already 4-bit.
+func packChannels(values []int, deep bool) (Pixel, Pixel) {
+	var high, low Pixel
+	for i, value := range values {
+		if deep {
+			high |= Pixel(value>>4) << (i * 4)
+			low |= Pixel(value&0xF) << (i * 4)
+		} else {
+			high |= Pixel(value) << (i * 4)
+		}
+	}
+	return high, low
+}
+
+// ---------------------------------------------------------------------------------------
+func isPixelDry(pixels []Pixel, fine []Pixel, index int) bool {
+	if fine == nil {
+		return pixels[index].IsDry()
+	}
+	channels := readChannels(pixels, fine, index)
+	return pixels[index]&PIXEL_DRY != 0 || channels.Alpha == channels.Max
+}
+
+// ---------------------------------------------------------------------------------------
+func (b *Block) Channels(index int) PixelChannels {
+	return readChannels(b.Pixels, b.Fine, index)
+}
+
+// ---------------------------------------------------------------------------------------
+// Pixel.IsDry for any block.
+func (b *Block) IsPixelDry(index int) bool {
+	return isPixelDry(b.Pixels, b.Fine, index)
+}
+
+// ---------------------------------------------------------------------------------------
+// The painted color of a pixel, with its opacity. 24-bit for 24-bit blocks.
+func (b *Block) PaintedColor(index int) Color {
+	if b.Fine == nil {
+		return b.Pixels[index].PaintedColor()
+	}
+	painted := b.Channels(index).Painted
+	return colorDeep | Color(painted[0]|painted[1]<<8|painted[2]<<16) |
+		Color(b.Pixels[index]>>28&3)<<deepColorOpacityShift
+}
@@ -0,0 +1,1056 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mukunda.com/nanopaint/core/clock"
+)
+
+// Behavioral tests shared by all BlockRepo implementations. Each implementation's test
+// file runs the suite with its own factory.
+
+type blockRepoFactory func(t *testing.T, cs ClockService) BlockRepo
+
+type maxDepthSetter interface {
+	SetMaxDepth(depth int)
+}
+
+type dryingPolicySetter interface {
+	SetDryingPolicy(policy *DryingPolicy)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func mixColors(colors ...Color) Color {
+	var r, g, b int
+	for _, color := range colors {
+		r += int(color & 0xF)
+		g += int((color >> 4) & 0xF)
+		b += int((color >> 8) & 0xF)
+	}
+
+	total := len(colors)
+	r = (r + (total / 2)) / total
+	g = (g + (total / 2)) / total
+	b = (b + (total / 2)) / total
+
+	return Color((b << 8) | (g << 4) | r)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testBlockRepoBubbling(t *testing.T, createRepo blockRepoFactory) {
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	repo := createRepo(t, clock)
+
+	//
+	// When a pixel is set, the color bubbles into the upper layers.
+	//
+
+	// The following tests have three stages:
+	// (1) Setting and verifying the pixel is set.
+	// (2) Verifying the upper layers. The color is blended and applied to the upper layers.
+	// (3) Verifying termination of the bubbling process. Blocks are not created when the alpha diminishes to zero.
+
+	// Base coords = arbitrarily deep location
+	baseCoords := coordsFromBits("0000 0000 0000 0000 0000 10", "0000 0000 0000 0000 0000 10")
+	coords1 := baseCoords.Down(0, 0)
+	coords2 := baseCoords.Down(0, 1)
+	coords3 := baseCoords.Down(1, 0)
+	coords4 := baseCoords.Down(1, 1)
+
+	blue := Color(0xF00)
+	red := Color(0x00F)
+
+	/////////////////////////////////////////////////////////////////
+	// (1.1) Setting 1 pixel
+	assert.NoError(t, repo.SetPixel(coords1, blue))
+	block, err := repo.GetBlock(coords1.ParentOfPixel())
+	assert.NoError(t, err)
+	assert.EqualValues(t, Pixel(int(blue)<<16)|PIXEL_SET, block.Pixels[coords1.PixelIndex()])
+
+	// Note that it doesn't matter which coords we call Up(1)
+	// on. They all go up to the same parent.
+	// (1.2) Checking color of upper layer
+	block, err = repo.GetBlock(coords1.Up(1).ParentOfPixel())
+	assert.NoError(t, err)
+	assert.EqualValues(t, Pixel(blue)|(3<<12), block.Pixels[coords1.Up(1).PixelIndex()])
+
+	// (1.3) termination
+	block, err = repo.GetBlock(coords1.Up(2).ParentOfPixel())
+	assert.Error(t, ErrBlockNotFound, err) // Bubble stops since alpha is zero.
+	assert.Nil(t, block)
+
+	/////////////////////////////////////////////////////////////////
+	// (2.1) Setting 2 pixels - increases alpha of upper layers.
+	repo.SetPixel(coords2, blue)
+	block, err = repo.GetBlock(coords2.ParentOfPixel())
+	assert.NoError(t, err)
+	assert.EqualValues(t, Pixel(int(blue)<<16)|PIXEL_SET, block.Pixels[coords2.PixelIndex()])
+
+	// (2.2) Alpha is increased to half since 2/4 pixels are set.
+	block, err = repo.GetBlock(coords2.Up(1).ParentOfPixel())
+	assert.NoError(t, err)
+	assert.EqualValues(t, Pixel(blue)|(7<<12), block.Pixels[coords2.Up(1).PixelIndex()])
+
+	// (2.2) Another layer is affected since alpha hasn't reached zero yet.
+	// 15\2 = 7, 7\4 = 1
+	block, err = repo.GetBlock(coords2.Up(2).ParentOfPixel())
+	assert.NoError(t, err)
+	assert.EqualValues(t, Pixel(blue)|(1<<12), block.Pixels[coords2.Up(2).PixelIndex()])
+
+	// (2.3) Termination
+	block, err = repo.GetBlock(coords2.Up(3).ParentOfPixel())
+	assert.Error(t, ErrBlockNotFound, err) // Bubble stops since alpha is zero.
+	assert.Nil(t, block)
+
+	/////////////////////////////////////////////////////////////////
+	// (3.1) Setting 3 pixels
+	repo.SetPixel(coords3, red)
+	block, err = repo.GetBlock(coords3.ParentOfPixel())
+	assert.NoError(t, err)
+	assert.EqualValues(t, Pixel(int(red)<<16)|PIXEL_SET, block.Pixels[coords3.PixelIndex()])
+
+	// (3.2) Upper layer 1, color is mixed: 2 blues + 1 red
+	block, err = repo.GetBlock(coords3.Up(1).ParentOfPixel())
+	assert.NoError(t, err)
+	mixed := mixColors(red, blue, blue)
+	assert.EqualValues(t, Pixel(mixed)|(11<<12), block.Pixels[coords3.Up(1).PixelIndex()])
+
+	// (3.2) Upper layer 2
+	block, err = repo.GetBlock(coords3.Up(2).ParentOfPixel())
+	assert.NoError(t, err)
+	assert.EqualValues(t, Pixel(mixed)|(2<<12), block.Pixels[coords3.Up(2).PixelIndex()])
+
+	// (3.3) Termination past layer 2
+	block, err = repo.GetBlock(coords3.Up(3).ParentOfPixel())
+	assert.Error(t, ErrBlockNotFound, err)
+	assert.Nil(t, block)
+
+	/////////////////////////////////////////////////////////////////
+	// (4.1) And 4 pixels. This will be red*2 + blue*2 (mixed evenly)
+	repo.SetPixel(coords4, red)
+	block, err = repo.GetBlock(coords4.ParentOfPixel())
+	assert.NoError(t, err)
+	assert.EqualValues(t, Pixel(int(red)<<16)|PIXEL_SET, block.Pixels[coords4.PixelIndex()])
+
+	// (4.2) upper layer, color is mixed evenly
+	block, err = repo.GetBlock(coords4.Up(1).ParentOfPixel())
+	assert.NoError(t, err)
+	mixed = mixColors(red, blue)
+	// expect full alpha on upper pixel.
+	assert.EqualValues(t, Pixel(mixed)|(15<<12), block.Pixels[coords4.Up(1).PixelIndex()])
+
+	// (4.3) upper layer 2, alpha = 15\4
+	block, err = repo.GetBlock(coords4.Up(2).ParentOfPixel())
+	assert.NoError(t, err)
+	assert.EqualValues(t, Pixel(mixed)|(3<<12), block.Pixels[coords4.Up(2).PixelIndex()])
+
+	// (4.4) termination
+	block, err = repo.GetBlock(coords4.Up(3).ParentOfPixel())
+	assert.Error(t, ErrBlockNotFound, err)
+	assert.Nil(t, block)
+
+}
+
+func getPixel(repo BlockRepo, coords Coords) (Pixel, error) {
+	block, err := repo.GetBlock(coords.ParentOfPixel())
+	if err != nil {
+		return 0, err
+	}
+	return block.Pixels[coords.PixelIndex()], nil
+}
+
+func digCoords(coords Coords, x, y, bits int) Coords {
+	for i := bits - 1; i >= 0; i-- {
+		coords = coords.Down(uint8((x>>i)&1), uint8((y>>i)&1))
+	}
+	return coords
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testBlockRepoBubble2(t *testing.T, createRepo blockRepoFactory, size int) {
+
+	// For this test, we're generating a random image and then painting it at 8x resolution.
+	// Then we read the data from the upper layers at a smaller scale to verify that the
+	// pixels are bubbled and shrunk accordingly.
+	// No complex blending testing here, just 1:1 pixel replication.
+	//
+	// The image is size*size. Every pixel is its own paint operation, which is a
+	// transaction for the persistent repos, so they use a smaller image.
+
+	pixelData := make([]Color, size*size)
+	for i := range pixelData {
+		pixelData[i] = Color(rand.Intn(0x1000))
+	}
+
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	repo := createRepo(t, clock)
+
+	// Some random and deep coordinate.
+	baseCoords := coordsFromBits(fmt.Sprintf("%020b", rand.Intn(1<<20)), fmt.Sprintf("%020b", rand.Intn(1<<20)))
+
+	// Paint the random pixels at x4 scale.
+	for x := 0; x < size; x++ {
+		for y := 0; y < size; y++ {
+			for px := 0; px < 4; px++ {
+				for py := 0; py < 4; py++ {
+					pcoords := digCoords(baseCoords, x, y, 7)
+					pcoords = digCoords(pcoords, px, py, 2)
+					repo.SetPixel(pcoords, pixelData[x+y*size])
+				}
+			}
+		}
+	}
+
+	// Then verify at higher levels that the image is the same.
+	for x := 0; x < size; x++ {
+		for y := 0; y < size; y++ {
+
+			// Up 1 levels
+			for px := 0; px < 2; px++ {
+				for py := 0; py < 2; py++ {
+					pcoords := digCoords(baseCoords, x, y, 7)
+					pcoords = digCoords(pcoords, px, py, 1)
+					pixel, err := getPixel(repo, pcoords)
+					assert.NoError(t, err)
+					assert.EqualValues(t, pixelData[x+y*size]|0xF000, pixel&0xFFFF)
+				}
+			}
+
+			// Up 2 levels
+			pcoords := digCoords(baseCoords, x, y, 7)
+			pixel, err := getPixel(repo, pcoords)
+			assert.NoError(t, err)
+			assert.EqualValues(t, pixelData[x+y*size]|0xF000, pixel&0xFFFF)
+
+		}
+	}
+
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testBlockRepoBubble3(t *testing.T, createRepo blockRepoFactory) {
+
+	// For this experiment we'll have 3 layers.
+	// (1) Set layer 3 to 2/4 pixels of red.
+	// (2) Set layer 2 pixel to blue.
+	// (3) Verify that layer 1 contains red and blue mixed evenly at 1/4 alpha.
+	//
+	// Layer 3 will blend layer 2 halfway towards red with the 2/4 pixels set, and that
+	// bubbles into layer 1 with 1/4 alpha.
+
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	repo := createRepo(t, clock)
+
+	repo.SetPixel(coordsFromBits("00000000 00", "00000000 00"), Color(0x00F))
+	repo.SetPixel(coordsFromBits("00000000 01", "00000000 01"), Color(0x00F))
+
+	repo.SetPixel(coordsFromBits("00000000 0", "00000000 0"), Color(0xF00))
+
+	pixel, err := getPixel(repo, coordsFromBits("00000000", "00000000"))
+	assert.NoError(t, err)
+
+	// This is a messy test since it depends on rounding errors.
+	// In the future we might change the alpha channel to have an exact middle?
+	assert.EqualValues(t, Pixel(0x00003807), pixel&0xFFFF)
+
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testBlockRepoDrying(t *testing.T, createRepo blockRepoFactory) {
+
+	//////////////////////////////////////////////////////////////////////////
+	// After a set time period, set pixels will "dry" and cannot be repainted.
+
+	{
+		clock := clock.CreateTestClockService().(*clock.TestClockService)
+		repo := createRepo(t, clock)
+
+		clock.Advance(time.Hour)
+		repo.SetPixel(coordsFromBits("00000000 00", "00000000 00"), Color(0x00F))
+		clock.Advance(time.Hour)
+		err := repo.SetPixel(coordsFromBits("00000000 00", "00000000 00"), Color(0x00F))
+		assert.ErrorIs(t, err, ErrPixelIsDry)
+	}
+
+	// In addition, covered pixels cannot be repainted. "Covered" is a state when the
+	// pixel is overwritten completely by lower layers (inherited alpha = 15/15).
+	// This is also treated as a "dry" error, even though it is not from any time period.
+
+	{
+		clock := clock.CreateTestClockService().(*clock.TestClockService)
+		repo := createRepo(t, clock)
+
+		clock.Advance(time.Hour)
+		repo.SetPixel(coordsFromBits("00000000 000", "00000000 000"), Color(0x00F))
+		repo.SetPixel(coordsFromBits("00000000 001", "00000000 000"), Color(0x00F))
+		repo.SetPixel(coordsFromBits("00000000 000", "00000000 001"), Color(0x00F))
+		repo.SetPixel(coordsFromBits("00000000 001", "00000000 001"), Color(0x00F))
+		err := repo.SetPixel(coordsFromBits("00000000 00", "00000000 00"), Color(0x00F))
+		assert.ErrorIs(t, err, ErrPixelIsDry)
+	}
+
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testBlockRepoPixelDrying(t *testing.T, createRepo blockRepoFactory) {
+	//////////////////////////////////////////////////////////////////////////////
+	// Each pixel dries on its own deadline. Painting a pixel doesn't keep the
+	// other wet pixels in the block from drying.
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	repo := createRepo(t, clock)
+	repo.(dryingPolicySetter).SetDryingPolicy(&DryingPolicy{Table: []int{0, 10}})
+
+	first := coordsFromBits("000000", "000000")
+	second := coordsFromBits("000001", "000000")
+	start := clock.Now().UnixMilli()
+
+	assert.NoError(t, repo.SetPixel(first, Color(0x00F)))
+	clock.Advance(6 * time.Second)
+	assert.NoError(t, repo.SetPixel(second, Color(0x00F)))
+
+	block, err := repo.GetBlock(first.ParentOfPixel())
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint16]UnixMillis{
+		uint16(first.PixelIndex()):  start + 10000,
+		uint16(second.PixelIndex()): start + 16000,
+	}, block.DryTimes)
+	assert.Equal(t, start+16000, block.DryTime)
+	read := block
+
+	clock.Advance(6 * time.Second)
+	assert.ErrorIs(t, repo.SetPixel(first, Color(0x0F0)), ErrPixelIsDry)
+	assert.NoError(t, repo.SetPixel(second, Color(0x0F0)))
+
+	block, err = repo.GetBlock(first.ParentOfPixel())
+	assert.NoError(t, err)
+	assert.NotZero(t, block.Pixels[first.PixelIndex()]&PIXEL_DRY)
+	assert.Zero(t, block.Pixels[second.PixelIndex()]&PIXEL_DRY)
+	assert.Equal(t, map[uint16]UnixMillis{
+		uint16(second.PixelIndex()): start + 22000,
+	}, block.DryTimes)
+
+	// Blocks that were read aren't changed by later paints.
+	assert.Len(t, read.DryTimes, 2)
+
+	//////////////////////////////////////////////////////////////////////////////
+	// Once everything is dry, no deadlines are left.
+	clock.Advance(time.Hour)
+	block, err = repo.GetBlock(first.ParentOfPixel())
+	assert.NoError(t, err)
+	assert.Empty(t, block.DryTimes)
+	assert.Zero(t, block.DryTime)
+	assert.NotZero(t, block.Pixels[second.PixelIndex()]&PIXEL_DRY)
+
+	//////////////////////////////////////////////////////////////////////////////
+	// The block dries later again when the latest wet pixel is undone or erased.
+	third := coordsFromBits("000000", "000001")
+	fourth := coordsFromBits("000001", "000001")
+	start = clock.Now().UnixMilli()
+	dryTime := func() UnixMillis {
+		block, err := repo.GetBlock(third.ParentOfPixel())
+		assert.NoError(t, err)
+		return block.DryTime
+	}
+
+	assert.NoError(t, repo.SetPixel(third, Color(0x00F)))
+	clock.Advance(6 * time.Second)
+	assert.NoError(t, repo.SetPixel(fourth, Color(0x00F)))
+	assert.Equal(t, start+16000, dryTime())
+	assert.NoError(t, repo.UndoPixel(fourth))
+	assert.Equal(t, start+10000, dryTime())
+	assert.NoError(t, repo.SetPixel(fourth, Color(0x00F)))
+	assert.NoError(t, repo.SetPixel(fourth, Transparent))
+	assert.Equal(t, start+10000, dryTime())
+	clock.Advance(4 * time.Second)
+	assert.Zero(t, dryTime())
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testBlockRepoDryPixels(t *testing.T, createRepo blockRepoFactory) {
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	repo := createRepo(t, clock)
+	repo.(dryingPolicySetter).SetDryingPolicy(&DryingPolicy{Table: []int{0, 10}})
+
+	var events []BlockEvent
+	repo.SetEventListener(func(event BlockEvent) {
+		if event.Type == BLOCK_EVENT_PIXELS_DRIED {
+			events = append(events, event)
+		}
+	})
+
+	a1 := coordsFromBits("0 000011", "0 000000")
+	a2 := coordsFromBits("0 000001", "0 000000")
+	b1 := coordsFromBits("1 000000", "1 000000")
+	assert.NoError(t, repo.SetPixel(a1, Color(0x00F)))
+	assert.NoError(t, repo.SetPixel(a2, Color(0x00F)))
+	clock.Advance(5 * time.Second)
+	assert.NoError(t, repo.SetPixel(b1, Color(0x00F)))
+
+	//////////////////////////////////////////////////////////////////////////
+	// Nothing happens before a deadline.
+	assert.NoError(t, repo.DryPixels())
+	assert.Empty(t, events)
+
+	//////////////////////////////////////////////////////////////////////////
+	// DryPixels dries the expired pixels and publishes an event for each block.
+	clock.Advance(5 * time.Second)
+	assert.NoError(t, repo.DryPixels())
+	assert.Equal(t, []BlockEvent{{
+		Type:   BLOCK_EVENT_PIXELS_DRIED,
+		Block:  a1.ParentOfPixel(),
+		Pixels: []uint16{uint16(a2.PixelIndex()), uint16(a1.PixelIndex())},
+		Values: []Pixel{0x00F<<16 | PIXEL_SET | PIXEL_DRY, 0x00F<<16 | PIXEL_SET | PIXEL_DRY},
+		Time:   clock.Now().UnixMilli(),
+	}}, events)
+
+	clock.Advance(5 * time.Second)
+	assert.NoError(t, repo.DryPixels())
+	assert.Len(t, events, 2)
+	assert.Equal(t, b1.ParentOfPixel(), events[1].Block)
+	assert.Equal(t, []uint16{uint16(b1.PixelIndex())}, events[1].Pixels)
+
+	// Pixels only dry once.
+	clock.Advance(time.Hour)
+	assert.NoError(t, repo.DryPixels())
+	assert.Len(t, events, 2)
+
+	block, err := repo.GetBlock(a1.ParentOfPixel())
+	assert.NoError(t, err)
+	assert.NotZero(t, block.Pixels[a1.PixelIndex()]&PIXEL_DRY)
+	assert.NotZero(t, block.Pixels[a2.PixelIndex()]&PIXEL_DRY)
+	assert.Empty(t, block.DryTimes)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testBlockRepoPaintEvents(t *testing.T, createRepo blockRepoFactory) {
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	repo := createRepo(t, clock)
+
+	var events []BlockEvent
+	repo.SetEventListener(func(event BlockEvent) {
+		events = append(events, event)
+	})
+
+	//////////////////////////////////////////////////////////////////////////
+	// A batch publishes one event per block for the painted pixels, then one per
+	// block for the bubbled colors, deepest first.
+	p1 := coordsFromBits("1 000011", "0 000000")
+	p2 := coordsFromBits("1 000010", "0 000000")
+	deep := coordsFromBits("11 000000", "00 000000")
+	results, err := repo.SetPixels([]PixelPaint{
+		{p1, Color(0x00F)},
+		{deep, Color(0x0F0)},
+		{p2, Color(0xF00)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []error{nil, nil, nil}, results)
+
+	now := clock.Now().UnixMilli()
+	block, err := repo.GetBlock(p1.ParentOfPixel())
+	assert.NoError(t, err)
+	top, err := repo.GetBlock(MakeEmptyCoords())
+	assert.NoError(t, err)
+
+	// The deep pixel is too faint to bubble past the first level.
+	deepBubble := deep.Up(1)
+	topBubble := p1.Up(1)
+	assert.Equal(t, []BlockEvent{{
+		Type:   BLOCK_EVENT_PIXELS_SET,
+		Block:  deep.ParentOfPixel(),
+		Pixels: []uint16{0},
+		Values: []Pixel{0x0F0<<16 | PIXEL_SET},
+		Time:   now,
+	}, {
+		Type:   BLOCK_EVENT_PIXELS_SET,
+		Block:  p1.ParentOfPixel(),
+		Pixels: []uint16{uint16(p2.PixelIndex()), uint16(p1.PixelIndex())},
+		Values: []Pixel{block.Pixels[p2.PixelIndex()], block.Pixels[p1.PixelIndex()]},
+		Time:   now,
+	}, {
+		Type:   BLOCK_EVENT_PIXELS_BUBBLED,
+		Block:  p1.ParentOfPixel(),
+		Pixels: []uint16{uint16(deepBubble.PixelIndex())},
+		Values: []Pixel{block.Pixels[deepBubble.PixelIndex()]},
+		Time:   now,
+	}, {
+		Type:   BLOCK_EVENT_PIXELS_BUBBLED,
+		Block:  MakeEmptyCoords(),
+		Pixels: []uint16{uint16(topBubble.PixelIndex())},
+		Values: []Pixel{top.Pixels[topBubble.PixelIndex()]},
+		Time:   now,
+	}}, events)
+
+	//////////////////////////////////////////////////////////////////////////
+	// Rejected pixels don't publish anything.
+	events = nil
+	clock.Advance(time.Hour)
+	assert.NoError(t, repo.DryPixels())
+	events = nil
+	assert.ErrorIs(t, repo.SetPixel(p1, Color(0xFFF)), ErrPixelIsDry)
+	assert.Empty(t, events)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testBlockRepoLastUpdated(t *testing.T, createRepo blockRepoFactory) {
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	repo := createRepo(t, clock)
+	repo.(dryingPolicySetter).SetDryingPolicy(&DryingPolicy{Table: []int{0, 10}})
+
+	lastUpdated := func(coords Coords) UnixMillis {
+		block, err := repo.GetBlock(coords)
+		assert.NoError(t, err)
+		return block.LastUpdated
+	}
+
+	//////////////////////////////////////////////////////////////////////////
+	// Painting updates the block and the blocks that the color bubbled into.
+	pixel := coordsFromBits("1 000011", "0 000000")
+	other := coordsFromBits("0 000000", "1 000000")
+	painted := clock.Now().UnixMilli()
+	assert.NoError(t, repo.SetPixel(pixel, Color(0x00F)))
+	assert.Equal(t, painted, lastUpdated(pixel.ParentOfPixel()))
+	assert.Equal(t, painted, lastUpdated(MakeEmptyCoords()))
+
+	clock.Advance(time.Second)
+	assert.NoError(t, repo.SetPixel(other, Color(0x00F)))
+	assert.Equal(t, painted, lastUpdated(pixel.ParentOfPixel()))
+	assert.Equal(t, clock.Now().UnixMilli(), lastUpdated(MakeEmptyCoords()))
+
+	//////////////////////////////////////////////////////////////////////////
+	// Drying updates the block to when the pixel dried, whether or not anything
+	// wrote the block since.
+	clock.Advance(time.Hour)
+	assert.Equal(t, painted+10_000, lastUpdated(pixel.ParentOfPixel()))
+	assert.NoError(t, repo.DryPixels())
+	assert.Equal(t, painted+10_000, lastUpdated(pixel.ParentOfPixel()))
+
+	blocks, err := repo.GetBlocks([]Coords{pixel.ParentOfPixel()})
+	assert.NoError(t, err)
+	assert.Equal(t, painted+10_000, blocks[0].LastUpdated)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testBlockRepoSetPixels(t *testing.T, createRepo blockRepoFactory) {
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+
+	////////////////////////////////////////////////////////////////////////////
+	// A batch at mixed depths ends with the same tree as painting each pixel on
+	// its own.
+	var pixels []PixelPaint
+	base := coordsFromBits("0110", "1010")
+	for i := 0; i < 200; i++ {
+		depth := 6 + rand.Intn(3)
+		coords := digCoords(base, rand.Intn(1<<depth), rand.Intn(1<<depth), depth)
+		pixels = append(pixels, PixelPaint{coords, Color(rand.Intn(0x1000))})
+	}
+
+	single := createRepo(t, clock)
+	for _, pixel := range pixels {
+		err := single.SetPixel(pixel.Coords, pixel.Color)
+		if err != nil {
+			assert.ErrorIs(t, err, ErrPixelIsDry) // Covered.
+		}
+	}
+
+	batch := createRepo(t, clock)
+	results, err := batch.SetPixels(pixels)
+	assert.NoError(t, err)
+	assert.Len(t, results, len(pixels))
+
+	for _, pixel := range pixels {
+		for coords := pixel.Coords; coords.BitLength() >= 6; coords = coords.Up(1) {
+			// Faint colors stop bubbling before the top, so some ancestors may not
+			// exist in either.
+			expected, expectedErr := getPixel(single, coords)
+			actual, err := getPixel(batch, coords)
+			assert.Equal(t, expectedErr, err)
+			// Coverage is checked before the batch is bubbled, so a pixel painted
+			// after its children may be set in the batch but not when painted alone.
+			assert.Equal(t, expected&0xFFFF, actual&0xFFFF)
+		}
+	}
+
+	////////////////////////////////////////////////////////////////////////////
+	// Each pixel gets its own result, and rejected pixels don't stop the others.
+	repo := createRepo(t, clock)
+	repo.(maxDepthSetter).SetMaxDepth(4)
+	dry := coordsFromBits("000000", "000000")
+	assert.NoError(t, repo.SetPixel(dry, Color(0x00F)))
+	clock.Advance(time.Hour)
+
+	ok1 := coordsFromBits("000001", "000000")
+	ok2 := coordsFromBits("1111 000001", "1111 000000")
+	tooDeep := coordsFromBits("00000 000000", "00000 000000")
+	results, err = repo.SetPixels([]PixelPaint{
+		{ok1, Color(0x0F0)},
+		{dry, Color(0x0F0)},
+		{tooDeep, Color(0x0F0)},
+		{ok2, Color(0x0F0)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []error{nil, ErrPixelIsDry, ErrMaxDepthExceeded, nil}, results)
+
+	for _, coords := range []Coords{ok1, ok2} {
+		pixel, err := getPixel(repo, coords)
+		assert.NoError(t, err)
+		assert.EqualValues(t, Pixel(0x0F0<<16)|PIXEL_SET, pixel)
+	}
+	pixel, err := getPixel(repo, dry)
+	assert.NoError(t, err)
+	assert.EqualValues(t, Pixel(0x00F<<16)|PIXEL_SET|PIXEL_DRY, pixel)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testBlockRepoGetBlocks(t *testing.T, createRepo blockRepoFactory) {
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	repo := createRepo(t, clock)
+
+	left := coordsFromBits("0", "1")
+	right := coordsFromBits("1", "1")
+	missing := coordsFromBits("0", "0")
+	assert.NoError(t, repo.SetPixel(digCoords(left, 3, 4, 6), Color(0xF00)))
+	assert.NoError(t, repo.SetPixel(digCoords(right, 5, 6, 6), Color(0x0F0)))
+
+	////////////////////////////////////////////////////////////////////////////
+	// Each entry matches GetBlock, and missing blocks are nil.
+	request := []Coords{right, missing, MakeEmptyCoords(), left, right}
+	blocks, err := repo.GetBlocks(request)
+	assert.NoError(t, err)
+	assert.Len(t, blocks, len(request))
+	assert.Nil(t, blocks[1])
+	for i, coords := range request {
+		if blocks[i] == nil {
+			continue
+		}
+		expected, err := repo.GetBlock(coords)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, blocks[i])
+	}
+
+	////////////////////////////////////////////////////////////////////////////
+	// Expired pixels are shown dry.
+	clock.Advance(time.Hour)
+	blocks, err = repo.GetBlocks([]Coords{left})
+	assert.NoError(t, err)
+	assert.Zero(t, blocks[0].DryTime)
+	assert.EqualValues(t, Pixel(0xF00<<16)|PIXEL_SET|PIXEL_DRY, blocks[0].Pixels[3+4*64])
+
+	////////////////////////////////////////////////////////////////////////////
+	// Large requests work too.
+	request = nil
+	for i := 0; i < 1200; i++ {
+		request = append(request, digCoords(MakeEmptyCoords(), i%64, i/64, 6))
+	}
+	request = append(request, right)
+	blocks, err = repo.GetBlocks(request)
+	assert.NoError(t, err)
+	assert.Len(t, blocks, len(request))
+	assert.NotNil(t, blocks[len(blocks)-1])
+	for _, block := range blocks[:len(blocks)-1] {
+		assert.Nil(t, block)
+	}
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testBlockRepoDryingPolicy(t *testing.T, createRepo blockRepoFactory) {
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	repo := createRepo(t, clock)
+	zone := coordsFromBits("0000", "0000")
+	repo.(dryingPolicySetter).SetDryingPolicy(&DryingPolicy{
+		Curve: DRYING_CURVE_TABLE,
+		Table: []int{0, 10, 20},
+		Zones: []DryingZone{{Coords: zone, DryTime: 100}},
+	})
+
+	checkDrying := func(coords Coords, dryTime time.Duration) {
+		start := clock.Now().UnixMilli()
+		assert.NoError(t, repo.SetPixel(coords, Color(0x00F)))
+
+		//////////////////////////////////////////////////////////////////////
+		// The deadline is exposed with the block while it is wet.
+		block, err := repo.GetBlock(coords.ParentOfPixel())
+		assert.NoError(t, err)
+		assert.Equal(t, start+dryTime.Milliseconds(), block.DryTime)
+
+		clock.Advance(dryTime - time.Millisecond)
+		assert.NoError(t, repo.SetPixel(coords, Color(0x0F0)))
+
+		// Repainting pushes the deadline back, so wait it out from here.
+		clock.Advance(dryTime)
+		assert.ErrorIs(t, repo.SetPixel(coords, Color(0xF00)), ErrPixelIsDry)
+		block, err = repo.GetBlock(coords.ParentOfPixel())
+		assert.NoError(t, err)
+		assert.Zero(t, block.DryTime)
+	}
+
+	// Level 1 (top block) and level 2 come from the table. Deeper levels use the last
+	// entry. Pixels in the zone use the zone's time regardless of level.
+	checkDrying(coordsFromBits("100000", "000000"), 10*time.Second)
+	checkDrying(coordsFromBits("1 000000", "0 000000"), 20*time.Second)
+	checkDrying(coordsFromBits("1000 000000", "0000 000000"), 20*time.Second)
+	checkDrying(coordsFromBits("0000 000000", "0000 000000"), 100*time.Second)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testBlockRepoMaxDepth(t *testing.T, createRepo blockRepoFactory) {
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	repo := createRepo(t, clock)
+	repo.(maxDepthSetter).SetMaxDepth(101)
+
+	err := repo.SetPixel(coordsFromBits(
+		strings.Repeat("0", 101)+"000000",
+		strings.Repeat("0", 101)+"000000"), Color(0x00F))
+	assert.NoError(t, err)
+
+	err = repo.SetPixel(coordsFromBits(
+		strings.Repeat("0", 101)+"0000000",
+		strings.Repeat("0", 101)+"0000000"), Color(0x00F))
+	assert.ErrorIs(t, err, ErrMaxDepthExceeded)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testBlockRepoHasBlocksUnder(t *testing.T, createRepo blockRepoFactory) {
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	repo := createRepo(t, clock)
+
+	has := func(coords Coords, levels int) bool {
+		result, err := repo.HasBlocksUnder(coords, levels)
+		assert.NoError(t, err)
+		return result
+	}
+
+	assert.False(t, has(MakeEmptyCoords(), 20))
+
+	//////////////////////////////////////////////////////////////////////////
+	// A lone pixel only bubbles one level before its alpha rounds to zero, so the
+	// blocks above that don't exist.
+	assert.NoError(t, repo.SetPixel(coordsFromBits("1010 000000", "0110 000000"), Color(0x00F)))
+	_, err := repo.GetBlock(MakeEmptyCoords())
+	assert.Equal(t, ErrBlockNotFound, err)
+
+	assert.True(t, has(MakeEmptyCoords(), 20))
+	assert.True(t, has(MakeEmptyCoords(), 3))
+	assert.False(t, has(MakeEmptyCoords(), 2))
+	assert.True(t, has(coordsFromBits("10", "01"), 1))
+	assert.False(t, has(coordsFromBits("10", "00"), 20))
+	assert.True(t, has(coordsFromBits("1010", "0110"), 0))
+	assert.False(t, has(coordsFromBits("1010", "0111"), 20))
+	assert.False(t, has(coordsFromBits("1010 1", "0110 1"), 20))
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testBlockRepoUndo(t *testing.T, createRepo blockRepoFactory) {
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	repo := createRepo(t, clock)
+	repo.(dryingPolicySetter).SetDryingPolicy(&DryingPolicy{Table: []int{10}})
+
+	pixel := coordsFromBits("1 000000", "0 000000")
+	assert.ErrorIs(t, repo.UndoPixel(pixel), ErrNothingToUndo)
+
+	//////////////////////////////////////////////////////////////////////////
+	// Undoing a new pixel unsets it and clears the color that it bubbled up.
+	assert.NoError(t, repo.SetPixel(pixel, Color(0x00F)))
+	above, err := getPixel(repo, pixel.Up(1))
+	assert.NoError(t, err)
+	assert.NotZero(t, above)
+
+	assert.NoError(t, repo.UndoPixel(pixel))
+	value, err := getPixel(repo, pixel)
+	assert.NoError(t, err)
+	assert.Zero(t, value)
+	above, err = getPixel(repo, pixel.Up(1))
+	assert.NoError(t, err)
+	assert.Zero(t, above)
+	block, err := repo.GetBlock(pixel.ParentOfPixel())
+	assert.NoError(t, err)
+	assert.Empty(t, block.DryTimes)
+	assert.ErrorIs(t, repo.UndoPixel(pixel), ErrNothingToUndo)
+
+	//////////////////////////////////////////////////////////////////////////
+	// Repainting a wet pixel can be undone back to the earlier color and deadline,
+	// but only once.
+	start := clock.Now().UnixMilli()
+	assert.NoError(t, repo.SetPixel(pixel, Color(0x00F)))
+	first, err := getPixel(repo, pixel.Up(1))
+	assert.NoError(t, err)
+	clock.Advance(2 * time.Second)
+	assert.NoError(t, repo.SetPixel(pixel, Color(0x0F0)))
+
+	assert.NoError(t, repo.UndoPixel(pixel))
+	value, err = getPixel(repo, pixel)
+	assert.NoError(t, err)
+	assert.Equal(t, PIXEL_SET|0x00F<<16, value)
+	above, err = getPixel(repo, pixel.Up(1))
+	assert.NoError(t, err)
+	assert.Equal(t, first, above)
+	block, err = repo.GetBlock(pixel.ParentOfPixel())
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint16]UnixMillis{uint16(pixel.PixelIndex()): start + 10000}, block.DryTimes)
+	assert.ErrorIs(t, repo.UndoPixel(pixel), ErrNothingToUndo)
+
+	//////////////////////////////////////////////////////////////////////////
+	// Once the pixel dries, it can't be undone.
+	assert.NoError(t, repo.SetPixel(pixel, Color(0xF00)))
+	clock.Advance(10 * time.Second)
+	assert.ErrorIs(t, repo.UndoPixel(pixel), ErrPixelIsDry)
+
+	//////////////////////////////////////////////////////////////////////////
+	// Undoing one of a covered group leaves the colors above as if it was never
+	// painted.
+	group := []Coords{
+		coordsFromBits("10 000000", "10 000000"),
+		coordsFromBits("10 000001", "10 000000"),
+		coordsFromBits("10 000000", "10 000001"),
+		coordsFromBits("10 000001", "10 000001"),
+	}
+	other := createRepo(t, clock)
+	for i, coords := range group {
+		color := Color(0x00F << (4 * (i % 3)))
+		assert.NoError(t, repo.SetPixel(coords, color))
+		if i != 3 {
+			assert.NoError(t, other.SetPixel(coords, color))
+		}
+	}
+	assert.NoError(t, repo.UndoPixel(group[3]))
+	for _, coords := range []Coords{group[0], group[0].Up(1), group[0].Up(2)} {
+		expected, err := getPixel(other, coords)
+		assert.NoError(t, err)
+		actual, err := getPixel(repo, coords)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testBlockRepoErase(t *testing.T, createRepo blockRepoFactory) {
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	repo := createRepo(t, clock)
+	repo.(dryingPolicySetter).SetDryingPolicy(&DryingPolicy{Table: []int{10}})
+
+	//////////////////////////////////////////////////////////////////////////
+	// Erasing nothing changes nothing.
+	pixel := coordsFromBits("1 000000", "0 000000")
+	assert.NoError(t, repo.SetPixel(pixel, Transparent))
+	_, err := repo.GetBlock(pixel.ParentOfPixel())
+	assert.ErrorIs(t, err, ErrBlockNotFound)
+
+	//////////////////////////////////////////////////////////////////////////
+	// Erasing a wet pixel is like it was never painted, including the color that it
+	// bubbled up.
+	assert.NoError(t, repo.SetPixel(pixel, Color(0x00F)))
+	assert.NoError(t, repo.SetPixel(pixel, Transparent))
+	value, err := getPixel(repo, pixel)
+	assert.NoError(t, err)
+	assert.Zero(t, value)
+	above, err := getPixel(repo, pixel.Up(1))
+	assert.NoError(t, err)
+	assert.Zero(t, above)
+	block, err := repo.GetBlock(pixel.ParentOfPixel())
+	assert.NoError(t, err)
+	assert.Empty(t, block.DryTimes)
+	assert.ErrorIs(t, repo.UndoPixel(pixel), ErrNothingToUndo)
+
+	// Dry pixels can't be erased.
+	assert.NoError(t, repo.SetPixel(pixel, Color(0xF00)))
+	clock.Advance(10 * time.Second)
+	assert.ErrorIs(t, repo.SetPixel(pixel, Transparent), ErrPixelIsDry)
+
+	//////////////////////////////////////////////////////////////////////////
+	// Erasing one of a covered group lowers the alpha above it, all the way up, and
+	// the color inherited by an erased pixel shows through.
+	group := []Coords{
+		coordsFromBits("10 000000", "10 000000"),
+		coordsFromBits("10 000001", "10 000000"),
+		coordsFromBits("10 000000", "10 000001"),
+		coordsFromBits("10 000001", "10 000001"),
+	}
+	other := createRepo(t, clock)
+	for i, coords := range group {
+		color := Color(0x00F << (4 * (i % 3)))
+		assert.NoError(t, repo.SetPixel(coords, color))
+		if i != 3 {
+			assert.NoError(t, other.SetPixel(coords, color))
+		}
+	}
+	covered, err := getPixel(repo, group[0].Up(1))
+	assert.NoError(t, err)
+	assert.Equal(t, Pixel(0xF000), covered&0xF000)
+
+	assert.NoError(t, repo.SetPixel(group[3], Transparent))
+	for _, coords := range []Coords{group[0], group[0].Up(1), group[0].Up(2)} {
+		expected, err := getPixel(other, coords)
+		assert.NoError(t, err)
+		actual, err := getPixel(repo, coords)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+	above, err = getPixel(repo, group[0].Up(1))
+	assert.NoError(t, err)
+	assert.Less(t, above&0xF000, Pixel(0xF000))
+
+	assert.NoError(t, repo.SetPixel(group[0].Up(1), Color(0xFFF)))
+	assert.NoError(t, repo.SetPixel(group[0].Up(1), Transparent))
+	erased, err := getPixel(repo, group[0].Up(1))
+	assert.NoError(t, err)
+	assert.Equal(t, above, erased)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestColorAlpha(t *testing.T) {
+	// Alphas are rounded to the closest opacity.
+	assert.Equal(t, Color(0xF00), ColorWithAlpha(0xF00, 15))
+	assert.Equal(t, 15, ColorWithAlpha(0xF00, 14).Alpha())
+	assert.Equal(t, 11, ColorWithAlpha(0xF00, 10).Alpha())
+	assert.Equal(t, 7, ColorWithAlpha(0xF00, 8).Alpha())
+	assert.Equal(t, 3, ColorWithAlpha(0xF00, 1).Alpha())
+	assert.Equal(t, Color(0xF00), ColorWithAlpha(0xF00, 1).RGB())
+	assert.Equal(t, Transparent, ColorWithAlpha(0xF00, 0))
+	assert.Equal(t, 0, Transparent.Alpha())
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testBlockRepoTranslucent(t *testing.T, createRepo blockRepoFactory) {
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	repo := createRepo(t, clock)
+
+	group := []Coords{
+		coordsFromBits("10 000000", "10 000000"),
+		coordsFromBits("10 000001", "10 000000"),
+		coordsFromBits("10 000000", "10 000001"),
+		coordsFromBits("10 000001", "10 000001"),
+	}
+	red := ColorWithAlpha(0x00F, 7)
+
+	//////////////////////////////////////////////////////////////////////////
+	// The opacity is kept with the painted color.
+	assert.NoError(t, repo.SetPixel(group[0], red))
+	value, err := getPixel(repo, group[0])
+	assert.NoError(t, err)
+	assert.Equal(t, red, value.PaintedColor())
+	assert.Equal(t, 7, value.PaintedAlpha())
+
+	//////////////////////////////////////////////////////////////////////////
+	// A translucent group doesn't cover the pixel above it, which inherits its alpha.
+	for _, coords := range group[1:] {
+		assert.NoError(t, repo.SetPixel(coords, red))
+	}
+	above, err := getPixel(repo, group[0].Up(1))
+	assert.NoError(t, err)
+	assert.Equal(t, Pixel(0x700F), above)
+
+	// The inherited color is blended over a painted one.
+	assert.NoError(t, repo.SetPixel(group[0].Up(1), Color(0x0F0)))
+	value, err = getPixel(repo, group[0].Up(2))
+	assert.NoError(t, err)
+	assert.Equal(t, Pixel(0x3087), value)
+
+	// Repainting opaque covers the pixel above again.
+	for _, coords := range group {
+		assert.NoError(t, repo.SetPixel(coords, Color(0x00F)))
+	}
+	assert.ErrorIs(t, repo.SetPixel(group[0].Up(1), Color(0x0F0)), ErrPixelIsDry)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestColor24(t *testing.T) {
+	orange := Color24WithAlpha(0x3380FF, 255)
+	assert.True(t, orange.IsDeep())
+	assert.Equal(t, uint32(0x3380FF), orange.RGB24())
+	assert.Equal(t, 15, orange.Alpha())
+
+	// 12-bit canvases round to the closest 4-bit channels.
+	assert.Equal(t, Color(0x38F), orange.To12())
+	assert.Equal(t, Color(0x38F), orange.RGB())
+	assert.Equal(t, ColorWithAlpha(0x38F, 7), Color24WithAlpha(0x3380FF, 0x77).To12())
+	assert.Equal(t, Transparent, Color24WithAlpha(0x3380FF, 0))
+	assert.Equal(t, Color(0x0F0), Color(0x0F0).To12())
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testBlockRepoColor24(t *testing.T, createRepo blockRepoFactory) {
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	repo := createRepo(t, clock)
+
+	group := []Coords{
+		coordsFromBits("10 000000", "10 000000"),
+		coordsFromBits("10 000001", "10 000000"),
+		coordsFromBits("10 000000", "10 000001"),
+		coordsFromBits("10 000001", "10 000001"),
+	}
+	orange := Color24WithAlpha(0x3380FF, 255)
+	getBlock := func(coords Coords) *Block {
+		block, err := repo.GetBlock(coords.ParentOfPixel())
+		assert.NoError(t, err)
+		return block
+	}
+
+	//////////////////////////////////////////////////////////////////////////
+	// Painting a 24-bit color upgrades the block and the blocks above it, and the low
+	// nibbles are kept in the fine pixels.
+	assert.NoError(t, repo.SetPixel(group[0], orange))
+	block := getBlock(group[0])
+	assert.NotNil(t, block.Fine)
+	assert.Equal(t, orange, block.PaintedColor(group[0].PixelIndex()))
+	assert.Equal(t, [3]int{0xFF, 0x80, 0x33}, block.Channels(group[0].PixelIndex()).Painted)
+	for level := 1; level <= 2; level++ {
+		assert.NotNil(t, getBlock(group[0].Up(level)).Fine)
+	}
+
+	//////////////////////////////////////////////////////////////////////////
+	// A covered group bubbles up at full precision.
+	for _, coords := range group[1:] {
+		assert.NoError(t, repo.SetPixel(coords, orange))
+	}
+	above := group[0].Up(1)
+	channels := getBlock(above).Channels(above.PixelIndex())
+	assert.Equal(t, [3]int{0xFF, 0x80, 0x33}, channels.Inherited)
+	assert.Equal(t, 255, channels.Alpha)
+	assert.True(t, getBlock(above).IsPixelDry(above.PixelIndex()))
+	assert.ErrorIs(t, repo.SetPixel(above, orange), ErrPixelIsDry)
+
+	// 12-bit colors painted into 24-bit blocks are expanded.
+	assert.NoError(t, repo.SetPixel(group[0], Color(0x00F)))
+	assert.Equal(t, Color24WithAlpha(0x0000FF, 255), getBlock(group[0]).PaintedColor(group[0].PixelIndex()))
+
+	//////////////////////////////////////////////////////////////////////////
+	// Undo and erase restore the fine pixels too.
+	assert.NoError(t, repo.UndoPixel(group[0]))
+	assert.Equal(t, orange, getBlock(group[0]).PaintedColor(group[0].PixelIndex()))
+	assert.NoError(t, repo.SetPixel(group[1], Transparent))
+	block = getBlock(group[1])
+	assert.Zero(t, block.Pixels[group[1].PixelIndex()])
+	assert.Zero(t, block.Fine[group[1].PixelIndex()])
+	channels = getBlock(above).Channels(above.PixelIndex())
+	assert.Less(t, channels.Alpha, 255)
+	assert.Equal(t, [3]int{0xFF, 0x80, 0x33}, channels.Inherited)
+
+	//////////////////////////////////////////////////////////////////////////
+	// Upgrading a repo converts each 12-bit block once, without changing its colors.
+	repo = createRepo(t, clock)
+	for _, coords := range group {
+		assert.NoError(t, repo.SetPixel(coords, Color(0x38F)))
+	}
+	before := getBlock(above)
+	count, err := repo.UpgradeColorDepth()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	after := getBlock(above)
+	assert.NotNil(t, after.Fine)
+	assert.Equal(t, [3]int{0xFF, 0x88, 0x33}, after.Channels(above.PixelIndex()).Inherited)
+	assert.Equal(t, before.IsPixelDry(above.PixelIndex()), after.IsPixelDry(above.PixelIndex()))
+	assert.Equal(t, Color24WithAlpha(0x3388FF, 255),
+		getBlock(group[0]).PaintedColor(group[0].PixelIndex()))
+
+	count, err = repo.UpgradeColorDepth()
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+}
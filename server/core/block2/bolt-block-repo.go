@@ -0,0 +1,344 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// A block repository persisted to disk with an embedded key-value store (bbolt). Blocks
+// are keyed by Coords.ToBytes() and stored with encodeMemBlock. Each paint operation is
+// one bolt transaction, so a failed write never leaves the tree partially bubbled.
+//
+// The "wet" bucket indexes the blocks that have wet pixels, with the earliest deadline
+// as an int64, so DryPixels doesn't need to scan every block.
+
+var (
+	boltBlocksBucket = []byte("blocks")
+	boltWetBucket    = []byte("wet")
+)
+
+// Blocks converted per transaction by UpgradeColorDepth.
+const boltUpgradeBatchSize = 1024
+
+// ---------------------------------------------------------------------------------------
+type (
+	BoltBlockRepo struct {
+		Clock    ClockService
+		db       *bbolt.DB
+		mutex    sync.Mutex
+		settings paintSettings
+		listener BlockEventListener
+	}
+
+	boltBlockStore struct {
+		bucket *bbolt.Bucket
+		wet    *bbolt.Bucket
+	}
+)
+
+// ---------------------------------------------------------------------------------------
+func CreateBoltBlockRepo(cs ClockService, path string) (*BoltBlockRepo, error) {
+	log.WithField(nil, "path", path).Infoln("Opening bolt block storage.")
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(btx *bbolt.Tx) error {
+		if _, err := btx.CreateBucketIfNotExists(boltBlocksBucket); err != nil {
+			return err
+		}
+		if btx.Bucket(boltWetBucket) != nil {
+			return nil
+		}
+		if _, err := btx.CreateBucket(boltWetBucket); err != nil {
+			return err
+		}
+		return indexBoltWetBlocks(openBoltBlockStore(btx))
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltBlockRepo{
+		Clock:    cs,
+		db:       db,
+		settings: defaultPaintSettings(),
+	}, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func openBoltBlockStore(btx *bbolt.Tx) *boltBlockStore {
+	return &boltBlockStore{
+		bucket: btx.Bucket(boltBlocksBucket),
+		wet:    btx.Bucket(boltWetBucket),
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Builds the wet index for a database that was created before it existed.
+func indexBoltWetBlocks(store *boltBlockStore) error {
+	return store.bucket.ForEach(func(key, data []byte) error {
+		block, err := decodeMemBlock(data)
+		if err != nil {
+			return err
+		}
+		return store.indexWetBlock(string(key), block)
+	})
+}
+
+// ---------------------------------------------------------------------------------------
+func (s *boltBlockStore) indexWetBlock(key string, block *MemBlock) error {
+	if block.FirstDryTime == 0 {
+		return s.wet.Delete([]byte(key))
+	}
+	return s.wet.Put([]byte(key), binary.LittleEndian.AppendUint64(nil, uint64(block.FirstDryTime)))
+}
+
+// ---------------------------------------------------------------------------------------
+func (s *boltBlockStore) loadBlock(key string) (*MemBlock, error) {
+	data := s.bucket.Get([]byte(key))
+	if data == nil {
+		return nil, nil
+	}
+	return decodeMemBlock(data)
+}
+
+// ---------------------------------------------------------------------------------------
+func (s *boltBlockStore) saveBlock(key string, block *MemBlock) error {
+	if err := s.bucket.Put([]byte(key), encodeMemBlock(block)); err != nil {
+		return err
+	}
+	return s.indexWetBlock(key, block)
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *BoltBlockRepo) GetBlock(coords Coords) (*Block, error) {
+	var block *MemBlock
+	err := r.db.View(func(btx *bbolt.Tx) error {
+		var err error
+		block, err = openBoltBlockStore(btx).loadBlock(string(coords.ToBytes()))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, ErrBlockNotFound
+	}
+
+	// Drying is only saved on the next write. Readers see the dried state either way.
+	dryBlock(block, r.Clock.Now().UnixMilli())
+	return block.toBlock(), nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *BoltBlockRepo) GetBlocks(coords []Coords) ([]*Block, error) {
+	loaded := make([]*MemBlock, len(coords))
+	err := r.db.View(func(btx *bbolt.Tx) error {
+		store := openBoltBlockStore(btx)
+		for i, c := range coords {
+			var err error
+			if loaded[i], err = store.loadBlock(string(c.ToBytes())); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := r.Clock.Now().UnixMilli()
+	blocks := make([]*Block, len(coords))
+	for i, block := range loaded {
+		if block != nil {
+			dryBlock(block, now)
+			blocks[i] = block.toBlock()
+		}
+	}
+	return blocks, nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Scans the keys that start with the coords' key prefix, which are sorted together.
+func (r *BoltBlockRepo) HasBlocksUnder(coords Coords, levels int) (bool, error) {
+	prefix := coords.keyPrefix()
+	found := false
+	err := r.db.View(func(btx *bbolt.Tx) error {
+		cursor := btx.Bucket(boltBlocksBucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			if coords.keyIsUnder(key, levels) {
+				found = true
+				return nil
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *BoltBlockRepo) SetPixel(coords Coords, color Color) error {
+	return singlePaintResult(r.SetPixels([]PixelPaint{{coords, color}}))
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *BoltBlockRepo) SetPixels(pixels []PixelPaint) ([]error, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var results []error
+	var tx *paintTx
+	err := r.db.Update(func(btx *bbolt.Tx) error {
+		var err error
+		tx = beginPaintTx(openBoltBlockStore(btx), r.Clock.Now().UnixMilli(), r.settings)
+		results, err = tx.setPixels(pixels)
+		if err != nil {
+			return err // Storage failure, roll back.
+		}
+		return tx.commit()
+	})
+	if err != nil {
+		return nil, err
+	}
+	publishBlockEvents(r.listener, tx.events)
+	return results, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *BoltBlockRepo) UndoPixel(coords Coords) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var result error
+	var tx *paintTx
+	err := r.db.Update(func(btx *bbolt.Tx) error {
+		tx = beginPaintTx(openBoltBlockStore(btx), r.Clock.Now().UnixMilli(), r.settings)
+		result = tx.undoPixel(coords)
+		if result != nil && !isPaintRejection(result) {
+			return result // Storage failure, roll back.
+		}
+		return tx.commit()
+	})
+	if err != nil {
+		return err
+	}
+	publishBlockEvents(r.listener, tx.events)
+	return result
+}
+
+// ---------------------------------------------------------------------------------------
+// Dries all pixels that have reached their deadline.
+func (r *BoltBlockRepo) DryPixels() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var tx *paintTx
+	err := r.db.Update(func(btx *bbolt.Tx) error {
+		store := openBoltBlockStore(btx)
+		tx = beginPaintTx(store, r.Clock.Now().UnixMilli(), r.settings)
+
+		var keys []string
+		err := store.wet.ForEach(func(key, value []byte) error {
+			if tx.now >= UnixMillis(binary.LittleEndian.Uint64(value)) {
+				keys = append(keys, string(key))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := tx.dryBlocks(keys); err != nil {
+			return err
+		}
+		return tx.commit()
+	})
+	if err != nil {
+		return err
+	}
+	publishBlockEvents(r.listener, tx.events)
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Blocks are converted in batches of boltUpgradeBatchSize, each its own bolt transaction,
+// so a large canvas isn't held in memory at once.
+func (r *BoltBlockRepo) UpgradeColorDepth() (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var keys []string
+	err := r.db.View(func(btx *bbolt.Tx) error {
+		return btx.Bucket(boltBlocksBucket).ForEach(func(key, _ []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	upgraded := 0
+	for start := 0; start < len(keys); start += boltUpgradeBatchSize {
+		var tx *paintTx
+		count := 0
+		err := r.db.Update(func(btx *bbolt.Tx) error {
+			var err error
+			tx = beginPaintTx(openBoltBlockStore(btx), r.Clock.Now().UnixMilli(), r.settings)
+			count, err = tx.upgradeBlocks(keys[start:min(start+boltUpgradeBatchSize, len(keys))])
+			if err != nil {
+				return err
+			}
+			return tx.commit()
+		})
+		if err != nil {
+			return upgraded, err
+		}
+		publishBlockEvents(r.listener, tx.events)
+		upgraded += count
+	}
+	return upgraded, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *BoltBlockRepo) SetEventListener(listener BlockEventListener) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.listener = listener
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *BoltBlockRepo) SetMaxDepth(depth int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.settings.maxDepth = depth
+}
+
+// ---------------------------------------------------------------------------------------
+// Changes how long painted pixels take to dry. Pixels that are already wet keep their
+// current deadline.
+func (r *BoltBlockRepo) SetDryingPolicy(policy *DryingPolicy) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.settings.dryTime = policy.GetDryTime
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *BoltBlockRepo) Close() error {
+	log.Infoln(nil, "Closing bolt block storage.")
+	return r.db.Close()
+}
@@ -0,0 +1,130 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/bbolt"
+	"go.mukunda.com/nanopaint/core/clock"
+)
+
+func createTestBoltBlockRepo(t *testing.T, cs ClockService) BlockRepo {
+	repo, err := CreateBoltBlockRepo(cs, filepath.Join(t.TempDir(), "blocks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Durability isn't under test here, and syncing every write is slow.
+	repo.db.NoSync = true
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestBoltBlockRepoBubbling(t *testing.T) { testBlockRepoBubbling(t, createTestBoltBlockRepo) }
+func TestBoltBlockBubble2(t *testing.T)      { testBlockRepoBubble2(t, createTestBoltBlockRepo, 20) }
+func TestBoltBlockBubble3(t *testing.T)      { testBlockRepoBubble3(t, createTestBoltBlockRepo) }
+func TestBoltBlockDrying(t *testing.T)       { testBlockRepoDrying(t, createTestBoltBlockRepo) }
+func TestBoltBlockMaxDepth(t *testing.T)     { testBlockRepoMaxDepth(t, createTestBoltBlockRepo) }
+func TestBoltBlockPixelDrying(t *testing.T) {
+	testBlockRepoPixelDrying(t, createTestBoltBlockRepo)
+}
+func TestBoltBlockDryPixels(t *testing.T) { testBlockRepoDryPixels(t, createTestBoltBlockRepo) }
+func TestBoltBlockSetPixels(t *testing.T) { testBlockRepoSetPixels(t, createTestBoltBlockRepo) }
+func TestBoltBlockGetBlocks(t *testing.T) { testBlockRepoGetBlocks(t, createTestBoltBlockRepo) }
+func TestBoltBlockRepoLastUpdated(t *testing.T) {
+	testBlockRepoLastUpdated(t, createTestBoltBlockRepo)
+}
+func TestBoltBlockRepoHasBlocksUnder(t *testing.T) {
+	testBlockRepoHasBlocksUnder(t, createTestBoltBlockRepo)
+}
+func TestBoltBlockPaintEvents(t *testing.T) {
+	testBlockRepoPaintEvents(t, createTestBoltBlockRepo)
+}
+func TestBoltBlockRepoUndo(t *testing.T) {
+	testBlockRepoUndo(t, createTestBoltBlockRepo)
+}
+func TestBoltBlockRepoErase(t *testing.T) {
+	testBlockRepoErase(t, createTestBoltBlockRepo)
+}
+func TestBoltBlockRepoTranslucent(t *testing.T) {
+	testBlockRepoTranslucent(t, createTestBoltBlockRepo)
+}
+func TestBoltBlockRepoColor24(t *testing.T) {
+	testBlockRepoColor24(t, createTestBoltBlockRepo)
+}
+func TestBoltBlockDryingPolicy(t *testing.T) {
+	testBlockRepoDryingPolicy(t, createTestBoltBlockRepo)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestBoltBlockRepoPersistence(t *testing.T) {
+	//////////////////////////////////////////////////////////////////////////
+	// Pixels, drying deadlines and bubbled colors survive reopening the file.
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	path := filepath.Join(t.TempDir(), "blocks.db")
+
+	repo, err := CreateBoltBlockRepo(clock, path)
+	assert.NoError(t, err)
+
+	wetCoords := coordsFromBits("00000000 00", "00000000 00")
+	assert.NoError(t, repo.SetPixel(wetCoords, Color(0x00F)))
+	assert.NoError(t, repo.SetPixel(coordsFromBits("00000000 01", "00000000 01"), Color(0xF00)))
+
+	before, err := getPixel(repo, wetCoords.Up(1))
+	assert.NoError(t, err)
+	assert.NoError(t, repo.Close())
+
+	repo, err = CreateBoltBlockRepo(clock, path)
+	assert.NoError(t, err)
+	defer repo.Close()
+
+	pixel, err := getPixel(repo, wetCoords)
+	assert.NoError(t, err)
+	assert.EqualValues(t, Pixel(0x00F<<16)|PIXEL_SET, pixel)
+
+	after, err := getPixel(repo, wetCoords.Up(1))
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+
+	// The pixel is still wet and can be repainted until the stored deadline passes.
+	assert.NoError(t, repo.SetPixel(wetCoords, Color(0x0F0)))
+	clock.Advance(time.Hour)
+	assert.ErrorIs(t, repo.SetPixel(wetCoords, Color(0x0F0)), ErrPixelIsDry)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestBoltBlockRepoWetIndex(t *testing.T) {
+	/////////////////////////////////////////////////////////////////////////////
+	// Databases from before the wet index existed are indexed when opened, so
+	// DryPixels still finds their wet blocks.
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	path := filepath.Join(t.TempDir(), "blocks.db")
+
+	repo, err := CreateBoltBlockRepo(clock, path)
+	assert.NoError(t, err)
+	coords := coordsFromBits("00000000 00", "00000000 00")
+	assert.NoError(t, repo.SetPixel(coords, Color(0x00F)))
+	assert.NoError(t, repo.db.Update(func(btx *bbolt.Tx) error {
+		return btx.DeleteBucket(boltWetBucket)
+	}))
+	assert.NoError(t, repo.Close())
+
+	repo, err = CreateBoltBlockRepo(clock, path)
+	assert.NoError(t, err)
+	defer repo.Close()
+
+	var events []BlockEvent
+	repo.SetEventListener(func(event BlockEvent) {
+		events = append(events, event)
+	})
+	clock.Advance(time.Hour)
+	assert.NoError(t, repo.DryPixels())
+	assert.Len(t, events, 1)
+	assert.Equal(t, coords.ParentOfPixel(), events[0].Block)
+}
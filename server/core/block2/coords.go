@@ -5,6 +5,7 @@
 package block2
 
 import (
+	"bytes"
 	"encoding/base64"
 	"slices"
 
@@ -180,3 +181,62 @@ func CoordsFromBase64(str string) Coords {
 func (c Coords) ToBase64() string {
 	return base64.URLEncoding.EncodeToString(c.ToBytes())
 }
+
+// ---------------------------------------------------------------------------------------
+// Returns the bytes that the keys (ToBytes) of c and of every block under it start with.
+// Other blocks can have keys with this prefix too, so matches still need HasPrefix.
+func (c Coords) keyPrefix() []byte {
+	// Never nil, since the SQL repo binds nil as NULL.
+	if c.Bitmod == 3 {
+		return append([]byte{}, c.Coords...)
+	}
+	return append([]byte{}, c.Coords[:len(c.Coords)-1]...)
+}
+
+// ---------------------------------------------------------------------------------------
+// True if the key (ToBytes) is of a block at most `levels` under c, or c itself. Keys are
+// trusted to be valid, since they come from storage.
+func (c Coords) keyIsUnder(key []byte, levels int) bool {
+	if len(key) == 0 {
+		return false
+	}
+	block := Coords{
+		Bitmod: key[len(key)-1],
+		Coords: key[:len(key)-1],
+	}
+	return block.BitLength() <= c.BitLength()+levels && block.HasPrefix(c)
+}
+
+// ---------------------------------------------------------------------------------------
+// True if c is inside of the area covered by prefix (or equal to it).
+func (c Coords) HasPrefix(prefix Coords) bool {
+	levels := c.BitLength() - prefix.BitLength()
+	if levels < 0 {
+		return false
+	}
+	return bytes.Equal(c.Up(levels).ToBytes(), prefix.ToBytes())
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the coordinates dx, dy units to the right and down, at the same depth. ok is
+// false if that is past the edge of the canvas.
+func (c Coords) Offset(dx, dy int) (result Coords, ok bool) {
+	cat.BadIf(dx < 0 || dy < 0, "coordinate offsets must not be negative")
+	coords := slices.Clone(c.Coords)
+
+	// Add with carry, starting from the deepest level. Level i is stored in byte i/4, in
+	// bit 3-i%4 for X and 7-i%4 for Y.
+	for level := c.BitLength() - 1; level >= 0 && (dx > 0 || dy > 0); level-- {
+		index, shift := level/4, 3-level%4
+		x := int(coords[index]>>shift&1) + dx
+		y := int(coords[index]>>(shift+4)&1) + dy
+		coords[index] &^= 1<<shift | 1<<(shift+4)
+		coords[index] |= byte(x&1)<<shift | byte(y&1)<<(shift+4)
+		dx, dy = x>>1, y>>1
+	}
+
+	return Coords{
+		Bitmod: c.Bitmod,
+		Coords: coords,
+	}, dx == 0 && dy == 0
+}
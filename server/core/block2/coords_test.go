@@ -220,3 +220,43 @@ func TestCoordsBase64Sanitization(t *testing.T) {
 	}
 
 }
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestCoordsHasPrefix(t *testing.T) {
+	prefix := coordsFromBits("10110", "00111")
+	assert.True(t, coordsFromBits("10110", "00111").HasPrefix(prefix))
+	assert.True(t, coordsFromBits("10110 1", "00111 0").HasPrefix(prefix))
+	assert.True(t, coordsFromBits("10110 0101 11", "00111 1111 00").HasPrefix(prefix))
+	assert.False(t, coordsFromBits("10111 0101 11", "00111 1111 00").HasPrefix(prefix))
+	assert.False(t, coordsFromBits("10110 0101 11", "00101 1111 00").HasPrefix(prefix))
+	assert.False(t, coordsFromBits("1011", "0011").HasPrefix(prefix))
+
+	// Everything is under the root.
+	assert.True(t, prefix.HasPrefix(MakeEmptyCoords()))
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestCoordsOffset(t *testing.T) {
+	origin := coordsFromBits("00101", "11000")
+
+	offset, ok := origin.Offset(0, 0)
+	assert.True(t, ok)
+	assert.Equal(t, origin.ToBytes(), offset.ToBytes())
+
+	offset, ok = origin.Offset(3, 5)
+	assert.True(t, ok)
+	assert.Equal(t, coordsFromBits("01000", "11101").ToBytes(), offset.ToBytes())
+
+	// Carries across the byte boundary.
+	offset, ok = coordsFromBits("0111 1", "0000 0").Offset(1, 0)
+	assert.True(t, ok)
+	assert.Equal(t, coordsFromBits("1000 0", "0000 0").ToBytes(), offset.ToBytes())
+
+	// Past the edge of the canvas.
+	_, ok = coordsFromBits("11111", "00000").Offset(1, 0)
+	assert.False(t, ok)
+	_, ok = origin.Offset(0, 8)
+	assert.False(t, ok)
+	_, ok = MakeEmptyCoords().Offset(0, 1)
+	assert.False(t, ok)
+}
@@ -0,0 +1,16 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+//go:build !unix
+
+package block2
+
+import "os"
+
+// ---------------------------------------------------------------------------------------
+// Other platforms have no flock, so the lock file is only created. Don't open the same
+// storage from two processes there.
+func lockDir(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+}
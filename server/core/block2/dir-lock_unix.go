@@ -0,0 +1,35 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+//go:build unix
+
+package block2
+
+import (
+	"os"
+	"syscall"
+)
+
+// ---------------------------------------------------------------------------------------
+// Creates the lock file at `path` and takes an exclusive lock on it, which is held until
+// the file is closed. The lock is released by the OS if the process dies, so a crash
+// doesn't leave the storage locked.
+//
+// Errors:
+//
+//	ErrStorageLocked: another process holds the lock.
+func lockDir(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrStorageLocked
+		}
+		return nil, err
+	}
+	return file, nil
+}
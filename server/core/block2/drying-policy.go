@@ -0,0 +1,159 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// The drying policy decides how long a painted pixel stays wet. Deeper levels take
+// longer to dry.
+//
+// The level of a pixel is the depth of its block plus one, so pixels in the top block
+// are level 1. Level 0 would be the root above the top block, which has no pixels, so
+// the first entry of DEFAULT_DRY_TIME is never used.
+
+const (
+	// Dry times come from Table, indexed by level. Levels past the end use the last
+	// entry.
+	DRYING_CURVE_TABLE = "table"
+	// Base + Step * (level - 1)
+	DRYING_CURVE_LINEAR = "linear"
+	// Base * Factor ^ (level - 1)
+	DRYING_CURVE_EXPONENTIAL = "exponential"
+
+	// Longest dry time in seconds. Every curve is capped at this, whatever Max is, so
+	// that deep levels of an exponential curve can't overflow into a negative time.
+	MaxDryTime = 365 * 24 * 60 * 60
+)
+
+var ErrBadDryingPolicy = errors.New("invalid drying policy")
+
+// ---------------------------------------------------------------------------------------
+type (
+	DryingPolicy struct {
+		// One of DRYING_CURVE_*.
+		Curve string
+		// Seconds per level, for the table curve.
+		Table []int
+		// Parameters for the other curves, in seconds. Max caps the result if > 0, and
+		// MaxDryTime always does.
+		Base   int
+		Step   int
+		Factor float64
+		Max    int
+		// Overrides for specific regions of the canvas. The zone with the longest
+		// matching prefix wins.
+		Zones []DryingZone
+	}
+
+	DryingZone struct {
+		Coords  Coords
+		DryTime int // seconds
+	}
+)
+
+// ---------------------------------------------------------------------------------------
+func DefaultDryingPolicy() *DryingPolicy {
+	return &DryingPolicy{
+		Curve: DRYING_CURVE_TABLE,
+		Table: DEFAULT_DRY_TIME,
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Checks that the policy gives a positive dry time at some level and never a negative
+// one.
+//
+// Errors:
+//
+//	ErrBadDryingPolicy: the curve is unknown, or its parameters are out of range.
+func (p *DryingPolicy) Validate() error {
+	bad := func(message string) error {
+		return fmt.Errorf("%w: %s", ErrBadDryingPolicy, message)
+	}
+
+	switch p.Curve {
+	case "", DRYING_CURVE_TABLE:
+		for _, seconds := range p.Table {
+			if seconds < 0 {
+				return bad("table entries can't be negative")
+			}
+		}
+	case DRYING_CURVE_LINEAR:
+		if p.Base < 0 || p.Step < 0 || p.Base+p.Step <= 0 {
+			return bad("linear base and step can't be negative, and one must be positive")
+		}
+	case DRYING_CURVE_EXPONENTIAL:
+		if p.Base <= 0 || !(p.Factor > 0) || math.IsInf(p.Factor, 0) {
+			return bad("exponential base and factor must be positive")
+		}
+	default:
+		return bad("unknown curve " + p.Curve)
+	}
+
+	if p.Max < 0 {
+		return bad("max can't be negative")
+	}
+	for _, zone := range p.Zones {
+		if zone.DryTime < 0 {
+			return bad("zone dry times can't be negative")
+		}
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns how long the pixel at the given coordinates takes to dry, in milliseconds.
+func (p *DryingPolicy) GetDryTime(pixelCoords Coords) UnixMillis {
+	if zone := p.findZone(pixelCoords); zone != nil {
+		return UnixMillis(min(zone.DryTime, MaxDryTime)) * 1000
+	}
+
+	level := pixelCoords.ParentOfPixel().BitLength() + 1
+	var seconds float64
+
+	switch p.Curve {
+	case DRYING_CURVE_LINEAR:
+		seconds = float64(p.Base) + float64(p.Step)*float64(level-1)
+	case DRYING_CURVE_EXPONENTIAL:
+		seconds = float64(p.Base) * math.Pow(p.Factor, float64(level-1))
+	default:
+		table := p.Table
+		if len(table) == 0 {
+			table = DEFAULT_DRY_TIME
+		}
+		if level >= len(table) {
+			level = len(table) - 1
+		}
+		seconds = float64(table[level])
+	}
+
+	if p.Max > 0 && seconds > float64(p.Max) {
+		seconds = float64(p.Max)
+	}
+	// Also catches NaN, which fails every comparison.
+	if !(seconds <= MaxDryTime) {
+		seconds = MaxDryTime
+	}
+	return UnixMillis(max(seconds, 0) * 1000)
+}
+
+// ---------------------------------------------------------------------------------------
+func (p *DryingPolicy) findZone(pixelCoords Coords) *DryingZone {
+	var best *DryingZone
+	for i := range p.Zones {
+		zone := &p.Zones[i]
+		if !pixelCoords.HasPrefix(zone.Coords) {
+			continue
+		}
+		if best == nil || zone.Coords.BitLength() > best.Coords.BitLength() {
+			best = zone
+		}
+	}
+	return best
+}
@@ -0,0 +1,112 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns pixel coordinates in a block at the given depth.
+func pixelAtDepth(depth int) Coords {
+	bits := strings.Repeat("0", depth+6)
+	return coordsFromBits(bits, bits)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestDryingPolicyTable(t *testing.T) {
+	/////////////////////////////////////////////////////////////////////////
+	// The default policy uses DEFAULT_DRY_TIME. The top block is level 1, and
+	// levels past the end of the table use the last entry.
+	policy := DefaultDryingPolicy()
+	assert.EqualValues(t, 15000, policy.GetDryTime(pixelAtDepth(0)))
+	assert.EqualValues(t, 30000, policy.GetDryTime(pixelAtDepth(1)))
+	assert.EqualValues(t, 300000, policy.GetDryTime(pixelAtDepth(4)))
+	assert.EqualValues(t, 600000, policy.GetDryTime(pixelAtDepth(5)))
+	assert.EqualValues(t, 600000, policy.GetDryTime(pixelAtDepth(50)))
+
+	// An empty table falls back to the default.
+	assert.EqualValues(t, 15000, (&DryingPolicy{}).GetDryTime(pixelAtDepth(0)))
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestDryingPolicyCurves(t *testing.T) {
+	linear := &DryingPolicy{Curve: DRYING_CURVE_LINEAR, Base: 10, Step: 5, Max: 40}
+	assert.EqualValues(t, 10000, linear.GetDryTime(pixelAtDepth(0)))
+	assert.EqualValues(t, 15000, linear.GetDryTime(pixelAtDepth(1)))
+	assert.EqualValues(t, 35000, linear.GetDryTime(pixelAtDepth(5)))
+	assert.EqualValues(t, 40000, linear.GetDryTime(pixelAtDepth(6)))
+	assert.EqualValues(t, 40000, linear.GetDryTime(pixelAtDepth(100)))
+
+	exponential := &DryingPolicy{Curve: DRYING_CURVE_EXPONENTIAL, Base: 2, Factor: 1.5}
+	assert.EqualValues(t, 2000, exponential.GetDryTime(pixelAtDepth(0)))
+	assert.EqualValues(t, 3000, exponential.GetDryTime(pixelAtDepth(1)))
+	assert.EqualValues(t, 4500, exponential.GetDryTime(pixelAtDepth(2)))
+
+	/////////////////////////////////////////////////////////////////////////
+	// Without a Max, curves are still capped at MaxDryTime. Deep levels of an
+	// exponential curve would overflow otherwise.
+	assert.EqualValues(t, MaxDryTime*1000, exponential.GetDryTime(pixelAtDepth(100)))
+	steep := &DryingPolicy{Curve: DRYING_CURVE_EXPONENTIAL, Base: 1, Factor: 1e300}
+	assert.EqualValues(t, MaxDryTime*1000, steep.GetDryTime(pixelAtDepth(100)))
+	long := &DryingPolicy{Curve: DRYING_CURVE_LINEAR, Base: 1 << 40}
+	assert.EqualValues(t, MaxDryTime*1000, long.GetDryTime(pixelAtDepth(0)))
+	zone := &DryingPolicy{Zones: []DryingZone{{Coords: MakeEmptyCoords(), DryTime: 1 << 50}}}
+	assert.EqualValues(t, MaxDryTime*1000, zone.GetDryTime(pixelAtDepth(0)))
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestDryingPolicyValidate(t *testing.T) {
+	for _, policy := range []*DryingPolicy{
+		DefaultDryingPolicy(),
+		{},
+		{Curve: DRYING_CURVE_LINEAR, Base: 10, Step: 5, Max: 40},
+		{Curve: DRYING_CURVE_LINEAR, Step: 5},
+		{Curve: DRYING_CURVE_EXPONENTIAL, Base: 2, Factor: 1.5},
+		{Curve: DRYING_CURVE_EXPONENTIAL, Base: 2, Factor: 0.5},
+	} {
+		assert.NoError(t, policy.Validate(), policy)
+	}
+
+	/////////////////////////////////////////////////////////////////////////
+	// Curves that would give zero or negative times everywhere are rejected.
+	for _, policy := range []*DryingPolicy{
+		{Curve: "cubic"},
+		{Table: []int{0, 15, -1}},
+		{Curve: DRYING_CURVE_LINEAR},
+		{Curve: DRYING_CURVE_LINEAR, Base: -10, Step: 5},
+		{Curve: DRYING_CURVE_EXPONENTIAL, Base: 2},
+		{Curve: DRYING_CURVE_EXPONENTIAL, Factor: 2},
+		{Curve: DRYING_CURVE_EXPONENTIAL, Base: 2, Factor: -1},
+		{Curve: DRYING_CURVE_LINEAR, Base: 10, Max: -1},
+		{Zones: []DryingZone{{Coords: MakeEmptyCoords(), DryTime: -5}}},
+	} {
+		assert.ErrorIs(t, policy.Validate(), ErrBadDryingPolicy, policy)
+	}
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestDryingPolicyZones(t *testing.T) {
+	////////////////////////////////////////////////////////////////////////////
+	// Zones override the curve for everything under their coordinates, at any
+	// depth. Nested zones are allowed and the deepest one wins.
+	policy := DefaultDryingPolicy()
+	policy.Zones = []DryingZone{
+		{Coords: coordsFromBits("01 0000", "00 0000"), DryTime: 7},
+		{Coords: coordsFromBits("01", "00"), DryTime: 3},
+	}
+
+	assert.EqualValues(t, 3000, policy.GetDryTime(coordsFromBits("01 100000", "00 000000")))
+	assert.EqualValues(t, 3000, policy.GetDryTime(coordsFromBits("01 000000", "00 100000")))
+	assert.EqualValues(t, 7000, policy.GetDryTime(coordsFromBits("01 0000 000000", "00 0000 000000")))
+	assert.EqualValues(t, 7000, policy.GetDryTime(coordsFromBits("01 0000 1111 000000", "00 0000 1111 000000")))
+	assert.EqualValues(t, 3000, policy.GetDryTime(coordsFromBits("01 0001 000000", "00 0000 000000")))
+
+	// Outside of the zones.
+	assert.EqualValues(t, 60000, policy.GetDryTime(coordsFromBits("00 000000", "00 000000")))
+	assert.EqualValues(t, 15000, policy.GetDryTime(coordsFromBits("100000", "000000")))
+}
@@ -0,0 +1,58 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+// The paint history is an append-only record of every pixel painted, for moderators to
+// investigate vandalism. Entries are only removed by retention, oldest first.
+
+type (
+	HistoryEntry struct {
+		Time   UnixMillis
+		Coords Coords
+		Color  Color
+		// Who painted the pixel, e.g., a username or IP address. Empty for the system.
+		Painter string
+		// The painter undid their last paint of the pixel (see BlockRepo.UndoPixel).
+		// Color is unused.
+		Undo bool
+	}
+
+	HistoryQuery struct {
+		// Only pixels under these coordinates. The empty coords match everything.
+		Coords Coords
+		// Only the pixel at Coords, not the pixels under it.
+		Exact bool
+		// Inclusive start time. Zero for no start.
+		Since UnixMillis
+		// Exclusive end time. Zero for no end.
+		Until UnixMillis
+		// Most entries returned. Zero for no limit.
+		Limit int
+		// Oldest first instead of newest first, e.g., to replay the entries.
+		Oldest bool
+	}
+
+	HistoryRepo interface {
+		// Records entries. They're expected to be in time order.
+		Append(entries []HistoryEntry) error
+
+		// Returns the matching entries, newest first unless the query is for the oldest.
+		Query(query HistoryQuery) ([]HistoryEntry, error)
+
+		// Removes the entries from before the given time. Returns how many were removed.
+		Prune(before UnixMillis) (int, error)
+
+		Close() error
+	}
+)
+
+// ---------------------------------------------------------------------------------------
+// True if the entry is in the query's time range and area.
+func (q *HistoryQuery) matches(entry *HistoryEntry) bool {
+	return entry.Time >= q.Since &&
+		(q.Until == 0 || entry.Time < q.Until) &&
+		entry.Coords.HasPrefix(q.Coords) &&
+		(!q.Exact || entry.Coords.BitLength() == q.Coords.BitLength())
+}
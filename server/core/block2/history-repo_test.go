@@ -0,0 +1,83 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type historyRepoFactory = func(t *testing.T) HistoryRepo
+
+// ---------------------------------------------------------------------------------------
+func createTestMemHistoryRepo(t *testing.T) HistoryRepo {
+	return CreateMemHistoryRepo()
+}
+
+func TestMemHistoryRepo(t *testing.T) { testHistoryRepo(t, createTestMemHistoryRepo) }
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testHistoryRepo(t *testing.T, createRepo historyRepoFactory) {
+	repo := createRepo(t)
+
+	a := coordsFromBits("10 000000", "01 000000")
+	b := coordsFromBits("10 000001", "01 000000")
+	// Shares the first byte of its key with a and b, but is in another block.
+	c := coordsFromBits("11 000000", "01 000000")
+	entries := []HistoryEntry{
+		{1000, a, Color(0x00F), "1.2.3.4", false},
+		{2000, b, Color(0x0F0), "alice", false},
+		{3000, c, Color(0xF00), "1.2.3.4", false},
+		{4000, a, Color(0xFFF), "", false},
+		{5000, b, 0, "alice", true},
+	}
+	assert.NoError(t, repo.Append(entries[:2]))
+	assert.NoError(t, repo.Append(entries[2:]))
+
+	query := func(q HistoryQuery) []HistoryEntry {
+		results, err := repo.Query(q)
+		assert.NoError(t, err)
+		return results
+	}
+	pick := func(indexes ...int) []HistoryEntry {
+		var results []HistoryEntry
+		for _, index := range indexes {
+			results = append(results, entries[index])
+		}
+		return results
+	}
+
+	//////////////////////////////////////////////////////////////////////////
+	// Newest first, by area, pixel and time.
+	assert.Equal(t, pick(4, 3, 2, 1, 0), query(HistoryQuery{Coords: MakeEmptyCoords()}))
+	assert.Equal(t, pick(4, 3, 1, 0), query(HistoryQuery{Coords: a.ParentOfPixel()}))
+	assert.Equal(t, pick(3, 0), query(HistoryQuery{Coords: a}))
+	assert.Equal(t, pick(2), query(HistoryQuery{Coords: c.ParentOfPixel()}))
+	assert.Equal(t, pick(2, 1), query(HistoryQuery{Coords: MakeEmptyCoords(), Since: 2000, Until: 4000}))
+	assert.Equal(t, pick(4, 3), query(HistoryQuery{Coords: a.ParentOfPixel(), Limit: 2}))
+	assert.Empty(t, query(HistoryQuery{Coords: coordsFromBits("0", "0")}))
+
+	// Only the pixel itself.
+	assert.Equal(t, pick(3, 0), query(HistoryQuery{Coords: a, Exact: true}))
+	assert.Equal(t, pick(4, 1), query(HistoryQuery{Coords: b, Exact: true}))
+	assert.Empty(t, query(HistoryQuery{Coords: a.ParentOfPixel(), Exact: true}))
+
+	// Oldest first, e.g., for replays.
+	assert.Equal(t, pick(0, 1, 3, 4), query(HistoryQuery{Coords: a.ParentOfPixel(), Oldest: true}))
+	assert.Equal(t, pick(1, 2), query(HistoryQuery{Coords: MakeEmptyCoords(), Since: 2000, Limit: 2, Oldest: true}))
+
+	//////////////////////////////////////////////////////////////////////////
+	// Retention removes the oldest entries.
+	count, err := repo.Prune(3000)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, pick(4, 3, 2), query(HistoryQuery{Coords: MakeEmptyCoords()}))
+	assert.Equal(t, pick(3), query(HistoryQuery{Coords: a, Exact: true}))
+	assert.Equal(t, pick(4), query(HistoryQuery{Coords: b, Exact: true, Oldest: true}))
+	count, err = repo.Prune(3000)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
@@ -5,7 +5,11 @@
 package block2
 
 import (
+	"container/list"
 	"errors"
+	"math"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,15 +29,63 @@ type UnixMillis = int64
 // ---------------------------------------------------------------------------------------
 type (
 	MemBlock struct {
-		Pixels  []Pixel
+		Pixels []Pixel
+		// The low nibbles of 24-bit blocks, see Block.Fine. Nil for 12-bit blocks.
+		Fine []Pixel
+		// Drying deadlines of the wet pixels, by pixel index. Dry and unpainted pixels
+		// have no entry, and the map is nil when nothing in the block is wet, so only
+		// busy blocks pay for it.
+		DryTimes map[uint16]UnixMillis
+		// No later than the earliest deadline in DryTimes, and the latest one, or zeros
+		// when nothing is wet, so a block doesn't need a scan to know that nothing is due.
+		// FirstDryTime can be early after a deadline is replaced or removed, which only
+		// costs a scan once that time passes. Change the deadlines with setDryTime.
+		FirstDryTime UnixMillis
+		LastDryTime  UnixMillis
+		// DryTimes was handed out by toBlock, so it's cloned before it's changed.
+		dryTimesShared bool
+		// What the wet pixels were before they were last painted, by pixel index, for
+		// UndoPixel. Entries are removed when the pixel dries, and the map is nil when
+		// it's empty, like DryTimes.
+		Undo map[uint16]PixelUndo
+		// When anything in the block last changed, including bubbled colors and drying.
+		LastUpdated UnixMillis
+	}
+
+	// The state of a pixel before it was painted. Pixel has the flags and painted color
+	// only, since the inherited color may have changed since, and DryTime is zero if the
+	// pixel was unset. Fine has the low nibbles of the painted color in 24-bit blocks.
+	PixelUndo struct {
+		Pixel   Pixel
+		Fine    Pixel
 		DryTime UnixMillis
 	}
 
 	MemBlockRepo struct {
-		Clock    ClockService
-		Blocks   map[string]*MemBlock
+		Clock ClockService
+		// Blocks are kept encoded (see encodeMemBlock), which is a fraction of the size
+		// for most blocks. The recently used ones are also kept decoded in a write-back
+		// cache, so the encoded data of a cached block is stale until flushBlocks.
+		blocks map[string][]byte
+		cache  map[string]*list.Element
+		// Most recently used first.
+		cacheOrder *list.List
+		cacheSize  int
+		// Every block key, sorted, so HasBlocksUnder can find the keys with a prefix like
+		// the bolt and SQL repos do.
+		keys     []string
 		mutex    sync.Mutex
-		maxDepth int
+		settings paintSettings
+		listener BlockEventListener
+		// Earliest drying deadline of each block with wet pixels, for DryPixels.
+		wetBlocks map[string]UnixMillis
+	}
+
+	memBlockCacheEntry struct {
+		key   string
+		block *MemBlock
+		// Changed since it was last encoded.
+		dirty bool
 	}
 )
 
@@ -41,180 +93,337 @@ var ErrMaxDepthExceeded = errors.New("max depth exceeded")
 
 const DefaultMemBlockRepoMaxDepth = 100
 
+// Decoded blocks kept in memory. The blocks above a painted pixel are loaded by every
+// paint under them, so only a few need to stay decoded.
+const memBlockCacheSize = 1024
+
 // ---------------------------------------------------------------------------------------
 func CreateMemBlockRepo(cs ClockService) BlockRepo {
 	log.Warnln(nil, "Using in-memory blockrepo. This implementation is for testing purposes and is not persisted.")
-	blocks := make(map[string]*MemBlock)
+	return newMemBlockRepo(cs)
+}
+
+// ---------------------------------------------------------------------------------------
+// An in-memory repo for replaying the paint history, where pixels never dry. Every pixel
+// in the history was painted over a wet pixel or none, so it's accepted again.
+func CreateReplayBlockRepo(cs ClockService) BlockRepo {
+	repo := newMemBlockRepo(cs)
+	repo.settings.dryTime = func(Coords) UnixMillis {
+		return math.MaxInt64 / 2
+	}
+	return repo
+}
+
+// ---------------------------------------------------------------------------------------
+func newMemBlockRepo(cs ClockService) *MemBlockRepo {
 	return &MemBlockRepo{
-		Clock:    cs,
-		Blocks:   blocks,
-		maxDepth: DefaultMemBlockRepoMaxDepth,
+		Clock:      cs,
+		blocks:     make(map[string][]byte),
+		cache:      make(map[string]*list.Element),
+		cacheOrder: list.New(),
+		cacheSize:  memBlockCacheSize,
+		settings:   defaultPaintSettings(),
+		wetBlocks:  make(map[string]UnixMillis),
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Replaces all blocks, e.g., with ones loaded from a snapshot.
+func (r *MemBlockRepo) setBlocks(blocks map[string]*MemBlock) {
+	cat.EnsureLocked(&r.mutex)
+
+	r.blocks = make(map[string][]byte, len(blocks))
+	r.cache = make(map[string]*list.Element)
+	r.cacheOrder.Init()
+	r.wetBlocks = make(map[string]UnixMillis)
+	r.keys = make([]string, 0, len(blocks))
+	for key, block := range blocks {
+		r.blocks[key] = encodeMemBlock(block)
+		r.indexWetBlock(key, block)
+		r.keys = append(r.keys, key)
 	}
+	slices.Sort(r.keys)
 }
 
 // ---------------------------------------------------------------------------------------
-// This is called when we load the block. When the dry time expires, any pending pixels
-// are dried.
-func (r *MemBlockRepo) dryBlock(block *MemBlock) {
+// Encodes the changed blocks in the cache, so the encoded blocks are all current.
+func (r *MemBlockRepo) flushBlocks() {
 	cat.EnsureLocked(&r.mutex)
 
-	if block.DryTime > 0 && r.Clock.Now().UnixMilli() >= block.DryTime {
-		block.DryTime = 0
-		for i := range block.Pixels {
-			if block.Pixels[i]&PIXEL_SET != 0 {
-				block.Pixels[i] |= PIXEL_DRY
-			}
+	for element := r.cacheOrder.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*memBlockCacheEntry)
+		if entry.dirty {
+			r.blocks[entry.key] = encodeMemBlock(entry.block)
+			entry.dirty = false
 		}
 	}
 }
 
 // ---------------------------------------------------------------------------------------
-func (r *MemBlockRepo) GetBlock(coords Coords) (*Block, error) {
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
+func (r *MemBlockRepo) cacheBlock(key string, block *MemBlock, dirty bool) {
+	if element, ok := r.cache[key]; ok {
+		entry := element.Value.(*memBlockCacheEntry)
+		entry.block = block
+		entry.dirty = entry.dirty || dirty
+		r.cacheOrder.MoveToFront(element)
+		return
+	}
 
-	block, ok := r.Blocks[string(coords.ToBytes())]
-	if !ok {
-		return nil, ErrBlockNotFound
+	r.cache[key] = r.cacheOrder.PushFront(&memBlockCacheEntry{key, block, dirty})
+	for r.cacheOrder.Len() > r.cacheSize {
+		oldest := r.cacheOrder.Remove(r.cacheOrder.Back()).(*memBlockCacheEntry)
+		if oldest.dirty {
+			r.blocks[oldest.key] = encodeMemBlock(oldest.block)
+		}
+		delete(r.cache, oldest.key)
 	}
+}
 
-	r.dryBlock(block)
-	return &Block{
-		Pixels: block.Pixels,
-	}, nil
+// ---------------------------------------------------------------------------------------
+func (r *MemBlockRepo) indexWetBlock(key string, block *MemBlock) {
+	if block.FirstDryTime > 0 {
+		r.wetBlocks[key] = block.FirstDryTime
+	} else {
+		delete(r.wetBlocks, key)
+	}
 }
 
 // ---------------------------------------------------------------------------------------
-func (r *MemBlockRepo) getOrCreateBlock(coords Coords) *MemBlock {
+func (r *MemBlockRepo) loadBlock(key string) (*MemBlock, error) {
 	cat.EnsureLocked(&r.mutex)
+	if element, ok := r.cache[key]; ok {
+		r.cacheOrder.MoveToFront(element)
+		return element.Value.(*memBlockCacheEntry).block, nil
+	}
 
-	block, ok := r.Blocks[string(coords.ToBytes())]
+	data, ok := r.blocks[key]
 	if !ok {
-		block = &MemBlock{
-			Pixels: make([]Pixel, 64*64),
-		}
-		r.Blocks[string(coords.ToBytes())] = block
+		return nil, nil
 	}
-	return block
+	block, err := decodeMemBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	r.cacheBlock(key, block, false)
+	return block, nil
 }
 
 // ---------------------------------------------------------------------------------------
-func (r *MemBlockRepo) bubbleColor(coords Coords) {
+func (r *MemBlockRepo) saveBlock(key string, block *MemBlock) error {
 	cat.EnsureLocked(&r.mutex)
-
-	if coords.BitLength() <= 6 {
-		return // At the top level.
-	}
-	blockCoords := coords.ParentOfPixel()
-	block := r.getOrCreateBlock(blockCoords)
-
-	// Gather 4 pixels
-	pixelIndex := coords.PixelIndex()
-	pixelIndex &= 0o7676
-
-	sum_r := 0
-	sum_g := 0
-	sum_b := 0
-	sum_a := 0
-
-	for py := 0; py < 2; py++ {
-		for px := 0; px < 2; px++ {
-			index := pixelIndex + py*64 + px
-			pixelData := block.Pixels[index]
-			if pixelData&PIXEL_SET != 0 {
-
-				painted := int((pixelData >> 16) & 0xFFF)
-				inherited := int((pixelData) & 0xFFFF)
-				alpha2 := inherited >> 12
-				alpha1 := 15 - alpha2
-
-				sum_a += 15
-				sum_r += (painted&0xF)*alpha1 + (inherited&0xF)*alpha2
-				sum_g += ((painted>>4)&0xF)*alpha1 + ((inherited>>4)&0xF)*alpha2
-				sum_b += ((painted>>8)&0xF)*alpha1 + ((inherited>>8)&0xF)*alpha2
-			} else {
-				// inherited only
-				if pixelData&0xF000 == 0 {
-					// Nothing inherited (alpha is zero). This will be treated like a
-					// transparent spot and lower the alpha.
-					continue
-				}
-				inherited := int(pixelData & 0xFFFF)
-				alpha := inherited >> 12
-				sum_a += alpha
-				sum_r += (inherited & 0xF) * alpha
-				sum_g += ((inherited >> 4) & 0xF) * alpha
-				sum_b += ((inherited >> 8) & 0xF) * alpha
-			}
-		}
+	if index, found := slices.BinarySearch(r.keys, key); !found {
+		r.keys = slices.Insert(r.keys, index, key)
 	}
+	r.cacheBlock(key, block, true)
+	r.indexWetBlock(key, block)
+	return nil
+}
 
-	sum_r = (sum_r + (sum_a >> 1)) / sum_a
-	sum_g = (sum_g + (sum_a >> 1)) / sum_a
-	sum_b = (sum_b + (sum_a >> 1)) / sum_a
-	sum_a /= 4
+// ---------------------------------------------------------------------------------------
+func (r *MemBlockRepo) GetBlock(coords Coords) (*Block, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	if sum_a == 0 {
-		return // Nothing more to bubble.
+	// Reading goes through a transaction too, since drying changes the block in place.
+	tx := beginPaintTx(r, r.Clock.Now().UnixMilli(), r.settings)
+	block, err := tx.findBlock(coords)
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, ErrBlockNotFound
+	}
+	if err := tx.commit(); err != nil {
+		return nil, err
 	}
+	publishBlockEvents(r.listener, tx.events)
 
-	computed := sum_r | (sum_g << 4) | (sum_b << 8) | (sum_a << 12)
+	return block.toBlock(), nil
+}
 
-	coords = coords.Up(1)
-	upperBlockCoords := coords.ParentOfPixel()
-	upperBlock := r.getOrCreateBlock(upperBlockCoords)
-	upperPixelIndex := coords.PixelIndex()
+// ---------------------------------------------------------------------------------------
+func (r *MemBlockRepo) GetBlocks(coords []Coords) ([]*Block, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	upperPixelValue := upperBlock.Pixels[upperPixelIndex]
-	if int(upperPixelValue&0xFFFF) == computed {
-		return // No change, stop the bubble.
+	tx := beginPaintTx(r, r.Clock.Now().UnixMilli(), r.settings)
+	blocks := make([]*Block, len(coords))
+	for i, c := range coords {
+		block, err := tx.findBlock(c)
+		if err != nil {
+			return nil, err
+		}
+		if block != nil {
+			blocks[i] = block.toBlock()
+		}
+	}
+	if err := tx.commit(); err != nil {
+		return nil, err
 	}
-	upperBlock.Pixels[upperPixelIndex] = (upperPixelValue & 0xFFFF0000) | Pixel(computed)
+	publishBlockEvents(r.listener, tx.events)
 
-	r.bubbleColor(coords)
+	return blocks, nil
 }
 
 // ---------------------------------------------------------------------------------------
-func (r *MemBlockRepo) SetPixel(coords Coords, color Color) error {
+// Scans the keys that start with the coords' key prefix, which are sorted together.
+func (r *MemBlockRepo) HasBlocksUnder(coords Coords, levels int) (bool, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	blockCoords := coords.ParentOfPixel()
-	if blockCoords.BitLength() > r.maxDepth {
-		return ErrMaxDepthExceeded
+	prefix := string(coords.keyPrefix())
+	index, _ := slices.BinarySearch(r.keys, prefix)
+	for _, key := range r.keys[index:] {
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		if coords.keyIsUnder([]byte(key), levels) {
+			return true, nil
+		}
 	}
-	block := r.getOrCreateBlock(blockCoords)
-	r.dryBlock(block)
+	return false, nil
+}
 
-	pixelIndex := coords.PixelIndex()
+// ---------------------------------------------------------------------------------------
+func (r *MemBlockRepo) SetPixel(coords Coords, color Color) error {
+	return singlePaintResult(r.SetPixels([]PixelPaint{{coords, color}}))
+}
 
-	if block.Pixels[pixelIndex]&PIXEL_DRY != 0 {
-		return ErrPixelIsDry
+// ---------------------------------------------------------------------------------------
+func (r *MemBlockRepo) SetPixels(pixels []PixelPaint) ([]error, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.setPixelsAt(pixels, r.Clock.Now().UnixMilli(), r.settings)
+}
+
+// ---------------------------------------------------------------------------------------
+// Paints as if the current time is `now`, with the given settings instead of the repo's.
+// Used to replay logged operations.
+func (r *MemBlockRepo) setPixelsAt(pixels []PixelPaint, now UnixMillis, settings paintSettings) ([]error, error) {
+	cat.EnsureLocked(&r.mutex)
+
+	// Rejected pixels are still committed. Loading the blocks may have dried them.
+	tx := beginPaintTx(r, now, settings)
+	results, err := tx.setPixels(pixels)
+	if err != nil {
+		return nil, err
 	}
+	if err := tx.commit(); err != nil {
+		return nil, err
+	}
+	publishBlockEvents(r.listener, tx.events)
+	return results, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *MemBlockRepo) UndoPixel(coords Coords) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	// Mask out existing color.
-	pixelValue := block.Pixels[pixelIndex] & 0xF000FFFF
+	return r.undoPixelAt(coords, r.Clock.Now().UnixMilli())
+}
 
-	if pixelValue&0xF000 == 0xF000 {
-		// Lower layer is overwriting this pixel completely. Treat it as dry.
-		return ErrPixelIsDry
+// ---------------------------------------------------------------------------------------
+// Undoes as if the current time is `now`. Used to replay logged operations.
+func (r *MemBlockRepo) undoPixelAt(coords Coords, now UnixMillis) error {
+	cat.EnsureLocked(&r.mutex)
+
+	// Rejections are still committed. Loading the block may have dried it.
+	tx := beginPaintTx(r, now, r.settings)
+	result := tx.undoPixel(coords)
+	if result != nil && !isPaintRejection(result) {
+		return result
+	}
+	if err := tx.commit(); err != nil {
+		return err
 	}
+	publishBlockEvents(r.listener, tx.events)
+	return result
+}
 
-	// Set new color.
-	pixelValue |= Pixel(color) << 16
-	pixelValue |= PIXEL_SET
+// ---------------------------------------------------------------------------------------
+// Blocks are converted a cache's worth at a time, so they don't all have to be decoded
+// at once.
+func (r *MemBlockRepo) UpgradeColorDepth() (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	block.Pixels[pixelIndex] = pixelValue
+	return r.upgradeColorDepth()
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *MemBlockRepo) upgradeColorDepth() (int, error) {
+	cat.EnsureLocked(&r.mutex)
 
-	block.DryTime = r.Clock.Now().UnixMilli() + 5000 // Debug. This is computed by layer
-	r.bubbleColor(coords)
+	// New blocks can be in the cache without being encoded yet.
+	r.flushBlocks()
+	keys := slices.Clone(r.keys)
 
+	upgraded := 0
+	for start := 0; start < len(keys); start += r.cacheSize {
+		tx := beginPaintTx(r, r.Clock.Now().UnixMilli(), r.settings)
+		count, err := tx.upgradeBlocks(keys[start:min(start+r.cacheSize, len(keys))])
+		if err != nil {
+			return upgraded, err
+		}
+		if err := tx.commit(); err != nil {
+			return upgraded, err
+		}
+		publishBlockEvents(r.listener, tx.events)
+		upgraded += count
+	}
+	return upgraded, nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Dries all pixels that have reached their deadline.
+func (r *MemBlockRepo) DryPixels() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.Clock.Now().UnixMilli()
+	var keys []string
+	for key, first := range r.wetBlocks {
+		if now >= first {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	tx := beginPaintTx(r, now, r.settings)
+	if err := tx.dryBlocks(keys); err != nil {
+		return err
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	publishBlockEvents(r.listener, tx.events)
 	return nil
 }
 
+// ---------------------------------------------------------------------------------------
+func (r *MemBlockRepo) SetEventListener(listener BlockEventListener) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.listener = listener
+}
+
+// ---------------------------------------------------------------------------------------
 func (r *MemBlockRepo) SetMaxDepth(depth int) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	r.maxDepth = depth
+	r.settings.maxDepth = depth
+}
+
+// ---------------------------------------------------------------------------------------
+// Changes how long painted pixels take to dry. Pixels that are already wet keep their
+// current deadline.
+func (r *MemBlockRepo) SetDryingPolicy(policy *DryingPolicy) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.settings.dryTime = policy.GetDryTime
 }
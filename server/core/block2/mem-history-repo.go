@@ -0,0 +1,102 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"sort"
+	"sync"
+)
+
+// In-memory paint history, for testing. Entries are kept in the order they're appended.
+
+type MemHistoryRepo struct {
+	entries []HistoryEntry
+	// Entries removed by Prune. The entry at entries[i] is number pruned+i.
+	pruned int
+	// Entry numbers of each pixel, oldest first, by coords key (see Coords.ToBytes). Exact
+	// queries like undo's only visit the pixel's own entries.
+	pixels map[string][]int
+	mutex  sync.Mutex
+}
+
+// ---------------------------------------------------------------------------------------
+func CreateMemHistoryRepo() *MemHistoryRepo {
+	log.Warnln(nil, "Using in-memory history. This implementation is for testing purposes and is not persisted.")
+	return &MemHistoryRepo{
+		pixels: make(map[string][]int),
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *MemHistoryRepo) Append(entries []HistoryEntry) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, entry := range entries {
+		key := string(entry.Coords.ToBytes())
+		r.pixels[key] = append(r.pixels[key], r.pruned+len(r.entries))
+		r.entries = append(r.entries, entry)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *MemHistoryRepo) Query(query HistoryQuery) ([]HistoryEntry, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Entry numbers to visit, oldest first, or nil for all of them.
+	var numbers []int
+	count := len(r.entries)
+	if query.Exact {
+		numbers = r.pixels[string(query.Coords.ToBytes())]
+		count = len(numbers)
+	}
+
+	var results []HistoryEntry
+	for i := 0; i < count; i++ {
+		if query.Limit != 0 && len(results) == query.Limit {
+			break
+		}
+		index := count - 1 - i
+		if query.Oldest {
+			index = i
+		}
+		if numbers != nil {
+			index = numbers[index] - r.pruned
+		}
+		if query.matches(&r.entries[index]) {
+			results = append(results, r.entries[index])
+		}
+	}
+	return results, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *MemHistoryRepo) Prune(before UnixMillis) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	count := sort.Search(len(r.entries), func(i int) bool {
+		return r.entries[i].Time >= before
+	})
+	// The removed entries are the oldest of each of their pixels.
+	for _, entry := range r.entries[:count] {
+		key := string(entry.Coords.ToBytes())
+		if numbers := r.pixels[key][1:]; len(numbers) > 0 {
+			r.pixels[key] = numbers
+		} else {
+			delete(r.pixels, key)
+		}
+	}
+	r.entries = append([]HistoryEntry{}, r.entries[count:]...)
+	r.pruned += count
+	return count, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *MemHistoryRepo) Close() error {
+	return nil
+}
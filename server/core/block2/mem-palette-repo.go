@@ -0,0 +1,71 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"slices"
+	"sync"
+)
+
+// In-memory palette zones, for testing.
+
+type MemPaletteRepo struct {
+	zones map[string]PaletteZone
+	mutex sync.Mutex
+}
+
+// ---------------------------------------------------------------------------------------
+func CreateMemPaletteRepo() *MemPaletteRepo {
+	log.Warnln(nil, "Using in-memory palette zones. This implementation is for testing purposes and is not persisted.")
+	return &MemPaletteRepo{
+		zones: map[string]PaletteZone{},
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *MemPaletteRepo) Put(zone PaletteZone) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	zone.Palette = slices.Clone(zone.Palette)
+	r.zones[string(zone.Coords.ToBytes())] = zone
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *MemPaletteRepo) Delete(coords Coords) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key := string(coords.ToBytes())
+	_, found := r.zones[key]
+	delete(r.zones, key)
+	return found, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *MemPaletteRepo) List() ([]PaletteZone, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	keys := make([]string, 0, len(r.zones))
+	for key := range r.zones {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var zones []PaletteZone
+	for _, key := range keys {
+		zone := r.zones[key]
+		zone.Palette = slices.Clone(zone.Palette)
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *MemPaletteRepo) Close() error {
+	return nil
+}
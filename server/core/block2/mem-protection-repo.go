@@ -0,0 +1,68 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"slices"
+	"sync"
+)
+
+// In-memory protected zones, for testing.
+
+type MemProtectionRepo struct {
+	zones map[string]ProtectedZone
+	mutex sync.Mutex
+}
+
+// ---------------------------------------------------------------------------------------
+func CreateMemProtectionRepo() *MemProtectionRepo {
+	log.Warnln(nil, "Using in-memory protected zones. This implementation is for testing purposes and is not persisted.")
+	return &MemProtectionRepo{
+		zones: map[string]ProtectedZone{},
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *MemProtectionRepo) Put(zone ProtectedZone) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.zones[string(zone.Coords.ToBytes())] = zone
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *MemProtectionRepo) Delete(coords Coords) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key := string(coords.ToBytes())
+	_, found := r.zones[key]
+	delete(r.zones, key)
+	return found, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *MemProtectionRepo) List() ([]ProtectedZone, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	keys := make([]string, 0, len(r.zones))
+	for key := range r.zones {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var zones []ProtectedZone
+	for _, key := range keys {
+		zones = append(zones, r.zones[key])
+	}
+	return zones, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *MemProtectionRepo) Close() error {
+	return nil
+}
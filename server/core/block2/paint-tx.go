@@ -0,0 +1,664 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"maps"
+	"slices"
+	"strings"
+)
+
+// The painting logic is shared by all storage backends. A backend implements blockStore
+// and each operation runs inside of a paintTx, which caches the blocks that it touches
+// and writes the modified ones back when the operation is committed.
+
+// ---------------------------------------------------------------------------------------
+type blockStore interface {
+	// Returns nil (without an error) if the block does not exist.
+	loadBlock(key string) (*MemBlock, error)
+	saveBlock(key string, block *MemBlock) error
+}
+
+// ---------------------------------------------------------------------------------------
+type (
+	// Repository settings that paint operations depend on.
+	paintSettings struct {
+		maxDepth int
+		// Returns how long the pixel at the given coordinates takes to dry, in
+		// milliseconds.
+		dryTime func(pixelCoords Coords) UnixMillis
+	}
+
+	paintTx struct {
+		store    blockStore
+		now      UnixMillis
+		settings paintSettings
+		blocks   map[string]*MemBlock
+		dirty    map[string]bool
+		// Published by the repo once the transaction is saved.
+		events []BlockEvent
+		// Pixels painted or bubbled so far, by event type and block key. These are turned
+		// into events when the transaction is committed.
+		changes map[BlockEventType]map[string]map[uint16]bool
+	}
+)
+
+// ---------------------------------------------------------------------------------------
+func defaultPaintSettings() paintSettings {
+	return paintSettings{
+		maxDepth: DefaultMemBlockRepoMaxDepth,
+		dryTime:  DefaultDryingPolicy().GetDryTime,
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+func beginPaintTx(store blockStore, now UnixMillis, settings paintSettings) *paintTx {
+	return &paintTx{
+		store:    store,
+		now:      now,
+		settings: settings,
+		blocks:   make(map[string]*MemBlock),
+		dirty:    make(map[string]bool),
+		changes:  make(map[BlockEventType]map[string]map[uint16]bool),
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Rejections are expected outcomes of a paint operation. Any other error is a storage
+// failure.
+func isPaintRejection(err error) bool {
+	return err == ErrPixelIsDry || err == ErrMaxDepthExceeded || err == ErrNothingToUndo
+}
+
+// ---------------------------------------------------------------------------------------
+// Unwraps the result of a batch of one pixel, for SetPixel.
+func singlePaintResult(results []error, err error) error {
+	if err != nil {
+		return err
+	}
+	return results[0]
+}
+
+// ---------------------------------------------------------------------------------------
+// Dries the pixels whose deadlines have passed. This is called whenever a block is
+// loaded. Returns the indexes of the pixels that dried, in ascending order.
+//
+// LastUpdated becomes the latest deadline that passed rather than the current time, so
+// it's the same whether the drying was saved or only seen by a reader.
+func dryBlock(block *MemBlock, now UnixMillis) []uint16 {
+	if block.FirstDryTime == 0 || now < block.FirstDryTime {
+		return nil
+	}
+
+	block.ownDryTimes()
+	var dried []uint16
+	block.FirstDryTime, block.LastDryTime = 0, 0
+	for index, dryTime := range block.DryTimes {
+		if now >= dryTime {
+			block.Pixels[index] |= PIXEL_DRY
+			delete(block.DryTimes, index)
+			delete(block.Undo, index)
+			dried = append(dried, index)
+			block.LastUpdated = max(block.LastUpdated, dryTime)
+		} else {
+			block.includeDryTime(dryTime)
+		}
+	}
+	if len(block.DryTimes) == 0 {
+		block.DryTimes = nil
+	}
+	if len(block.Undo) == 0 {
+		block.Undo = nil
+	}
+	slices.Sort(dried)
+	return dried
+}
+
+// ---------------------------------------------------------------------------------------
+// Sets the drying deadline of a pixel, or removes it if the deadline is zero.
+func (b *MemBlock) setDryTime(index uint16, dryTime UnixMillis) {
+	b.ownDryTimes()
+	old := b.DryTimes[index]
+	if dryTime == 0 {
+		delete(b.DryTimes, index)
+		if len(b.DryTimes) == 0 {
+			b.DryTimes = nil
+		}
+	} else {
+		if b.DryTimes == nil {
+			b.DryTimes = make(map[uint16]UnixMillis)
+		}
+		b.DryTimes[index] = dryTime
+	}
+
+	// Only an earlier latest deadline needs a scan. See MemBlock.FirstDryTime.
+	if b.DryTimes == nil {
+		b.FirstDryTime, b.LastDryTime = 0, 0
+	} else if old == b.LastDryTime && (dryTime == 0 || dryTime < old) {
+		b.updateDryTimeRange()
+	} else if dryTime != 0 {
+		b.includeDryTime(dryTime)
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+func (b *MemBlock) includeDryTime(dryTime UnixMillis) {
+	if b.FirstDryTime == 0 || dryTime < b.FirstDryTime {
+		b.FirstDryTime = dryTime
+	}
+	b.LastDryTime = max(b.LastDryTime, dryTime)
+}
+
+// ---------------------------------------------------------------------------------------
+// Sets FirstDryTime and LastDryTime from DryTimes, e.g., after the block is decoded.
+func (b *MemBlock) updateDryTimeRange() {
+	b.FirstDryTime, b.LastDryTime = 0, 0
+	for _, dryTime := range b.DryTimes {
+		b.includeDryTime(dryTime)
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+func (b *MemBlock) ownDryTimes() {
+	if b.dryTimesShared {
+		b.DryTimes = maps.Clone(b.DryTimes)
+		b.dryTimesShared = false
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// The Block shares the block's data, which the caller must not change. DryTimes is
+// cloned by the block if it changes later, since readers can still be using it.
+func (b *MemBlock) toBlock() *Block {
+	b.dryTimesShared = b.DryTimes != nil
+	return &Block{
+		Pixels:      b.Pixels,
+		Fine:        b.Fine,
+		LastUpdated: b.LastUpdated,
+		DryTime:     b.LastDryTime,
+		DryTimes:    b.DryTimes,
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Converts a 12-bit block to 24 bits. A 4-bit channel v becomes v*17, whose nibbles are
+// both v, so the low nibbles are a copy of the high ones.
+func (b *MemBlock) upgrade() {
+	b.Fine = make([]Pixel, len(b.Pixels))
+	for i, pixel := range b.Pixels {
+		b.Fine[i] = pixel & 0x0FFFFFFF
+	}
+	for index, undo := range b.Undo {
+		undo.Fine = undo.Pixel & 0x0FFF0000
+		b.Undo[index] = undo
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Replaces the inherited color and alpha of a pixel, at the precision of the block.
+func (b *MemBlock) setInherited(index int, values [4]int) {
+	high, low := packChannels(values[:], b.Fine != nil)
+	b.Pixels[index] = b.Pixels[index]&0xFFFF0000 | high
+	if b.Fine != nil {
+		b.Fine[index] = b.Fine[index]&0xFFFF0000 | low
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns nil if the block does not exist.
+func (tx *paintTx) findBlock(coords Coords) (*MemBlock, error) {
+	key := string(coords.ToBytes())
+	if block, ok := tx.blocks[key]; ok {
+		return block, nil
+	}
+
+	block, err := tx.store.loadBlock(key)
+	if err != nil || block == nil {
+		return nil, err
+	}
+
+	if dried := dryBlock(block, tx.now); dried != nil {
+		tx.dirty[key] = true
+		tx.events = append(tx.events, tx.makeEvent(BLOCK_EVENT_PIXELS_DRIED, coords, block, dried))
+	}
+	tx.blocks[key] = block
+	return block, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (tx *paintTx) getOrCreateBlock(coords Coords) (*MemBlock, error) {
+	block, err := tx.findBlock(coords)
+	if err != nil {
+		return nil, err
+	}
+
+	if block == nil {
+		key := string(coords.ToBytes())
+		block = &MemBlock{
+			Pixels: make([]Pixel, 64*64),
+		}
+		tx.blocks[key] = block
+		tx.dirty[key] = true
+	}
+	return block, nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Loads the given blocks so that any expired pixels are dried. Used by DryPixels with the
+// blocks that a backend knows to be wet.
+func (tx *paintTx) dryBlocks(keys []string) error {
+	for _, key := range keys {
+		if _, err := tx.findBlock(CoordsFromBytes([]byte(key))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Converts the given blocks to 24 bits. Returns how many were converted. LastUpdated
+// changes so that cached copies are refreshed with the new precision.
+func (tx *paintTx) upgradeBlocks(keys []string) (int, error) {
+	upgraded := 0
+	for _, key := range keys {
+		block, err := tx.findBlock(CoordsFromBytes([]byte(key)))
+		if err != nil {
+			return 0, err
+		}
+		if block == nil || block.Fine != nil {
+			continue
+		}
+		block.upgrade()
+		block.LastUpdated = tx.now
+		tx.dirty[key] = true
+		upgraded++
+	}
+	return upgraded, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (tx *paintTx) markDirty(coords Coords) {
+	tx.dirty[string(coords.ToBytes())] = true
+}
+
+// ---------------------------------------------------------------------------------------
+// Records a changed pixel for the events of this transaction.
+func (tx *paintTx) notePixel(eventType BlockEventType, blockCoords Coords, index int) {
+	blocks := tx.changes[eventType]
+	if blocks == nil {
+		blocks = make(map[string]map[uint16]bool)
+		tx.changes[eventType] = blocks
+	}
+	key := string(blockCoords.ToBytes())
+	if blocks[key] == nil {
+		blocks[key] = make(map[uint16]bool)
+	}
+	blocks[key][uint16(index)] = true
+}
+
+// ---------------------------------------------------------------------------------------
+func (tx *paintTx) makeEvent(eventType BlockEventType, coords Coords, block *MemBlock, pixels []uint16) BlockEvent {
+	values := make([]Pixel, len(pixels))
+	var fine []Pixel
+	if block.Fine != nil {
+		fine = make([]Pixel, len(pixels))
+	}
+	for i, index := range pixels {
+		values[i] = block.Pixels[index]
+		if fine != nil {
+			fine[i] = block.Fine[index]
+		}
+	}
+	return BlockEvent{
+		Type:   eventType,
+		Block:  coords,
+		Pixels: pixels,
+		Values: values,
+		Fine:   fine,
+		Time:   tx.now,
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Turns the recorded changes into events, painted pixels first, then bubbled pixels from
+// the deepest block up. Values are taken at this point, so each event has the final
+// state of its pixels.
+func (tx *paintTx) flushChanges() {
+	for _, eventType := range []BlockEventType{BLOCK_EVENT_PIXELS_SET, BLOCK_EVENT_PIXELS_BUBBLED} {
+		blocks := tx.changes[eventType]
+		keys := make([]string, 0, len(blocks))
+		for key := range blocks {
+			keys = append(keys, key)
+		}
+		slices.SortFunc(keys, func(a, b string) int {
+			depthA := CoordsFromBytes([]byte(a)).BitLength()
+			depthB := CoordsFromBytes([]byte(b)).BitLength()
+			if depthA != depthB {
+				return depthB - depthA
+			}
+			return strings.Compare(a, b)
+		})
+
+		for _, key := range keys {
+			pixels := make([]uint16, 0, len(blocks[key]))
+			for index := range blocks[key] {
+				pixels = append(pixels, index)
+			}
+			slices.Sort(pixels)
+			coords := CoordsFromBytes([]byte(key))
+			tx.events = append(tx.events, tx.makeEvent(eventType, coords, tx.blocks[key], pixels))
+		}
+	}
+	tx.changes = make(map[BlockEventType]map[string]map[uint16]bool)
+}
+
+// ---------------------------------------------------------------------------------------
+// Writes all modified blocks back to the store.
+func (tx *paintTx) commit() error {
+	for key := range tx.dirty {
+		if err := tx.store.saveBlock(key, tx.blocks[key]); err != nil {
+			return err
+		}
+	}
+	tx.dirty = make(map[string]bool)
+	tx.flushChanges()
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Recomputes the inherited color of the pixel above `coords` from the 2x2 group that
+// `coords` is in. Returns false if it didn't change, which ends the bubble.
+func (tx *paintTx) bubbleOnce(coords Coords) (bool, error) {
+	if coords.BitLength() <= 6 {
+		return false, nil // At the top level.
+	}
+	blockCoords := coords.ParentOfPixel()
+	block, err := tx.findBlock(blockCoords)
+	if err != nil || block == nil {
+		return false, err // Nothing to bubble, e.g., erasing where nothing was painted.
+	}
+
+	// Gather 4 pixels
+	pixelIndex := coords.PixelIndex()
+	pixelIndex &= 0o7676
+
+	// Channels are at the precision of the block, so full is 15 or 255. Weights are
+	// alphas scaled by full, so that a translucent painted color under the inherited one
+	// keeps its precision. Unpainted pixels have no painted weight, and pixels without
+	// anything inherited either are treated like transparent spots that lower the alpha.
+	var sums [3]int
+	sum_a := 0
+	full := 15
+	if block.Fine != nil {
+		full = 255
+	}
+	for py := 0; py < 2; py++ {
+		for px := 0; px < 2; px++ {
+			pixel := readChannels(block.Pixels, block.Fine, pixelIndex+py*64+px)
+
+			// The inherited color is drawn over the painted one.
+			alpha2 := pixel.Alpha * full
+			alpha1 := pixel.PaintedAlpha * (full - pixel.Alpha)
+			sum_a += alpha1 + alpha2
+			for c := range sums {
+				sums[c] += pixel.Painted[c]*alpha1 + pixel.Inherited[c]*alpha2
+			}
+		}
+	}
+
+	// Too little alpha inherits nothing. That only happens when the group lost its
+	// color, e.g., to an undo, so the pixel above is still cleared.
+	var computed [4]int
+	if sum_a/(4*full) != 0 {
+		for c := range sums {
+			computed[c] = (sums[c] + (sum_a >> 1)) / sum_a
+		}
+		computed[3] = sum_a / (4 * full)
+	}
+
+	coords = coords.Up(1)
+	upperBlockCoords := coords.ParentOfPixel()
+	var upperBlock *MemBlock
+	if computed[3] == 0 {
+		// Nothing to clear if the block doesn't exist.
+		upperBlock, err = tx.findBlock(upperBlockCoords)
+	} else {
+		upperBlock, err = tx.getOrCreateBlock(upperBlockCoords)
+	}
+	if err != nil || upperBlock == nil {
+		return false, err
+	}
+	upperPixelIndex := coords.PixelIndex()
+
+	// The pixel above is compared and written at the higher precision of the two blocks.
+	// 4-bit values expand exactly to 8 bits, and a 12-bit block above a 24-bit one is
+	// converted.
+	deep := block.Fine != nil || upperBlock.Fine != nil
+	upper := readChannels(upperBlock.Pixels, upperBlock.Fine, upperPixelIndex)
+	current := [4]int{upper.Inherited[0], upper.Inherited[1], upper.Inherited[2], upper.Alpha}
+	for c := range computed {
+		if deep && block.Fine == nil {
+			computed[c] *= 17
+		}
+		if deep && upperBlock.Fine == nil {
+			current[c] *= 17
+		}
+	}
+	if current == computed {
+		return false, nil // No change, stop the bubble.
+	}
+	if deep && upperBlock.Fine == nil {
+		upperBlock.upgrade()
+	}
+	upperBlock.setInherited(upperPixelIndex, computed)
+	upperBlock.LastUpdated = tx.now
+	tx.markDirty(upperBlockCoords)
+	tx.notePixel(BLOCK_EVENT_PIXELS_BUBBLED, upperBlockCoords, upperPixelIndex)
+
+	return true, nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Bubbles the colors of the given pixels up the tree. Pixels are processed from the
+// deepest level up, and each 2x2 group is only computed once per level, so ancestors
+// shared by many pixels are updated once.
+func (tx *paintTx) bubbleColors(pixels []Coords) error {
+	// Pending pixels by bit length, keyed by the pixel above them.
+	pending := make(map[int]map[string]Coords)
+	deepest := 0
+	queue := func(coords Coords) {
+		length := coords.BitLength()
+		if length <= 6 {
+			return // At the top level.
+		}
+		if pending[length] == nil {
+			pending[length] = make(map[string]Coords)
+		}
+		pending[length][string(coords.Up(1).ToBytes())] = coords
+		deepest = max(deepest, length)
+	}
+
+	for _, coords := range pixels {
+		queue(coords)
+	}
+
+	for length := deepest; length > 6; length-- {
+		group := pending[length]
+		keys := make([]string, 0, len(group))
+		for key := range group {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		for _, key := range keys {
+			changed, err := tx.bubbleOnce(group[key])
+			if err != nil {
+				return err
+			}
+			if changed {
+				queue(group[key].Up(1))
+			}
+		}
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Paints a pixel without bubbling its color.
+func (tx *paintTx) paintPixel(coords Coords, color Color) error {
+	blockCoords := coords.ParentOfPixel()
+	if blockCoords.BitLength() > tx.settings.maxDepth {
+		return ErrMaxDepthExceeded
+	}
+	var block *MemBlock
+	var err error
+	if color == Transparent {
+		// Nothing to erase if the block doesn't exist.
+		block, err = tx.findBlock(blockCoords)
+	} else {
+		block, err = tx.getOrCreateBlock(blockCoords)
+	}
+	if err != nil || block == nil {
+		return err
+	}
+
+	pixelIndex := coords.PixelIndex()
+
+	// A lower layer overwriting this pixel completely is treated as dry too.
+	if isPixelDry(block.Pixels, block.Fine, pixelIndex) {
+		return ErrPixelIsDry
+	}
+
+	if color == Transparent {
+		tx.erasePixel(blockCoords, block, pixelIndex)
+		return nil
+	}
+
+	if color.IsDeep() && block.Fine == nil {
+		block.upgrade()
+	}
+
+	if block.Undo == nil {
+		block.Undo = make(map[uint16]PixelUndo)
+	}
+	undo := PixelUndo{
+		Pixel:   block.Pixels[pixelIndex] & 0xFFFF0000,
+		DryTime: block.DryTimes[uint16(pixelIndex)],
+	}
+	if block.Fine != nil {
+		undo.Fine = block.Fine[pixelIndex] & 0xFFFF0000
+	}
+	block.Undo[uint16(pixelIndex)] = undo
+
+	// Mask out existing color and set the new one.
+	rgb := color.channels(block.Fine != nil)
+	high, low := packChannels(rgb[:], block.Fine != nil)
+	pixelValue := block.Pixels[pixelIndex] & 0xC000FFFF
+	pixelValue |= high << 16
+	pixelValue |= Pixel(color.opacity()) << 28
+	pixelValue |= PIXEL_SET
+
+	block.Pixels[pixelIndex] = pixelValue
+	if block.Fine != nil {
+		block.Fine[pixelIndex] = block.Fine[pixelIndex]&0xFFFF | low<<16
+	}
+
+	block.setDryTime(uint16(pixelIndex), tx.now+tx.settings.dryTime(coords))
+	block.LastUpdated = tx.now
+	tx.markDirty(blockCoords)
+	tx.notePixel(BLOCK_EVENT_PIXELS_SET, blockCoords, pixelIndex)
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Clears the painted color of a wet pixel, along with its deadline and undo, so it's like
+// it was never painted. The caller bubbles the change.
+func (tx *paintTx) erasePixel(blockCoords Coords, block *MemBlock, pixelIndex int) {
+	if block.Pixels[pixelIndex]&PIXEL_SET == 0 {
+		return
+	}
+
+	block.Pixels[pixelIndex] &= 0xFFFF
+	if block.Fine != nil {
+		block.Fine[pixelIndex] &= 0xFFFF
+	}
+	block.setDryTime(uint16(pixelIndex), 0)
+	delete(block.Undo, uint16(pixelIndex))
+	if len(block.Undo) == 0 {
+		block.Undo = nil
+	}
+
+	block.LastUpdated = tx.now
+	tx.markDirty(blockCoords)
+	tx.notePixel(BLOCK_EVENT_PIXELS_SET, blockCoords, pixelIndex)
+}
+
+// ---------------------------------------------------------------------------------------
+// Paints the pixels in order and then bubbles them together. Returns the result of each
+// pixel, nil or a rejection. Whether a pixel is covered is decided before any of the
+// batch is bubbled, so the batch acts like a single stroke.
+//
+// The second return is a storage failure, in which case nothing should be committed.
+func (tx *paintTx) setPixels(pixels []PixelPaint) ([]error, error) {
+	results := make([]error, len(pixels))
+	painted := make([]Coords, 0, len(pixels))
+
+	for i, pixel := range pixels {
+		err := tx.paintPixel(pixel.Coords, pixel.Color)
+		if err != nil && !isPaintRejection(err) {
+			return nil, err
+		}
+		results[i] = err
+		if err == nil {
+			painted = append(painted, pixel.Coords)
+		}
+	}
+
+	return results, tx.bubbleColors(painted)
+}
+
+// ---------------------------------------------------------------------------------------
+// Restores a wet pixel to its state before it was last painted and bubbles the change.
+// Returns ErrNothingToUndo, ErrPixelIsDry or a storage failure.
+func (tx *paintTx) undoPixel(coords Coords) error {
+	blockCoords := coords.ParentOfPixel()
+	block, err := tx.findBlock(blockCoords)
+	if err != nil {
+		return err
+	}
+	if block == nil {
+		return ErrNothingToUndo
+	}
+
+	pixelIndex := uint16(coords.PixelIndex())
+	pixel := block.Pixels[pixelIndex]
+	if pixel&PIXEL_SET == 0 {
+		return ErrNothingToUndo
+	}
+	if isPixelDry(block.Pixels, block.Fine, int(pixelIndex)) {
+		return ErrPixelIsDry
+	}
+	undo, ok := block.Undo[pixelIndex]
+	if !ok {
+		return ErrNothingToUndo // e.g., painted before undo was tracked.
+	}
+
+	block.Pixels[pixelIndex] = undo.Pixel | pixel&0xFFFF
+	if block.Fine != nil {
+		block.Fine[pixelIndex] = undo.Fine | block.Fine[pixelIndex]&0xFFFF
+	}
+	block.setDryTime(pixelIndex, undo.DryTime)
+	delete(block.Undo, pixelIndex)
+	if len(block.Undo) == 0 {
+		block.Undo = nil
+	}
+
+	block.LastUpdated = tx.now
+	tx.markDirty(blockCoords)
+	tx.notePixel(BLOCK_EVENT_PIXELS_SET, blockCoords, int(pixelIndex))
+
+	return tx.bubbleColors([]Coords{coords})
+}
@@ -0,0 +1,94 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+// Palette zones restrict a region of the canvas to a fixed set of colors, e.g., for a
+// themed event. The zone with the longest matching prefix applies to a pixel, same as
+// DryingZone. The restriction itself is up to the services; the repo only stores the
+// zones.
+
+type (
+	PaletteZone struct {
+		// Block coordinates. The zone covers every pixel under them.
+		Coords Coords
+		// The allowed colors, including their opacity. Transparent is always allowed, so
+		// that wet pixels can still be erased.
+		Palette []Color
+		// Other colors are changed to the nearest palette color instead of being
+		// rejected.
+		Snap bool
+	}
+
+	PaletteRepo interface {
+		// Adds a zone, or replaces the zone with the same coords.
+		Put(zone PaletteZone) error
+
+		// Removes the zone with the given coords. Returns false if there is none.
+		Delete(coords Coords) (bool, error)
+
+		// Returns all zones, ordered by their coords.
+		List() ([]PaletteZone, error)
+
+		Close() error
+	}
+)
+
+// ---------------------------------------------------------------------------------------
+// Returns the zone that applies to the pixel, or nil if it's unrestricted.
+func FindPaletteZone(zones []PaletteZone, pixelCoords Coords) *PaletteZone {
+	var best *PaletteZone
+	for i := range zones {
+		zone := &zones[i]
+		if !pixelCoords.HasPrefix(zone.Coords) {
+			continue
+		}
+		if best == nil || zone.Coords.BitLength() > best.Coords.BitLength() {
+			best = zone
+		}
+	}
+	return best
+}
+
+// ---------------------------------------------------------------------------------------
+// True if the color is in the palette. 12-bit and 24-bit colors are the same if they
+// look the same.
+func (z *PaletteZone) Allows(color Color) bool {
+	if color == Transparent {
+		return true
+	}
+	for _, entry := range z.Palette {
+		if entry.RGB24() == color.RGB24() && entry.Alpha() == color.Alpha() {
+			return true
+		}
+	}
+	return false
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the palette color closest to the given color, by its channels and alpha.
+// Transparent is returned as is.
+func (z *PaletteZone) Nearest(color Color) Color {
+	if color == Transparent || len(z.Palette) == 0 {
+		return color
+	}
+
+	distance := func(a, b Color) int {
+		ca, cb := a.channels(true), b.channels(true)
+		total := 0
+		for i := range ca {
+			total += (ca[i] - cb[i]) * (ca[i] - cb[i])
+		}
+		alpha := (a.Alpha() - b.Alpha()) * 17
+		return total + alpha*alpha
+	}
+
+	best := z.Palette[0]
+	for _, entry := range z.Palette[1:] {
+		if distance(entry, color) < distance(best, color) {
+			best = entry
+		}
+	}
+	return best
+}
@@ -0,0 +1,100 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type paletteRepoFactory = func(t *testing.T) PaletteRepo
+
+// ---------------------------------------------------------------------------------------
+func createTestMemPaletteRepo(t *testing.T) PaletteRepo {
+	return CreateMemPaletteRepo()
+}
+
+func TestMemPaletteRepo(t *testing.T) { testPaletteRepo(t, createTestMemPaletteRepo) }
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testPaletteRepo(t *testing.T, createRepo paletteRepoFactory) {
+	repo := createRepo(t)
+
+	list := func() []PaletteZone {
+		zones, err := repo.List()
+		assert.NoError(t, err)
+		return zones
+	}
+
+	a := PaletteZone{
+		Coords:  coordsFromBits("10", "01"),
+		Palette: []Color{0x000, 0xFFF, ColorWithAlpha(0x00F, 7)},
+	}
+	b := PaletteZone{
+		Coords:  coordsFromBits("1", "0"),
+		Palette: []Color{Color24WithAlpha(0x3380FF, 255)},
+		Snap:    true,
+	}
+
+	//////////////////////////////////////////////////////////////////////////
+	// Zones are listed by their coords.
+	assert.Empty(t, list())
+	assert.NoError(t, repo.Put(a))
+	assert.NoError(t, repo.Put(b))
+	assert.Equal(t, []PaletteZone{b, a}, list())
+
+	// Putting a zone again replaces it.
+	a.Palette = []Color{0xF00}
+	a.Snap = true
+	assert.NoError(t, repo.Put(a))
+	assert.Equal(t, []PaletteZone{b, a}, list())
+
+	//////////////////////////////////////////////////////////////////////////
+	// Only existing zones are deleted.
+	found, err := repo.Delete(b.Coords)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	found, err = repo.Delete(b.Coords)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.Equal(t, []PaletteZone{a}, list())
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestPaletteZones(t *testing.T) {
+	outer := PaletteZone{
+		Coords:  coordsFromBits("1", "0"),
+		Palette: []Color{0x000, 0xFFF},
+	}
+	inner := PaletteZone{
+		Coords:  coordsFromBits("10", "01"),
+		Palette: []Color{0x00F, ColorWithAlpha(0x0F0, 7), Color24WithAlpha(0x3380FF, 255)},
+	}
+	zones := []PaletteZone{inner, outer}
+
+	//////////////////////////////////////////////////////////////////////////
+	// The zone with the longest prefix applies.
+	assert.Equal(t, &zones[0], FindPaletteZone(zones, coordsFromBits("10 000000", "01 000000")))
+	assert.Equal(t, &zones[1], FindPaletteZone(zones, coordsFromBits("11 000000", "01 000000")))
+	assert.Nil(t, FindPaletteZone(zones, coordsFromBits("01 000000", "01 000000")))
+
+	//////////////////////////////////////////////////////////////////////////
+	// Colors must match with their opacity. Transparent is always allowed.
+	assert.True(t, inner.Allows(0x00F))
+	assert.True(t, inner.Allows(Color24WithAlpha(0x0000FF, 255)))
+	assert.True(t, inner.Allows(ColorWithAlpha(0x0F0, 7)))
+	assert.False(t, inner.Allows(0x0F0))
+	assert.False(t, inner.Allows(0x38F))
+	assert.True(t, inner.Allows(Transparent))
+
+	//////////////////////////////////////////////////////////////////////////
+	// Snapping picks the closest color.
+	assert.Equal(t, Color(0x00F), inner.Nearest(0x00E))
+	assert.Equal(t, ColorWithAlpha(0x0F0, 7), inner.Nearest(ColorWithAlpha(0x1E1, 7)))
+	assert.Equal(t, Color24WithAlpha(0x3380FF, 255), inner.Nearest(0x38F))
+	assert.Equal(t, Color(0xFFF), outer.Nearest(0xCCC))
+	assert.Equal(t, Transparent, outer.Nearest(Transparent))
+}
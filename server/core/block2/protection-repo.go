@@ -0,0 +1,48 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+// Protected zones freeze a region of the canvas, e.g., a finished mural, so that nothing
+// under them can be painted, even wet pixels. Like palette zones, the repo only stores
+// them; the services enforce them.
+
+type (
+	ProtectedZone struct {
+		// Block coordinates. The zone covers every pixel under them.
+		Coords Coords
+		// When the protection ends. Zero if it never does.
+		Expires UnixMillis
+	}
+
+	ProtectionRepo interface {
+		// Adds a zone, or replaces the zone with the same coords.
+		Put(zone ProtectedZone) error
+
+		// Removes the zone with the given coords. Returns false if there is none.
+		Delete(coords Coords) (bool, error)
+
+		// Returns all zones, ordered by their coords, including expired ones.
+		List() ([]ProtectedZone, error)
+
+		Close() error
+	}
+)
+
+// ---------------------------------------------------------------------------------------
+// True if the zone has expired by the given time.
+func (z *ProtectedZone) IsExpired(now UnixMillis) bool {
+	return z.Expires != 0 && now >= z.Expires
+}
+
+// ---------------------------------------------------------------------------------------
+// True if any zone that hasn't expired covers the pixel.
+func IsPixelProtected(zones []ProtectedZone, pixelCoords Coords, now UnixMillis) bool {
+	for i := range zones {
+		if !zones[i].IsExpired(now) && pixelCoords.HasPrefix(zones[i].Coords) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type protectionRepoFactory = func(t *testing.T) ProtectionRepo
+
+// ---------------------------------------------------------------------------------------
+func createTestMemProtectionRepo(t *testing.T) ProtectionRepo {
+	return CreateMemProtectionRepo()
+}
+
+func TestMemProtectionRepo(t *testing.T) { testProtectionRepo(t, createTestMemProtectionRepo) }
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func testProtectionRepo(t *testing.T, createRepo protectionRepoFactory) {
+	repo := createRepo(t)
+
+	list := func() []ProtectedZone {
+		zones, err := repo.List()
+		assert.NoError(t, err)
+		return zones
+	}
+
+	a := ProtectedZone{Coords: coordsFromBits("10", "01")}
+	b := ProtectedZone{Coords: coordsFromBits("1", "0"), Expires: 5000}
+
+	//////////////////////////////////////////////////////////////////////////
+	// Zones are listed by their coords.
+	assert.Empty(t, list())
+	assert.NoError(t, repo.Put(a))
+	assert.NoError(t, repo.Put(b))
+	assert.Equal(t, []ProtectedZone{b, a}, list())
+
+	// Putting a zone again replaces it.
+	a.Expires = 9000
+	assert.NoError(t, repo.Put(a))
+	assert.Equal(t, []ProtectedZone{b, a}, list())
+
+	//////////////////////////////////////////////////////////////////////////
+	// Only existing zones are deleted.
+	found, err := repo.Delete(b.Coords)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	found, err = repo.Delete(b.Coords)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.Equal(t, []ProtectedZone{a}, list())
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestProtectedZones(t *testing.T) {
+	zones := []ProtectedZone{
+		{Coords: coordsFromBits("10", "01"), Expires: 5000},
+		{Coords: coordsFromBits("0", "0")},
+	}
+
+	//////////////////////////////////////////////////////////////////////////
+	// Everything under a zone is protected until it expires.
+	assert.True(t, IsPixelProtected(zones, coordsFromBits("10 000000", "01 000000"), 1000))
+	assert.True(t, IsPixelProtected(zones, coordsFromBits("10 000000 1", "01 000000 1"), 4999))
+	assert.False(t, IsPixelProtected(zones, coordsFromBits("10 000000", "01 000000"), 5000))
+	assert.False(t, IsPixelProtected(zones, coordsFromBits("11 000000", "01 000000"), 1000))
+	assert.True(t, IsPixelProtected(zones, coordsFromBits("000000", "000000"), 1<<40))
+	assert.False(t, IsPixelProtected(nil, coordsFromBits("000000", "000000"), 0))
+}
@@ -0,0 +1,562 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"database/sql"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// A block repository backed by database/sql so the canvas can be inspected and backed
+// up with ordinary SQL tools. SQLite is the reference driver. Each paint operation,
+// including the bubbled colors, runs in a single SQL transaction.
+
+// ---------------------------------------------------------------------------------------
+type (
+	SqlBlockRepo struct {
+		Clock    ClockService
+		db       *sql.DB
+		mutex    sync.Mutex
+		settings paintSettings
+		listener BlockEventListener
+	}
+
+	sqlBlockStore struct {
+		tx *sql.Tx
+	}
+)
+
+// Most parameters bound to one query. Older SQLite builds allow no more than 999.
+const sqlMaxQueryParams = 500
+
+// Schema migrations, applied in order. The index+1 is the schema version. Never modify
+// an existing entry; append a new one instead.
+var sqlBlockMigrations = []string{
+	`CREATE TABLE blocks (
+		coords       BLOB PRIMARY KEY,
+		pixels       BLOB NOT NULL,
+		dry_time     INTEGER NOT NULL DEFAULT 0,
+		last_updated INTEGER NOT NULL DEFAULT 0
+	)`,
+	// Per-pixel deadlines, see encodeDryTimes. NULL when nothing is wet. dry_time now
+	// holds the earliest deadline in the block.
+	`ALTER TABLE blocks ADD COLUMN dry_times BLOB`,
+	// For DryPixels.
+	`CREATE INDEX blocks_dry_time ON blocks (dry_time) WHERE dry_time > 0`,
+	// 0: pixels are raw pixel data (see encodePixelData). 1: pixels are packed (see
+	// packPixels). Older rows stay raw until they're written again.
+	`ALTER TABLE blocks ADD COLUMN pixel_format INTEGER NOT NULL DEFAULT 0`,
+	// Undo states of the wet pixels, see encodeUndo. NULL when there are none.
+	`ALTER TABLE blocks ADD COLUMN undo BLOB`,
+	// The low nibbles of 24-bit blocks, packed like pixels (see Block.Fine). NULL for
+	// 12-bit blocks.
+	`ALTER TABLE blocks ADD COLUMN fine BLOB`,
+}
+
+const (
+	sqlPixelFormatRaw    = 0
+	sqlPixelFormatPacked = 1
+)
+
+// ---------------------------------------------------------------------------------------
+// Brings a schema up to date with its migrations. The current version is kept in the
+// given version table, so schemas for different things can share a database.
+func migrateSqlSchema(db *sql.DB, versionTable string, migrations []string, name string) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + versionTable + ` (version INTEGER NOT NULL)`)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	version := 0
+	err = tx.QueryRow(`SELECT version FROM ` + versionTable).Scan(&version)
+	if err == sql.ErrNoRows {
+		if _, err = tx.Exec(`INSERT INTO ` + versionTable + ` (version) VALUES (0)`); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		log.WithField(nil, "version", version+1).Infoln("Migrating " + name + " schema.")
+		if _, err = tx.Exec(migrations[version]); err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.Exec(`UPDATE `+versionTable+` SET version = ?`, version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ---------------------------------------------------------------------------------------
+// The block schema version is kept in schema_version.
+func migrateSqlBlockSchema(db *sql.DB) error {
+	return migrateSqlSchema(db, "schema_version", sqlBlockMigrations, "block")
+}
+
+// ---------------------------------------------------------------------------------------
+// The database handle is owned by the repo after this call and is closed by Close.
+func CreateSqlBlockRepo(cs ClockService, db *sql.DB) (*SqlBlockRepo, error) {
+	if err := migrateSqlBlockSchema(db); err != nil {
+		return nil, err
+	}
+
+	return &SqlBlockRepo{
+		Clock:    cs,
+		db:       db,
+		settings: defaultPaintSettings(),
+	}, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (s *sqlBlockStore) loadBlock(key string) (*MemBlock, error) {
+	var pixelData, fineData, dryTimeData, undoData []byte
+	var dryTime, lastUpdated UnixMillis
+	var pixelFormat int
+	err := s.tx.QueryRow(`SELECT pixels, pixel_format, fine, dry_time, dry_times, undo,
+		last_updated FROM blocks WHERE coords = ?`, []byte(key)).Scan(
+		&pixelData, &pixelFormat, &fineData, &dryTime, &dryTimeData, &undoData, &lastUpdated)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return decodeSqlBlock(pixelData, pixelFormat, fineData, dryTime, dryTimeData, undoData,
+		lastUpdated)
+}
+
+// ---------------------------------------------------------------------------------------
+// Loads many blocks with as few queries as possible. Missing blocks are left out of the
+// result.
+func (s *sqlBlockStore) loadBlocks(keys []string) (map[string]*MemBlock, error) {
+	blocks := map[string]*MemBlock{}
+	for start := 0; start < len(keys); start += sqlMaxQueryParams {
+		chunk := keys[start:min(start+sqlMaxQueryParams, len(keys))]
+		args := make([]any, len(chunk))
+		for i, key := range chunk {
+			args[i] = []byte(key)
+		}
+
+		placeholders := strings.Repeat(",?", len(chunk))[1:]
+		rows, err := s.tx.Query(`SELECT coords, pixels, pixel_format, fine, dry_time,
+			dry_times, undo, last_updated FROM blocks WHERE coords IN (`+placeholders+`)`,
+			args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var key, pixelData, fineData, dryTimeData, undoData []byte
+			var dryTime, lastUpdated UnixMillis
+			var pixelFormat int
+			err := rows.Scan(&key, &pixelData, &pixelFormat, &fineData, &dryTime, &dryTimeData,
+				&undoData, &lastUpdated)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			block, err := decodeSqlBlock(pixelData, pixelFormat, fineData, dryTime, dryTimeData,
+				undoData, lastUpdated)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			blocks[string(key)] = block
+		}
+		if err := rows.Close(); err != nil {
+			return nil, err
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func decodeSqlBlock(pixelData []byte, pixelFormat int, fineData []byte, dryTime UnixMillis, dryTimeData []byte, undoData []byte, lastUpdated UnixMillis) (*MemBlock, error) {
+	var pixels []Pixel
+	var err error
+	switch pixelFormat {
+	case sqlPixelFormatRaw:
+		pixels, err = decodePixelData(pixelData)
+	case sqlPixelFormatPacked:
+		pixels, err = unpackPixels(pixelData)
+	default:
+		err = ErrBadBlockData
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var fine []Pixel
+	if fineData != nil {
+		if fine, err = unpackPixels(fineData); err != nil {
+			return nil, err
+		}
+	}
+
+	// Rows written before dry_times existed only have the block-wide deadline.
+	dryTimes := legacyDryTimes(pixels, dryTime)
+	if dryTimeData != nil {
+		if dryTimes, _, err = decodeDryTimes(dryTimeData); err != nil {
+			return nil, err
+		}
+	}
+
+	var undo map[uint16]PixelUndo
+	if undoData != nil {
+		if undo, _, err = decodeUndo(undoData); err != nil {
+			return nil, err
+		}
+	}
+
+	block := &MemBlock{
+		Pixels:      pixels,
+		Fine:        fine,
+		DryTimes:    dryTimes,
+		Undo:        undo,
+		LastUpdated: lastUpdated,
+	}
+	block.updateDryTimeRange()
+	return block, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (s *sqlBlockStore) saveBlock(key string, block *MemBlock) error {
+	var dryTimeData []byte
+	if len(block.DryTimes) > 0 {
+		dryTimeData = encodeDryTimes(block.DryTimes)
+	}
+	var undoData []byte
+	if len(block.Undo) > 0 {
+		undoData = encodeUndo(block.Undo, block.Fine != nil)
+	}
+	var fineData []byte
+	if block.Fine != nil {
+		fineData = packPixels(block.Fine)
+	}
+
+	_, err := s.tx.Exec(`INSERT INTO blocks
+			(coords, pixels, pixel_format, fine, dry_time, dry_times, undo, last_updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (coords) DO UPDATE SET
+			pixels = excluded.pixels,
+			pixel_format = excluded.pixel_format,
+			fine = excluded.fine,
+			dry_time = excluded.dry_time,
+			dry_times = excluded.dry_times,
+			undo = excluded.undo,
+			last_updated = excluded.last_updated`,
+		[]byte(key), packPixels(block.Pixels), sqlPixelFormatPacked, fineData, block.FirstDryTime,
+		dryTimeData, undoData, block.LastUpdated)
+	return err
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlBlockRepo) GetBlock(coords Coords) (*Block, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := r.Clock.Now().UnixMilli()
+	store := &sqlBlockStore{tx}
+	block, err := store.loadBlock(string(coords.ToBytes()))
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, ErrBlockNotFound
+	}
+
+	// Drying is only saved on the next write. Readers see the dried state either way.
+	dryBlock(block, now)
+	return block.toBlock(), nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlBlockRepo) GetBlocks(coords []Coords) ([]*Block, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	keys := make([]string, len(coords))
+	for i, c := range coords {
+		keys[i] = string(c.ToBytes())
+	}
+
+	now := r.Clock.Now().UnixMilli()
+	store := &sqlBlockStore{tx}
+	loaded, err := store.loadBlocks(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]*Block, len(keys))
+	for i, key := range keys {
+		if block := loaded[key]; block != nil {
+			dryBlock(block, now)
+			blocks[i] = block.toBlock()
+		}
+	}
+	return blocks, nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the smallest key greater than every key with the prefix, or nil if there is
+// none.
+func keyPrefixEnd(prefix []byte) []byte {
+	end := slices.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Scans the keys that start with the coords' key prefix, which sort together.
+func (r *SqlBlockRepo) HasBlocksUnder(coords Coords, levels int) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	prefix := coords.keyPrefix()
+	query := `SELECT coords FROM blocks WHERE coords >= ?`
+	args := []any{prefix}
+	if end := keyPrefixEnd(prefix); end != nil {
+		query += ` AND coords < ?`
+		args = append(args, end)
+	}
+
+	rows, err := r.db.Query(query+` ORDER BY coords`, args...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key []byte
+		if err := rows.Scan(&key); err != nil {
+			return false, err
+		}
+		if coords.keyIsUnder(key, levels) {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlBlockRepo) SetPixel(coords Coords, color Color) error {
+	return singlePaintResult(r.SetPixels([]PixelPaint{{coords, color}}))
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlBlockRepo) SetPixels(pixels []PixelPaint) ([]error, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Rejected pixels are still committed. Loading the blocks may have dried them.
+	now := r.Clock.Now().UnixMilli()
+	ptx := beginPaintTx(&sqlBlockStore{tx}, now, r.settings)
+	results, err := ptx.setPixels(pixels)
+	if err != nil {
+		return nil, err
+	}
+	if err := ptx.commit(); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	publishBlockEvents(r.listener, ptx.events)
+	return results, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlBlockRepo) UndoPixel(coords Coords) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Rejections are still committed. Loading the block may have dried it.
+	ptx := beginPaintTx(&sqlBlockStore{tx}, r.Clock.Now().UnixMilli(), r.settings)
+	result := ptx.undoPixel(coords)
+	if result != nil && !isPaintRejection(result) {
+		return result
+	}
+	if err := ptx.commit(); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	publishBlockEvents(r.listener, ptx.events)
+	return result
+}
+
+// ---------------------------------------------------------------------------------------
+// Only 12-bit rows are converted, in batches of sqlMaxQueryParams, each its own SQL
+// transaction.
+func (r *SqlBlockRepo) UpgradeColorDepth() (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	rows, err := r.db.Query(`SELECT coords FROM blocks WHERE fine IS NULL ORDER BY coords`)
+	if err != nil {
+		return 0, err
+	}
+	var keys []string
+	for rows.Next() {
+		var key []byte
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys = append(keys, string(key))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	upgraded := 0
+	for start := 0; start < len(keys); start += sqlMaxQueryParams {
+		count, err := r.upgradeBlocks(keys[start:min(start+sqlMaxQueryParams, len(keys))])
+		if err != nil {
+			return upgraded, err
+		}
+		upgraded += count
+	}
+	return upgraded, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlBlockRepo) upgradeBlocks(keys []string) (int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	ptx := beginPaintTx(&sqlBlockStore{tx}, r.Clock.Now().UnixMilli(), r.settings)
+	count, err := ptx.upgradeBlocks(keys)
+	if err != nil {
+		return 0, err
+	}
+	if err := ptx.commit(); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	publishBlockEvents(r.listener, ptx.events)
+	return count, nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Dries all pixels that have reached their deadline.
+func (r *SqlBlockRepo) DryPixels() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := r.Clock.Now().UnixMilli()
+	rows, err := tx.Query(`SELECT coords FROM blocks WHERE dry_time > 0 AND dry_time <= ?
+		ORDER BY coords`, now)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for rows.Next() {
+		var key []byte
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, string(key))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	ptx := beginPaintTx(&sqlBlockStore{tx}, now, r.settings)
+	if err := ptx.dryBlocks(keys); err != nil {
+		return err
+	}
+	if err := ptx.commit(); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	publishBlockEvents(r.listener, ptx.events)
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlBlockRepo) SetEventListener(listener BlockEventListener) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.listener = listener
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlBlockRepo) SetMaxDepth(depth int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.settings.maxDepth = depth
+}
+
+// ---------------------------------------------------------------------------------------
+// Changes how long painted pixels take to dry. Pixels that are already wet keep their
+// current deadline.
+func (r *SqlBlockRepo) SetDryingPolicy(policy *DryingPolicy) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.settings.dryTime = policy.GetDryTime
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlBlockRepo) Close() error {
+	log.Infoln(nil, "Closing SQL block storage.")
+	return r.db.Close()
+}
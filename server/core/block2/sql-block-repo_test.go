@@ -0,0 +1,172 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"go.mukunda.com/nanopaint/core/clock"
+)
+
+func openTestSqliteDb(t *testing.T, path string) *sql.DB {
+	// Durability isn't under test here, and syncing every write is slow.
+	db, err := sql.Open("sqlite3", path+"?_sync=OFF&_journal=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func createTestSqlBlockRepo(t *testing.T, cs ClockService) BlockRepo {
+	repo, err := CreateSqlBlockRepo(cs, openTestSqliteDb(t, filepath.Join(t.TempDir(), "blocks.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestSqlBlockRepoBubbling(t *testing.T) { testBlockRepoBubbling(t, createTestSqlBlockRepo) }
+func TestSqlBlockBubble2(t *testing.T)      { testBlockRepoBubble2(t, createTestSqlBlockRepo, 20) }
+func TestSqlBlockBubble3(t *testing.T)      { testBlockRepoBubble3(t, createTestSqlBlockRepo) }
+func TestSqlBlockDrying(t *testing.T)       { testBlockRepoDrying(t, createTestSqlBlockRepo) }
+func TestSqlBlockMaxDepth(t *testing.T)     { testBlockRepoMaxDepth(t, createTestSqlBlockRepo) }
+func TestSqlBlockPixelDrying(t *testing.T) {
+	testBlockRepoPixelDrying(t, createTestSqlBlockRepo)
+}
+func TestSqlBlockDryPixels(t *testing.T) { testBlockRepoDryPixels(t, createTestSqlBlockRepo) }
+func TestSqlBlockSetPixels(t *testing.T) { testBlockRepoSetPixels(t, createTestSqlBlockRepo) }
+func TestSqlBlockGetBlocks(t *testing.T) { testBlockRepoGetBlocks(t, createTestSqlBlockRepo) }
+func TestSqlBlockRepoLastUpdated(t *testing.T) {
+	testBlockRepoLastUpdated(t, createTestSqlBlockRepo)
+}
+func TestSqlBlockRepoHasBlocksUnder(t *testing.T) {
+	testBlockRepoHasBlocksUnder(t, createTestSqlBlockRepo)
+}
+func TestSqlBlockPaintEvents(t *testing.T) {
+	testBlockRepoPaintEvents(t, createTestSqlBlockRepo)
+}
+func TestSqlBlockRepoUndo(t *testing.T) {
+	testBlockRepoUndo(t, createTestSqlBlockRepo)
+}
+func TestSqlBlockRepoErase(t *testing.T) {
+	testBlockRepoErase(t, createTestSqlBlockRepo)
+}
+func TestSqlBlockRepoTranslucent(t *testing.T) {
+	testBlockRepoTranslucent(t, createTestSqlBlockRepo)
+}
+func TestSqlBlockRepoColor24(t *testing.T) {
+	testBlockRepoColor24(t, createTestSqlBlockRepo)
+}
+func TestSqlBlockDryingPolicy(t *testing.T) {
+	testBlockRepoDryingPolicy(t, createTestSqlBlockRepo)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestSqlBlockRepoMigrations(t *testing.T) {
+	//////////////////////////////////////////////////////////////////////
+	// Opening a database applies all migrations once and records the
+	// schema version. Reopening it keeps the existing data.
+	clock := clock.CreateTestClockService()
+	path := filepath.Join(t.TempDir(), "blocks.db")
+
+	repo, err := CreateSqlBlockRepo(clock, openTestSqliteDb(t, path))
+	assert.NoError(t, err)
+	coords := coordsFromBits("00000000 00", "00000000 00")
+	assert.NoError(t, repo.SetPixel(coords, Color(0x00F)))
+	assert.NoError(t, repo.Close())
+
+	db := openTestSqliteDb(t, path)
+	repo, err = CreateSqlBlockRepo(clock, db)
+	assert.NoError(t, err)
+	defer repo.Close()
+
+	var version int
+	assert.NoError(t, db.QueryRow(`SELECT version FROM schema_version`).Scan(&version))
+	assert.Equal(t, len(sqlBlockMigrations), version)
+
+	pixel, err := getPixel(repo, coords)
+	assert.NoError(t, err)
+	assert.EqualValues(t, Pixel(0x00F<<16)|PIXEL_SET, pixel)
+
+	// The columns are readable with plain SQL.
+	var dryTime, lastUpdated int64
+	err = db.QueryRow(`SELECT dry_time, last_updated FROM blocks WHERE coords = ?`,
+		coords.ParentOfPixel().ToBytes()).Scan(&dryTime, &lastUpdated)
+	assert.NoError(t, err)
+	assert.Greater(t, dryTime, clock.Now().UnixMilli())
+	assert.Equal(t, clock.Now().UnixMilli(), lastUpdated)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestSqlBlockRepoPixelFormat(t *testing.T) {
+	clock := clock.CreateTestClockService()
+	db := openTestSqliteDb(t, filepath.Join(t.TempDir(), "blocks.db"))
+	repo, err := CreateSqlBlockRepo(clock, db)
+	assert.NoError(t, err)
+	defer repo.Close()
+
+	coords := coordsFromBits("00000000 00", "00000000 00")
+	key := coords.ParentOfPixel().ToBytes()
+	assert.NoError(t, repo.SetPixel(coords, Color(0x00F)))
+	before, err := repo.GetBlock(coords.ParentOfPixel())
+	assert.NoError(t, err)
+
+	//////////////////////////////////////////////////////////////////////
+	// Pixels are stored packed.
+	var pixelData []byte
+	var pixelFormat int
+	err = db.QueryRow(`SELECT pixels, pixel_format FROM blocks WHERE coords = ?`, key).
+		Scan(&pixelData, &pixelFormat)
+	assert.NoError(t, err)
+	assert.Equal(t, sqlPixelFormatPacked, pixelFormat)
+	assert.Less(t, len(pixelData), 100)
+
+	//////////////////////////////////////////////////////////////////////
+	// Rows from before packing are still read.
+	_, err = db.Exec(`UPDATE blocks SET pixels = ?, pixel_format = 0 WHERE coords = ?`,
+		encodePixelData(before.Pixels), key)
+	assert.NoError(t, err)
+	after, err := repo.GetBlock(coords.ParentOfPixel())
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestSqlBlockRepoAtomicBubbling(t *testing.T) {
+	/////////////////////////////////////////////////////////////////////////////
+	// SetPixel and the bubbled parent colors are written in one transaction. If
+	// any write fails, none of them are kept.
+	clock := clock.CreateTestClockService()
+	db := openTestSqliteDb(t, filepath.Join(t.TempDir(), "blocks.db"))
+	repo, err := CreateSqlBlockRepo(clock, db)
+	assert.NoError(t, err)
+	defer repo.Close()
+
+	coords := coordsFromBits("00000000 00", "00000000 00")
+	parentBlock := coords.Up(1).ParentOfPixel().ToBytes()
+
+	// Simulate a failure while writing the parent block. The child block is written
+	// first or last depending on map order, either way nothing should be kept.
+	_, err = db.Exec(`CREATE TRIGGER fail_parent BEFORE INSERT ON blocks
+		WHEN NEW.coords = X'` + hex.EncodeToString(parentBlock) + `'
+		BEGIN SELECT RAISE(ABORT, 'simulated failure'); END`)
+	assert.NoError(t, err)
+
+	assert.Error(t, repo.SetPixel(coords, Color(0x00F)))
+
+	var count int
+	assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM blocks`).Scan(&count))
+	assert.Equal(t, 0, count)
+
+	_, err = repo.GetBlock(coords.ParentOfPixel())
+	assert.ErrorIs(t, err, ErrBlockNotFound)
+}
@@ -0,0 +1,153 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// Paint history in SQLite. It can share a database with SqlBlockRepo, since its schema
+// version is kept separately in history_schema_version.
+//
+// Entries are found by time with an index, and by area with the coords index, over the
+// range of keys that start with the area's key prefix (see Coords.keyPrefix), or the key
+// itself for exact queries.
+
+type SqlHistoryRepo struct {
+	db    *sql.DB
+	mutex sync.Mutex
+}
+
+// Schema migrations, applied in order. The index+1 is the schema version. Never modify
+// an existing entry; append a new one instead.
+var sqlHistoryMigrations = []string{
+	`CREATE TABLE history (
+		id      INTEGER PRIMARY KEY AUTOINCREMENT,
+		time    INTEGER NOT NULL,
+		coords  BLOB NOT NULL,
+		color   INTEGER NOT NULL,
+		painter TEXT NOT NULL
+	)`,
+	`CREATE INDEX history_time ON history (time)`,
+	`CREATE INDEX history_coords ON history (coords, time)`,
+	// 1 for undo entries, see HistoryEntry.Undo.
+	`ALTER TABLE history ADD COLUMN undo INTEGER NOT NULL DEFAULT 0`,
+}
+
+// ---------------------------------------------------------------------------------------
+// The database handle is owned by the repo after this call and is closed by Close.
+func CreateSqlHistoryRepo(db *sql.DB) (*SqlHistoryRepo, error) {
+	if err := migrateSqlSchema(db, "history_schema_version", sqlHistoryMigrations, "history"); err != nil {
+		return nil, err
+	}
+
+	return &SqlHistoryRepo{
+		db: db,
+	}, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlHistoryRepo) Append(entries []HistoryEntry) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.Prepare(`INSERT INTO history (time, coords, color, painter, undo)
+		VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	for _, entry := range entries {
+		_, err := insert.Exec(entry.Time, entry.Coords.ToBytes(), entry.Color, entry.Painter, entry.Undo)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlHistoryRepo) Query(query HistoryQuery) ([]HistoryEntry, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	where := `coords = ? AND time >= ?`
+	args := []any{query.Coords.ToBytes(), query.Since}
+	if !query.Exact {
+		prefix := query.Coords.keyPrefix()
+		where = `coords >= ? AND time >= ?`
+		args = []any{prefix, query.Since}
+		if end := keyPrefixEnd(prefix); end != nil {
+			where += ` AND coords < ?`
+			args = append(args, end)
+		}
+	}
+	if query.Until != 0 {
+		where += ` AND time < ?`
+		args = append(args, query.Until)
+	}
+
+	order := ` ORDER BY time DESC, id DESC`
+	if query.Oldest {
+		order = ` ORDER BY time, id`
+	}
+	rows, err := r.db.Query(`SELECT time, coords, color, painter, undo FROM history WHERE `+where+order,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []HistoryEntry
+	for rows.Next() && (query.Limit == 0 || len(results) < query.Limit) {
+		var entry HistoryEntry
+		var key []byte
+		if err := rows.Scan(&entry.Time, &key, &entry.Color, &entry.Painter, &entry.Undo); err != nil {
+			return nil, err
+		}
+		if len(key) == 0 {
+			return nil, ErrBadBlockData
+		}
+		entry.Coords = Coords{
+			Bitmod: key[len(key)-1],
+			Coords: key[:len(key)-1],
+		}
+		// The key range can include pixels outside of the area.
+		if query.matches(&entry) {
+			results = append(results, entry)
+		}
+	}
+	return results, rows.Err()
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlHistoryRepo) Prune(before UnixMillis) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	result, err := r.db.Exec(`DELETE FROM history WHERE time < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+	count, err := result.RowsAffected()
+	return int(count), err
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlHistoryRepo) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	log.Infoln(nil, "Closing SQL history storage.")
+	return r.db.Close()
+}
@@ -0,0 +1,46 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mukunda.com/nanopaint/core/clock"
+)
+
+// ---------------------------------------------------------------------------------------
+func createTestSqlHistoryRepo(t *testing.T) HistoryRepo {
+	repo, err := CreateSqlHistoryRepo(openTestSqliteDb(t, filepath.Join(t.TempDir(), "history.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func TestSqlHistoryRepo(t *testing.T) { testHistoryRepo(t, createTestSqlHistoryRepo) }
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestSqlHistoryRepoSharedDatabase(t *testing.T) {
+	//////////////////////////////////////////////////////////////////////
+	// History and blocks can be kept in the same database, each with its own
+	// schema version.
+	path := filepath.Join(t.TempDir(), "nanopaint.db")
+	blocks, err := CreateSqlBlockRepo(clock.CreateTestClockService(), openTestSqliteDb(t, path))
+	assert.NoError(t, err)
+	defer blocks.Close()
+	db := openTestSqliteDb(t, path)
+	history, err := CreateSqlHistoryRepo(db)
+	assert.NoError(t, err)
+	defer history.Close()
+
+	var version int
+	assert.NoError(t, db.QueryRow(`SELECT version FROM history_schema_version`).Scan(&version))
+	assert.Equal(t, len(sqlHistoryMigrations), version)
+	assert.NoError(t, db.QueryRow(`SELECT version FROM schema_version`).Scan(&version))
+	assert.Equal(t, len(sqlBlockMigrations), version)
+}
@@ -0,0 +1,107 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"sync"
+)
+
+// Palette zones in SQLite. Like SqlHistoryRepo, it can share a database with the
+// other repos. Palettes are stored as little-endian uint32 colors.
+
+type SqlPaletteRepo struct {
+	db    *sql.DB
+	mutex sync.Mutex
+}
+
+// Schema migrations, applied in order. The index+1 is the schema version. Never modify
+// an existing entry; append a new one instead.
+var sqlPaletteMigrations = []string{
+	`CREATE TABLE palette_zones (
+		coords  BLOB PRIMARY KEY,
+		palette BLOB NOT NULL,
+		snap    INTEGER NOT NULL
+	)`,
+}
+
+// ---------------------------------------------------------------------------------------
+// The database handle is owned by the repo after this call and is closed by Close.
+func CreateSqlPaletteRepo(db *sql.DB) (*SqlPaletteRepo, error) {
+	if err := migrateSqlSchema(db, "palette_schema_version", sqlPaletteMigrations, "palette"); err != nil {
+		return nil, err
+	}
+
+	return &SqlPaletteRepo{
+		db: db,
+	}, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlPaletteRepo) Put(zone PaletteZone) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	palette := make([]byte, 0, len(zone.Palette)*4)
+	for _, color := range zone.Palette {
+		palette = binary.LittleEndian.AppendUint32(palette, uint32(color))
+	}
+	_, err := r.db.Exec(`INSERT OR REPLACE INTO palette_zones (coords, palette, snap) VALUES (?, ?, ?)`,
+		zone.Coords.ToBytes(), palette, zone.Snap)
+	return err
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlPaletteRepo) Delete(coords Coords) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	result, err := r.db.Exec(`DELETE FROM palette_zones WHERE coords = ?`, coords.ToBytes())
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlPaletteRepo) List() ([]PaletteZone, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	rows, err := r.db.Query(`SELECT coords, palette, snap FROM palette_zones ORDER BY coords`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var zones []PaletteZone
+	for rows.Next() {
+		var zone PaletteZone
+		var key, palette []byte
+		if err := rows.Scan(&key, &palette, &zone.Snap); err != nil {
+			return nil, err
+		}
+		if len(key) == 0 || len(palette)%4 != 0 {
+			return nil, ErrBadBlockData
+		}
+		zone.Coords = CoordsFromBytes(key)
+		for i := 0; i < len(palette); i += 4 {
+			zone.Palette = append(zone.Palette, Color(binary.LittleEndian.Uint32(palette[i:])))
+		}
+		zones = append(zones, zone)
+	}
+	return zones, rows.Err()
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlPaletteRepo) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	log.Infoln(nil, "Closing SQL palette storage.")
+	return r.db.Close()
+}
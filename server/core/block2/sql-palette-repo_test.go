@@ -0,0 +1,47 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ---------------------------------------------------------------------------------------
+func createTestSqlPaletteRepo(t *testing.T) PaletteRepo {
+	repo, err := CreateSqlPaletteRepo(openTestSqliteDb(t, filepath.Join(t.TempDir(), "palettes.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func TestSqlPaletteRepo(t *testing.T) { testPaletteRepo(t, createTestSqlPaletteRepo) }
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestSqlPaletteRepoPersistence(t *testing.T) {
+	//////////////////////////////////////////////////////////////////////
+	// Zones are still there after reopening the database.
+	path := filepath.Join(t.TempDir(), "palettes.db")
+	repo, err := CreateSqlPaletteRepo(openTestSqliteDb(t, path))
+	assert.NoError(t, err)
+	zone := PaletteZone{
+		Coords:  coordsFromBits("10", "01"),
+		Palette: []Color{0xF00, Color24WithAlpha(0x3380FF, 0x77)},
+		Snap:    true,
+	}
+	assert.NoError(t, repo.Put(zone))
+	assert.NoError(t, repo.Close())
+
+	repo, err = CreateSqlPaletteRepo(openTestSqliteDb(t, path))
+	assert.NoError(t, err)
+	defer repo.Close()
+	zones, err := repo.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []PaletteZone{zone}, zones)
+}
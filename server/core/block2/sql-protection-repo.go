@@ -0,0 +1,98 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"database/sql"
+	"sync"
+)
+
+// Protected zones in SQLite. Like SqlHistoryRepo, it can share a database with the
+// other repos.
+
+type SqlProtectionRepo struct {
+	db    *sql.DB
+	mutex sync.Mutex
+}
+
+// Schema migrations, applied in order. The index+1 is the schema version. Never modify
+// an existing entry; append a new one instead.
+var sqlProtectionMigrations = []string{
+	`CREATE TABLE protected_zones (
+		coords  BLOB PRIMARY KEY,
+		expires INTEGER NOT NULL
+	)`,
+}
+
+// ---------------------------------------------------------------------------------------
+// The database handle is owned by the repo after this call and is closed by Close.
+func CreateSqlProtectionRepo(db *sql.DB) (*SqlProtectionRepo, error) {
+	if err := migrateSqlSchema(db, "protection_schema_version", sqlProtectionMigrations, "protection"); err != nil {
+		return nil, err
+	}
+
+	return &SqlProtectionRepo{
+		db: db,
+	}, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlProtectionRepo) Put(zone ProtectedZone) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, err := r.db.Exec(`INSERT OR REPLACE INTO protected_zones (coords, expires) VALUES (?, ?)`,
+		zone.Coords.ToBytes(), zone.Expires)
+	return err
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlProtectionRepo) Delete(coords Coords) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	result, err := r.db.Exec(`DELETE FROM protected_zones WHERE coords = ?`, coords.ToBytes())
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlProtectionRepo) List() ([]ProtectedZone, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	rows, err := r.db.Query(`SELECT coords, expires FROM protected_zones ORDER BY coords`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var zones []ProtectedZone
+	for rows.Next() {
+		var zone ProtectedZone
+		var key []byte
+		if err := rows.Scan(&key, &zone.Expires); err != nil {
+			return nil, err
+		}
+		if len(key) == 0 {
+			return nil, ErrBadBlockData
+		}
+		zone.Coords = CoordsFromBytes(key)
+		zones = append(zones, zone)
+	}
+	return zones, rows.Err()
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *SqlProtectionRepo) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	log.Infoln(nil, "Closing SQL protection storage.")
+	return r.db.Close()
+}
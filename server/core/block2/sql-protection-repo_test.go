@@ -0,0 +1,43 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ---------------------------------------------------------------------------------------
+func createTestSqlProtectionRepo(t *testing.T) ProtectionRepo {
+	repo, err := CreateSqlProtectionRepo(openTestSqliteDb(t, filepath.Join(t.TempDir(), "protection.db")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func TestSqlProtectionRepo(t *testing.T) { testProtectionRepo(t, createTestSqlProtectionRepo) }
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestSqlProtectionRepoPersistence(t *testing.T) {
+	//////////////////////////////////////////////////////////////////////
+	// Zones are still there after reopening the database.
+	path := filepath.Join(t.TempDir(), "protection.db")
+	repo, err := CreateSqlProtectionRepo(openTestSqliteDb(t, path))
+	assert.NoError(t, err)
+	zone := ProtectedZone{Coords: coordsFromBits("10", "01"), Expires: 1234}
+	assert.NoError(t, repo.Put(zone))
+	assert.NoError(t, repo.Close())
+
+	repo, err = CreateSqlProtectionRepo(openTestSqliteDb(t, path))
+	assert.NoError(t, err)
+	defer repo.Close()
+	zones, err := repo.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []ProtectedZone{zone}, zones)
+}
@@ -0,0 +1,772 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.mukunda.com/nanopaint/cat"
+)
+
+// An in-memory block repository made durable with a write-ahead log. Every paint
+// operation is appended to the log before it is applied, along with the time it happened.
+// After a crash, the last checkpoint is loaded and the log is replayed at the recorded
+// times with the recorded dry times, which reproduces the same block state, including
+// drying deadlines, even if the drying policy has changed since.
+//
+// Files in the storage directory:
+//   checkpoint  Snapshot of all blocks and the sequence number of the last operation
+//               it includes.
+//   wal.log     Operations since the checkpoint.
+//   lock        Locked while the repository is open, so that only one process can
+//               write to the log.
+//
+// WAL record:
+//   [0:4]  payload length, uint32 little-endian
+//   [4:n]  payload: seq uint64, time int64, pixel count uint16, then for each pixel:
+//          dry time int64 (ms), color uint16, coords length uint8, coords bytes
+//   [n:+4] CRC32 of the payload
+//
+// A record holds one SetPixel or SetPixels call, so that a batch is replayed as a batch,
+// or one UndoPixel call. Batches larger than maxWalRecordPixels are split into several
+// records, and are applied as separate batches both live and on replay.
+//
+// 12-bit colors with their opacity fit in 15 bits, so an undo is a single pixel with the
+// top bit of its color set (walUndoFlag), and its dry time is unused. Records with 24-bit
+// colors have walWideColors set in the pixel count, and their colors are uint32.
+//
+// Dry times used to be uint32, which wraps after about 49 days. Records with int64 dry
+// times have walLongDryTimes set in the pixel count, which all new records do. Older
+// records without it are still read.
+//
+// Converting the blocks to 24 bits changes how later paints bubble, so UpgradeColorDepth
+// isn't logged but writes a checkpoint before anything else can happen.
+//
+// Each record is synced to disk before the operation is applied, so an operation that
+// returned is never lost in a crash.
+//
+// A torn record at the end of the log (e.g., power loss during a write) is incomplete or
+// fails the CRC check and is discarded. An invalid record anywhere else means the log is
+// corrupt, and recovery fails with ErrBadWal instead of dropping the records after it.
+
+const (
+	walFileName        = "wal.log"
+	checkpointFileName = "checkpoint"
+	lockFileName       = "lock"
+	checkpointMagic    = "NPCK"
+
+	DefaultWalCheckpointOps = 10000
+
+	walUndoFlag     = 0x8000
+	walWideColors   = 0x8000
+	walLongDryTimes = 0x4000
+
+	// The pixel count shares its 16 bits with the flags.
+	maxWalRecordPixels = walLongDryTimes - 1
+	// A pixel takes at most 8+4+1+255 bytes. Older records could have more, smaller
+	// pixels.
+	maxWalPayloadLength = 8 + 8 + 2 + 0x7FFF*264
+)
+
+var (
+	ErrBadCheckpoint = errors.New("invalid checkpoint file")
+	ErrBadWal        = errors.New("corrupt write-ahead log")
+	ErrStorageLocked = errors.New("block storage is in use by another process")
+)
+
+// ---------------------------------------------------------------------------------------
+type (
+	WalBlockRepo struct {
+		mem   *MemBlockRepo
+		dir   string
+		wal   *os.File
+		lock  *os.File
+		mutex sync.Mutex
+
+		// Sequence number of the last logged operation.
+		seq uint64
+		// A checkpoint is written after this many operations.
+		checkpointOps      int
+		opsSinceCheckpoint int
+	}
+
+	walRecord struct {
+		seq    uint64
+		time   UnixMillis
+		pixels []walPixel
+	}
+
+	walPixel struct {
+		dryTime UnixMillis
+		color   Color
+		coords  Coords
+		undo    bool
+	}
+)
+
+// ---------------------------------------------------------------------------------------
+// Opens or creates a WAL repository in `dir` and recovers the existing state.
+//
+// Errors:
+//
+//	ErrStorageLocked: another process has the repository open.
+//	ErrBadWal: the log is corrupt before its last record.
+func CreateWalBlockRepo(cs ClockService, dir string) (*WalBlockRepo, error) {
+	log.WithField(nil, "dir", dir).Infoln("Opening WAL block storage.")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	lock, err := lockDir(filepath.Join(dir, lockFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &WalBlockRepo{
+		mem:           newMemBlockRepo(cs),
+		dir:           dir,
+		lock:          lock,
+		checkpointOps: DefaultWalCheckpointOps,
+	}
+
+	if err := r.recover(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *WalBlockRepo) recover() error {
+	if err := r.loadCheckpoint(); err != nil {
+		return err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(r.dir, walFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	validLength, replayed, err := r.replay(wal)
+	if err != nil {
+		wal.Close()
+		return err
+	}
+
+	// Cut off a torn record so new records are appended after valid data.
+	if err := wal.Truncate(validLength); err != nil {
+		wal.Close()
+		return err
+	}
+	if _, err := wal.Seek(validLength, io.SeekStart); err != nil {
+		wal.Close()
+		return err
+	}
+
+	log.WithField(nil, "operations", replayed).Infoln("Recovered block storage.")
+	r.wal = wal
+	r.opsSinceCheckpoint = replayed
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Applies all valid log records that are newer than the checkpoint. Returns the length
+// of the valid portion of the log.
+func (r *WalBlockRepo) replay(wal *os.File) (int64, int, error) {
+	info, err := wal.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	reader := bufio.NewReader(wal)
+	var validLength int64
+	replayed := 0
+
+	r.mem.mutex.Lock()
+	defer r.mem.mutex.Unlock()
+
+	for {
+		record, size, err := readWalRecord(reader)
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			log.WithField(nil, "offset", validLength).Warnln("Discarding torn record at the end of the log.")
+			break
+		} else if err != nil {
+			torn, terr := isTornWalTail(wal, validLength, size, info.Size())
+			if terr != nil {
+				return 0, 0, terr
+			}
+			if !torn {
+				return 0, 0, fmt.Errorf("%w: invalid record at offset %d", ErrBadWal, validLength)
+			}
+			log.WithField(nil, "offset", validLength).Warnln("Discarding torn record at the end of the log.")
+			break
+		}
+		validLength += int64(size)
+
+		if record.seq <= r.seq {
+			// Already included in the checkpoint.
+			continue
+		}
+		r.seq = record.seq
+
+		if record.isUndo() {
+			err := r.mem.undoPixelAt(record.pixels[0].coords, record.time)
+			if err != nil && !isPaintRejection(err) {
+				return 0, 0, err
+			}
+			replayed++
+			continue
+		}
+
+		// Only pixels within the depth limit are logged, so it isn't checked again. It
+		// may have been changed since.
+		_, err = r.mem.setPixelsAt(record.paints(), record.time, record.settings(math.MaxInt))
+		if err != nil {
+			return 0, 0, err
+		}
+		replayed++
+	}
+
+	return validLength, replayed, nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Whether an invalid record at `offset` can be a torn write rather than corruption: it
+// ends at the end of the log, or the rest of the log is zeros that some filesystems leave
+// after a crash. `size` is zero if the record's length is invalid.
+func isTornWalTail(wal *os.File, offset int64, size int, fileSize int64) (bool, error) {
+	if size > 0 {
+		return offset+int64(size) >= fileSize, nil
+	}
+	rest := make([]byte, fileSize-offset)
+	if _, err := wal.ReadAt(rest, offset); err != nil {
+		return false, err
+	}
+	for _, b := range rest {
+		if b != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (record walRecord) isUndo() bool {
+	return len(record.pixels) == 1 && record.pixels[0].undo
+}
+
+// ---------------------------------------------------------------------------------------
+func (record walRecord) paints() []PixelPaint {
+	paints := make([]PixelPaint, len(record.pixels))
+	for i, pixel := range record.pixels {
+		paints[i] = PixelPaint{pixel.coords, pixel.color}
+	}
+	return paints
+}
+
+// ---------------------------------------------------------------------------------------
+// Settings to apply the record with, so that its pixels dry at the logged times.
+func (record walRecord) settings(maxDepth int) paintSettings {
+	dryTimes := make(map[string]UnixMillis, len(record.pixels))
+	for _, pixel := range record.pixels {
+		dryTimes[string(pixel.coords.ToBytes())] = pixel.dryTime
+	}
+	return paintSettings{
+		maxDepth: maxDepth,
+		dryTime: func(coords Coords) UnixMillis {
+			return dryTimes[string(coords.ToBytes())]
+		},
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// The record must have no more than maxWalRecordPixels pixels.
+func encodeWalRecord(record walRecord) []byte {
+	payload := binary.LittleEndian.AppendUint64(nil, record.seq)
+	payload = binary.LittleEndian.AppendUint64(payload, uint64(record.time))
+	wide := false
+	for _, pixel := range record.pixels {
+		wide = wide || pixel.color.IsDeep()
+	}
+	count := uint16(len(record.pixels)) | walLongDryTimes
+	if wide {
+		count |= walWideColors
+	}
+	payload = binary.LittleEndian.AppendUint16(payload, count)
+	for _, pixel := range record.pixels {
+		coords := pixel.coords.ToBytes()
+		payload = binary.LittleEndian.AppendUint64(payload, uint64(pixel.dryTime))
+		if wide {
+			payload = binary.LittleEndian.AppendUint32(payload, uint32(pixel.color))
+		} else {
+			color := uint16(pixel.color)
+			if pixel.undo {
+				color |= walUndoFlag
+			}
+			payload = binary.LittleEndian.AppendUint16(payload, color)
+		}
+		payload = append(payload, byte(len(coords)))
+		payload = append(payload, coords...)
+	}
+
+	data := binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))
+	data = append(data, payload...)
+	return binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(payload))
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the record and its size in the log.
+//
+// Errors:
+//
+//	io.EOF: there are no more records.
+//	io.ErrUnexpectedEOF: the log ends in the middle of the record.
+//	ErrBadWal: the record is invalid. The size is returned if its length is valid.
+func readWalRecord(reader io.Reader) (walRecord, int, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return walRecord{}, 0, err
+	}
+
+	payloadLength := int(binary.LittleEndian.Uint32(header[:]))
+	if payloadLength < 8+8+2 || payloadLength > maxWalPayloadLength {
+		return walRecord{}, 0, ErrBadWal
+	}
+
+	data := make([]byte, payloadLength+4)
+	if _, err := io.ReadFull(reader, data); err == io.EOF {
+		return walRecord{}, 0, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return walRecord{}, 0, err
+	}
+	size := 4 + len(data)
+
+	payload := data[:payloadLength]
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(data[payloadLength:]) {
+		return walRecord{}, size, ErrBadWal
+	}
+
+	record := walRecord{
+		seq:  binary.LittleEndian.Uint64(payload[0:]),
+		time: UnixMillis(binary.LittleEndian.Uint64(payload[8:])),
+	}
+	count := int(binary.LittleEndian.Uint16(payload[16:]))
+	read := payload[18:]
+	colorSize := 2
+	if count&walWideColors != 0 {
+		count &^= walWideColors
+		colorSize = 4
+	}
+	dryTimeSize := 4
+	if count&walLongDryTimes != 0 {
+		count &^= walLongDryTimes
+		dryTimeSize = 8
+	}
+
+	// The checksum passed, but the pixels are still validated since the coords are
+	// used to index into blocks.
+	valid := func() (valid bool) {
+		defer func() {
+			if recover() != nil {
+				valid = false
+			}
+		}()
+		for i := 0; i < count; i++ {
+			header := dryTimeSize + colorSize + 1
+			if len(read) < header || len(read) < header+int(read[header-1]) {
+				return false
+			}
+			pixel := walPixel{
+				coords: CoordsFromBytes(append([]byte{}, read[header:header+int(read[header-1])]...)),
+			}
+			if dryTimeSize == 8 {
+				pixel.dryTime = UnixMillis(binary.LittleEndian.Uint64(read))
+			} else {
+				pixel.dryTime = UnixMillis(binary.LittleEndian.Uint32(read))
+			}
+			if colorSize == 4 {
+				pixel.color = Color(binary.LittleEndian.Uint32(read[dryTimeSize:]))
+			} else {
+				color := binary.LittleEndian.Uint16(read[dryTimeSize:])
+				pixel.color = Color(color &^ walUndoFlag)
+				pixel.undo = color&walUndoFlag != 0
+			}
+			if pixel.coords.BitLength() < 6 || (pixel.undo && count != 1) {
+				return false
+			}
+			record.pixels = append(record.pixels, pixel)
+			read = read[header+int(read[header-1]):]
+		}
+		return len(read) == 0
+	}()
+	if !valid {
+		return walRecord{}, size, ErrBadWal
+	}
+
+	return record, size, nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Checkpoint file:
+//
+//	[0:4]   magic "NPCK"
+//	[4:12]  sequence number of the last operation included
+//	[12:16] number of blocks
+//	For each block:
+//	  key length uint16, key, data length uint32, encodeMemBlock data
+//	CRC32 of everything before it
+func (r *WalBlockRepo) loadCheckpoint() error {
+	data, err := os.ReadFile(filepath.Join(r.dir, checkpointFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if len(data) < 20 || string(data[:4]) != checkpointMagic {
+		return ErrBadCheckpoint
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return ErrBadCheckpoint
+	}
+
+	seq := binary.LittleEndian.Uint64(body[4:])
+	count := int(binary.LittleEndian.Uint32(body[12:]))
+	blocks := make(map[string]*MemBlock, count)
+	read := body[16:]
+
+	for i := 0; i < count; i++ {
+		if len(read) < 2 {
+			return ErrBadCheckpoint
+		}
+		keyLength := int(binary.LittleEndian.Uint16(read))
+		read = read[2:]
+		if len(read) < keyLength+4 {
+			return ErrBadCheckpoint
+		}
+		key := string(read[:keyLength])
+		read = read[keyLength:]
+
+		blockLength := int(binary.LittleEndian.Uint32(read))
+		read = read[4:]
+		if len(read) < blockLength {
+			return ErrBadCheckpoint
+		}
+		block, err := decodeMemBlock(read[:blockLength])
+		if err != nil {
+			return err
+		}
+		read = read[blockLength:]
+		blocks[key] = block
+	}
+
+	r.mem.mutex.Lock()
+	defer r.mem.mutex.Unlock()
+	r.mem.setBlocks(blocks)
+	r.seq = seq
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Writes a snapshot of all blocks and clears the log. The snapshot is written to a
+// temporary file first, so a crash during a checkpoint leaves the previous one intact.
+// Records already in the snapshot are skipped by sequence number if the log isn't
+// cleared before a crash.
+func (r *WalBlockRepo) Checkpoint() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.mem.mutex.Lock()
+	defer r.mem.mutex.Unlock()
+
+	return r.checkpoint()
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *WalBlockRepo) checkpoint() error {
+	cat.EnsureLocked(&r.mutex)
+	cat.EnsureLocked(&r.mem.mutex)
+
+	data := r.encodeCheckpoint()
+	path := filepath.Join(r.dir, checkpointFileName)
+	if err := writeFileSynced(path+".tmp", data); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	if err := r.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := r.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	r.opsSinceCheckpoint = 0
+	log.WithField(nil, "seq", r.seq).Debugln("Wrote block checkpoint.")
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *WalBlockRepo) encodeCheckpoint() []byte {
+	cat.EnsureLocked(&r.mem.mutex)
+
+	r.mem.flushBlocks()
+
+	// Sorted so the same state always produces the same file.
+	keys := r.mem.keys
+
+	data := []byte(checkpointMagic)
+	data = binary.LittleEndian.AppendUint64(data, r.seq)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(keys)))
+	for _, key := range keys {
+		block := r.mem.blocks[key]
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(key)))
+		data = append(data, key...)
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(block)))
+		data = append(data, block...)
+	}
+	return binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+}
+
+// ---------------------------------------------------------------------------------------
+func writeFileSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *WalBlockRepo) GetBlock(coords Coords) (*Block, error) {
+	return r.mem.GetBlock(coords)
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *WalBlockRepo) GetBlocks(coords []Coords) ([]*Block, error) {
+	return r.mem.GetBlocks(coords)
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *WalBlockRepo) HasBlocksUnder(coords Coords, levels int) (bool, error) {
+	return r.mem.HasBlocksUnder(coords, levels)
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *WalBlockRepo) SetPixel(coords Coords, color Color) error {
+	return singlePaintResult(r.SetPixels([]PixelPaint{{coords, color}}))
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *WalBlockRepo) SetPixels(pixels []PixelPaint) ([]error, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.mem.mutex.Lock()
+	defer r.mem.mutex.Unlock()
+
+	// The depth limit is checked here so that only pixels within it are logged.
+	results := make([]error, len(pixels))
+	now := r.mem.Clock.Now().UnixMilli()
+	var walPixels []walPixel
+	var logged []int
+	for i, pixel := range pixels {
+		if pixel.Coords.ParentOfPixel().BitLength() > r.mem.settings.maxDepth {
+			results[i] = ErrMaxDepthExceeded
+			continue
+		}
+		walPixels = append(walPixels, walPixel{
+			dryTime: r.mem.settings.dryTime(pixel.Coords),
+			color:   pixel.Color,
+			coords:  pixel.Coords,
+		})
+		logged = append(logged, i)
+	}
+	if len(logged) == 0 {
+		return results, nil
+	}
+
+	var records []walRecord
+	for start := 0; start < len(walPixels); start += maxWalRecordPixels {
+		records = append(records, walRecord{
+			seq:    r.seq + uint64(len(records)) + 1,
+			time:   now,
+			pixels: walPixels[start:min(start+maxWalRecordPixels, len(walPixels))],
+		})
+	}
+	// Rejected pixels are in the log too, and are replayed the same way.
+	if err := r.writeRecords(records); err != nil {
+		return nil, err
+	}
+
+	for i, record := range records {
+		paintResults, err := r.mem.setPixelsAt(record.paints(), record.time, record.settings(math.MaxInt))
+		if err != nil {
+			return nil, err
+		}
+		for j, result := range paintResults {
+			results[logged[i*maxWalRecordPixels+j]] = result
+		}
+	}
+
+	if r.checkpointOps > 0 && r.opsSinceCheckpoint >= r.checkpointOps {
+		if err := r.checkpoint(); err != nil {
+			log.WithError(nil, err).Errorln("Failed to write block checkpoint.")
+		}
+	}
+	return results, nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Appends the records to the log and syncs it. The records are written with one call so
+// that a crash can only tear the last one. If the write fails, the log is cut back so
+// that nothing is appended after a partial record.
+func (r *WalBlockRepo) writeRecords(records []walRecord) error {
+	cat.EnsureLocked(&r.mutex)
+
+	var data []byte
+	for _, record := range records {
+		data = append(data, encodeWalRecord(record)...)
+	}
+
+	offset, err := r.wal.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = r.wal.Write(data)
+	if err == nil {
+		err = r.wal.Sync()
+	}
+	if err != nil {
+		if terr := r.wal.Truncate(offset); terr == nil {
+			r.wal.Seek(offset, io.SeekStart)
+		}
+		return err
+	}
+
+	r.seq = records[len(records)-1].seq
+	r.opsSinceCheckpoint += len(records)
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *WalBlockRepo) UndoPixel(coords Coords) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.mem.mutex.Lock()
+	defer r.mem.mutex.Unlock()
+
+	record := walRecord{
+		seq:    r.seq + 1,
+		time:   r.mem.Clock.Now().UnixMilli(),
+		pixels: []walPixel{{coords: coords, undo: true}},
+	}
+	// Rejected undos are in the log too, and are replayed the same way.
+	if err := r.writeRecords([]walRecord{record}); err != nil {
+		return err
+	}
+
+	err := r.mem.undoPixelAt(coords, record.time)
+	if err != nil && !isPaintRejection(err) {
+		return err
+	}
+
+	if r.checkpointOps > 0 && r.opsSinceCheckpoint >= r.checkpointOps {
+		if cerr := r.checkpoint(); cerr != nil {
+			log.WithError(nil, cerr).Errorln("Failed to write block checkpoint.")
+		}
+	}
+	return err
+}
+
+// ---------------------------------------------------------------------------------------
+// The converted blocks are saved with a checkpoint instead of the log, before anything
+// else is painted.
+func (r *WalBlockRepo) UpgradeColorDepth() (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.mem.mutex.Lock()
+	defer r.mem.mutex.Unlock()
+
+	upgraded, err := r.mem.upgradeColorDepth()
+	if err != nil {
+		return upgraded, err
+	}
+	return upgraded, r.checkpoint()
+}
+
+// ---------------------------------------------------------------------------------------
+// Drying isn't logged. It follows from the logged times, so replaying the log dries the
+// same pixels when their blocks are loaded.
+func (r *WalBlockRepo) DryPixels() error {
+	return r.mem.DryPixels()
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *WalBlockRepo) SetEventListener(listener BlockEventListener) {
+	r.mem.SetEventListener(listener)
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *WalBlockRepo) SetMaxDepth(depth int) {
+	r.mem.SetMaxDepth(depth)
+}
+
+// ---------------------------------------------------------------------------------------
+func (r *WalBlockRepo) SetDryingPolicy(policy *DryingPolicy) {
+	r.mem.SetDryingPolicy(policy)
+}
+
+// ---------------------------------------------------------------------------------------
+// Sets how many operations are logged before a checkpoint is written automatically.
+// Zero disables automatic checkpoints.
+func (r *WalBlockRepo) SetCheckpointOps(ops int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.checkpointOps = ops
+}
+
+// ---------------------------------------------------------------------------------------
+// Writes a final checkpoint, closes the log and releases the lock.
+func (r *WalBlockRepo) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.mem.mutex.Lock()
+	defer r.mem.mutex.Unlock()
+
+	log.Infoln(nil, "Closing WAL block storage.")
+	err := r.checkpoint()
+	if cerr := r.wal.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := r.lock.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,486 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package block2
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mukunda.com/nanopaint/core/clock"
+)
+
+func createTestWalBlockRepo(t *testing.T, cs ClockService) BlockRepo {
+	repo, err := CreateWalBlockRepo(cs, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestWalBlockRepoBubbling(t *testing.T) { testBlockRepoBubbling(t, createTestWalBlockRepo) }
+func TestWalBlockBubble2(t *testing.T)      { testBlockRepoBubble2(t, createTestWalBlockRepo, 77) }
+func TestWalBlockBubble3(t *testing.T)      { testBlockRepoBubble3(t, createTestWalBlockRepo) }
+func TestWalBlockDrying(t *testing.T)       { testBlockRepoDrying(t, createTestWalBlockRepo) }
+func TestWalBlockMaxDepth(t *testing.T)     { testBlockRepoMaxDepth(t, createTestWalBlockRepo) }
+func TestWalBlockPixelDrying(t *testing.T) {
+	testBlockRepoPixelDrying(t, createTestWalBlockRepo)
+}
+func TestWalBlockDryPixels(t *testing.T) { testBlockRepoDryPixels(t, createTestWalBlockRepo) }
+func TestWalBlockSetPixels(t *testing.T) { testBlockRepoSetPixels(t, createTestWalBlockRepo) }
+func TestWalBlockGetBlocks(t *testing.T) { testBlockRepoGetBlocks(t, createTestWalBlockRepo) }
+func TestWalBlockRepoLastUpdated(t *testing.T) {
+	testBlockRepoLastUpdated(t, createTestWalBlockRepo)
+}
+func TestWalBlockRepoHasBlocksUnder(t *testing.T) {
+	testBlockRepoHasBlocksUnder(t, createTestWalBlockRepo)
+}
+func TestWalBlockPaintEvents(t *testing.T) {
+	testBlockRepoPaintEvents(t, createTestWalBlockRepo)
+}
+func TestWalBlockRepoUndo(t *testing.T) {
+	testBlockRepoUndo(t, createTestWalBlockRepo)
+}
+func TestWalBlockRepoErase(t *testing.T) {
+	testBlockRepoErase(t, createTestWalBlockRepo)
+}
+func TestWalBlockRepoTranslucent(t *testing.T) {
+	testBlockRepoTranslucent(t, createTestWalBlockRepo)
+}
+func TestWalBlockRepoColor24(t *testing.T) {
+	testBlockRepoColor24(t, createTestWalBlockRepo)
+}
+func TestWalBlockDryingPolicy(t *testing.T) {
+	testBlockRepoDryingPolicy(t, createTestWalBlockRepo)
+}
+
+// Paints random pixels near each other over time, so that some dry and some get
+// repainted, erased, undone or rejected. The repo is switched to a short drying policy;
+// recovered repos keep the default one, which shouldn't matter because the log has the
+// dry times.
+func paintRandomWalWorkload(t *testing.T, repo BlockRepo, clock *clock.TestClockService, ops int) {
+	repo.(dryingPolicySetter).SetDryingPolicy(&DryingPolicy{Table: []int{5}})
+	base := coordsFromBits("0101 0000", "0011 0000")
+	for i := 0; i < ops; i++ {
+		coords := digCoords(base, rand.Intn(16), rand.Intn(16), 4)
+		coords = digCoords(coords, 0, 0, 2)
+		color := Color(rand.Intn(0x1000))
+		if rand.Intn(8) == 0 {
+			color = Transparent
+		}
+		if rand.Intn(5) == 0 {
+			err := repo.UndoPixel(coords)
+			if err != nil && err != ErrNothingToUndo {
+				assert.ErrorIs(t, err, ErrPixelIsDry)
+			}
+		} else if err := repo.SetPixel(coords, color); err != nil {
+			assert.ErrorIs(t, err, ErrPixelIsDry)
+		}
+		clock.Advance(time.Duration(rand.Intn(500)) * time.Millisecond)
+	}
+}
+
+// "Crashes" the repo by dropping it without a final checkpoint. The OS releases the
+// lock of a process that dies.
+func crashWalRepo(repo *WalBlockRepo) {
+	repo.wal.Close()
+	repo.lock.Close()
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the encoded blocks of the repo, all up to date.
+func walRepoBlocks(repo *WalBlockRepo) map[string][]byte {
+	repo.mem.mutex.Lock()
+	defer repo.mem.mutex.Unlock()
+	repo.mem.flushBlocks()
+	return repo.mem.blocks
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestWalBlockRepoRecovery(t *testing.T) {
+	///////////////////////////////////////////////////////////////////////////////
+	// After a crash, the log is replayed at the recorded times and the recovered
+	// blocks are exactly the same as before the crash.
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	dir := t.TempDir()
+
+	repo, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	repo.SetCheckpointOps(0)
+	paintRandomWalWorkload(t, repo, clock, 500)
+	crashWalRepo(repo)
+
+	recovered, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	defer recovered.Close()
+	assert.Equal(t, walRepoBlocks(repo), walRepoBlocks(recovered))
+	assert.Equal(t, repo.seq, recovered.seq)
+
+	// Painting continues after the recovered operations.
+	paintRandomWalWorkload(t, recovered, clock, 10)
+	assert.Equal(t, repo.seq+10, recovered.seq)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestWalBlockRepoDryingRecovery(t *testing.T) {
+	/////////////////////////////////////////////////////////////////////////////////
+	// Drying deadlines come from the logged time, not the time of recovery. A pixel
+	// that was wet before the crash dries at the same moment after recovery.
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	dir := t.TempDir()
+	coords := coordsFromBits("00000000 00", "00000000 00")
+
+	repo, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	assert.NoError(t, repo.SetPixel(coords, Color(0x00F)))
+	crashWalRepo(repo)
+
+	// Recovery happens a bit later, but before the deadline.
+	clock.Advance(time.Second)
+	recovered, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	defer recovered.Close()
+
+	block, err := recovered.GetBlock(coords.ParentOfPixel())
+	assert.NoError(t, err)
+	key := string(coords.ParentOfPixel().ToBytes())
+	original, err := decodeMemBlock(walRepoBlocks(repo)[key])
+	assert.NoError(t, err)
+	replayed, err := decodeMemBlock(walRepoBlocks(recovered)[key])
+	assert.NoError(t, err)
+	assert.Equal(t, original.DryTimes, replayed.DryTimes)
+	assert.Zero(t, block.Pixels[coords.PixelIndex()]&PIXEL_DRY)
+
+	clock.Advance(time.Hour)
+	assert.ErrorIs(t, recovered.SetPixel(coords, Color(0x00F)), ErrPixelIsDry)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestWalBlockRepoColor24Recovery(t *testing.T) {
+	/////////////////////////////////////////////////////////////////////////////////
+	// 24-bit colors are logged in full, and an upgrade survives a crash through the
+	// checkpoint that it writes.
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	dir := t.TempDir()
+
+	repo, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	repo.SetCheckpointOps(0)
+	paintRandomWalWorkload(t, repo, clock, 100)
+	count, err := repo.UpgradeColorDepth()
+	assert.NoError(t, err)
+	assert.Positive(t, count)
+	base := coordsFromBits("0101 0000", "0011 0000")
+	for i := 0; i < 100; i++ {
+		coords := digCoords(digCoords(base, rand.Intn(16), rand.Intn(16), 4), 0, 0, 2)
+		color := Color24WithAlpha(rand.Uint32(), 1+rand.Intn(255))
+		if err := repo.SetPixel(coords, color); err != nil {
+			assert.ErrorIs(t, err, ErrPixelIsDry)
+		}
+		clock.Advance(time.Duration(rand.Intn(500)) * time.Millisecond)
+	}
+	crashWalRepo(repo)
+
+	recovered, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	defer recovered.Close()
+	assert.Equal(t, walRepoBlocks(repo), walRepoBlocks(recovered))
+	count, err = recovered.UpgradeColorDepth()
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestWalBlockRepoCheckpoints(t *testing.T) {
+	/////////////////////////////////////////////////////////////////////////////////
+	// Checkpoints are written periodically and clear the log. Recovery loads the last
+	// checkpoint and replays only the operations after it.
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	dir := t.TempDir()
+
+	repo, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	repo.SetCheckpointOps(100)
+	paintRandomWalWorkload(t, repo, clock, 250)
+
+	_, err = os.Stat(filepath.Join(dir, checkpointFileName))
+	assert.NoError(t, err)
+	assert.Less(t, repo.opsSinceCheckpoint, 100)
+	crashWalRepo(repo)
+
+	recovered, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, walRepoBlocks(repo), walRepoBlocks(recovered))
+	assert.Equal(t, repo.opsSinceCheckpoint, recovered.opsSinceCheckpoint)
+
+	// A clean shutdown writes a final checkpoint and leaves an empty log.
+	assert.NoError(t, recovered.Close())
+	info, err := os.Stat(filepath.Join(dir, walFileName))
+	assert.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	reopened, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, walRepoBlocks(repo), walRepoBlocks(reopened))
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestWalBlockRepoStaleLog(t *testing.T) {
+	//////////////////////////////////////////////////////////////////////////////////
+	// If a crash happens after a checkpoint is written but before the log is cleared,
+	// the operations already in the checkpoint are not applied twice.
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	dir := t.TempDir()
+
+	repo, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	repo.SetCheckpointOps(0)
+	paintRandomWalWorkload(t, repo, clock, 50)
+
+	logData, err := os.ReadFile(filepath.Join(dir, walFileName))
+	assert.NoError(t, err)
+	assert.NoError(t, repo.Checkpoint())
+	crashWalRepo(repo)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, walFileName), logData, 0600))
+
+	recovered, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	defer recovered.Close()
+	assert.Equal(t, walRepoBlocks(repo), walRepoBlocks(recovered))
+	assert.Equal(t, 0, recovered.opsSinceCheckpoint)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestWalBlockRepoTornRecord(t *testing.T) {
+	//////////////////////////////////////////////////////////////////////////////
+	// A partially written record at the end of the log is discarded, and new
+	// records are appended after the last valid one.
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	dir := t.TempDir()
+
+	repo, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	paintRandomWalWorkload(t, repo, clock, 20)
+	crashWalRepo(repo)
+
+	torn := encodeWalRecord(walRecord{
+		seq:  repo.seq + 1,
+		time: clock.Now().UnixMilli(),
+		pixels: []walPixel{{
+			dryTime: 1000,
+			color:   0xFFF,
+			coords:  coordsFromBits("00000000 00", "00000000 00"),
+		}},
+	})
+	file, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	_, err = file.Write(torn[:len(torn)-3])
+	assert.NoError(t, err)
+	file.Close()
+
+	recovered, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, walRepoBlocks(repo), walRepoBlocks(recovered))
+	assert.Equal(t, repo.seq, recovered.seq)
+
+	coords := coordsFromBits("11111111 11", "11111111 11")
+	assert.NoError(t, recovered.SetPixel(coords, Color(0x0F0)))
+	crashWalRepo(recovered)
+
+	reopened, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	pixel, err := getPixel(reopened, coords)
+	assert.NoError(t, err)
+	assert.EqualValues(t, Pixel(0x0F0<<16)|PIXEL_SET, pixel)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestWalBlockRepoCorruptRecord(t *testing.T) {
+	//////////////////////////////////////////////////////////////////////////////
+	// An invalid record that isn't at the end of the log can't be a torn write.
+	// Recovery fails rather than discarding the records after it, and the log is
+	// left as it is.
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	dir := t.TempDir()
+
+	repo, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	paintRandomWalWorkload(t, repo, clock, 20)
+	crashWalRepo(repo)
+
+	path := filepath.Join(dir, walFileName)
+	logData, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	logData[10] ^= 0xFF
+	assert.NoError(t, os.WriteFile(path, logData, 0600))
+
+	_, err = CreateWalBlockRepo(clock, dir)
+	assert.ErrorIs(t, err, ErrBadWal)
+	corrupted, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, logData, corrupted)
+
+	/////////////////////////////////////////////////////////////////////////////
+	// The same goes for a bad record length.
+	logData[10] ^= 0xFF
+	logData[0] = 0xFF
+	logData[3] = 0xFF
+	assert.NoError(t, os.WriteFile(path, logData, 0600))
+	_, err = CreateWalBlockRepo(clock, dir)
+	assert.ErrorIs(t, err, ErrBadWal)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestWalBlockRepoZeroTail(t *testing.T) {
+	//////////////////////////////////////////////////////////////////////////////
+	// Zeros after the last record, which a crash can leave behind, are discarded like
+	// a torn record. So is a last record that fails the CRC check.
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	dir := t.TempDir()
+
+	repo, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	paintRandomWalWorkload(t, repo, clock, 20)
+	crashWalRepo(repo)
+
+	path := filepath.Join(dir, walFileName)
+	logData, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, append(logData, make([]byte, 100)...), 0600))
+
+	recovered, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, walRepoBlocks(repo), walRepoBlocks(recovered))
+	crashWalRepo(recovered)
+
+	badLast := append([]byte{}, logData...)
+	badLast[len(badLast)-1] ^= 0xFF
+	assert.NoError(t, os.WriteFile(path, badLast, 0600))
+	recovered, err = CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	defer recovered.Close()
+	assert.Equal(t, repo.seq-1, recovered.seq)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestWalBlockRepoLargeBatch(t *testing.T) {
+	//////////////////////////////////////////////////////////////////////////////
+	// A batch with more pixels than fit in one record is split into several, and is
+	// recovered in full.
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	dir := t.TempDir()
+
+	repo, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	repo.SetCheckpointOps(0)
+	base := coordsFromBits("0101", "0011")
+	var pixels []PixelPaint
+	for y := 0; y < 170; y++ {
+		for x := 0; x < 200; x++ {
+			pixels = append(pixels, PixelPaint{digCoords(base, x, y, 8), Color(0x1000 | x)})
+		}
+	}
+	assert.Greater(t, len(pixels), maxWalRecordPixels)
+	results, err := repo.SetPixels(pixels)
+	assert.NoError(t, err)
+	for _, result := range results {
+		assert.NoError(t, result)
+	}
+	records := uint64((len(pixels) + maxWalRecordPixels - 1) / maxWalRecordPixels)
+	assert.Greater(t, records, uint64(1))
+	assert.Equal(t, records, repo.seq)
+	crashWalRepo(repo)
+
+	recovered, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	defer recovered.Close()
+	assert.Equal(t, walRepoBlocks(repo), walRepoBlocks(recovered))
+	assert.Equal(t, records, recovered.seq)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestWalBlockRepoLock(t *testing.T) {
+	//////////////////////////////////////////////////////////////////////////////
+	// Only one repo can have the directory open at a time.
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	dir := t.TempDir()
+
+	repo, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	_, err = CreateWalBlockRepo(clock, dir)
+	assert.ErrorIs(t, err, ErrStorageLocked)
+
+	assert.NoError(t, repo.Close())
+	reopened, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	assert.NoError(t, reopened.Close())
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestWalBlockRepoLongDryTime(t *testing.T) {
+	//////////////////////////////////////////////////////////////////////////////
+	// Dry times past the range of uint32 milliseconds (about 49 days) are recovered
+	// as they were.
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	dir := t.TempDir()
+	coords := coordsFromBits("00000000 00", "00000000 00")
+
+	repo, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	repo.SetDryingPolicy(&DryingPolicy{Table: []int{60 * 24 * 60 * 60}})
+	assert.NoError(t, repo.SetPixel(coords, Color(0x00F)))
+	crashWalRepo(repo)
+
+	recovered, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	defer recovered.Close()
+	assert.Equal(t, walRepoBlocks(repo), walRepoBlocks(recovered))
+
+	clock.Advance(59 * 24 * time.Hour)
+	assert.NoError(t, recovered.SetPixel(coords, Color(0x0F0)))
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestWalBlockRepoLegacyRecord(t *testing.T) {
+	//////////////////////////////////////////////////////////////////////////////
+	// Records from before walLongDryTimes have uint32 dry times, and are still
+	// replayed.
+	clock := clock.CreateTestClockService().(*clock.TestClockService)
+	dir := t.TempDir()
+	coords := coordsFromBits("00000000 00", "00000000 00")
+
+	payload := binary.LittleEndian.AppendUint64(nil, 1)
+	payload = binary.LittleEndian.AppendUint64(payload, uint64(clock.Now().UnixMilli()))
+	payload = binary.LittleEndian.AppendUint16(payload, 1)
+	payload = binary.LittleEndian.AppendUint32(payload, 5000)
+	payload = binary.LittleEndian.AppendUint16(payload, 0x00F)
+	payload = append(payload, byte(len(coords.ToBytes())))
+	payload = append(payload, coords.ToBytes()...)
+	data := binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))
+	data = append(data, payload...)
+	data = binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(payload))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, walFileName), data, 0600))
+
+	repo, err := CreateWalBlockRepo(clock, dir)
+	assert.NoError(t, err)
+	defer repo.Close()
+	assert.EqualValues(t, 1, repo.seq)
+	pixel, err := getPixel(repo, coords)
+	assert.NoError(t, err)
+	assert.EqualValues(t, Pixel(0x00F<<16)|PIXEL_SET, pixel)
+
+	block, err := decodeMemBlock(walRepoBlocks(repo)[string(coords.ParentOfPixel().ToBytes())])
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint16]UnixMillis{uint16(coords.PixelIndex()): clock.Now().UnixMilli() + 5000}, block.DryTimes)
+}
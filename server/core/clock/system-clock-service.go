@@ -16,6 +16,13 @@ func (cs *SystemClockService) Now() time.Time {
 	return time.Now()
 }
 
+// Calls the callback every `duration` on its own goroutine, for the rest of the process
+// lifetime. A callback that runs long delays the next call rather than overlapping it.
 func (cs *SystemClockService) StartInterval(duration time.Duration, callback IntervalCallback) {
-	// not implemented yet
+	ticker := time.NewTicker(duration)
+	go func() {
+		for range ticker.C {
+			callback()
+		}
+	}()
 }
@@ -20,3 +20,24 @@ func TestSystemClock(t *testing.T) {
 	cs := CreateSystemClockService()
 	assert.Greater(t, cs.Now().UnixMilli(), before.UnixMilli())
 }
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestSystemClockInterval(t *testing.T) {
+	// Intervals are called repeatedly in the background.
+	cs := CreateSystemClockService()
+	calls := make(chan bool, 10)
+	cs.StartInterval(time.Millisecond*5, func() {
+		select {
+		case calls <- true:
+		default:
+		}
+	})
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-calls:
+		case <-time.After(time.Second):
+			t.Fatal("interval was not called")
+		}
+	}
+}
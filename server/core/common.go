@@ -5,7 +5,67 @@ import "go.mukunda.com/nanopaint/common"
 var log = common.GetLogger("core")
 
 type coreConfig struct {
-	storageType             string
-	blockDryInterval        int
-	disableBlockDryInterval bool
+	// "mem", "bolt", "sqlite" or "wal"
+	StorageType string `yaml:"storageType"`
+	// File path for persistent storage types. For "wal" this is a directory.
+	StoragePath string `yaml:"storagePath"`
+	// Number of logged operations between checkpoints for "wal" storage.
+	WalCheckpointOps        int  `yaml:"walCheckpointOps"`
+	BlockDryInterval        int  `yaml:"blockDryInterval"`
+	DisableBlockDryInterval bool `yaml:"disableBlockDryInterval"`
+	// 12 or 24. 12-bit canvases round 24-bit colors to 12 bits when they're painted.
+	// Changing a canvas to 24 bits doesn't convert its blocks; that's done by the migrate
+	// command, or as 24-bit colors are painted. See block2.Color.
+	ColorDepth int `yaml:"colorDepth"`
+	// How long painted pixels take to dry.
+	Drying dryingConfig `yaml:"drying"`
+	// Where paint history is kept and for how long.
+	History historyConfig `yaml:"history"`
+	// Where palette zones are kept. They're managed through the admin API.
+	Palettes paletteConfig `yaml:"palettes"`
+	// Where protected zones are kept. They're managed through the admin API.
+	Protection protectionConfig `yaml:"protection"`
+}
+
+type historyConfig struct {
+	// "mem" or "sqlite"
+	StorageType string `yaml:"storageType"`
+	// File path for "sqlite". It can be the same database as the block storage.
+	StoragePath string `yaml:"storagePath"`
+	// Seconds to keep entries. Zero keeps them forever.
+	Retention int `yaml:"retention"`
+	// Milliseconds between removing expired entries.
+	PruneInterval int `yaml:"pruneInterval"`
+}
+
+type paletteConfig struct {
+	// "mem" or "sqlite"
+	StorageType string `yaml:"storageType"`
+	// File path for "sqlite". It can be the same database as the block storage.
+	StoragePath string `yaml:"storagePath"`
+}
+
+type protectionConfig struct {
+	// "mem" or "sqlite"
+	StorageType string `yaml:"storageType"`
+	// File path for "sqlite". It can be the same database as the block storage.
+	StoragePath string `yaml:"storagePath"`
+}
+
+// See block2.DryingPolicy. Times are in seconds.
+type dryingConfig struct {
+	// "table", "linear" or "exponential"
+	Curve  string             `yaml:"curve"`
+	Table  []int              `yaml:"table"`
+	Base   int                `yaml:"base"`
+	Step   int                `yaml:"step"`
+	Factor float64            `yaml:"factor"`
+	Max    int                `yaml:"max"`
+	Zones  []dryingZoneConfig `yaml:"zones"`
+}
+
+type dryingZoneConfig struct {
+	// Base64 block coordinates, same as the API.
+	Coords  string `yaml:"coords"`
+	DryTime int    `yaml:"dryTime"`
 }
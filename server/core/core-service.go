@@ -1,20 +1,62 @@
 package core
 
 import (
+	"context"
+	"sync/atomic"
+	"time"
+
 	"go.mukunda.com/nanopaint/core/block2"
 	"go.mukunda.com/nanopaint/core/clock"
+	"go.uber.org/fx"
 )
 
 type CoreIntervals interface{}
 
-type coreIntervals struct{}
+type coreIntervals struct {
+	stopped atomic.Bool
+}
+
+// ---------------------------------------------------------------------------------------
+// Background routines. They start with the application and are skipped after it stops,
+// since intervals can't be canceled.
+func CreateCoreIntervals(lc fx.Lifecycle, config *coreConfig, clock clock.ClockService, blocks block2.BlockRepo, history block2.HistoryRepo) CoreIntervals {
+	ci := &coreIntervals{}
+
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			if !config.DisableBlockDryInterval {
+				clock.StartInterval(time.Millisecond*time.Duration(config.BlockDryInterval),
+					ci.guard(func() {
+						if err := blocks.DryPixels(); err != nil {
+							log.WithError(nil, err).Errorln("Failed to dry pixels.")
+						}
+					}))
+			}
+			if config.History.Retention > 0 {
+				clock.StartInterval(time.Millisecond*time.Duration(config.History.PruneInterval),
+					ci.guard(func() {
+						retention := time.Second * time.Duration(config.History.Retention)
+						if _, err := history.Prune(clock.Now().Add(-retention).UnixMilli()); err != nil {
+							log.WithError(nil, err).Errorln("Failed to prune paint history.")
+						}
+					}))
+			}
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			ci.stopped.Store(true)
+			return nil
+		},
+	})
+
+	return ci
+}
 
-func CreateCoreIntervals(config *coreConfig, clock clock.ClockService, blocks block2.BlockRepo) CoreIntervals {
-	// if !config.disableBlockDryInterval {
-	// 	clock.StartInterval(time.Millisecond*time.Duration(config.blockDryInterval),
-	// 		func() {
-	// 			blocks.DryPixels()
-	// 		})
-	// }
-	return &coreIntervals{}
+// ---------------------------------------------------------------------------------------
+func (ci *coreIntervals) guard(callback clock.IntervalCallback) clock.IntervalCallback {
+	return func() {
+		if !ci.stopped.Load() {
+			callback()
+		}
+	}
 }
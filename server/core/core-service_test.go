@@ -0,0 +1,147 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package core
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mukunda.com/nanopaint/config"
+	"go.mukunda.com/nanopaint/core/block2"
+	"go.mukunda.com/nanopaint/core/clock"
+	"go.uber.org/fx"
+	"go.uber.org/fx/fxtest"
+)
+
+type coreTester struct {
+	app     *fxtest.App
+	clock   *clock.TestClockService
+	blocks  BlockService
+	history HistoryService
+	mutex   sync.Mutex
+	// Only BLOCK_EVENT_PIXELS_DRIED.
+	events []block2.BlockEvent
+}
+
+// ---------------------------------------------------------------------------------------
+func createCoreTester(t *testing.T, coreConfig string) *coreTester {
+	ct := &coreTester{}
+	ct.app = fxtest.New(t,
+		config.ProvideFromYamlString(coreConfig),
+		fx.Provide(clock.CreateTestClockService),
+		Fx(),
+		fx.Invoke(func(cs clock.ClockService, blocks BlockService, history HistoryService, events BlockEventService) {
+			ct.clock = cs.(*clock.TestClockService)
+			ct.blocks = blocks
+			ct.history = history
+			events.Subscribe(func(event block2.BlockEvent) {
+				if event.Type != block2.BLOCK_EVENT_PIXELS_DRIED {
+					return
+				}
+				ct.mutex.Lock()
+				defer ct.mutex.Unlock()
+				ct.events = append(ct.events, event)
+			})
+		}),
+	).RequireStart()
+	return ct
+}
+
+// ---------------------------------------------------------------------------------------
+func (ct *coreTester) eventCount() int {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+	return len(ct.events)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestBlockDryInterval(t *testing.T) {
+	ct := createCoreTester(t, `
+core:
+  blockDryInterval: 1000
+  drying:
+    table: [0, 10]
+`)
+	defer ct.app.RequireStop()
+
+	coords := block2.MakeEmptyCoords()
+	for i := 0; i < 6; i++ {
+		coords = coords.Down(0, 0)
+	}
+	assert.NoError(t, ct.blocks.SetPixel(nil, coords, block2.Color(0x00F)))
+
+	///////////////////////////////////////////////////////////////////////////
+	// The sweeper dries pixels in the background once their deadline passes and
+	// publishes an event, without anything reading the block.
+	ct.clock.Advance(9 * time.Second)
+	assert.Equal(t, 0, ct.eventCount())
+
+	ct.clock.Advance(time.Second)
+	assert.Equal(t, 1, ct.eventCount())
+	assert.Equal(t, block2.BLOCK_EVENT_PIXELS_DRIED, ct.events[0].Type)
+	assert.Equal(t, []uint16{0}, ct.events[0].Pixels)
+
+	ct.clock.Advance(time.Minute)
+	assert.Equal(t, 1, ct.eventCount())
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestDisableBlockDryInterval(t *testing.T) {
+	ct := createCoreTester(t, `
+core:
+  disableBlockDryInterval: true
+`)
+	defer ct.app.RequireStop()
+
+	coords := block2.MakeEmptyCoords()
+	for i := 0; i < 6; i++ {
+		coords = coords.Down(0, 0)
+	}
+	assert.NoError(t, ct.blocks.SetPixel(nil, coords, block2.Color(0x00F)))
+
+	////////////////////////////////////////////////////////////////////////
+	// With the sweeper disabled, pixels only dry when their block is used.
+	ct.clock.Advance(time.Hour)
+	assert.Equal(t, 0, ct.eventCount())
+
+	_, err := ct.blocks.GetBlock(coords.ParentOfPixel())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ct.eventCount())
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestBadIntervalConfig(t *testing.T) {
+	//////////////////////////////////////////////////////////////////////////////
+	// Intervals that can't be ticked are config errors rather than a panic when the
+	// app starts, and so are drying policies that can't give a sane dry time. A
+	// disabled sweeper doesn't need an interval.
+	for _, content := range []string{
+		"core:\n  blockDryInterval: 0\n",
+		"core:\n  blockDryInterval: -5\n",
+		"core:\n  history:\n    retention: 60\n    pruneInterval: 0\n",
+		"core:\n  drying:\n    curve: cubic\n",
+		"core:\n  drying:\n    curve: exponential\n    base: 10\n",
+		"core:\n  drying:\n    curve: exponential\n    factor: 2\n",
+		"core:\n  drying:\n    curve: linear\n",
+		"core:\n  drying:\n    table: [0, 15, -30]\n",
+	} {
+		app := fx.New(
+			config.ProvideFromYamlString(content),
+			fx.Provide(clock.CreateTestClockService),
+			Fx(),
+			fx.NopLogger,
+		)
+		assert.ErrorIs(t, app.Err(), ErrBadConfig, content)
+	}
+
+	ct := createCoreTester(t, `
+core:
+  blockDryInterval: 0
+  disableBlockDryInterval: true
+`)
+	ct.app.RequireStop()
+}
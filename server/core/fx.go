@@ -5,34 +5,226 @@
 package core
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"go.mukunda.com/nanopaint/cat"
 	"go.mukunda.com/nanopaint/config"
 	"go.mukunda.com/nanopaint/core/block2"
 	"go.mukunda.com/nanopaint/core/clock"
 	"go.uber.org/fx"
+
+	_ "github.com/mattn/go-sqlite3"
 )
 
+var ErrBadConfig = errors.New("invalid core config")
+
 var defaultCoreConfig = coreConfig{
-	storageType:             "mem",
-	blockDryInterval:        1000,
-	disableBlockDryInterval: false,
+	StorageType:             "mem",
+	StoragePath:             "nanopaint.db",
+	WalCheckpointOps:        block2.DefaultWalCheckpointOps,
+	BlockDryInterval:        1000,
+	DisableBlockDryInterval: false,
+	ColorDepth:              12,
+	// An empty table means block2.DEFAULT_DRY_TIME.
+	Drying: dryingConfig{
+		Curve: block2.DRYING_CURVE_TABLE,
+	},
+	// A week of history, so the in-memory default doesn't grow forever. Zero must be
+	// configured to keep it all.
+	History: historyConfig{
+		StorageType:   "mem",
+		StoragePath:   "history.db",
+		Retention:     7 * 24 * 60 * 60,
+		PruneInterval: 60_000,
+	},
+	Palettes: paletteConfig{
+		StorageType: "mem",
+		StoragePath: "palettes.db",
+	},
+	Protection: protectionConfig{
+		StorageType: "mem",
+		StoragePath: "protection.db",
+	},
+}
+
+// ---------------------------------------------------------------------------------------
+func (c *dryingConfig) toPolicy() *block2.DryingPolicy {
+	policy := &block2.DryingPolicy{
+		Curve:  c.Curve,
+		Table:  c.Table,
+		Base:   c.Base,
+		Step:   c.Step,
+		Factor: c.Factor,
+		Max:    c.Max,
+	}
+	for _, zone := range c.Zones {
+		policy.Zones = append(policy.Zones, block2.DryingZone{
+			Coords:  block2.CoordsFromBase64(zone.Coords),
+			DryTime: zone.DryTime,
+		})
+	}
+	return policy
 }
 
 // ---------------------------------------------------------------------------------------
-func createBlockRepo(config *coreConfig, clock clock.ClockService) block2.BlockRepo {
+func createBlockRepo(lc fx.Lifecycle, config *coreConfig, clock clock.ClockService) block2.BlockRepo {
+	var repo interface {
+		block2.BlockRepo
+		SetDryingPolicy(policy *block2.DryingPolicy)
+		Close() error
+	}
 
-	if config.storageType == "mem" {
-		return block2.CreateMemBlockRepo(clock)
-	} else {
+	switch config.StorageType {
+	case "mem":
+		memRepo := block2.CreateMemBlockRepo(clock).(*block2.MemBlockRepo)
+		memRepo.SetDryingPolicy(config.Drying.toPolicy())
+		return memRepo
+	case "bolt":
+		boltRepo, err := block2.CreateBoltBlockRepo(clock, config.StoragePath)
+		cat.Catch(err, "Failed to open bolt block storage.")
+		repo = boltRepo
+	case "wal":
+		walRepo, err := block2.CreateWalBlockRepo(clock, config.StoragePath)
+		cat.Catch(err, "Failed to recover WAL block storage.")
+		walRepo.SetCheckpointOps(config.WalCheckpointOps)
+		repo = walRepo
+	case "sqlite":
+		db, err := sql.Open("sqlite3", config.StoragePath)
+		cat.Catch(err, "Failed to open SQLite block storage.")
+		sqlRepo, err := block2.CreateSqlBlockRepo(clock, db)
+		cat.Catch(err, "Failed to initialize SQLite block storage.")
+		repo = sqlRepo
+	default:
 		panic("unknown block storage type")
 	}
+
+	repo.SetDryingPolicy(config.Drying.toPolicy())
+
+	lc.Append(fx.Hook{
+		OnStop: func(context.Context) error {
+			return repo.Close()
+		},
+	})
+	return repo
+}
+
+// ---------------------------------------------------------------------------------------
+func createBlockService(config *coreConfig, repo block2.BlockRepo, history HistoryService, palettes PaletteService, protection ProtectionService) BlockService {
+	if config.ColorDepth != 12 && config.ColorDepth != 24 {
+		panic("unsupported color depth")
+	}
+	service := CreateBlockService(repo, history).(*blockService)
+	service.colorDepth = config.ColorDepth
+	service.palettes = palettes
+	service.protection = protection
+	return service
+}
+
+// ---------------------------------------------------------------------------------------
+func createPaletteService(config *coreConfig, repo block2.PaletteRepo) PaletteService {
+	service := CreatePaletteService(repo).(*paletteService)
+	service.colorDepth = config.ColorDepth
+	return service
+}
+
+// ---------------------------------------------------------------------------------------
+func createHistoryRepo(lc fx.Lifecycle, config *coreConfig) block2.HistoryRepo {
+	var repo block2.HistoryRepo
+
+	switch config.History.StorageType {
+	case "mem":
+		return block2.CreateMemHistoryRepo()
+	case "sqlite":
+		db, err := sql.Open("sqlite3", config.History.StoragePath)
+		cat.Catch(err, "Failed to open SQLite history storage.")
+		sqlRepo, err := block2.CreateSqlHistoryRepo(db)
+		cat.Catch(err, "Failed to initialize SQLite history storage.")
+		repo = sqlRepo
+	default:
+		panic("unknown history storage type")
+	}
+
+	lc.Append(fx.Hook{
+		OnStop: func(context.Context) error {
+			return repo.Close()
+		},
+	})
+	return repo
+}
+
+// ---------------------------------------------------------------------------------------
+func createPaletteRepo(lc fx.Lifecycle, config *coreConfig) block2.PaletteRepo {
+	var repo block2.PaletteRepo
+
+	switch config.Palettes.StorageType {
+	case "mem":
+		return block2.CreateMemPaletteRepo()
+	case "sqlite":
+		db, err := sql.Open("sqlite3", config.Palettes.StoragePath)
+		cat.Catch(err, "Failed to open SQLite palette storage.")
+		sqlRepo, err := block2.CreateSqlPaletteRepo(db)
+		cat.Catch(err, "Failed to initialize SQLite palette storage.")
+		repo = sqlRepo
+	default:
+		panic("unknown palette storage type")
+	}
+
+	lc.Append(fx.Hook{
+		OnStop: func(context.Context) error {
+			return repo.Close()
+		},
+	})
+	return repo
+}
+
+// ---------------------------------------------------------------------------------------
+func createProtectionRepo(lc fx.Lifecycle, config *coreConfig) block2.ProtectionRepo {
+	var repo block2.ProtectionRepo
+
+	switch config.Protection.StorageType {
+	case "mem":
+		return block2.CreateMemProtectionRepo()
+	case "sqlite":
+		db, err := sql.Open("sqlite3", config.Protection.StoragePath)
+		cat.Catch(err, "Failed to open SQLite protection storage.")
+		sqlRepo, err := block2.CreateSqlProtectionRepo(db)
+		cat.Catch(err, "Failed to initialize SQLite protection storage.")
+		repo = sqlRepo
+	default:
+		panic("unknown protection storage type")
+	}
+
+	lc.Append(fx.Hook{
+		OnStop: func(context.Context) error {
+			return repo.Close()
+		},
+	})
+	return repo
 }
 
 // ---------------------------------------------------------------------------------------
-func createCoreConfig(config config.Config) *coreConfig {
+// Errors:
+//
+//	ErrBadConfig: an interval is zero or negative, which would panic when its ticker is
+//	              started, or the drying policy is invalid (see block2.DryingPolicy).
+func createCoreConfig(config config.Config) (*coreConfig, error) {
 	cc := coreConfig{}
 	cc = defaultCoreConfig
 	config.Load("core", &cc)
-	return &cc
+
+	if !cc.DisableBlockDryInterval && cc.BlockDryInterval <= 0 {
+		return nil, fmt.Errorf("%w: core.blockDryInterval must be positive", ErrBadConfig)
+	}
+	if cc.History.Retention > 0 && cc.History.PruneInterval <= 0 {
+		return nil, fmt.Errorf("%w: core.history.pruneInterval must be positive", ErrBadConfig)
+	}
+	if err := cc.Drying.toPolicy().Validate(); err != nil {
+		return nil, fmt.Errorf("%w: core.drying: %w", ErrBadConfig, err)
+	}
+	return &cc, nil
 }
 
 // ---------------------------------------------------------------------------------------
@@ -41,9 +233,18 @@ func Fx() fx.Option {
 		fx.Provide(
 			createCoreConfig,
 			createBlockRepo,
-			CreateBlockService,
+			createHistoryRepo,
+			createPaletteRepo,
+			createProtectionRepo,
+			CreateHistoryService,
+			createPaletteService,
+			CreateProtectionService,
+			createBlockService,
+			CreateImageService,
+			CreateTimelapseService,
+			CreateBlockEventService,
 			CreateCoreIntervals,
 		),
-		fx.Invoke(func(CoreIntervals) {}),
+		fx.Invoke(func(CoreIntervals, BlockEventService) {}),
 	)
 }
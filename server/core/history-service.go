@@ -0,0 +1,91 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package core
+
+import (
+	"go.mukunda.com/nanopaint/cat"
+	"go.mukunda.com/nanopaint/common"
+	"go.mukunda.com/nanopaint/core/block2"
+	"go.mukunda.com/nanopaint/core/clock"
+)
+
+// Records who painted what and when, for moderators. The BlockService records every
+// pixel that it paints. See block2.HistoryRepo.
+
+type (
+	HistoryService interface {
+		Record(c common.Context, pixels []block2.PixelPaint)
+		RecordUndo(c common.Context, coords block2.Coords)
+		Query(query block2.HistoryQuery) []block2.HistoryEntry
+		Prune(before block2.UnixMillis) int
+	}
+
+	historyService struct {
+		repo  block2.HistoryRepo
+		clock clock.ClockService
+	}
+)
+
+// ---------------------------------------------------------------------------------------
+func CreateHistoryService(repo block2.HistoryRepo, clock clock.ClockService) HistoryService {
+	return &historyService{
+		repo:  repo,
+		clock: clock,
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Records the pixels as painted now by the context's identity (see common.Identity).
+// Errors are panics.
+func (s *historyService) Record(c common.Context, pixels []block2.PixelPaint) {
+	if len(pixels) == 0 {
+		return
+	}
+
+	now := s.clock.Now().UnixMilli()
+	painter := common.Identity(c)
+	entries := make([]block2.HistoryEntry, len(pixels))
+	for i, pixel := range pixels {
+		entries[i] = block2.HistoryEntry{
+			Time:    now,
+			Coords:  pixel.Coords,
+			Color:   pixel.Color,
+			Painter: painter,
+		}
+	}
+	cat.Catch(s.repo.Append(entries), "Failed to record paint history.")
+}
+
+// ---------------------------------------------------------------------------------------
+// Records that the context's identity undid their last paint of the pixel. Errors are
+// panics.
+func (s *historyService) RecordUndo(c common.Context, coords block2.Coords) {
+	entry := block2.HistoryEntry{
+		Time:    s.clock.Now().UnixMilli(),
+		Coords:  coords,
+		Painter: common.Identity(c),
+		Undo:    true,
+	}
+	cat.Catch(s.repo.Append([]block2.HistoryEntry{entry}), "Failed to record paint history.")
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the matching entries, newest first. Errors are panics.
+func (s *historyService) Query(query block2.HistoryQuery) []block2.HistoryEntry {
+	entries, err := s.repo.Query(query)
+	cat.Catch(err, "Failed to query paint history.")
+
+	return entries
+}
+
+// ---------------------------------------------------------------------------------------
+// Removes the entries from before the given time and returns how many. Errors are
+// panics.
+func (s *historyService) Prune(before block2.UnixMillis) int {
+	count, err := s.repo.Prune(before)
+	cat.Catch(err, "Failed to prune paint history.")
+
+	return count
+}
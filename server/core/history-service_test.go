@@ -0,0 +1,158 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mukunda.com/nanopaint/common"
+	"go.mukunda.com/nanopaint/core/block2"
+	"go.mukunda.com/nanopaint/core/clock"
+)
+
+// ---------------------------------------------------------------------------------------
+// A BlockService over memory storage, with its own history.
+func createTestBlockService(cs clock.ClockService) BlockService {
+	history := CreateHistoryService(block2.CreateMemHistoryRepo(), cs)
+	return CreateBlockService(block2.CreateMemBlockRepo(cs), history)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestHistoryService(t *testing.T) {
+	tcs := clock.CreateTestClockService().(*clock.TestClockService)
+	history := CreateHistoryService(block2.CreateMemHistoryRepo(), tcs)
+	blocks := CreateBlockService(block2.CreateMemBlockRepo(tcs), history)
+
+	user := common.CreateBasicContext()
+	user.Set("username", "alice")
+	user.Set("ip", "1.2.3.4")
+	guest := common.CreateBasicContext()
+	guest.Set("ip", "5.6.7.8")
+
+	first := tcs.Now().UnixMilli()
+	assert.NoError(t, blocks.SetPixel(user, pixelCoordsAt(6, 0, 0), block2.Color(0x00F)))
+	tcs.Advance(time.Hour)
+	results := blocks.SetPixels(guest, []block2.PixelPaint{
+		{Coords: pixelCoordsAt(6, 1, 0), Color: block2.Color(0x0F0)},
+		// Dry by now, so it isn't recorded.
+		{Coords: pixelCoordsAt(6, 0, 0), Color: block2.Color(0xF00)},
+	})
+	assert.Equal(t, []error{nil, block2.ErrPixelIsDry}, results)
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(7, 6, 6), block2.Color(0xFFF)))
+	second := tcs.Now().UnixMilli()
+
+	//////////////////////////////////////////////////////////////////////////
+	// Every painted pixel is recorded with the painter, newest first.
+	entries := history.Query(block2.HistoryQuery{Coords: block2.MakeEmptyCoords()})
+	assert.Equal(t, []block2.HistoryEntry{
+		{Time: second, Coords: pixelCoordsAt(7, 6, 6), Color: block2.Color(0xFFF), Painter: ""},
+		{Time: second, Coords: pixelCoordsAt(6, 1, 0), Color: block2.Color(0x0F0), Painter: "5.6.7.8"},
+		{Time: first, Coords: pixelCoordsAt(6, 0, 0), Color: block2.Color(0x00F), Painter: "alice"},
+	}, entries)
+
+	entries = history.Query(block2.HistoryQuery{Coords: pixelCoordsAt(6, 0, 0)})
+	assert.Len(t, entries, 1)
+	entries = history.Query(block2.HistoryQuery{Coords: block2.MakeEmptyCoords(), Until: second})
+	assert.Len(t, entries, 1)
+
+	//////////////////////////////////////////////////////////////////////////
+	// Retention.
+	assert.Equal(t, 1, history.Prune(second))
+	assert.Len(t, history.Query(block2.HistoryQuery{Coords: block2.MakeEmptyCoords()}), 2)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestBlockServiceUndoPixel(t *testing.T) {
+	tcs := clock.CreateTestClockService().(*clock.TestClockService)
+	history := CreateHistoryService(block2.CreateMemHistoryRepo(), tcs)
+	blocks := CreateBlockService(block2.CreateMemBlockRepo(tcs), history)
+
+	alice := common.CreateBasicContext()
+	alice.Set("username", "alice")
+	bob := common.CreateBasicContext()
+	bob.Set("username", "bob")
+	pixel := pixelCoordsAt(6, 0, 0)
+	paintedColor := func() block2.Color {
+		block, err := blocks.GetBlock(pixel.ParentOfPixel())
+		assert.NoError(t, err)
+		return block2.Color(block.Pixels[pixel.PixelIndex()] >> 16 & 0xFFF)
+	}
+
+	assert.ErrorIs(t, blocks.UndoPixel(alice, pixel), block2.ErrNothingToUndo)
+	assert.NoError(t, blocks.SetPixel(alice, pixel, block2.Color(0x00F)))
+	assert.NoError(t, blocks.SetPixel(alice, pixel, block2.Color(0x0F0)))
+
+	//////////////////////////////////////////////////////////////////////////
+	// Only the last painter can undo, and only once.
+	assert.ErrorIs(t, blocks.UndoPixel(bob, pixel), ErrNotPainter)
+	assert.ErrorIs(t, blocks.UndoPixel(nil, pixel), ErrNotPainter)
+	assert.NoError(t, blocks.UndoPixel(alice, pixel))
+	assert.Equal(t, block2.Color(0x00F), paintedColor())
+	assert.ErrorIs(t, blocks.UndoPixel(alice, pixel), block2.ErrNothingToUndo)
+
+	// The undo is recorded.
+	entries := history.Query(block2.HistoryQuery{Coords: pixel})
+	if assert.Len(t, entries, 3) {
+		assert.True(t, entries[0].Undo)
+		assert.Equal(t, "alice", entries[0].Painter)
+	}
+
+	//////////////////////////////////////////////////////////////////////////
+	// Dry pixels stay.
+	assert.NoError(t, blocks.SetPixel(bob, pixel, block2.Color(0xF00)))
+	tcs.Advance(time.Hour)
+	assert.ErrorIs(t, blocks.UndoPixel(bob, pixel), block2.ErrPixelIsDry)
+	assert.Equal(t, block2.Color(0xF00), paintedColor())
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestHistoryPruneInterval(t *testing.T) {
+	ct := createCoreTester(t, `
+core:
+  disableBlockDryInterval: true
+  history:
+    retention: 3600
+    pruneInterval: 60000
+`)
+	defer ct.app.RequireStop()
+
+	assert.NoError(t, ct.blocks.SetPixel(nil, pixelCoordsAt(6, 0, 0), block2.Color(0x00F)))
+	query := block2.HistoryQuery{Coords: block2.MakeEmptyCoords()}
+
+	//////////////////////////////////////////////////////////////////////////
+	// Entries are removed in the background once they're past the retention.
+	ct.clock.Advance(time.Hour)
+	assert.Len(t, ct.history.Query(query), 1)
+	ct.clock.Advance(time.Minute)
+	assert.Empty(t, ct.history.Query(query))
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestHistoryDefaultRetention(t *testing.T) {
+	for _, keepForever := range []bool{false, true} {
+		config := "core:\n  disableBlockDryInterval: true\n"
+		if keepForever {
+			config += "  history:\n    retention: 0\n"
+		}
+		ct := createCoreTester(t, config)
+
+		//////////////////////////////////////////////////////////////////////
+		// The history is kept for a week unless a retention is configured, and zero
+		// keeps it forever.
+		assert.NoError(t, ct.blocks.SetPixel(nil, pixelCoordsAt(6, 0, 0), block2.Color(0x00F)))
+		query := block2.HistoryQuery{Coords: block2.MakeEmptyCoords()}
+		ct.clock.Advance(7 * 24 * time.Hour)
+		assert.Len(t, ct.history.Query(query), 1)
+		ct.clock.Advance(time.Minute)
+		if keepForever {
+			assert.Len(t, ct.history.Query(query), 1)
+		} else {
+			assert.Empty(t, ct.history.Query(query))
+		}
+		ct.app.RequireStop()
+	}
+}
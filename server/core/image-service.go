@@ -0,0 +1,510 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package core
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"go.mukunda.com/nanopaint/common"
+	"go.mukunda.com/nanopaint/core/block2"
+)
+
+// Renders regions of the canvas to images, e.g., to share artwork outside of the app.
+//
+// A region is everything under a root block, down to a target depth below it. At depth
+// 0 that is the root block's 64x64 pixels, and each level down doubles the size. The
+// painted colors of the levels above the target are drawn first, and each deeper level
+// is drawn over them. At the target depth, the inherited color stands in for everything
+// painted below it: a painted pixel is blended with it by the inherited alpha, and an
+// unpainted pixel is drawn with the inherited color and alpha.
+//
+// Images can also be stamped into a region, e.g., to seed events. The image covers the
+// pixels at the target depth from the top left of the root block, each quantized to the
+// 12-bit color format and painted through the BlockService with normal bubbling. Pixels
+// less than half opaque are left alone.
+//
+// Tiles are single blocks rendered for viewers that don't decode the pixel flags. They
+// are the same as a region of depth 0, optionally with a checkerboard under transparent
+// pixels and a debug tint on wet and dry pixels.
+//
+// A pyramid is the tiles of every block from a root down some levels, written to a
+// directory so that tile viewers can browse a snapshot offline. The tree is walked
+// depth-first, so only the current path is in memory, and subtrees without any blocks are
+// skipped. Blocks that don't exist have no tile, which viewers show as empty.
+
+type (
+	ImageService interface {
+		RenderRegion(root block2.Coords, depth int, pixelSize int) (*image.NRGBA, error)
+		ExportPng(w io.Writer, root block2.Coords, depth int, pixelSize int) error
+		StampImage(c common.Context, img image.Image, root block2.Coords, depth int, dryRun bool) (StampResult, error)
+		RenderTile(block *block2.Block, options TileOptions) *image.NRGBA
+		ExportPyramid(dir string, root block2.Coords, levels int, layout PyramidLayout) (int, error)
+	}
+
+	// How a single block is rendered as a tile.
+	TileOptions struct {
+		// Draws a checkerboard where the block is fully transparent.
+		Checkerboard bool
+		// Tints the painted pixels by whether they are wet or dry.
+		DebugDrying bool
+	}
+
+	// The outcome of stamping an image. In a dry run, nothing is painted and Painted is
+	// how many pixels would be.
+	StampResult struct {
+		// Opaque pixels in the image.
+		Pixels  int
+		Painted int
+		// Rejected with ErrPixelIsDry.
+		Dry int
+		// Rejected with ErrMaxDepthExceeded. Not checked in a dry run.
+		TooDeep int
+		// Rejected with ErrColorNotAllowed. Not checked in a dry run.
+		NotAllowed int
+		// Rejected with ErrProtected. Not checked in a dry run.
+		Protected int
+	}
+
+	imageService struct {
+		blocks BlockService
+	}
+)
+
+// How the tiles of a pyramid are laid out in the directory.
+type PyramidLayout string
+
+const (
+	// <z>/<x>/<y>.png, where z is the level below the root.
+	PyramidXyz PyramidLayout = "xyz"
+	// canvas.dzi and canvas_files/<level>/<x>_<y>.png for Deep Zoom viewers.
+	PyramidDzi PyramidLayout = "dzi"
+)
+
+// Largest width or height of a rendered image.
+const MaxImageSize = 8192
+
+var (
+	ErrImageSize      = errors.New("image size is out of range")
+	ErrPyramidOptions = errors.New("invalid pyramid options")
+)
+
+// ---------------------------------------------------------------------------------------
+func CreateImageService(blocks BlockService) ImageService {
+	return &imageService{
+		blocks: blocks,
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the width and height of a rendered region, or ErrImageSize.
+func RegionImageSize(depth int, pixelSize int) (int, error) {
+	if depth < 0 || pixelSize < 1 || 64<<min(depth, 16) > MaxImageSize/pixelSize {
+		return 0, ErrImageSize
+	}
+	return (64 << depth) * pixelSize, nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the coords `levels` below the root at x, y on that level.
+func coordsBelow(root block2.Coords, levels int, x, y int) block2.Coords {
+	for bit := levels - 1; bit >= 0; bit-- {
+		root = root.Down(uint8((x>>bit)&1), uint8((y>>bit)&1))
+	}
+	return root
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the blocks `levels` below the root, as a grid of 1<<levels blocks per side.
+func blocksBelow(root block2.Coords, levels int) []block2.Coords {
+	side := 1 << levels
+	coords := make([]block2.Coords, 0, side*side)
+	for y := 0; y < side; y++ {
+		for x := 0; x < side; x++ {
+			coords = append(coords, coordsBelow(root, levels, x, y))
+		}
+	}
+	return coords
+}
+
+// ---------------------------------------------------------------------------------------
+// Expands a channel of a 12-bit block to 8 bits. Channels of 24-bit blocks, where full
+// is 255, are returned as is.
+func expandChannel(value int, full int) int {
+	return value * 255 / full
+}
+
+// ---------------------------------------------------------------------------------------
+// Draws a non-premultiplied color over the image pixel at offset.
+func blendOver(img *image.NRGBA, offset int, r, g, b, a int) {
+	dst := img.Pix[offset : offset+4]
+	da := int(dst[3]) * (255 - a) / 255
+	outA := a + da
+	if outA == 0 {
+		return
+	}
+	dst[0] = uint8((r*a + int(dst[0])*da + outA/2) / outA)
+	dst[1] = uint8((g*a + int(dst[1])*da + outA/2) / outA)
+	dst[2] = uint8((b*a + int(dst[2])*da + outA/2) / outA)
+	dst[3] = uint8(outA)
+}
+
+// ---------------------------------------------------------------------------------------
+// Draws one level of blocks onto the image. Each pixel of the level covers a square of
+// `scale` image pixels.
+func drawLevel(img *image.NRGBA, blocks []*block2.Block, side int, scale int, final bool) {
+	for blockIndex, block := range blocks {
+		if block == nil {
+			continue
+		}
+		originX := (blockIndex % side) * 64 * scale
+		originY := (blockIndex / side) * 64 * scale
+
+		for index, pixel := range block.Pixels {
+			channels := block.Channels(index)
+			full := channels.Max
+			alpha := channels.Alpha
+
+			var r, g, b, a int
+			if pixel&block2.PIXEL_SET != 0 {
+				if !final {
+					// The levels below cover the inherited color.
+					alpha = 0
+				}
+				// The inherited color over the painted one, which can be translucent.
+				// Weights are alphas scaled by the full channel.
+				weight1 := channels.PaintedAlpha * (full - alpha)
+				weight2 := alpha * full
+				total := weight1 + weight2
+				mix := func(c int) int {
+					value := channels.Painted[c]*weight1 + channels.Inherited[c]*weight2
+					return expandChannel((value+total/2)/total, full)
+				}
+				r, g, b, a = mix(0), mix(1), mix(2), (total*255+full*full/2)/(full*full)
+			} else if final && alpha != 0 {
+				r = expandChannel(channels.Inherited[0], full)
+				g = expandChannel(channels.Inherited[1], full)
+				b = expandChannel(channels.Inherited[2], full)
+				a = expandChannel(alpha, full)
+			} else {
+				continue
+			}
+
+			x := originX + (index%64)*scale
+			y := originY + (index/64)*scale
+			for sy := y; sy < y+scale; sy++ {
+				for sx := x; sx < x+scale; sx++ {
+					blendOver(img, img.PixOffset(sx, sy), r, g, b, a)
+				}
+			}
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Renders the region under the root block. Each pixel at the target depth is pixelSize
+// pixels wide in the image.
+//
+// Errors:
+//
+//	ErrImageSize: the image would be larger than MaxImageSize, or the depth or pixel
+//	              size is invalid.
+//	block2.ErrBlockNotFound: the root block doesn't exist.
+func (s *imageService) RenderRegion(root block2.Coords, depth int, pixelSize int) (*image.NRGBA, error) {
+	size, err := RegionImageSize(depth, pixelSize)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.blocks.GetBlock(root); err != nil {
+		return nil, err
+	}
+
+	return drawRegion(s.blocks.GetBlocks, root, depth, pixelSize, size), nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Draws the region under the root block with blocks from getBlocks, which has the
+// contract of BlockService.GetBlocks. The size must be from RegionImageSize.
+func drawRegion(getBlocks func([]block2.Coords) []*block2.Block, root block2.Coords, depth int, pixelSize int, size int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for level := 0; level <= depth; level++ {
+		side := 1 << level
+		blocks := getBlocks(blocksBelow(root, level))
+		drawLevel(img, blocks, side, pixelSize<<(depth-level), level == depth)
+	}
+	return img
+}
+
+// ---------------------------------------------------------------------------------------
+// Renders a block's effective colors to a 64x64 image.
+func (s *imageService) RenderTile(block *block2.Block, options TileOptions) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	drawLevel(img, []*block2.Block{block}, 1, 1, true)
+
+	for index, pixel := range block.Pixels {
+		offset := img.PixOffset(index%64, index/64)
+		if options.Checkerboard && img.Pix[offset+3] == 0 {
+			shade := uint8(255)
+			if (index%64/8+index/64/8)%2 == 1 {
+				shade = 204
+			}
+			copy(img.Pix[offset:offset+4], []uint8{shade, shade, shade, 255})
+		}
+		if options.DebugDrying && pixel&block2.PIXEL_SET != 0 {
+			if pixel&block2.PIXEL_DRY != 0 {
+				blendOver(img, offset, 0, 255, 255, 128)
+			} else {
+				blendOver(img, offset, 255, 0, 255, 128)
+			}
+		}
+	}
+	return img
+}
+
+// ---------------------------------------------------------------------------------------
+// Renders the region and writes it as a PNG. Errors are the same as RenderRegion, or
+// from the writer.
+func (s *imageService) ExportPng(w io.Writer, root block2.Coords, depth int, pixelSize int) error {
+	img, err := s.RenderRegion(root, depth, pixelSize)
+	if err != nil {
+		return err
+	}
+	return png.Encode(w, img)
+}
+
+// ---------------------------------------------------------------------------------------
+// Reduces an 8-bit channel to 4 bits.
+func quantize4(value uint8) int {
+	return (int(value)*15 + 127) / 255
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the 12-bit color of an image pixel, or false if it's less than half opaque.
+func quantizeColor(c color.Color) (block2.Color, bool) {
+	nrgba := color.NRGBAModel.Convert(c).(color.NRGBA)
+	if nrgba.A < 128 {
+		return 0, false
+	}
+	return block2.Color(quantize4(nrgba.R) | quantize4(nrgba.G)<<4 | quantize4(nrgba.B)<<8), true
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the pixels of the image that land in the block at bx, by of the target depth.
+func stampBlockPixels(img image.Image, blockCoords block2.Coords, bx, by int) []block2.PixelPaint {
+	bounds := img.Bounds()
+	var pixels []block2.PixelPaint
+	for y := by * 64; y < min((by+1)*64, bounds.Dy()); y++ {
+		for x := bx * 64; x < min((bx+1)*64, bounds.Dx()); x++ {
+			value, ok := quantizeColor(img.At(bounds.Min.X+x, bounds.Min.Y+y))
+			if !ok {
+				continue
+			}
+			pixels = append(pixels, block2.PixelPaint{
+				Coords: coordsBelow(blockCoords, 6, x%64, y%64),
+				Color:  value,
+			})
+		}
+	}
+	return pixels
+}
+
+// ---------------------------------------------------------------------------------------
+// Paints the image into the region under the root block, one pixel of the image per
+// pixel at the target depth. Each block of the target depth is painted as one batch. A
+// dry run only counts the pixels that would be rejected for being dry. The pixels are
+// recorded in the history as painted by the context.
+//
+// Errors:
+//
+//	ErrImageSize: the image is larger than the region or MaxImageSize, or the depth is
+//	              invalid.
+func (s *imageService) StampImage(c common.Context, img image.Image, root block2.Coords, depth int, dryRun bool) (StampResult, error) {
+	var result StampResult
+	bounds := img.Bounds()
+	if depth < 0 || bounds.Dx() > MaxImageSize || bounds.Dy() > MaxImageSize ||
+		bounds.Dx() > 64<<min(depth, 16) || bounds.Dy() > 64<<min(depth, 16) {
+		return result, ErrImageSize
+	}
+
+	blocksX := (bounds.Dx() + 63) / 64
+	blocksY := (bounds.Dy() + 63) / 64
+	for by := 0; by < blocksY; by++ {
+		for bx := 0; bx < blocksX; bx++ {
+			blockCoords := coordsBelow(root, depth, bx, by)
+			pixels := stampBlockPixels(img, blockCoords, bx, by)
+			if len(pixels) == 0 {
+				continue
+			}
+			result.Pixels += len(pixels)
+
+			if dryRun {
+				block := s.blocks.GetBlocks([]block2.Coords{blockCoords})[0]
+				for _, pixel := range pixels {
+					if block != nil && block.IsPixelDry(pixel.Coords.PixelIndex()) {
+						result.Dry++
+					} else {
+						result.Painted++
+					}
+				}
+				continue
+			}
+
+			for _, err := range s.blocks.SetPixels(c, pixels) {
+				switch err {
+				case nil:
+					result.Painted++
+				case block2.ErrPixelIsDry:
+					result.Dry++
+				case block2.ErrMaxDepthExceeded:
+					result.TooDeep++
+				case ErrColorNotAllowed:
+					result.NotAllowed++
+				case ErrProtected:
+					result.Protected++
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Scales the image down by half, averaging each 2x2 square weighted by alpha.
+func halveImage(img *image.NRGBA) *image.NRGBA {
+	size := img.Bounds().Dx() / 2
+	result := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			var r, g, b, a int
+			for _, offset := range []int{
+				img.PixOffset(x*2, y*2), img.PixOffset(x*2+1, y*2),
+				img.PixOffset(x*2, y*2+1), img.PixOffset(x*2+1, y*2+1),
+			} {
+				alpha := int(img.Pix[offset+3])
+				r += int(img.Pix[offset]) * alpha
+				g += int(img.Pix[offset+1]) * alpha
+				b += int(img.Pix[offset+2]) * alpha
+				a += alpha
+			}
+			if a == 0 {
+				continue
+			}
+			offset := result.PixOffset(x, y)
+			result.Pix[offset] = uint8((r + a/2) / a)
+			result.Pix[offset+1] = uint8((g + a/2) / a)
+			result.Pix[offset+2] = uint8((b + a/2) / a)
+			result.Pix[offset+3] = uint8((a + 2) / 4)
+		}
+	}
+	return result
+}
+
+// ---------------------------------------------------------------------------------------
+func writePngFile(path string, img image.Image) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ---------------------------------------------------------------------------------------
+// Writes the Deep Zoom descriptor for a square image with the given width.
+func writeDziDescriptor(path string, width int) error {
+	size := strconv.Itoa(width)
+	return os.WriteFile(path, []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<Image xmlns="http://schemas.microsoft.com/deepzoom/2008" Format="png" Overlap="0" TileSize="64">
+  <Size Width="`+size+`" Height="`+size+`"/>
+</Image>
+`), 0644)
+}
+
+// ---------------------------------------------------------------------------------------
+// Writes the tiles from the root down `levels` levels to the directory. Returns how many
+// tiles were written.
+//
+// In the Deep Zoom layout, the levels smaller than a tile are the root tile scaled down,
+// so level 6 is the root block.
+//
+// Errors:
+//
+//	ErrPyramidOptions: levels is negative or the layout is unknown.
+//	Otherwise, errors are from writing the files.
+func (s *imageService) ExportPyramid(dir string, root block2.Coords, levels int, layout PyramidLayout) (int, error) {
+	if levels < 0 || (layout != PyramidXyz && layout != PyramidDzi) {
+		return 0, ErrPyramidOptions
+	}
+
+	written := 0
+	writeTile := func(level, x, y int, img *image.NRGBA) error {
+		path := filepath.Join(dir, strconv.Itoa(level), strconv.Itoa(x), strconv.Itoa(y)+".png")
+		if layout == PyramidDzi {
+			path = filepath.Join(dir, "canvas_files", strconv.Itoa(level+6),
+				strconv.Itoa(x)+"_"+strconv.Itoa(y)+".png")
+		}
+		written++
+		return writePngFile(path, img)
+	}
+
+	if layout == PyramidDzi {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return 0, err
+		}
+		if err := writeDziDescriptor(filepath.Join(dir, "canvas.dzi"), 64<<levels); err != nil {
+			return 0, err
+		}
+	}
+
+	var walk func(coords block2.Coords, level, x, y int) error
+	walk = func(coords block2.Coords, level, x, y int) error {
+		if !s.blocks.HasBlocksUnder(coords, levels-level) {
+			return nil
+		}
+
+		block, err := s.blocks.GetBlock(coords)
+		if err != nil && err != block2.ErrBlockNotFound {
+			return err
+		}
+		if block != nil {
+			img := s.RenderTile(block, TileOptions{})
+			if err := writeTile(level, x, y, img); err != nil {
+				return err
+			}
+			for smaller := -1; layout == PyramidDzi && level == 0 && smaller >= -6; smaller-- {
+				img = halveImage(img)
+				if err := writeTile(smaller, 0, 0, img); err != nil {
+					return err
+				}
+			}
+		}
+
+		if level == levels {
+			return nil
+		}
+		for child := 0; child < 4; child++ {
+			dx, dy := child&1, child>>1
+			if err := walk(coords.Down(uint8(dx), uint8(dy)), level+1, x*2+dx, y*2+dy); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err := walk(root, 0, 0, 0)
+	return written, err
+}
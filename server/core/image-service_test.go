@@ -0,0 +1,298 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package core
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mukunda.com/nanopaint/core/block2"
+	"go.mukunda.com/nanopaint/core/clock"
+)
+
+// ---------------------------------------------------------------------------------------
+// Returns the coordinates of the pixel at x, y on the level with the given bit length.
+func pixelCoordsAt(bits int, x, y int) block2.Coords {
+	coords := block2.MakeEmptyCoords()
+	for bit := bits - 1; bit >= 0; bit-- {
+		coords = coords.Down(uint8((x>>bit)&1), uint8((y>>bit)&1))
+	}
+	return coords
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestImageServiceRenderRegion(t *testing.T) {
+	blocks := createTestBlockService(clock.CreateTestClockService())
+	images := CreateImageService(blocks)
+
+	red := color.NRGBA{255, 0, 0, 255}
+	transparent := color.NRGBA{}
+
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(6, 0, 0), block2.Color(0x00F)))
+	// Under the top level pixel at 2, 0.
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(7, 4, 0), block2.Color(0xF00)))
+	// Painted green at the top, with a blue pixel under it.
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(6, 3, 0), block2.Color(0x0F0)))
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(7, 6, 0), block2.Color(0xF00)))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// At the target depth, colors painted below are blended in by their alpha. One of
+	// four pixels is alpha 3.
+	img, err := images.RenderRegion(block2.MakeEmptyCoords(), 0, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 64, 64), img.Bounds())
+	assert.Equal(t, red, img.NRGBAAt(0, 0))
+	assert.Equal(t, transparent, img.NRGBAAt(1, 0))
+	assert.Equal(t, color.NRGBA{0, 0, 255, 51}, img.NRGBAAt(2, 0))
+	assert.Equal(t, color.NRGBA{0, 204, 51, 255}, img.NRGBAAt(3, 0))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// One level down, the pixels themselves are drawn over the painted colors above.
+	img, err = images.RenderRegion(block2.MakeEmptyCoords(), 1, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 128, 128), img.Bounds())
+	assert.Equal(t, red, img.NRGBAAt(1, 1))
+	assert.Equal(t, color.NRGBA{0, 0, 255, 255}, img.NRGBAAt(4, 0))
+	assert.Equal(t, transparent, img.NRGBAAt(5, 0))
+	assert.Equal(t, color.NRGBA{0, 0, 255, 255}, img.NRGBAAt(6, 0))
+	assert.Equal(t, color.NRGBA{0, 255, 0, 255}, img.NRGBAAt(7, 1))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// Pixels can be scaled up.
+	img, err = images.RenderRegion(block2.MakeEmptyCoords(), 0, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 192, 192), img.Bounds())
+	assert.Equal(t, red, img.NRGBAAt(2, 2))
+	assert.Equal(t, transparent, img.NRGBAAt(3, 0))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// The root can be any block.
+	img, err = images.RenderRegion(pixelCoordsAt(1, 0, 0), 0, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, color.NRGBA{0, 0, 255, 255}, img.NRGBAAt(4, 0))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// The PNG is the same image.
+	var data bytes.Buffer
+	assert.NoError(t, images.ExportPng(&data, block2.MakeEmptyCoords(), 1, 1))
+	decoded, err := png.Decode(&data)
+	assert.NoError(t, err)
+	img, _ = images.RenderRegion(block2.MakeEmptyCoords(), 1, 1)
+	assert.Equal(t, img.Bounds(), decoded.Bounds())
+	assert.Equal(t, color.NRGBAModel.Convert(img.At(4, 0)), color.NRGBAModel.Convert(decoded.At(4, 0)))
+	assert.Equal(t, color.NRGBAModel.Convert(img.At(5, 0)), color.NRGBAModel.Convert(decoded.At(5, 0)))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// Sizes are limited, and the root must exist.
+	_, err = images.RenderRegion(block2.MakeEmptyCoords(), 8, 1)
+	assert.ErrorIs(t, err, ErrImageSize)
+	_, err = images.RenderRegion(block2.MakeEmptyCoords(), 4, 9)
+	assert.ErrorIs(t, err, ErrImageSize)
+	_, err = images.RenderRegion(block2.MakeEmptyCoords(), -1, 1)
+	assert.ErrorIs(t, err, ErrImageSize)
+	_, err = images.RenderRegion(block2.MakeEmptyCoords(), 0, 0)
+	assert.ErrorIs(t, err, ErrImageSize)
+	_, err = images.RenderRegion(pixelCoordsAt(3, 7, 7), 0, 1)
+	assert.ErrorIs(t, err, block2.ErrBlockNotFound)
+
+	size, err := RegionImageSize(7, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, MaxImageSize, size)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestImageServiceRenderColor24(t *testing.T) {
+	blocks := createTestBlockService(clock.CreateTestClockService())
+	blocks.(*blockService).colorDepth = 24
+	images := CreateImageService(blocks)
+
+	/////////////////////////////////////////////////////////////////////////////
+	// 24-bit blocks are drawn with their full channels, including the colors bubbled up
+	// from below.
+	orange := block2.Color24WithAlpha(0x3380FF, 255)
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(6, 0, 0), orange))
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(7, 2, 0), orange))
+
+	img, err := images.RenderRegion(block2.MakeEmptyCoords(), 0, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, color.NRGBA{0xFF, 0x80, 0x33, 255}, img.NRGBAAt(0, 0))
+	assert.Equal(t, color.NRGBA{0xFF, 0x80, 0x33, 63}, img.NRGBAAt(1, 0))
+
+	// On a 12-bit canvas, the same color is rounded.
+	blocks = createTestBlockService(clock.CreateTestClockService())
+	images = CreateImageService(blocks)
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(6, 0, 0), orange))
+	img, err = images.RenderRegion(block2.MakeEmptyCoords(), 0, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, color.NRGBA{0xFF, 0x88, 0x33, 255}, img.NRGBAAt(0, 0))
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestImageServiceStampImage(t *testing.T) {
+	tcs := clock.CreateTestClockService()
+	blocks := createTestBlockService(tcs)
+	images := CreateImageService(blocks)
+	root := block2.MakeEmptyCoords()
+
+	// A dry pixel where the image will be stamped.
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(7, 3, 0), block2.Color(0xFFF)))
+	tcs.(*clock.TestClockService).Advance(time.Hour)
+
+	img := image.NewNRGBA(image.Rect(0, 0, 70, 2))
+	img.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 255})
+	img.SetNRGBA(1, 0, color.NRGBA{255, 0, 0, 100})
+	img.SetNRGBA(2, 0, color.NRGBA{0, 255, 0, 200})
+	img.SetNRGBA(3, 0, color.NRGBA{0, 0, 255, 255})
+	img.SetNRGBA(69, 1, color.NRGBA{136, 136, 136, 255})
+
+	pixelAt := func(x, y int) block2.Pixel {
+		block, err := blocks.GetBlock(pixelCoordsAt(1, x/64, y/64))
+		assert.NoError(t, err)
+		return block.Pixels[(y%64)*64+x%64]
+	}
+
+	/////////////////////////////////////////////////////////////////////////////
+	// A dry run only counts.
+	result, err := images.StampImage(nil, img, root, 1, true)
+	assert.NoError(t, err)
+	assert.Equal(t, StampResult{Pixels: 4, Painted: 3, Dry: 1}, result)
+	assert.Zero(t, pixelAt(0, 0)&block2.PIXEL_SET)
+
+	/////////////////////////////////////////////////////////////////////////////
+	// Opaque pixels are quantized and painted, and the dry pixel is left alone.
+	result, err = images.StampImage(nil, img, root, 1, false)
+	assert.NoError(t, err)
+	assert.Equal(t, StampResult{Pixels: 4, Painted: 3, Dry: 1}, result)
+	assert.Equal(t, block2.Pixel(0x00F), (pixelAt(0, 0)>>16)&0xFFF)
+	assert.Zero(t, pixelAt(1, 0)&block2.PIXEL_SET)
+	assert.Equal(t, block2.Pixel(0x0F0), (pixelAt(2, 0)>>16)&0xFFF)
+	assert.Equal(t, block2.Pixel(0xFFF), (pixelAt(3, 0)>>16)&0xFFF)
+	assert.Equal(t, block2.Pixel(0x888), (pixelAt(69, 1)>>16)&0xFFF)
+
+	// With normal bubbling.
+	top, err := blocks.GetBlock(root)
+	assert.NoError(t, err)
+	assert.NotZero(t, top.Pixels[0]&0xF000)
+
+	/////////////////////////////////////////////////////////////////////////////
+	// The image must fit in the region.
+	_, err = images.StampImage(nil, image.NewNRGBA(image.Rect(0, 0, 129, 1)), root, 1, false)
+	assert.ErrorIs(t, err, ErrImageSize)
+	_, err = images.StampImage(nil, img, root, -1, false)
+	assert.ErrorIs(t, err, ErrImageSize)
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestImageServiceRenderTile(t *testing.T) {
+	images := CreateImageService(nil)
+
+	block := &block2.Block{Pixels: make([]block2.Pixel, 64*64)}
+	// Wet red, dry green, blue inherited from below, and translucent red, half covered
+	// by blue from below.
+	block.Pixels[0] = block2.PIXEL_SET | 0x00F<<16
+	block.Pixels[2] = block2.PIXEL_SET | block2.PIXEL_DRY | 0x0F0<<16
+	block.Pixels[3] = 0xF000 | 0xF00
+	block.Pixels[4] = block2.PIXEL_SET | 2<<28 | 0x00F<<16
+	block.Pixels[5] = block2.PIXEL_SET | 2<<28 | 0x00F<<16 | 0x8000 | 0xF00
+
+	/////////////////////////////////////////////////////////////////////////////
+	// The effective colors, with transparent pixels left transparent.
+	img := images.RenderTile(block, TileOptions{})
+	assert.Equal(t, image.Rect(0, 0, 64, 64), img.Bounds())
+	assert.Equal(t, color.NRGBA{255, 0, 0, 255}, img.NRGBAAt(0, 0))
+	assert.Equal(t, color.NRGBA{}, img.NRGBAAt(1, 0))
+	assert.Equal(t, color.NRGBA{0, 255, 0, 255}, img.NRGBAAt(2, 0))
+	assert.Equal(t, color.NRGBA{0, 0, 255, 255}, img.NRGBAAt(3, 0))
+	assert.Equal(t, color.NRGBA{255, 0, 0, 119}, img.NRGBAAt(4, 0))
+	assert.Equal(t, color.NRGBA{68, 0, 187, 192}, img.NRGBAAt(5, 0))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// The checkerboard fills the transparent pixels only.
+	img = images.RenderTile(block, TileOptions{Checkerboard: true})
+	assert.Equal(t, color.NRGBA{255, 0, 0, 255}, img.NRGBAAt(0, 0))
+	assert.Equal(t, color.NRGBA{255, 255, 255, 255}, img.NRGBAAt(1, 0))
+	assert.Equal(t, color.NRGBA{204, 204, 204, 255}, img.NRGBAAt(8, 0))
+	assert.Equal(t, color.NRGBA{204, 204, 204, 255}, img.NRGBAAt(0, 8))
+	assert.Equal(t, color.NRGBA{255, 255, 255, 255}, img.NRGBAAt(8, 8))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// Wet pixels are tinted magenta and dry pixels cyan.
+	img = images.RenderTile(block, TileOptions{DebugDrying: true})
+	assert.Equal(t, color.NRGBA{255, 0, 128, 255}, img.NRGBAAt(0, 0))
+	assert.Equal(t, color.NRGBA{0, 255, 128, 255}, img.NRGBAAt(2, 0))
+	assert.Equal(t, color.NRGBA{0, 0, 255, 255}, img.NRGBAAt(3, 0))
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestImageServiceExportPyramid(t *testing.T) {
+	blocks := createTestBlockService(clock.CreateTestClockService())
+	images := CreateImageService(blocks)
+	root := block2.MakeEmptyCoords()
+
+	readPng := func(path string) image.Image {
+		file, err := os.Open(path)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer file.Close()
+		img, err := png.Decode(file)
+		assert.NoError(t, err)
+		return img
+	}
+
+	// One pixel near the top, and a lone pixel deep in the bottom right quarter. Its
+	// color doesn't bubble all the way up, so the blocks above it don't exist.
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(6, 0, 0), block2.Color(0x00F)))
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(9, 511, 511), block2.Color(0x0F0)))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// XYZ tiles of the blocks that exist. The top left quarter has nothing under it,
+	// so it isn't visited.
+	dir := t.TempDir()
+	count, err := images.ExportPyramid(dir, root, 3, PyramidXyz)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	img := readPng(filepath.Join(dir, "0", "0", "0.png"))
+	assert.Equal(t, color.NRGBA{255, 0, 0, 255}, color.NRGBAModel.Convert(img.At(0, 0)))
+	img = readPng(filepath.Join(dir, "3", "7", "7.png"))
+	assert.Equal(t, color.NRGBA{0, 255, 0, 255}, color.NRGBAModel.Convert(img.At(63, 63)))
+	assert.FileExists(t, filepath.Join(dir, "2", "3", "3.png"))
+	assert.NoDirExists(t, filepath.Join(dir, "1"))
+
+	// Levels past the target aren't searched or written.
+	dir = t.TempDir()
+	count, err = images.ExportPyramid(dir, root, 2, PyramidXyz)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	/////////////////////////////////////////////////////////////////////////////
+	// Deep Zoom has the root scaled down for the levels smaller than a tile.
+	dir = t.TempDir()
+	count, err = images.ExportPyramid(dir, root, 3, PyramidDzi)
+	assert.NoError(t, err)
+	assert.Equal(t, 9, count)
+	descriptor, err := os.ReadFile(filepath.Join(dir, "canvas.dzi"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(descriptor), `TileSize="64"`)
+	assert.Contains(t, string(descriptor), `<Size Width="512" Height="512"/>`)
+	assert.FileExists(t, filepath.Join(dir, "canvas_files", "9", "7_7.png"))
+	img = readPng(filepath.Join(dir, "canvas_files", "5", "0_0.png"))
+	assert.Equal(t, image.Rect(0, 0, 32, 32), img.Bounds())
+	assert.Equal(t, color.NRGBA{255, 0, 0, 64}, color.NRGBAModel.Convert(img.At(0, 0)))
+	img = readPng(filepath.Join(dir, "canvas_files", "0", "0_0.png"))
+	assert.Equal(t, image.Rect(0, 0, 1, 1), img.Bounds())
+
+	_, err = images.ExportPyramid(dir, root, -1, PyramidXyz)
+	assert.ErrorIs(t, err, ErrPyramidOptions)
+	_, err = images.ExportPyramid(dir, root, 1, "tiff")
+	assert.ErrorIs(t, err, ErrPyramidOptions)
+}
@@ -0,0 +1,121 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package core
+
+import (
+	"errors"
+	"slices"
+	"sync"
+
+	"go.mukunda.com/nanopaint/cat"
+	"go.mukunda.com/nanopaint/core/block2"
+)
+
+// Restricts regions of the canvas to a fixed palette, for admins. The BlockService
+// checks every painted color here. See block2.PaletteZone.
+//
+// Colors are checked after they're rounded for the canvas, so the palettes of zones on
+// 12-bit canvases are rounded the same way when they're saved.
+
+type (
+	PaletteService interface {
+		GetZones() []block2.PaletteZone
+		SetZone(zone block2.PaletteZone)
+		DeleteZone(coords block2.Coords) bool
+		CheckColor(pixelCoords block2.Coords, color block2.Color) (block2.Color, error)
+	}
+
+	paletteService struct {
+		repo block2.PaletteRepo
+		// 12 or 24, see coreConfig.ColorDepth.
+		colorDepth int
+		// A copy of the zones in the repo, since every paint needs them.
+		zones []block2.PaletteZone
+		mutex sync.RWMutex
+	}
+)
+
+var ErrColorNotAllowed = errors.New("color is not in the palette of the zone")
+
+// ---------------------------------------------------------------------------------------
+// The canvas is 12-bit unless the config says otherwise. Errors are panics.
+func CreatePaletteService(repo block2.PaletteRepo) PaletteService {
+	zones, err := repo.List()
+	cat.Catch(err, "Failed to load palette zones.")
+
+	return &paletteService{
+		repo:       repo,
+		colorDepth: 12,
+		zones:      zones,
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns all zones, ordered by their coords.
+func (s *paletteService) GetZones() []block2.PaletteZone {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return slices.Clone(s.zones)
+}
+
+// ---------------------------------------------------------------------------------------
+// Adds a zone, or replaces the zone with the same coords. 24-bit colors are rounded to
+// 12 bits on 12-bit canvases, like painted colors. Errors are panics.
+func (s *paletteService) SetZone(zone block2.PaletteZone) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.colorDepth == 12 {
+		palette := make([]block2.Color, 0, len(zone.Palette))
+		for _, color := range zone.Palette {
+			if color = color.To12(); !slices.Contains(palette, color) {
+				palette = append(palette, color)
+			}
+		}
+		zone.Palette = palette
+	}
+	cat.Catch(s.repo.Put(zone), "Failed to save palette zone.")
+	s.reload()
+}
+
+// ---------------------------------------------------------------------------------------
+// Removes the zone with the given coords. Returns false if there is none. Errors are
+// panics.
+func (s *paletteService) DeleteZone(coords block2.Coords) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	found, err := s.repo.Delete(coords)
+	cat.Catch(err, "Failed to delete palette zone.")
+	s.reload()
+	return found
+}
+
+// ---------------------------------------------------------------------------------------
+func (s *paletteService) reload() {
+	cat.EnsureLocked(&s.mutex)
+
+	zones, err := s.repo.List()
+	cat.Catch(err, "Failed to load palette zones.")
+	s.zones = zones
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the color to paint at the pixel: the color itself if its zone allows it, or the
+// nearest palette color if the zone snaps. Otherwise it's ErrColorNotAllowed.
+func (s *paletteService) CheckColor(pixelCoords block2.Coords, color block2.Color) (block2.Color, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	zone := block2.FindPaletteZone(s.zones, pixelCoords)
+	if zone == nil || zone.Allows(color) {
+		return color, nil
+	}
+	if zone.Snap {
+		return zone.Nearest(color), nil
+	}
+	return color, ErrColorNotAllowed
+}
@@ -0,0 +1,85 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package core
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mukunda.com/nanopaint/core/block2"
+	"go.mukunda.com/nanopaint/core/clock"
+)
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestPaletteService(t *testing.T) {
+	tcs := clock.CreateTestClockService()
+	history := CreateHistoryService(block2.CreateMemHistoryRepo(), tcs)
+	repo := block2.CreateMemPaletteRepo()
+	palettes := CreatePaletteService(repo)
+	blocks := CreateBlockService(block2.CreateMemBlockRepo(tcs), history).(*blockService)
+	blocks.palettes = palettes
+
+	// The top left quarter of the top block, and the top left of that.
+	outer := block2.MakeEmptyCoords().Down(0, 0)
+	inner := outer.Down(0, 0)
+	assert.Empty(t, palettes.GetZones())
+	palettes.SetZone(block2.PaletteZone{Coords: outer, Palette: []block2.Color{0x000, 0xFFF}})
+	palettes.SetZone(block2.PaletteZone{Coords: inner, Palette: []block2.Color{0x00F}, Snap: true})
+	assert.Len(t, palettes.GetZones(), 2)
+
+	//////////////////////////////////////////////////////////////////////////
+	// Other colors are rejected in a zone, and snapped in a zone that snaps. Erasing is
+	// always allowed.
+	assert.ErrorIs(t, blocks.SetPixel(nil, pixelCoordsAt(6, 20, 0), 0x00F), ErrColorNotAllowed)
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(6, 20, 0), 0xFFF))
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(6, 20, 0), block2.Transparent))
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(6, 0, 0), 0x11E))
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(6, 40, 0), 0x0F0))
+
+	entries := history.Query(block2.HistoryQuery{Coords: pixelCoordsAt(6, 0, 0)})
+	assert.Equal(t, block2.Color(0x00F), entries[0].Color)
+
+	results := blocks.SetPixels(nil, []block2.PixelPaint{
+		{Coords: pixelCoordsAt(6, 21, 0), Color: 0x0F0},
+		{Coords: pixelCoordsAt(6, 1, 0), Color: 0x0F0},
+		{Coords: pixelCoordsAt(6, 21, 1), Color: 0x000},
+	})
+	assert.Equal(t, []error{ErrColorNotAllowed, nil, nil}, results)
+	block, err := blocks.GetBlock(block2.MakeEmptyCoords())
+	assert.NoError(t, err)
+	assert.Zero(t, block.Pixels[pixelCoordsAt(6, 21, 0).PixelIndex()])
+	assert.Equal(t, block2.Color(0x00F), block.Pixels[pixelCoordsAt(6, 1, 0).PixelIndex()].PaintedColor())
+	assert.Len(t, history.Query(block2.HistoryQuery{Coords: block2.MakeEmptyCoords()}), 6)
+
+	// Stamped images follow the same rules.
+	img := image.NewNRGBA(image.Rect(0, 0, 24, 1))
+	img.SetNRGBA(2, 0, color.NRGBA{255, 0, 0, 255})
+	img.SetNRGBA(23, 0, color.NRGBA{255, 0, 0, 255})
+	stamped, err := CreateImageService(blocks).StampImage(nil, img, block2.MakeEmptyCoords(), 0, false)
+	assert.NoError(t, err)
+	assert.Equal(t, StampResult{Pixels: 2, Painted: 1, NotAllowed: 1}, stamped)
+
+	//////////////////////////////////////////////////////////////////////////
+	// Palettes are rounded like painted colors on 12-bit canvases, so 24-bit colors in a
+	// palette can still be painted.
+	deep := block2.MakeEmptyCoords().Down(1, 1)
+	palettes.SetZone(block2.PaletteZone{Coords: deep, Palette: []block2.Color{
+		block2.Color24WithAlpha(0x0088FF, 255), block2.Color24WithAlpha(0x0080FF, 255),
+	}})
+	assert.Equal(t, []block2.Color{0x08F}, palettes.GetZones()[2].Palette)
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(6, 40, 40),
+		block2.Color24WithAlpha(0x0088FF, 255)))
+	assert.True(t, palettes.DeleteZone(deep))
+
+	//////////////////////////////////////////////////////////////////////////
+	// Zones are saved in the repo and can be removed.
+	assert.Len(t, CreatePaletteService(repo).GetZones(), 2)
+	assert.True(t, palettes.DeleteZone(outer))
+	assert.False(t, palettes.DeleteZone(outer))
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(6, 22, 0), 0x00F))
+	assert.Len(t, CreatePaletteService(repo).GetZones(), 1)
+}
@@ -0,0 +1,119 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package core
+
+import (
+	"errors"
+	"slices"
+	"sync"
+
+	"go.mukunda.com/nanopaint/cat"
+	"go.mukunda.com/nanopaint/core/block2"
+	"go.mukunda.com/nanopaint/core/clock"
+)
+
+// Freezes regions of the canvas, for moderators. The BlockService checks every paint and
+// undo here. See block2.ProtectedZone. Expired zones are ignored, and removed from the
+// repo the next time the zones change.
+
+type (
+	ProtectionService interface {
+		GetZones() []block2.ProtectedZone
+		Protect(zone block2.ProtectedZone)
+		Unprotect(coords block2.Coords) bool
+		IsProtected(pixelCoords block2.Coords) bool
+	}
+
+	protectionService struct {
+		repo  block2.ProtectionRepo
+		clock clock.ClockService
+		// A copy of the zones in the repo, since every paint needs them.
+		zones []block2.ProtectedZone
+		mutex sync.RWMutex
+	}
+)
+
+var ErrProtected = errors.New("pixel is in a protected zone")
+
+// ---------------------------------------------------------------------------------------
+// Errors are panics.
+func CreateProtectionService(repo block2.ProtectionRepo, clock clock.ClockService) ProtectionService {
+	zones, err := repo.List()
+	cat.Catch(err, "Failed to load protected zones.")
+
+	return &protectionService{
+		repo:  repo,
+		clock: clock,
+		zones: zones,
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the zones that haven't expired, ordered by their coords.
+func (s *protectionService) GetZones() []block2.ProtectedZone {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	now := s.clock.Now().UnixMilli()
+	return slices.DeleteFunc(slices.Clone(s.zones), func(zone block2.ProtectedZone) bool {
+		return zone.IsExpired(now)
+	})
+}
+
+// ---------------------------------------------------------------------------------------
+// Adds a zone, or replaces the zone with the same coords. Errors are panics.
+func (s *protectionService) Protect(zone block2.ProtectedZone) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.pruneExpired()
+	cat.Catch(s.repo.Put(zone), "Failed to save protected zone.")
+	s.reload()
+}
+
+// ---------------------------------------------------------------------------------------
+// Removes the zone with the given coords. Returns false if there is none, or if it has
+// expired. Errors are panics.
+func (s *protectionService) Unprotect(coords block2.Coords) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.pruneExpired()
+	found, err := s.repo.Delete(coords)
+	cat.Catch(err, "Failed to delete protected zone.")
+	s.reload()
+	return found
+}
+
+// ---------------------------------------------------------------------------------------
+func (s *protectionService) pruneExpired() {
+	cat.EnsureLocked(&s.mutex)
+
+	now := s.clock.Now().UnixMilli()
+	for _, zone := range s.zones {
+		if zone.IsExpired(now) {
+			_, err := s.repo.Delete(zone.Coords)
+			cat.Catch(err, "Failed to delete protected zone.")
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+func (s *protectionService) reload() {
+	cat.EnsureLocked(&s.mutex)
+
+	zones, err := s.repo.List()
+	cat.Catch(err, "Failed to load protected zones.")
+	s.zones = zones
+}
+
+// ---------------------------------------------------------------------------------------
+// True if a zone that hasn't expired covers the pixel.
+func (s *protectionService) IsProtected(pixelCoords block2.Coords) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return block2.IsPixelProtected(s.zones, pixelCoords, s.clock.Now().UnixMilli())
+}
@@ -0,0 +1,82 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package core
+
+import (
+	"image"
+	"image/color"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mukunda.com/nanopaint/common"
+	"go.mukunda.com/nanopaint/core/block2"
+	"go.mukunda.com/nanopaint/core/clock"
+)
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestProtectionService(t *testing.T) {
+	tcs := clock.CreateTestClockService().(*clock.TestClockService)
+	history := CreateHistoryService(block2.CreateMemHistoryRepo(), tcs)
+	repo := block2.CreateMemProtectionRepo()
+	protection := CreateProtectionService(repo, tcs)
+	blocks := CreateBlockService(block2.CreateMemBlockRepo(tcs), history).(*blockService)
+	blocks.protection = protection
+
+	alice := common.CreateBasicContext()
+	alice.Set("username", "alice")
+	mural := pixelCoordsAt(6, 0, 0)
+	assert.NoError(t, blocks.SetPixel(alice, mural, 0x00F))
+
+	//////////////////////////////////////////////////////////////////////////
+	// Nothing under a protected zone can be painted or undone, even wet pixels.
+	zone := block2.MakeEmptyCoords().Down(0, 0)
+	protection.Protect(block2.ProtectedZone{Coords: zone})
+	assert.Equal(t, []block2.ProtectedZone{{Coords: zone}}, protection.GetZones())
+	assert.ErrorIs(t, blocks.SetPixel(alice, mural, 0xF00), ErrProtected)
+	assert.ErrorIs(t, blocks.SetPixel(alice, pixelCoordsAt(7, 0, 0), 0xF00), ErrProtected)
+	assert.ErrorIs(t, blocks.UndoPixel(alice, mural), ErrProtected)
+	assert.NoError(t, blocks.SetPixel(alice, pixelCoordsAt(6, 40, 0), 0xF00))
+
+	results := blocks.SetPixels(alice, []block2.PixelPaint{
+		{Coords: pixelCoordsAt(6, 1, 0), Color: 0x0F0},
+		{Coords: pixelCoordsAt(6, 41, 0), Color: 0x0F0},
+	})
+	assert.Equal(t, []error{ErrProtected, nil}, results)
+
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 1))
+	img.SetNRGBA(2, 0, color.NRGBA{255, 0, 0, 255})
+	img.SetNRGBA(42, 0, color.NRGBA{255, 0, 0, 255})
+	stamped, err := CreateImageService(blocks).StampImage(nil, img, block2.MakeEmptyCoords(), 0, false)
+	assert.NoError(t, err)
+	assert.Equal(t, StampResult{Pixels: 2, Painted: 1, Protected: 1}, stamped)
+
+	// Zones are saved in the repo.
+	assert.Len(t, CreateProtectionService(repo, tcs).GetZones(), 1)
+
+	//////////////////////////////////////////////////////////////////////////
+	// Removing the zone lifts the protection.
+	assert.True(t, protection.Unprotect(zone))
+	assert.False(t, protection.Unprotect(zone))
+	assert.NoError(t, blocks.UndoPixel(alice, mural))
+
+	//////////////////////////////////////////////////////////////////////////
+	// Zones with an expiry time end by the clock, and are removed the next time the
+	// zones change.
+	expires := tcs.Now().Add(time.Minute).UnixMilli()
+	protection.Protect(block2.ProtectedZone{Coords: zone, Expires: expires})
+	assert.ErrorIs(t, blocks.SetPixel(alice, mural, 0xF00), ErrProtected)
+	tcs.Advance(time.Minute)
+	assert.Empty(t, protection.GetZones())
+	assert.NoError(t, blocks.SetPixel(alice, mural, 0xF00))
+
+	zones, err := repo.List()
+	assert.NoError(t, err)
+	assert.Len(t, zones, 1)
+	protection.Protect(block2.ProtectedZone{Coords: zone.Down(1, 1)})
+	zones, err = repo.List()
+	assert.NoError(t, err)
+	assert.Len(t, zones, 1)
+}
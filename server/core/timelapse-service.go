@@ -0,0 +1,334 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.mukunda.com/nanopaint/cat"
+	"go.mukunda.com/nanopaint/core/block2"
+	"go.mukunda.com/nanopaint/core/clock"
+)
+
+// Replays the paint history of a region, e.g., to make a time-lapse of an event.
+//
+// The events are the history entries under the root block, oldest first. Frames are
+// rendered by painting the events into a scratch repo where pixels never dry, so every
+// event is accepted again as it was when it was recorded, and rendering the region like
+// ImageService.RenderRegion at each step of the time window. A frame shows everything
+// painted at or before its time, less what was undone. Drying isn't shown, and neither is
+// anything painted before the history's retention.
+
+type (
+	TimelapseService interface {
+		Events(root block2.Coords, since, until block2.UnixMillis, limit int) []block2.HistoryEntry
+		EventPage(root block2.Coords, since, until block2.UnixMillis, limit int) ([]block2.HistoryEntry, block2.UnixMillis)
+		RenderFrames(options TimelapseOptions, frame TimelapseFrameFunc) (int, error)
+		ExportGif(w io.Writer, options TimelapseOptions, delay time.Duration) (int, error)
+		ExportPngFrames(dir string, options TimelapseOptions) (int, error)
+	}
+
+	// The region and time window of a time-lapse.
+	TimelapseOptions struct {
+		Root      block2.Coords
+		Depth     int
+		PixelSize int
+		// The first frame.
+		Since block2.UnixMillis
+		// The last frame is at or before this. Zero for now.
+		Until block2.UnixMillis
+		// Time between frames.
+		Interval time.Duration
+	}
+
+	// Receives each frame of a time-lapse.
+	TimelapseFrameFunc func(time block2.UnixMillis, img *image.NRGBA) error
+
+	timelapseService struct {
+		history HistoryService
+		clock   clock.ClockService
+	}
+)
+
+const (
+	// Most frames rendered for one time-lapse.
+	MaxTimelapseFrames = 1000
+	// Largest width or height of a time-lapse frame. Frames are rendered one at a time,
+	// but a long time-lapse at MaxImageSize would still take hours and gigabytes.
+	MaxTimelapseFrameSize = 2048
+	// History entries read at a time while rendering.
+	timelapseHistoryPage = 10000
+)
+
+var ErrTimelapseOptions = errors.New("invalid time-lapse options")
+
+// ---------------------------------------------------------------------------------------
+func CreateTimelapseService(history HistoryService, clock clock.ClockService) TimelapseService {
+	return &timelapseService{
+		history: history,
+		clock:   clock,
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the history entries under the root block in the time range, oldest first.
+// Until is exclusive, and zero for no end. Zero limit for no limit. Errors are panics.
+func (s *timelapseService) Events(root block2.Coords, since, until block2.UnixMillis, limit int) []block2.HistoryEntry {
+	return s.history.Query(block2.HistoryQuery{
+		Coords: root,
+		Since:  since,
+		Until:  until,
+		Limit:  limit,
+		Oldest: true,
+	})
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns a page of about `limit` events like Events, and the since of the next page, or
+// zero after the last page. Pages end between milliseconds, so paging by time neither
+// skips nor repeats events (see historyPager.fetch). A page can be over the limit when
+// more events than that share its millisecond. Errors are panics.
+func (s *timelapseService) EventPage(root block2.Coords, since, until block2.UnixMillis, limit int) ([]block2.HistoryEntry, block2.UnixMillis) {
+	pager := historyPager{timelapse: s, root: root, until: until, pageSize: limit, next: since}
+	pager.fetch()
+	if pager.done {
+		return pager.page, 0
+	}
+	return pager.page, pager.next
+}
+
+// ---------------------------------------------------------------------------------------
+// Renders the region at each step of the time window and passes the frames to the
+// callback in order. Returns how many frames were rendered. Errors from the callback
+// stop the rendering and are returned.
+//
+// Errors:
+//
+//	ErrImageSize: the frames would be larger than MaxTimelapseFrameSize, or the depth or
+//	              pixel size is invalid.
+//	ErrTimelapseOptions: the interval isn't positive, the window ends before it starts,
+//	                     or it has more than MaxTimelapseFrames frames.
+func (s *timelapseService) RenderFrames(options TimelapseOptions, frame TimelapseFrameFunc) (int, error) {
+	size, err := RegionImageSize(options.Depth, options.PixelSize)
+	if err != nil {
+		return 0, err
+	}
+	if size > MaxTimelapseFrameSize {
+		return 0, ErrImageSize
+	}
+	until := options.Until
+	if until == 0 {
+		until = s.clock.Now().UnixMilli()
+	}
+	interval := options.Interval.Milliseconds()
+	if interval <= 0 || until < options.Since || (until-options.Since)/interval >= MaxTimelapseFrames {
+		return 0, ErrTimelapseOptions
+	}
+
+	// The scratch repo is only ever used here, so its errors are unexpected.
+	replay := block2.CreateReplayBlockRepo(s.clock)
+	getBlocks := func(coords []block2.Coords) []*block2.Block {
+		blocks, err := replay.GetBlocks(coords)
+		cat.Catch(err, "Failed to read replay blocks.")
+		return blocks
+	}
+
+	// Paints are replayed in batches between the undos.
+	var pixels []block2.PixelPaint
+	flush := func() {
+		if len(pixels) > 0 {
+			_, err := replay.SetPixels(pixels)
+			cat.Catch(err, "Failed to replay paint history.")
+			pixels = pixels[:0]
+		}
+	}
+
+	events := &historyPager{timelapse: s, root: options.Root, until: until + 1, pageSize: timelapseHistoryPage}
+	frames := 0
+	for at := options.Since; at <= until; at += interval {
+		for event := events.peek(); event != nil && event.Time <= at; event = events.peek() {
+			if event.Undo {
+				flush()
+				err := replay.UndoPixel(event.Coords)
+				if err != block2.ErrNothingToUndo && err != block2.ErrPixelIsDry {
+					cat.Catch(err, "Failed to replay paint history.")
+				}
+			} else {
+				pixels = append(pixels, block2.PixelPaint{Coords: event.Coords, Color: event.Color})
+			}
+			events.pop()
+		}
+		flush()
+
+		img := drawRegion(getBlocks, options.Root, options.Depth, options.PixelSize, size)
+		if err := frame(at, img); err != nil {
+			return frames, err
+		}
+		frames++
+	}
+	return frames, nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Reads the history entries for a time-lapse a page at a time, oldest first, so that a
+// long history isn't loaded all at once.
+type historyPager struct {
+	timelapse *timelapseService
+	root      block2.Coords
+	// Exclusive end time, or zero for no end.
+	until    block2.UnixMillis
+	pageSize int
+	// Start of the next page.
+	next block2.UnixMillis
+	page []block2.HistoryEntry
+	done bool
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the next entry without removing it, or nil after the last one.
+func (p *historyPager) peek() *block2.HistoryEntry {
+	if len(p.page) == 0 && !p.done {
+		p.fetch()
+	}
+	if len(p.page) == 0 {
+		return nil
+	}
+	return &p.page[0]
+}
+
+// ---------------------------------------------------------------------------------------
+func (p *historyPager) pop() {
+	p.page = p.page[1:]
+}
+
+// ---------------------------------------------------------------------------------------
+// Pages are split by time, since entries have no other order to continue from. A full
+// page can end partway through the entries of its last millisecond, so those are left
+// for the next page. If the whole page is one millisecond, that millisecond is read in
+// full instead.
+func (p *historyPager) fetch() {
+	page := p.timelapse.Events(p.root, p.next, p.until, p.pageSize)
+	if len(page) < p.pageSize {
+		p.page, p.done = page, true
+		return
+	}
+
+	last := page[len(page)-1].Time
+	end := len(page)
+	for end > 0 && page[end-1].Time == last {
+		end--
+	}
+	if end == 0 {
+		p.page = p.timelapse.Events(p.root, last, last+1, 0)
+		p.next = last + 1
+	} else {
+		p.page = page[:end]
+		p.next = last
+	}
+	p.done = p.until != 0 && p.next >= p.until
+}
+
+// ---------------------------------------------------------------------------------------
+// Renders the time-lapse as an animated GIF, with each frame shown for the delay. The
+// frames are drawn over white and mapped to the Plan 9 palette. Each frame is written as
+// it's rendered, so an error can leave a partial GIF in the writer. Errors are the same
+// as RenderFrames, or from the writer.
+func (s *timelapseService) ExportGif(w io.Writer, options TimelapseOptions, delay time.Duration) (int, error) {
+	gw := &gifStreamWriter{w: w}
+	frames, err := s.RenderFrames(options, func(at block2.UnixMillis, img *image.NRGBA) error {
+		paletted := image.NewPaletted(img.Bounds(), palette.Plan9)
+		draw.Draw(paletted, img.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(paletted, img.Bounds(), img, image.Point{}, draw.Over)
+		return gw.writeFrame(paletted, int(delay/(10*time.Millisecond)))
+	})
+	if err != nil {
+		return frames, err
+	}
+	return frames, gw.close()
+}
+
+// ---------------------------------------------------------------------------------------
+// Writes an animated GIF that loops forever, one frame at a time. image/gif only encodes
+// whole animations, so each frame is encoded as a GIF of its own and its image data is
+// copied out. The frames must all be the same size.
+type gifStreamWriter struct {
+	w       io.Writer
+	started bool
+}
+
+// The NETSCAPE2.0 application extension with a loop count of zero, which image/gif writes
+// for animations.
+var gifLoopExtension = []byte{
+	0x21, 0xFF, 0x0B, 'N', 'E', 'T', 'S', 'C', 'A', 'P', 'E', '2', '.', '0',
+	0x03, 0x01, 0x00, 0x00, 0x00,
+}
+
+// ---------------------------------------------------------------------------------------
+func (gw *gifStreamWriter) writeFrame(img *image.Paletted, delay int) error {
+	var frame bytes.Buffer
+	err := gif.EncodeAll(&frame, &gif.GIF{
+		Image: []*image.Paletted{img},
+		Delay: []int{delay},
+		Config: image.Config{
+			ColorModel: img.Palette,
+			Width:      img.Bounds().Dx(),
+			Height:     img.Bounds().Dy(),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// The header and logical screen descriptor are 13 bytes, followed by the global
+	// color table if its flag is set. The frame is everything after, except the trailer.
+	data := frame.Bytes()
+	headerSize := 13
+	if data[10]&0x80 != 0 {
+		headerSize += 3 << (data[10]&0x07 + 1)
+	}
+	if !gw.started {
+		if _, err := gw.w.Write(data[:headerSize]); err != nil {
+			return err
+		}
+		if _, err := gw.w.Write(gifLoopExtension); err != nil {
+			return err
+		}
+		gw.started = true
+	}
+	_, err = gw.w.Write(data[headerSize : len(data)-1])
+	return err
+}
+
+// ---------------------------------------------------------------------------------------
+// Writes the trailer after the last frame.
+func (gw *gifStreamWriter) close() error {
+	_, err := gw.w.Write([]byte{0x3B})
+	return err
+}
+
+// ---------------------------------------------------------------------------------------
+// Renders the time-lapse as numbered PNG files in the directory, frame-00000.png and so
+// on. Errors are the same as RenderFrames, or from writing the files.
+func (s *timelapseService) ExportPngFrames(dir string, options TimelapseOptions) (int, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	index := 0
+	return s.RenderFrames(options, func(at block2.UnixMillis, img *image.NRGBA) error {
+		path := filepath.Join(dir, fmt.Sprintf("frame-%05d.png", index))
+		index++
+		return writePngFile(path, img)
+	})
+}
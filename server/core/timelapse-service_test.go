@@ -0,0 +1,203 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package core
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mukunda.com/nanopaint/common"
+	"go.mukunda.com/nanopaint/core/block2"
+	"go.mukunda.com/nanopaint/core/clock"
+)
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestTimelapseService(t *testing.T) {
+	tcs := clock.CreateTestClockService().(*clock.TestClockService)
+	history := CreateHistoryService(block2.CreateMemHistoryRepo(), tcs)
+	blocks := CreateBlockService(block2.CreateMemBlockRepo(tcs), history)
+	timelapse := CreateTimelapseService(history, tcs)
+	root := block2.MakeEmptyCoords()
+
+	red := color.NRGBA{255, 0, 0, 255}
+	green := color.NRGBA{0, 255, 0, 255}
+	blue := color.NRGBA{0, 0, 255, 255}
+	transparent := color.NRGBA{}
+
+	// Red, then green next to it, then the red pixel is repainted blue while it's wet.
+	start := tcs.Now().UnixMilli()
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(6, 0, 0), block2.Color(0x00F)))
+	tcs.Advance(time.Second)
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(6, 1, 0), block2.Color(0x0F0)))
+	tcs.Advance(time.Second)
+	assert.NoError(t, blocks.SetPixel(nil, pixelCoordsAt(6, 0, 0), block2.Color(0xF00)))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// Events are oldest first.
+	events := timelapse.Events(root, 0, 0, 0)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, block2.Color(0x00F), events[0].Color)
+		assert.Equal(t, block2.Color(0x0F0), events[1].Color)
+		assert.Equal(t, block2.Color(0xF00), events[2].Color)
+	}
+	assert.Len(t, timelapse.Events(root, start+1, 0, 0), 2)
+	assert.Len(t, timelapse.Events(root, 0, 0, 1), 1)
+	assert.Empty(t, timelapse.Events(pixelCoordsAt(1, 1, 1), 0, 0, 0))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// Each frame shows what was painted at or before its time.
+	var frames []*image.NRGBA
+	var times []block2.UnixMillis
+	options := TimelapseOptions{
+		Root:      root,
+		PixelSize: 1,
+		Since:     start - 1000,
+		Interval:  time.Second,
+	}
+	count, err := timelapse.RenderFrames(options, func(at block2.UnixMillis, img *image.NRGBA) error {
+		times = append(times, at)
+		frames = append(frames, img)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+	assert.Equal(t, []block2.UnixMillis{start - 1000, start, start + 1000, start + 2000}, times)
+	assert.Equal(t, transparent, frames[0].NRGBAAt(0, 0))
+	assert.Equal(t, red, frames[1].NRGBAAt(0, 0))
+	assert.Equal(t, transparent, frames[1].NRGBAAt(1, 0))
+	assert.Equal(t, red, frames[2].NRGBAAt(0, 0))
+	assert.Equal(t, green, frames[2].NRGBAAt(1, 0))
+	assert.Equal(t, blue, frames[3].NRGBAAt(0, 0))
+	assert.Equal(t, green, frames[3].NRGBAAt(1, 0))
+
+	// Events before the window are replayed into the first frame.
+	frames = nil
+	options.Since = start + 500
+	count, err = timelapse.RenderFrames(options, func(at block2.UnixMillis, img *image.NRGBA) error {
+		frames = append(frames, img)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, red, frames[0].NRGBAAt(0, 0))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// Bad windows and sizes are rejected.
+	noFrame := func(block2.UnixMillis, *image.NRGBA) error { return nil }
+	_, err = timelapse.RenderFrames(TimelapseOptions{Root: root, PixelSize: 1, Since: start}, noFrame)
+	assert.ErrorIs(t, err, ErrTimelapseOptions)
+	_, err = timelapse.RenderFrames(TimelapseOptions{Root: root, PixelSize: 1, Since: start + 5000,
+		Interval: time.Second}, noFrame)
+	assert.ErrorIs(t, err, ErrTimelapseOptions)
+	_, err = timelapse.RenderFrames(TimelapseOptions{Root: root, PixelSize: 1, Since: start,
+		Interval: time.Millisecond}, noFrame)
+	assert.ErrorIs(t, err, ErrTimelapseOptions)
+	_, err = timelapse.RenderFrames(TimelapseOptions{Root: root, Since: start, Interval: time.Second}, noFrame)
+	assert.ErrorIs(t, err, ErrImageSize)
+	// Frames are capped well below MaxImageSize.
+	_, err = timelapse.RenderFrames(TimelapseOptions{Root: root, Depth: 6, PixelSize: 1, Since: start,
+		Interval: time.Second}, noFrame)
+	assert.ErrorIs(t, err, ErrImageSize)
+
+	/////////////////////////////////////////////////////////////////////////////
+	// GIFs are drawn over white.
+	var data bytes.Buffer
+	options.Since = start
+	count, err = timelapse.ExportGif(&data, options, 500*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	anim, err := gif.DecodeAll(&data)
+	if assert.NoError(t, err) {
+		assert.Len(t, anim.Image, 3)
+		assert.Equal(t, []int{50, 50, 50}, anim.Delay)
+		assert.Equal(t, 0, anim.LoopCount)
+		assert.Equal(t, color.RGBA{255, 0, 0, 255}, color.RGBAModel.Convert(anim.Image[0].At(0, 0)))
+		assert.Equal(t, color.RGBA{0, 0, 255, 255}, color.RGBAModel.Convert(anim.Image[2].At(0, 0)))
+		assert.Equal(t, color.RGBA{255, 255, 255, 255}, color.RGBAModel.Convert(anim.Image[2].At(5, 5)))
+	}
+
+	/////////////////////////////////////////////////////////////////////////////
+	// PNG frames are numbered files.
+	dir := filepath.Join(t.TempDir(), "frames")
+	count, err = timelapse.ExportPngFrames(dir, options)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.FileExists(t, filepath.Join(dir, "frame-00000.png"))
+	assert.FileExists(t, filepath.Join(dir, "frame-00002.png"))
+	assert.NoFileExists(t, filepath.Join(dir, "frame-00003.png"))
+
+	/////////////////////////////////////////////////////////////////////////////
+	// Undone paints disappear from the frames after the undo.
+	alice := common.CreateBasicContext()
+	alice.Set("username", "alice")
+	tcs.Advance(time.Second)
+	undoStart := tcs.Now().UnixMilli()
+	assert.NoError(t, blocks.SetPixel(alice, pixelCoordsAt(6, 2, 0), block2.Color(0x00F)))
+	tcs.Advance(time.Second)
+	assert.NoError(t, blocks.UndoPixel(alice, pixelCoordsAt(6, 2, 0)))
+
+	frames = nil
+	options.Since = undoStart
+	options.Until = undoStart + 1000
+	count, err = timelapse.RenderFrames(options, func(at block2.UnixMillis, img *image.NRGBA) error {
+		frames = append(frames, img)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, red, frames[0].NRGBAAt(2, 0))
+	assert.Equal(t, transparent, frames[1].NRGBAAt(2, 0))
+	assert.Equal(t, green, frames[1].NRGBAAt(1, 0))
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestTimelapseHistoryPager(t *testing.T) {
+	tcs := clock.CreateTestClockService().(*clock.TestClockService)
+	history := CreateHistoryService(block2.CreateMemHistoryRepo(), tcs)
+	blocks := CreateBlockService(block2.CreateMemBlockRepo(tcs), history)
+	timelapse := CreateTimelapseService(history, tcs).(*timelapseService)
+	root := block2.MakeEmptyCoords()
+
+	// Batches of 5, 1 and 3 pixels, each batch in one millisecond.
+	start := tcs.Now().UnixMilli()
+	for _, count := range []int{5, 1, 3} {
+		var pixels []block2.PixelPaint
+		for x := 0; x < count; x++ {
+			pixels = append(pixels, block2.PixelPaint{Coords: pixelCoordsAt(6, x, 0), Color: block2.Color(0xF00)})
+		}
+		blocks.SetPixels(nil, pixels)
+		tcs.Advance(time.Second)
+	}
+	all := timelapse.Events(root, 0, 0, 0)
+	assert.Len(t, all, 9)
+
+	///////////////////////////////////////////////////////////////////////////////
+	// Pages that end partway through a millisecond, or are all one millisecond, still
+	// read every entry once, in order.
+	for _, pageSize := range []int{1, 2, 4, 5, 6, 100} {
+		pager := &historyPager{timelapse: timelapse, root: root, until: start + 10000, pageSize: pageSize}
+		var read []block2.HistoryEntry
+		for event := pager.peek(); event != nil; event = pager.peek() {
+			read = append(read, *event)
+			pager.pop()
+		}
+		assert.Equal(t, all, read, pageSize)
+	}
+
+	// The end time is exclusive.
+	pager := &historyPager{timelapse: timelapse, root: root, until: start + 1000, pageSize: 2}
+	count := 0
+	for pager.peek() != nil {
+		pager.pop()
+		count++
+	}
+	assert.Equal(t, 5, count)
+}
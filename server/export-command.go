@@ -0,0 +1,66 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+
+	"go.mukunda.com/nanopaint/core"
+	"go.mukunda.com/nanopaint/core/block2"
+	"go.mukunda.com/nanopaint/core/clock"
+	"go.uber.org/fx"
+)
+
+// Exports a region of the canvas to a PNG file, the same as GET /api/export.
+//
+//	nanopaint export -config <yaml> -root <coords> -depth <levels> -pixelSize <n> -out <file>
+
+// ---------------------------------------------------------------------------------------
+// Runs the core services without the HTTP server, for commands that work on the canvas
+// directly.
+func runWithCore(configPath string, invoke any) error {
+	app := fx.New(
+		provideConfig(configPath),
+		fx.Provide(clock.CreateSystemClockService),
+		core.Fx(),
+		fx.Invoke(invoke),
+		fx.NopLogger,
+	)
+	if err := app.Err(); err != nil {
+		return err
+	}
+	if err := app.Start(context.Background()); err != nil {
+		return err
+	}
+	return app.Stop(context.Background())
+}
+
+// ---------------------------------------------------------------------------------------
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	configPath := flags.String("config", "", "YAML config file with the block storage to read.")
+	root := flags.String("root", "Aw==", "Base64 coords of the root block.")
+	depth := flags.Int("depth", 0, "Levels below the root block to render.")
+	pixelSize := flags.Int("pixelSize", 1, "Image pixels per canvas pixel.")
+	out := flags.String("out", "export.png", "PNG file to write.")
+	flags.Parse(args)
+
+	rootCoords := block2.CoordsFromBase64(*root)
+
+	return runWithCore(*configPath, func(images core.ImageService) error {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if err := images.ExportPng(file, rootCoords, *depth, *pixelSize); err != nil {
+			return err
+		}
+		return file.Close()
+	})
+}
@@ -0,0 +1,53 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package main
+
+import (
+	"flag"
+	"fmt"
+	"image/png"
+	"os"
+
+	"go.mukunda.com/nanopaint/core"
+	"go.mukunda.com/nanopaint/core/block2"
+)
+
+// Stamps a PNG file into a region of the canvas, the same as POST /api/admin/stamp.
+//
+//	nanopaint import -config <yaml> -root <coords> -depth <levels> -in <file> [-dryRun]
+
+// ---------------------------------------------------------------------------------------
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	configPath := flags.String("config", "", "YAML config file with the block storage to write.")
+	root := flags.String("root", "Aw==", "Base64 coords of the root block.")
+	depth := flags.Int("depth", 0, "Levels below the root block to paint the image at.")
+	in := flags.String("in", "", "PNG file to read.")
+	dryRun := flags.Bool("dryRun", false, "Only report how many pixels would be painted.")
+	flags.Parse(args)
+
+	rootCoords := block2.CoordsFromBase64(*root)
+
+	file, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		return err
+	}
+
+	return runWithCore(*configPath, func(images core.ImageService) error {
+		result, err := images.StampImage(nil, img, rootCoords, *depth, *dryRun)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("pixels: %d, painted: %d, dry: %d, too deep: %d, not allowed: %d, "+
+			"protected: %d\n", result.Pixels, result.Painted, result.Dry, result.TooDeep,
+			result.NotAllowed, result.Protected)
+		return nil
+	})
+}
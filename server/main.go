@@ -5,20 +5,92 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+
 	"go.mukunda.com/nanopaint/api"
+	"go.mukunda.com/nanopaint/cat"
 	"go.mukunda.com/nanopaint/config"
 	"go.mukunda.com/nanopaint/core"
 	"go.mukunda.com/nanopaint/core/clock"
 	"go.uber.org/fx"
 )
 
+// Subcommands that work on the canvas without starting the server.
+var commands = map[string]func(args []string) error{
+	"export":         exportCommand,
+	"import":         importCommand,
+	"migrate-colors": migrateColorsCommand,
+	"pyramid":        pyramidCommand,
+	"timelapse":      timelapseCommand,
+}
+
 // ---------------------------------------------------------------------------------------
-// Just an entry point. We'll keep this file minimal.
-func main() {
-	fx.New(
-		config.ProvideFromYamlString(``),
+// Runs a subcommand, printing its error instead of panicking.
+func runCommand(name string, command func(args []string) error, args []string) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			ce, ok := recovered.(cat.ControlledError)
+			if !ok {
+				panic(recovered)
+			}
+			err = ce.Problem
+		}
+	}()
+	if err := command(args); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Returns the config option for a -config flag. Empty uses the defaults, which keep the
+// canvas in memory. See README.md for the keys.
+func provideConfig(path string) fx.Option {
+	if path == "" {
+		return config.ProvideFromYamlString(``)
+	}
+	// The config package falls back to the defaults for missing files, but starting with
+	// the wrong storage isn't something to recover from.
+	if _, err := os.Stat(path); err != nil {
+		return fx.Error(err)
+	}
+	return config.ProvideFromYamlFile(path)
+}
+
+// ---------------------------------------------------------------------------------------
+// Everything the server runs, minus the fx app.
+func serverOptions(configPath string) fx.Option {
+	return fx.Options(
+		provideConfig(configPath),
 		fx.Provide(clock.CreateSystemClockService),
 		core.Fx(),
 		api.Fx(),
-	).Run()
+	)
+}
+
+// ---------------------------------------------------------------------------------------
+// Just an entry point. We'll keep this file minimal.
+//
+//	nanopaint -config <yaml>
+//	nanopaint <command> [flags]
+//
+// The config file can also be given with the NANOPAINT_CONFIG environment variable.
+func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := runCommand(os.Args[1], command, os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	flags := flag.NewFlagSet("nanopaint", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("NANOPAINT_CONFIG"), "YAML config file.")
+	flags.Parse(os.Args[1:])
+
+	fx.New(serverOptions(*configPath)).Run()
 }
@@ -0,0 +1,90 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mukunda.com/nanopaint/api"
+	"go.mukunda.com/nanopaint/common"
+	"go.mukunda.com/nanopaint/core"
+	"go.mukunda.com/nanopaint/core/block2"
+	"go.mukunda.com/nanopaint/test"
+	"go.uber.org/fx"
+	"go.uber.org/fx/fxtest"
+)
+
+// ---------------------------------------------------------------------------------------
+// Writes a config file for the server into a temp directory.
+func writeTestConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestServerConfigStorage(t *testing.T) {
+	dir := t.TempDir()
+	configPath := writeTestConfig(t, `
+http:
+  port: 0
+core:
+  storageType: bolt
+  storagePath: `+filepath.Join(dir, "canvas.db")+`
+  disableBlockDryInterval: true
+`)
+	pixel := block2.MakeEmptyCoords().Down(0, 0).Down(0, 0).Down(0, 0).Down(1, 0).Down(0, 0).Down(0, 0)
+
+	// The canvas survives a restart.
+	for run := 0; run < 2; run++ {
+		var blocks core.BlockService
+		app := fxtest.New(t, serverOptions(configPath), fx.Populate(&blocks)).RequireStart()
+		if run == 0 {
+			assert.NoError(t, blocks.SetPixel(common.CreateBasicContext(), pixel, 0xF00))
+		}
+		block, err := blocks.GetBlock(pixel.ParentOfPixel())
+		assert.NoError(t, err)
+		assert.NotZero(t, block.Pixels[pixel.PixelIndex()]&block2.PIXEL_SET)
+		app.RequireStop()
+	}
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestServerConfigMissing(t *testing.T) {
+	app := fx.New(serverOptions(filepath.Join(t.TempDir(), "missing.yaml")), fx.NopLogger)
+	assert.Error(t, app.Err())
+	assert.Error(t, app.Start(context.Background()))
+}
+
+// ///////////////////////////////////////////////////////////////////////////////////////
+func TestServerAdminKey(t *testing.T) {
+	configPath := writeTestConfig(t, `
+http:
+  port: 0
+  adminKey: "secret"
+core:
+  disableBlockDryInterval: true
+`)
+	var hs api.HttpService
+	app := fxtest.New(t, serverOptions(configPath), fx.Populate(&hs)).RequireStart()
+	defer app.RequireStop()
+	rq := func() *test.Request {
+		return test.MakeRequest(t, "http://localhost:"+strconv.Itoa(hs.GetPort()))
+	}
+
+	///////////////////////////////////////////////////////////////////////////
+	// The server serves the API, and the admin API is enabled by the key in the
+	// config file.
+	pixel := block2.MakeEmptyCoords().Down(0, 0).Down(0, 0).Down(0, 0).Down(0, 0).Down(0, 0).Down(0, 0)
+	rq().Post("/api/paint/"+pixel.ToBase64()).Send(map[string]string{"color": "f00"}).Expect(200, "PIXEL_SET")
+	rq().Get("/api/admin/palettes").Expect(403, "FORBIDDEN", "Invalid admin key.")
+	rq().Get("/api/admin/palettes").Header("Authorization", "Bearer secret").Expect(200, "PALETTES")
+}
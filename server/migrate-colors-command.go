@@ -0,0 +1,34 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"go.mukunda.com/nanopaint/core/block2"
+)
+
+// Converts every block of a 12-bit canvas to 24 bits. Set core.colorDepth to 24 in the
+// config as well, so that the server accepts 24-bit colors. The server shouldn't be
+// running on the same storage.
+//
+//	nanopaint migrate-colors -config <yaml>
+
+// ---------------------------------------------------------------------------------------
+func migrateColorsCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate-colors", flag.ExitOnError)
+	configPath := flags.String("config", "", "YAML config file with the block storage to convert.")
+	flags.Parse(args)
+
+	return runWithCore(*configPath, func(blocks block2.BlockRepo) error {
+		count, err := blocks.UpgradeColorDepth()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("converted blocks: %d\n", count)
+		return nil
+	})
+}
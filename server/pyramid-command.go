@@ -0,0 +1,39 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"go.mukunda.com/nanopaint/core"
+	"go.mukunda.com/nanopaint/core/block2"
+)
+
+// Writes a tile pyramid of the canvas to a directory for offline deep-zoom viewers.
+//
+//	nanopaint pyramid -config <yaml> -root <coords> -levels <n> -layout xyz|dzi -out <dir>
+
+// ---------------------------------------------------------------------------------------
+func pyramidCommand(args []string) error {
+	flags := flag.NewFlagSet("pyramid", flag.ExitOnError)
+	configPath := flags.String("config", "", "YAML config file with the block storage to read.")
+	root := flags.String("root", "Aw==", "Base64 coords of the root block.")
+	levels := flags.Int("levels", 4, "Levels below the root block to include.")
+	layout := flags.String("layout", string(core.PyramidXyz), "Tile layout, xyz or dzi.")
+	out := flags.String("out", "pyramid", "Directory to write the tiles to.")
+	flags.Parse(args)
+
+	rootCoords := block2.CoordsFromBase64(*root)
+
+	return runWithCore(*configPath, func(images core.ImageService) error {
+		count, err := images.ExportPyramid(*out, rootCoords, *levels, core.PyramidLayout(*layout))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("tiles: %d\n", count)
+		return nil
+	})
+}
@@ -33,6 +33,7 @@ type Request struct {
 	Body         any
 	Mpwriter     *multipart.Writer
 	ResponseBody []byte
+	Response     http.Header
 	Executed     bool
 }
 
@@ -199,6 +200,7 @@ func (r *Request) Run() *Request {
 	resp, err := client.Do(req)
 	assert.NoError(r.T, err)
 	r.StatusCode = resp.StatusCode
+	r.Response = resp.Header
 
 	body, err := io.ReadAll(resp.Body)
 	assert.NoError(r.T, err)
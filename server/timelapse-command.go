@@ -0,0 +1,118 @@
+// ///////////////////////////////////////////////////////////////////////////////////////
+// Nanopaint (C) 2024 Mukunda Johnson (me@mukunda.com)
+// Distributed under the MIT license. See LICENSE.txt for details.
+// ///////////////////////////////////////////////////////////////////////////////////////
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mukunda.com/nanopaint/core"
+	"go.mukunda.com/nanopaint/core/block2"
+)
+
+// Renders a time-lapse of a region from the paint history. The config needs persistent
+// history storage (core.history.storageType: sqlite), or there's nothing to replay.
+//
+//	nanopaint timelapse -config <yaml> -root <coords> -depth <levels> -pixelSize <n>
+//	    -since <RFC 3339> -until <RFC 3339> -interval <duration> -format gif|png -out <path>
+//
+// A GIF is written to the out file, and PNG frames to the out directory.
+
+// ---------------------------------------------------------------------------------------
+// Returns the time in Unix milliseconds, or zero for the empty string.
+func parseTimeFlag(name string, value string) (block2.UnixMillis, error) {
+	if value == "" {
+		return 0, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fmt.Errorf("-%s must be an RFC 3339 time: %w", name, err)
+	}
+	return t.UnixMilli(), nil
+}
+
+// ---------------------------------------------------------------------------------------
+// Frames are written as they're rendered, into a temporary file that replaces the path
+// only once the GIF is complete. A bad window or a failure doesn't leave a partial file.
+func exportGifFile(timelapse core.TimelapseService, path string, options core.TimelapseOptions, delay time.Duration) (int, error) {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	frames, err := timelapse.ExportGif(file, options, delay)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return 0, err
+	}
+	return frames, nil
+}
+
+// ---------------------------------------------------------------------------------------
+func timelapseCommand(args []string) error {
+	flags := flag.NewFlagSet("timelapse", flag.ExitOnError)
+	configPath := flags.String("config", "", "YAML config file with the history storage to read.")
+	root := flags.String("root", "Aw==", "Base64 coords of the root block.")
+	depth := flags.Int("depth", 0, "Levels below the root block to render.")
+	pixelSize := flags.Int("pixelSize", 1, "Image pixels per canvas pixel.")
+	since := flags.String("since", "", "Time of the first frame (RFC 3339).")
+	until := flags.String("until", "", "Time of the last frame (RFC 3339). Default now.")
+	interval := flags.Duration("interval", time.Minute, "Canvas time between frames.")
+	delay := flags.Duration("delay", 100*time.Millisecond, "How long each GIF frame is shown.")
+	format := flags.String("format", "gif", "Output format, gif or png.")
+	out := flags.String("out", "", "File (gif) or directory (png) to write. Default timelapse.gif or timelapse.")
+	flags.Parse(args)
+
+	if *since == "" {
+		return errors.New("-since is required")
+	}
+	options := core.TimelapseOptions{
+		Root:      block2.CoordsFromBase64(*root),
+		Depth:     *depth,
+		PixelSize: *pixelSize,
+		Interval:  *interval,
+	}
+	var err error
+	if options.Since, err = parseTimeFlag("since", *since); err != nil {
+		return err
+	}
+	if options.Until, err = parseTimeFlag("until", *until); err != nil {
+		return err
+	}
+
+	return runWithCore(*configPath, func(timelapse core.TimelapseService) error {
+		var frames int
+		switch *format {
+		case "gif":
+			path := *out
+			if path == "" {
+				path = "timelapse.gif"
+			}
+			if frames, err = exportGifFile(timelapse, path, options, *delay); err != nil {
+				return err
+			}
+		case "png":
+			dir := *out
+			if dir == "" {
+				dir = "timelapse"
+			}
+			if frames, err = timelapse.ExportPngFrames(dir, options); err != nil {
+				return err
+			}
+		default:
+			return errors.New("-format must be gif or png")
+		}
+		fmt.Printf("frames: %d\n", frames)
+		return nil
+	})
+}